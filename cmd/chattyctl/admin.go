@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// AdminTokenEnvVar the token sent to the admin endpoint when -token is not given
+const AdminTokenEnvVar = "CHATTY_ADMIN_TOKEN"
+
+// adminFlags what the admin endpoint commands take
+type adminFlags struct {
+	url     string
+	token   string
+	timeout time.Duration
+}
+
+func addAdminFlags(fs *flag.FlagSet) *adminFlags {
+	ret := new(adminFlags)
+	fs.StringVar(&ret.url, "url", "", "where the admin handler of the node is mounted, http://host:port/cache")
+	fs.StringVar(&ret.token, "token", model.GetEnvVarWithDefault(AdminTokenEnvVar, ""), "sent as a bearer token")
+	fs.DurationVar(&ret.timeout, "timeout", 30*time.Second, "how long the request may take")
+	return ret
+}
+
+// do sends the request for path, relative to url
+func (t *adminFlags) do(ctx context.Context, method string, path string) (*http.Response, error) {
+	target := strings.TrimSuffix(t.url, "/") + "/" + strings.TrimPrefix(path, "/")
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	client := http.Client{Timeout: t.timeout}
+	return client.Do(req)
+}
+
+func adminRequest(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("admin", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	af := addAdminFlags(fs)
+	method := fs.String("method", http.MethodGet, "the http method")
+	if fs.Parse(args) != nil {
+		return exitUsage
+	}
+	if len(af.url) == 0 || fs.NArg() != 1 {
+		fmt.Fprintln(stderr, "-url and a path such as /namespaces or /cluster are needed")
+		return exitUsage
+	}
+	resp, err := af.do(ctx, strings.ToUpper(*method), fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stderr, "request failed: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	io.Copy(stdout, resp.Body)
+	if resp.StatusCode >= http.StatusBadRequest {
+		fmt.Fprintf(stderr, "%s\n", resp.Status)
+		return 1
+	}
+	return 0
+}
+
+func dump(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	af := addAdminFlags(fs)
+	out := fs.String("o", "", "the file to write, one JSON entry per line")
+	if fs.Parse(args) != nil {
+		return exitUsage
+	}
+	if len(af.url) == 0 || len(*out) == 0 {
+		fmt.Fprintln(stderr, "-url and -o are needed")
+		return exitUsage
+	}
+	resp, err := af.do(ctx, http.MethodGet, "/snapshot")
+	if err != nil {
+		fmt.Fprintf(stderr, "request failed: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(stderr, resp.Body)
+		fmt.Fprintf(stderr, "%s\n", resp.Status)
+		return 1
+	}
+	file, err := os.Create(*out)
+	if err != nil {
+		fmt.Fprintf(stderr, "unable to create %s: %v\n", *out, err)
+		return 1
+	}
+	entries := 0
+	scanner := bufio.NewScanner(resp.Body)
+	// a line holds a whole value, let them be as big as the cache allows
+	scanner.Buffer(make([]byte, 64*1024), 1<<30)
+	writer := bufio.NewWriter(file)
+	for scanner.Scan() {
+		writer.Write(scanner.Bytes())
+		writer.WriteByte('\n')
+		entries++
+	}
+	err = scanner.Err()
+	if err == nil {
+		err = writer.Flush()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "unable to write %s: %v\n", *out, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "wrote %d entries to %s\n", entries, *out)
+	return 0
+}
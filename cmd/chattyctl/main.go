@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+// chattyctl looks at and pokes a chatty-cache cluster from the outside.  It talks to the cluster's nats with the
+// cluster pass phrase, so replication can be watched and checked without changing the nodes, and to the admin
+// endpoint of a node.
+//
+//	chattyctl tail      [nats flags] [-json] [-count n]
+//	chattyctl publish   [nats flags] -cache name -key key [-tenant id] [-value json | -invalidate] [-ttl d]
+//	chattyctl verify    [nats flags] [-count n] [-timeout d]
+//	chattyctl admin     -url url [-token token] [-method GET] path
+//	chattyctl dump      -url url [-token token] -o file
+//
+// The nats flags default to the same environment the nodes read, NATS_SERVER, CHATTY_PASSPHRASE and the rest
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+)
+
+// exitUsage the exit code for bad arguments, 1 is for a command that failed
+const exitUsage = 2
+
+// command runs a sub command with the arguments after its name and returns the exit code
+type command func(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int
+
+var commands = map[string]command{
+	"tail":    tail,
+	"publish": publish,
+	"verify":  verify,
+	"admin":   adminRequest,
+	"dump":    dump,
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	code := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
+
+func run(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return exitUsage
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n", args[0])
+		usage(stderr)
+		return exitUsage
+	}
+	return cmd(ctx, args[1:], stdout, stderr)
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, `usage: chattyctl <command> [flags]
+
+  tail     print the replication traffic, decrypted
+  publish  publish a put or an invalidate as if a node had
+  verify   check the pass phrase decrypts the traffic seen
+  admin    send a request to the admin endpoint of a node
+  dump     save the entries of a node to a file
+
+chattyctl <command> -h for the flags of a command`)
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/theotw/chatty-cache/pkg/admin"
+	"github.com/theotw/chatty-cache/pkg/cache"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer a buffer a command can write while the test reads it
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (t *syncBuffer) Write(p []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.buf.Write(p)
+}
+
+func (t *syncBuffer) String() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.buf.String()
+}
+
+func TestNatsCommands(t *testing.T) {
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, NoSigs: true, NoLog: true})
+	if !assert.Nil(t, err) {
+		return
+	}
+	go ns.Start()
+	defer ns.Shutdown()
+	if !assert.True(t, ns.ReadyForConnections(5*time.Second)) {
+		return
+	}
+	natsArgs := []string{"-server", ns.ClientURL(), "-passphrase", "bob"}
+
+	// publishes until the command watching the traffic has seen enough of it
+	watch := func(args []string, publishArgs []string) (int, string) {
+		var out syncBuffer
+		done := make(chan int)
+		go func() {
+			done <- run(context.Background(), args, &out, &out)
+		}()
+		for {
+			select {
+			case code := <-done:
+				return code, out.String()
+			case <-time.After(20 * time.Millisecond):
+				var discard bytes.Buffer
+				assert.Equal(t, 0, run(context.Background(), append([]string{"publish"}, publishArgs...), &discard, &discard), discard.String())
+			}
+		}
+	}
+
+	code, out := watch(append([]string{"tail", "-count", "1", "-json"}, natsArgs...),
+		append([]string{"-cache", "users", "-key", "key1", "-value", `{"name":"bob"}`, "-node", "node9"}, natsArgs...))
+	assert.Equal(t, 0, code)
+	var tailed tailedMessage
+	if assert.Nil(t, json.Unmarshal([]byte(out), &tailed), out) {
+		assert.Equal(t, "chatty.replicate.users", tailed.Subject)
+		assert.Equal(t, "node9", tailed.NodeID)
+		assert.Equal(t, "put", tailed.Action)
+		assert.Equal(t, "key1", tailed.Key)
+		assert.Equal(t, `{"name":"bob"}`, string(tailed.Value))
+		assert.Empty(t, tailed.Error)
+	}
+
+	code, out = watch(append([]string{"verify", "-count", "2"}, natsArgs...),
+		append([]string{"-cache", "users", "-key", "key1", "-invalidate"}, natsArgs...))
+	assert.Equal(t, 0, code, out)
+	assert.Contains(t, out, "2 messages: 2 decrypted, 0 in the clear, 0 failed")
+
+	code, out = watch([]string{"verify", "-count", "1", "-server", ns.ClientURL(), "-passphrase", "alice"},
+		append([]string{"-cache", "users", "-key", "key1", "-invalidate"}, natsArgs...))
+	assert.Equal(t, 1, code, "the wrong pass phrase does not decrypt")
+	assert.Contains(t, out, "1 failed")
+
+	var stderr bytes.Buffer
+	assert.Equal(t, exitUsage, run(context.Background(), []string{"publish", "-cache", "users", "-key", "key1", "-value", "not json"}, &stderr, &stderr))
+	assert.Equal(t, exitUsage, run(context.Background(), []string{"publish", "-cache", "users", "-value", "1"}, &stderr, &stderr), "no key")
+	assert.Equal(t, exitUsage, run(context.Background(), []string{"nothing"}, &stderr, &stderr))
+}
+
+func TestAdminCommands(t *testing.T) {
+	memCache := cache.NewInMemCache(0, nil)
+	defer memCache.Close(context.Background())
+	assert.Nil(t, memCache.Put("users", "key1", "value1"))
+	assert.Nil(t, memCache.Put("users", "key2", "value2"))
+	handler := admin.NewHandler(memCache, admin.WithAuthorizer(func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Bearer secret"
+	}))
+	mux := http.NewServeMux()
+	mux.Handle("/cache/", http.StripPrefix("/cache", handler))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	url := srv.URL + "/cache"
+
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, 0, run(context.Background(), []string{"admin", "-url", url, "/namespaces/users/keys"}, &stdout, &stderr), stderr.String())
+	assert.Equal(t, `["key1","key2"]`, strings.TrimSpace(stdout.String()))
+	stdout.Reset()
+	assert.Equal(t, 1, run(context.Background(), []string{"admin", "-url", url, "-method", "delete", "/namespaces/users"}, &stdout, &stderr))
+
+	file := filepath.Join(t.TempDir(), "dump.json")
+	assert.Equal(t, 0, run(context.Background(), []string{"dump", "-url", url, "-token", "secret", "-o", file}, &stdout, &stderr), stderr.String())
+	assert.Contains(t, stdout.String(), "wrote 2 entries")
+	bits, err := os.ReadFile(file)
+	if assert.Nil(t, err) {
+		lines := strings.Split(strings.TrimSpace(string(bits)), "\n")
+		if assert.Equal(t, 2, len(lines)) {
+			var entry admin.SnapshotEntryJSON
+			assert.Nil(t, json.Unmarshal([]byte(lines[1]), &entry))
+			assert.Equal(t, "key2", entry.CacheKey)
+			assert.Equal(t, `"value2"`, string(entry.Value))
+		}
+	}
+}
@@ -0,0 +1,313 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/theotw/chatty-cache/pkg/chatter"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// natsFlags what every nats command takes, on top of the environment
+type natsFlags struct {
+	config  *chatter.NatsConfig
+	servers string
+	tenants tenantPassPhrases
+}
+
+// tenantPassPhrases the repeatable -tenant-passphrase tenant=phrase flag
+type tenantPassPhrases map[string]string
+
+func (t tenantPassPhrases) String() string {
+	ret := make([]string, 0, len(t))
+	for tenant := range t {
+		ret = append(ret, tenant+"=...")
+	}
+	return strings.Join(ret, ",")
+}
+
+func (t tenantPassPhrases) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 {
+		return errors.New("want tenant=passphrase")
+	}
+	t[parts[0]] = parts[1]
+	return nil
+}
+
+func addNatsFlags(fs *flag.FlagSet) *natsFlags {
+	ret := new(natsFlags)
+	ret.config = chatter.NatsConfigFromEnv()
+	ret.tenants = make(tenantPassPhrases)
+	fs.StringVar(&ret.servers, "server", strings.Join(ret.config.URLs, ","), "comma separated nats servers")
+	fs.StringVar(&ret.config.MasterPassPhrase, "passphrase", ret.config.MasterPassPhrase, "the cluster pass phrase, empty for traffic in the clear")
+	fs.StringVar(&ret.config.ReplicateSubject, "subject", ret.config.ReplicateSubject, "the replication subject prefix")
+	fs.StringVar(&ret.config.TenantSubject, "tenant-subject", ret.config.TenantSubject, "the tenant replication subject prefix")
+	fs.Var(ret.tenants, "tenant-passphrase", "tenant=passphrase for a tenant with its own key, repeatable")
+	return ret
+}
+
+// codec the envelope codec for the flags, nodeID is stamped on what is published
+func (t *natsFlags) codec(nodeID string) *chatter.EnvelopeCodec {
+	ret := chatter.NewEnvelopeCodec(nodeID, t.config.MasterPassPhrase)
+	for tenant, phrase := range t.tenants {
+		ret.SetTenantPassPhrase(tenant, phrase)
+	}
+	return ret
+}
+
+func (t *natsFlags) connect() (*nats.Conn, error) {
+	t.config.URLs = strings.Split(t.servers, ",")
+	t.config.Name = "chattyctl"
+	return t.config.Connect()
+}
+
+// observe calls handle with every replication envelope until ctx is done or handle returns false
+func (t *natsFlags) observe(ctx context.Context, handle func(msg *nats.Msg) bool) error {
+	nc, err := t.connect()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	msgs := make(chan *nats.Msg, 1024)
+	for _, subject := range t.config.ReplicationSubjects() {
+		_, err = nc.ChanSubscribe(subject, msgs)
+		if err != nil {
+			return err
+		}
+	}
+	err = nc.Flush()
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg := <-msgs:
+			if !handle(msg) {
+				return nil
+			}
+		}
+	}
+}
+
+// tailedMessage what tail -json prints for a message
+type tailedMessage struct {
+	Time     time.Time       `json:"time"`
+	Subject  string          `json:"subject"`
+	NodeID   string          `json:"nodeId,omitempty"`
+	TenantID string          `json:"tenantId,omitempty"`
+	Action   string          `json:"action,omitempty"`
+	Cache    string          `json:"cacheName,omitempty"`
+	Key      string          `json:"cacheKey,omitempty"`
+	Version  int64           `json:"version,omitempty"`
+	Expires  *time.Time      `json:"expires,omitempty"`
+	Value    json.RawMessage `json:"value,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+func tail(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	nf := addNatsFlags(fs)
+	asJSON := fs.Bool("json", false, "print a JSON object per message")
+	count := fs.Int("count", 0, "stop after this many messages, 0 runs until interrupted")
+	if fs.Parse(args) != nil {
+		return exitUsage
+	}
+	codec := nf.codec("")
+	encoder := json.NewEncoder(stdout)
+	seen := 0
+	err := nf.observe(ctx, func(msg *nats.Msg) bool {
+		tailed := tailMessage(codec, msg)
+		if *asJSON {
+			encoder.Encode(tailed)
+		} else {
+			fmt.Fprintln(stdout, tailed.String())
+		}
+		seen++
+		return *count == 0 || seen < *count
+	})
+	if err != nil {
+		fmt.Fprintf(stderr, "unable to watch nats: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// tailMessage decodes what it can of msg
+func tailMessage(codec *chatter.EnvelopeCodec, msg *nats.Msg) tailedMessage {
+	var ret tailedMessage
+	ret.Time = time.Now()
+	ret.Subject = msg.Subject
+	message, header, err := codec.Decode(msg.Data)
+	if header != nil {
+		ret.NodeID = header.NodeID
+		ret.TenantID = header.TenantID
+	}
+	if err != nil {
+		ret.Error = err.Error()
+		return ret
+	}
+	ret.Action = message.Action.String()
+	ret.Cache = message.CacheName
+	ret.Key = message.CacheKey
+	ret.Version = message.Version
+	if message.ExpiresAt != 0 {
+		expires := time.Unix(0, message.ExpiresAt)
+		ret.Expires = &expires
+	}
+	if len(message.CacheValue) > 0 {
+		bits, err := base64.StdEncoding.DecodeString(message.CacheValue)
+		if err != nil || !json.Valid(bits) {
+			ret.Error = "the value is not base 64 encoded JSON"
+		} else {
+			ret.Value = bits
+		}
+	}
+	return ret
+}
+
+func (t tailedMessage) String() string {
+	var sb strings.Builder
+	sb.WriteString(t.Time.Format("15:04:05.000"))
+	sb.WriteString(" " + t.Subject)
+	if len(t.NodeID) > 0 {
+		sb.WriteString(" node=" + t.NodeID)
+	}
+	if len(t.TenantID) > 0 {
+		sb.WriteString(" tenant=" + t.TenantID)
+	}
+	if len(t.Action) > 0 {
+		sb.WriteString(fmt.Sprintf(" %s %s %q version=%d", t.Action, t.Cache, t.Key, t.Version))
+	}
+	if t.Expires != nil {
+		sb.WriteString(" expires=" + t.Expires.Format(time.RFC3339))
+	}
+	if len(t.Value) > 0 {
+		sb.WriteString(" " + string(t.Value))
+	}
+	if len(t.Error) > 0 {
+		sb.WriteString(" error: " + t.Error)
+	}
+	return sb.String()
+}
+
+func publish(_ context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("publish", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	nf := addNatsFlags(fs)
+	hostname, _ := os.Hostname()
+	nodeID := fs.String("node", "chattyctl-"+hostname, "the node ID the message is sent as")
+	cacheName := fs.String("cache", "", "the cache name")
+	cacheKey := fs.String("key", "", "the cache key")
+	tenantID := fs.String("tenant", "", "the tenant of the cache name")
+	value := fs.String("value", "", "the value as JSON")
+	invalidate := fs.Bool("invalidate", false, "publish an invalidate instead of a put")
+	version := fs.Int64("version", 0, "the version, 0 for now in unix nanoseconds so it beats what the nodes hold")
+	ttl := fs.Duration("ttl", 0, "how long the value lives, 0 for ever")
+	if fs.Parse(args) != nil {
+		return exitUsage
+	}
+	if len(*cacheName) == 0 || len(*cacheKey) == 0 || (!*invalidate && !json.Valid([]byte(*value))) {
+		fmt.Fprintln(stderr, "-cache and -key are needed, and a JSON -value unless -invalidate is set")
+		return exitUsage
+	}
+	var message model.CacheRelayMessage
+	message.CacheName = *cacheName
+	message.CacheKey = *cacheKey
+	message.TenantID = *tenantID
+	message.Version = *version
+	if message.Version == 0 {
+		message.Version = time.Now().UnixNano()
+	}
+	if *invalidate {
+		message.Action = model.RelayInvalidate
+	} else {
+		message.CacheValue = base64.StdEncoding.EncodeToString([]byte(*value))
+		if *ttl > 0 {
+			message.ExpiresAt = time.Now().Add(*ttl).UnixNano()
+		}
+	}
+	bits, err := nf.codec(*nodeID).Encode(&message)
+	if err != nil {
+		fmt.Fprintf(stderr, "unable to encode the message: %v\n", err)
+		return 1
+	}
+	nc, err := nf.connect()
+	if err != nil {
+		fmt.Fprintf(stderr, "unable to connect to nats: %v\n", err)
+		return 1
+	}
+	defer nc.Close()
+	subject := nf.config.SubjectForCache(message.TenantID, message.CacheName)
+	err = nc.Publish(subject, bits)
+	if err == nil {
+		err = nc.Flush()
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "unable to publish on %s: %v\n", subject, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "published %s %s %q version %d on %s\n", message.Action, message.CacheName, message.CacheKey, message.Version, subject)
+	return 0
+}
+
+func verify(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	nf := addNatsFlags(fs)
+	count := fs.Int("count", 10, "how many messages to check")
+	timeout := fs.Duration("timeout", 30*time.Second, "how long to wait for them")
+	if fs.Parse(args) != nil {
+		return exitUsage
+	}
+	codec := nf.codec("")
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	seen, decrypted, clear, failed := 0, 0, 0, 0
+	err := nf.observe(ctx, func(msg *nats.Msg) bool {
+		seen++
+		_, header, err := codec.Decode(msg.Data)
+		switch {
+		case err != nil:
+			failed++
+			node := "unknown"
+			if header != nil {
+				node = header.NodeID
+			}
+			fmt.Fprintf(stdout, "FAIL %s from node %s: %v\n", msg.Subject, node, err)
+		case header.Encrypted():
+			decrypted++
+		default:
+			clear++
+		}
+		return seen < *count
+	})
+	if err != nil {
+		fmt.Fprintf(stderr, "unable to watch nats: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "%d messages: %d decrypted, %d in the clear, %d failed\n", seen, decrypted, clear, failed)
+	if seen == 0 {
+		fmt.Fprintln(stderr, "no traffic seen, nothing was verified")
+		return 1
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
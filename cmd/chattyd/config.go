@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/theotw/chatty-cache/pkg/cache"
+	"io"
+	"os"
+	"time"
+)
+
+// DefaultMaxBytes the cache size when none is configured
+const DefaultMaxBytes = 64 * 1024 * 1024
+
+// config what chattyd runs with, read from the -config file with the flags on top
+type config struct {
+	// Listen the address of the cache API
+	Listen string `json:"listen"`
+	// AdminListen the address of the admin endpoint and /metrics, empty turns them off
+	AdminListen string `json:"adminListen"`
+	// AdminToken the bearer token the admin endpoint wants for values and changes, they are refused without one
+	AdminToken string `json:"adminToken"`
+	MaxBytes   uint64 `json:"maxBytes"`
+	// Relay none, nats, jetstream, redis, peer, gossip or multicast.  Each is configured by its usual environment
+	Relay string `json:"relay"`
+	// DefaultReplication all, local or invalidate for the namespaces not in Namespaces
+	DefaultReplication string                     `json:"defaultReplication"`
+	Namespaces         map[string]namespaceConfig `json:"namespaces"`
+	// MemcachedListen the address of the memcached text protocol, empty turns it off
+	MemcachedListen string `json:"memcachedListen"`
+	// MemcachedPrefixes memcached keys starting with a prefix go to its namespace, the others to memcached
+	MemcachedPrefixes map[string]string `json:"memcachedPrefixes"`
+	// ShutdownTimeout how long requests in flight and queued replication get on SIGTERM
+	ShutdownTimeout duration `json:"shutdownTimeout"`
+}
+
+// namespaceConfig the settings of one namespace
+type namespaceConfig struct {
+	// Replication all, local or invalidate
+	Replication string `json:"replication"`
+	// TTL of the puts that do not give one, 0 for ever
+	TTL duration `json:"ttl"`
+}
+
+// duration a time.Duration written as 30s in the file and on the command line
+type duration time.Duration
+
+func (t duration) String() string {
+	return time.Duration(t).String()
+}
+
+func (t *duration) Set(value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*t = duration(d)
+	return nil
+}
+
+func (t duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+func (t *duration) UnmarshalJSON(bits []byte) error {
+	var s string
+	err := json.Unmarshal(bits, &s)
+	if err != nil {
+		return err
+	}
+	return t.Set(s)
+}
+
+func defaultConfig() *config {
+	ret := new(config)
+	ret.Listen = ":8080"
+	ret.MaxBytes = DefaultMaxBytes
+	ret.Relay = "nats"
+	ret.DefaultReplication = "all"
+	ret.Namespaces = make(map[string]namespaceConfig)
+	ret.ShutdownTimeout = duration(10 * time.Second)
+	return ret
+}
+
+// flagSet binds the flags to cfg, configFile gets the -config flag
+func flagSet(cfg *config, configFile *string, output io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("chattyd", flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.StringVar(configFile, "config", "", "a JSON config file, the flags override it")
+	fs.StringVar(&cfg.Listen, "listen", cfg.Listen, "the address of the cache API")
+	fs.StringVar(&cfg.AdminListen, "admin-listen", cfg.AdminListen, "the address of the admin endpoint and /metrics, off when empty")
+	fs.StringVar(&cfg.AdminToken, "admin-token", cfg.AdminToken, "the bearer token for reading values and changes on the admin endpoint")
+	fs.Uint64Var(&cfg.MaxBytes, "max-bytes", cfg.MaxBytes, "the most bytes the cache holds, 0 for no limit")
+	fs.StringVar(&cfg.Relay, "relay", cfg.Relay, "none, nats, jetstream, redis, peer, gossip or multicast")
+	fs.StringVar(&cfg.DefaultReplication, "replication", cfg.DefaultReplication, "all, local or invalidate for namespaces that are not configured")
+	fs.StringVar(&cfg.MemcachedListen, "memcached-listen", cfg.MemcachedListen, "the address of the memcached text protocol, off when empty")
+	fs.Var(&cfg.ShutdownTimeout, "shutdown-timeout", "how long to finish requests and replication on SIGTERM")
+	return fs
+}
+
+// loadConfig the defaults, then the -config file, then the other flags
+func loadConfig(args []string, output io.Writer) (*config, error) {
+	var configFile string
+	ret := defaultConfig()
+	err := flagSet(ret, &configFile, output).Parse(args)
+	if err != nil || len(configFile) == 0 {
+		return ret, err
+	}
+	ret = defaultConfig()
+	bits, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(bits))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(ret)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", configFile, err)
+	}
+	// parsing again puts the flags on top of the file
+	return ret, flagSet(ret, &configFile, output).Parse(args)
+}
+
+// replicationPolicy the policy for all, local or invalidate
+func replicationPolicy(name string) (cache.ReplicationPolicy, error) {
+	switch name {
+	case "all", "":
+		return cache.ReplicateAll, nil
+	case "local":
+		return cache.LocalOnly, nil
+	case "invalidate":
+		return cache.InvalidateOnly, nil
+	}
+	return cache.ReplicateAll, fmt.Errorf("unknown replication %q, want all, local or invalidate", name)
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+// chattyd runs a replicated InMemCache as a server, so services not written in Go can share it over HTTP and JSON.
+// Run one next to each service, they replicate to each other through the relay.
+//
+//	chattyd -relay nats -listen :8080 -admin-listen 127.0.0.1:6060
+//	chattyd -config chattyd.json
+//
+// See handler for the API.  With -memcached-listen :11211 it also speaks the memcached text protocol, see
+// memcached.Server.  On SIGTERM or SIGINT readiness fails, requests in flight finish and what the relay still has
+// queued is sent, for no longer than -shutdown-timeout
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/theotw/chatty-cache/pkg/chatter"
+	"github.com/theotw/chatty-cache/pkg/logging"
+	"github.com/theotw/chatty-cache/pkg/memcached"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// ReadHeaderTimeout how long a client gets to send the request headers
+const ReadHeaderTimeout = 10 * time.Second
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	code := run(ctx, os.Args[1:], os.Stderr, nil)
+	stop()
+	os.Exit(code)
+}
+
+// run serves until ctx is done, ready is told the API address once it listens
+func run(ctx context.Context, args []string, stderr io.Writer, ready func(apiAddr string)) int {
+	logger := logging.Default()
+	cfg, err := loadConfig(args, stderr)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	relay, err := newRelay(cfg.Relay)
+	if err != nil {
+		logger.WithError(err).Errorf("Unable to start the %s relay", cfg.Relay)
+		return 1
+	}
+	srv, err := newServer(cfg, relay)
+	if err != nil {
+		logger.WithError(err).Errorf("Bad config")
+		if relay != nil {
+			relay.Close(context.Background())
+		}
+		return 1
+	}
+
+	failed := make(chan error, 3)
+	api, err := serve(cfg.Listen, srv.handler(), failed)
+	if err != nil {
+		logger.WithError(err).Errorf("Unable to listen on %s", cfg.Listen)
+		srv.cache.Close(context.Background())
+		return 1
+	}
+	logger.Infof("Cache API listening on %s with the %s relay", api.Addr, cfg.Relay)
+	var adminServer *http.Server
+	if len(cfg.AdminListen) > 0 {
+		adminServer, err = serve(cfg.AdminListen, srv.adminHandler(cfg.AdminToken), failed)
+		if err != nil {
+			logger.WithError(err).Errorf("Unable to listen on %s", cfg.AdminListen)
+			api.Close()
+			srv.cache.Close(context.Background())
+			return 1
+		}
+		logger.Infof("Admin endpoint listening on %s", adminServer.Addr)
+	}
+	var memcachedServer *memcached.Server
+	if len(cfg.MemcachedListen) > 0 {
+		memcachedServer, err = serveMemcached(cfg, srv, failed)
+		if err != nil {
+			logger.WithError(err).Errorf("Unable to listen on %s", cfg.MemcachedListen)
+			api.Close()
+			if adminServer != nil {
+				adminServer.Close()
+			}
+			srv.cache.Close(context.Background())
+			return 1
+		}
+	}
+	if ready != nil {
+		ready(api.Addr)
+	}
+
+	code := 0
+	select {
+	case <-ctx.Done():
+		logger.Infof("Shutting down")
+	case err = <-failed:
+		logger.WithError(err).Errorf("Server failed, shutting down")
+		code = 1
+	}
+	srv.drain()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+	err = api.Shutdown(shutdownCtx)
+	if err != nil {
+		logger.WithError(err).Warnf("Requests were still running at the shutdown timeout")
+	}
+	if adminServer != nil {
+		adminServer.Shutdown(shutdownCtx)
+	}
+	if memcachedServer != nil {
+		memcachedServer.Close()
+	}
+	err = srv.cache.Close(shutdownCtx)
+	if err != nil {
+		logger.WithError(err).Warnf("Relay did not close cleanly")
+	}
+	return code
+}
+
+// serve listens on addr and serves handler until it is shut down, failures after the listen go to failed
+func serve(addr string, handler http.Handler, failed chan<- error) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ret := &http.Server{Addr: listener.Addr().String(), Handler: handler, ReadHeaderTimeout: ReadHeaderTimeout}
+	go func() {
+		err := ret.Serve(listener)
+		if !errors.Is(err, http.ErrServerClosed) {
+			failed <- err
+		}
+	}()
+	return ret, nil
+}
+
+// serveMemcached serves the memcached text protocol over the cache until it is closed
+func serveMemcached(cfg *config, srv *server, failed chan<- error) (*memcached.Server, error) {
+	listener, err := net.Listen("tcp", cfg.MemcachedListen)
+	if err != nil {
+		return nil, err
+	}
+	var opts []memcached.Option
+	for prefix, namespace := range cfg.MemcachedPrefixes {
+		opts = append(opts, memcached.WithPrefix(prefix, namespace))
+	}
+	ret := memcached.NewServer(srv.cache, opts...)
+	go func() {
+		err := ret.Serve(listener)
+		if !errors.Is(err, memcached.ErrServerClosed) {
+			failed <- err
+		}
+	}()
+	logging.Default().Infof("Memcached listening on %s", listener.Addr())
+	return ret, nil
+}
+
+// newRelay the relay called name, configured by its environment.  nil for none
+func newRelay(name string) (chatter.CacheChatter, error) {
+	switch name {
+	case "none", "":
+		return nil, nil
+	case "nats":
+		return chatter.NewNatsMessageChatterRelay()
+	case "jetstream":
+		return chatter.NewJetStreamChatterRelay()
+	case "redis":
+		return chatter.NewRedisChatterRelay()
+	case "peer":
+		return chatter.NewPeerChatterRelay()
+	case "gossip":
+		return chatter.NewGossipChatterRelay()
+	case "multicast":
+		return chatter.NewMulticastChatterRelay()
+	}
+	return nil, fmt.Errorf("unknown relay %q", name)
+}
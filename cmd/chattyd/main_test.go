@@ -0,0 +1,212 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/theotw/chatty-cache/pkg/cache"
+	"github.com/theotw/chatty-cache/pkg/chatter"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "chattyd.json")
+	assert.Nil(t, os.WriteFile(file, []byte(`{
+		"listen": ":9000",
+		"relay": "none",
+		"namespaces": {"sessions": {"replication": "local", "ttl": "30m"}},
+		"memcachedPrefixes": {"session:": "sessions"},
+		"shutdownTimeout": "3s"
+	}`), 0600))
+	var stderr bytes.Buffer
+	cfg, err := loadConfig([]string{"-config", file, "-listen", ":9001"}, &stderr)
+	if assert.Nil(t, err) {
+		assert.Equal(t, ":9001", cfg.Listen, "the flags override the file")
+		assert.Equal(t, "none", cfg.Relay)
+		assert.Equal(t, uint64(DefaultMaxBytes), cfg.MaxBytes)
+		assert.Equal(t, namespaceConfig{Replication: "local", TTL: duration(30 * time.Minute)}, cfg.Namespaces["sessions"])
+		assert.Equal(t, duration(3*time.Second), cfg.ShutdownTimeout)
+		assert.Equal(t, map[string]string{"session:": "sessions"}, cfg.MemcachedPrefixes)
+	}
+
+	assert.Nil(t, os.WriteFile(file, []byte(`{"listne": ":9000"}`), 0600))
+	_, err = loadConfig([]string{"-config", file}, &stderr)
+	assert.NotNil(t, err, "a misspelt setting is not ignored")
+	cfg, _ = loadConfig(nil, &stderr)
+	cfg.Namespaces["users"] = namespaceConfig{Replication: "everything"}
+	_, err = newServer(cfg, nil)
+	assert.NotNil(t, err)
+}
+
+func TestServer(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MaxBytes = 1024
+	cfg.Namespaces["sessions"] = namespaceConfig{TTL: duration(time.Hour)}
+	srv, err := newServer(cfg, nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer srv.cache.Close(context.Background())
+	handler := srv.handler()
+	do := func(method string, target string, body string) (int, string) {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code, strings.TrimSpace(w.Body.String())
+	}
+
+	code, _ := do(http.MethodPut, "/v1/users/team1/bob", `{"name": "bob"}`)
+	assert.Equal(t, http.StatusNoContent, code)
+	code, body := do(http.MethodGet, "/v1/users/team1/bob", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"name":"bob"}`, body)
+	code, _ = do(http.MethodPut, "/v1/users/bad", `not json`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do(http.MethodPut, "/v1/users/big", `"`+strings.Repeat("x", 2000)+`"`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+	code, _ = do(http.MethodPost, "/v1/users/team1/bob", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+	code, _ = do(http.MethodGet, "/v1/users", "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = do(http.MethodPut, "/v1/sessions/s1", `1`)
+	assert.Equal(t, http.StatusNoContent, code)
+	info, err := srv.cache.Entry("", "sessions", "s1")
+	if assert.Nil(t, err) {
+		assert.WithinDuration(t, time.Now().Add(time.Hour), info.Expires, time.Minute, "the namespace TTL is used")
+	}
+	code, _ = do(http.MethodPut, "/v1/sessions/s2?ttl=1ms", `1`)
+	assert.Equal(t, http.StatusNoContent, code)
+	time.Sleep(5 * time.Millisecond)
+	code, _ = do(http.MethodGet, "/v1/sessions/s2", "")
+	assert.Equal(t, http.StatusNotFound, code, "the ttl of the put wins")
+	code, _ = do(http.MethodPut, "/v1/sessions/s3?ttl=soon", `1`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = do(http.MethodDelete, "/v1/users/team1/bob", "")
+	assert.Equal(t, http.StatusNoContent, code)
+	var val string
+	assert.Equal(t, cache.NoItem, srv.cache.Get("users", "team1/bob", &val).(*cache.CacheError).Problem)
+
+	adminHandler := srv.adminHandler("secret")
+	for _, target := range []string{"/metrics", "/cache/cluster"} {
+		w := httptest.NewRecorder()
+		adminHandler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, http.StatusOK, w.Code, target)
+	}
+
+	t.Run("No size limit", func(t *testing.T) {
+		unlimited := defaultConfig()
+		unlimited.MaxBytes = 0
+		srv, err := newServer(unlimited, nil)
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer srv.cache.Close(context.Background())
+		w := httptest.NewRecorder()
+		srv.handler().ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/v1/users/big", strings.NewReader(`"`+strings.Repeat("x", 2000)+`"`)))
+		assert.Equal(t, http.StatusNoContent, w.Code, "-max-bytes 0 takes any size")
+	})
+
+	code, _ = do(http.MethodGet, "/readyz", "")
+	assert.Equal(t, http.StatusOK, code)
+	srv.drain()
+	code, _ = do(http.MethodGet, "/readyz", "")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	code, _ = do(http.MethodGet, "/healthz", "")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addrs := make(chan string, 1)
+	done := make(chan int)
+	var stderr bytes.Buffer
+	go func() {
+		done <- run(ctx, []string{"-relay", "none", "-listen", "127.0.0.1:0", "-admin-listen", "127.0.0.1:0", "-memcached-listen", "127.0.0.1:0"}, &stderr, func(apiAddr string) {
+			addrs <- apiAddr
+		})
+	}()
+	var addr string
+	select {
+	case addr = <-addrs:
+	case code := <-done:
+		t.Fatalf("exited with %d: %s", code, stderr.String())
+	}
+	req, _ := http.NewRequest(http.MethodPut, "http://"+addr+"/v1/users/key1", strings.NewReader(`"value"`))
+	resp, err := http.DefaultClient.Do(req)
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+	resp, err = http.Get("http://" + addr + "/v1/users/key1")
+	if assert.Nil(t, err) {
+		bits, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, `"value"`, string(bits))
+	}
+	cancel()
+	select {
+	case code := <-done:
+		assert.Equal(t, 0, code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not shut down")
+	}
+	_, err = http.Get("http://" + addr + "/healthz")
+	assert.NotNil(t, err, "the listener is closed")
+}
+
+func TestReady(t *testing.T) {
+	// a port nothing listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	gone := listener.Addr().String()
+	listener.Close()
+	t.Setenv(chatter.PeerListenEnvVar, "127.0.0.1:0")
+	t.Setenv(chatter.PeersEnvVar, gone)
+	relay, err := chatter.NewPeerChatterRelay()
+	if !assert.Nil(t, err) {
+		return
+	}
+	srv, err := newServer(defaultConfig(), relay)
+	if !assert.Nil(t, err) {
+		relay.Close(context.Background())
+		return
+	}
+	defer srv.cache.Close(context.Background())
+	ready := func() (int, string) {
+		w := httptest.NewRecorder()
+		srv.handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return w.Code, w.Body.String()
+	}
+	code, body := ready()
+	assert.Equal(t, http.StatusServiceUnavailable, code, "no peer is reachable")
+	assert.Contains(t, body, chatter.StatusDisconnected)
+
+	t.Setenv(chatter.PeersEnvVar, "")
+	peer, err := chatter.NewPeerChatterRelay()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer peer.Close(context.Background())
+	relay.AddPeer(peer.ListenAddr())
+	assert.Eventually(t, func() bool {
+		code, _ := ready()
+		return code == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond, "ready once a peer is connected")
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/theotw/chatty-cache/pkg/admin"
+	"github.com/theotw/chatty-cache/pkg/cache"
+	"github.com/theotw/chatty-cache/pkg/chatter"
+	"github.com/theotw/chatty-cache/pkg/metrics"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// server the cache API over an InMemCache
+type server struct {
+	cache    *cache.InMemCache
+	maxBytes uint64
+	// ttls the TTL of the configured namespaces that have one
+	ttls map[string]time.Duration
+	// draining is set once shutdown starts, readiness fails from then on
+	draining int32
+}
+
+// newServer the cache, with the replication of the namespaces set, replicating through relay which may be nil
+func newServer(cfg *config, relay chatter.CacheChatter) (*server, error) {
+	policy, err := replicationPolicy(cfg.DefaultReplication)
+	if err != nil {
+		return nil, err
+	}
+	ret := new(server)
+	ret.maxBytes = cfg.MaxBytes
+	ret.ttls = make(map[string]time.Duration)
+	ret.cache = cache.NewInMemCache(cfg.MaxBytes, relay)
+	ret.cache.SetDefaultReplicationPolicy(policy)
+	for name, ns := range cfg.Namespaces {
+		policy, err = replicationPolicy(ns.Replication)
+		if err != nil {
+			return nil, fmt.Errorf("namespace %s: %w", name, err)
+		}
+		ret.cache.SetReplicationPolicy(name, policy)
+		if ns.TTL > 0 {
+			ret.ttls[name] = time.Duration(ns.TTL)
+		}
+	}
+	return ret, nil
+}
+
+// handler the cache API:
+//
+//	GET    /v1/{namespace}/{key}           the value as JSON
+//	PUT    /v1/{namespace}/{key}?ttl=30s   stores the JSON body, ttl overrides the namespace TTL, 0 for ever
+//	DELETE /v1/{namespace}/{key}           deletes the key across the cluster
+//	GET    /healthz                        200 while the process is up
+//	GET    /readyz                         200 while the relay is connected and shutdown has not started
+//
+// A key may hold / as it is, the namespace may not
+func (t *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/", t.serveKey)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("/readyz", t.serveReady)
+	return mux
+}
+
+// adminHandler the admin endpoint under /cache/ and the prometheus metrics under /metrics
+func (t *server) adminHandler(token string) http.Handler {
+	var opts []admin.Option
+	if len(token) > 0 {
+		opts = append(opts, admin.WithAuthorizer(func(r *http.Request) bool {
+			return r.Header.Get("Authorization") == "Bearer "+token
+		}))
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.NewCollector(t.cache, nil))
+	mux := http.NewServeMux()
+	mux.Handle("/cache/", http.StripPrefix("/cache", admin.NewHandler(t.cache, opts...)))
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	return mux
+}
+
+// drain fails readiness so the load balancer stops sending before the listeners close
+func (t *server) drain() {
+	atomic.StoreInt32(&t.draining, 1)
+}
+
+func (t *server) serveReady(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&t.draining) != 0 {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+		return
+	}
+	if status, ok := t.cache.Chatter().(chatter.StatusChatter); ok && !status.Connected() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": status.Status()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+func (t *server) serveKey(w http.ResponseWriter, r *http.Request) {
+	namespace, key, err := namespaceAndKey(r.URL)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		var value json.RawMessage
+		err = t.cache.GetCtx(r.Context(), namespace, key, &value)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(value)
+	case http.MethodPut:
+		t.put(w, r, namespace, key)
+	case http.MethodDelete:
+		err = t.cache.DeleteCtx(r.Context(), namespace, key)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "DELETE, GET, PUT")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (t *server) put(w http.ResponseWriter, r *http.Request, namespace string, key string) {
+	ttl := t.ttls[namespace]
+	if s := r.URL.Query().Get("ttl"); len(s) > 0 {
+		var err error
+		ttl, err = time.ParseDuration(s)
+		if err != nil || ttl < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("bad ttl %q", s))
+			return
+		}
+	}
+	// nothing bigger than the cache fits, 0 is a cache with no size limit
+	reader := r.Body
+	if t.maxBytes > 0 {
+		reader = http.MaxBytesReader(w, r.Body, int64(t.maxBytes))
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	if !json.Valid(body) {
+		writeError(w, http.StatusBadRequest, errors.New("the body is not JSON"))
+		return
+	}
+	var opts []cache.PutOption
+	if ttl > 0 {
+		opts = append(opts, cache.WithTTL(ttl))
+	}
+	err = t.cache.PutCtx(r.Context(), namespace, key, json.RawMessage(body), opts...)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// namespaceAndKey the unescaped namespace and key of /v1/{namespace}/{key}
+func namespaceAndKey(u *url.URL) (string, string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(u.EscapedPath(), "/v1/"), "/", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 {
+		return "", "", errors.New("want /v1/{namespace}/{key}")
+	}
+	namespace, err := url.PathUnescape(parts[0])
+	if err != nil {
+		return "", "", err
+	}
+	key, err := url.PathUnescape(parts[1])
+	return namespace, key, err
+}
+
+// writeCacheError maps the CacheError problem to a status
+func writeCacheError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var cacheErr *cache.CacheError
+	if errors.As(err, &cacheErr) {
+		switch cacheErr.Problem {
+		case cache.NoItem:
+			status = http.StatusNotFound
+		case cache.InvalidTenant, cache.NotJsonifiable:
+			status = http.StatusBadRequest
+		case cache.ExceedsTotalCacheSize, cache.ObjectToLarge:
+			status = http.StatusRequestEntityTooLarge
+		case cache.Closed:
+			status = http.StatusServiceUnavailable
+		case cache.ReplicationFailed:
+			status = http.StatusBadGateway
+		}
+	}
+	writeError(w, status, err)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,347 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+// Package admin an http.Handler for looking into and poking at a running cache, meant for a debug port
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/theotw/chatty-cache/pkg/cache"
+	"github.com/theotw/chatty-cache/pkg/chatter"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Authorizer says whether the request may read values or change the cache
+type Authorizer func(r *http.Request) bool
+
+// Option configures the handler
+type Option func(h *Handler)
+
+// WithAuthorizer guards the value, delete and resync endpoints with authorize.  Without one they are refused
+func WithAuthorizer(authorize Authorizer) Option {
+	return func(h *Handler) {
+		h.authorize = authorize
+	}
+}
+
+// Handler serves, relative to where it is mounted:
+//
+//	GET    /namespaces                              cache names with their entry counts and bytes
+//	GET    /namespaces/{cache}/keys?prefix=&limit=  the keys of a cache name
+//	GET    /namespaces/{cache}/keys/{key}           the metadata of an entry
+//	GET    /namespaces/{cache}/keys/{key}/value     the JSON of the value, authorized
+//	DELETE /namespaces/{cache}/keys/{key}           deletes the key across the cluster, authorized
+//	DELETE /namespaces/{cache}                      deletes every key of the cache name, authorized
+//	GET    /snapshot                                every entry with its value as JSON lines, authorized
+//	GET    /cluster                                 this node, the members and the relay status
+//	POST   /resync                                  sends every replicated entry again, authorized
+//
+// Every namespace endpoint takes ?tenant= for the cache names of a tenant.  Path segments are URL unescaped, so
+// keys holding a / are sent as %2F
+type Handler struct {
+	cache     *cache.InMemCache
+	authorize Authorizer
+}
+
+// NewHandler the admin handler for c
+func NewHandler(c *cache.InMemCache, opts ...Option) *Handler {
+	ret := new(Handler)
+	ret.cache = c
+	for _, opt := range opts {
+		opt(ret)
+	}
+	return ret
+}
+
+// NamespaceJSON a cache name in the /namespaces listing
+type NamespaceJSON struct {
+	TenantID  string `json:"tenantId,omitempty"`
+	CacheName string `json:"cacheName"`
+	Entries   int    `json:"entries"`
+	Bytes     uint64 `json:"bytes"`
+}
+
+// EntryJSON the metadata of an entry
+type EntryJSON struct {
+	TenantID    string     `json:"tenantId,omitempty"`
+	CacheName   string     `json:"cacheName"`
+	CacheKey    string     `json:"cacheKey"`
+	Size        uint64     `json:"size"`
+	CacheTime   time.Time  `json:"cacheTime"`
+	LastTouched time.Time  `json:"lastTouched"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	Version     int64      `json:"version"`
+	// Origin the node the value came from, empty when it was put on this node
+	Origin string `json:"origin,omitempty"`
+}
+
+// SnapshotEntryJSON a line of /snapshot
+type SnapshotEntryJSON struct {
+	EntryJSON
+	Value json.RawMessage `json:"value"`
+}
+
+// ClusterJSON what /cluster returns
+type ClusterJSON struct {
+	// NodeID and Members are only known when the chatter keeps track of them
+	NodeID  string   `json:"nodeId,omitempty"`
+	Members []string `json:"members,omitempty"`
+	// Chatter the type of the relay, empty for a local only cache
+	Chatter string `json:"chatter,omitempty"`
+	// Status of the relay connection when the chatter is a chatter.StatusChatter
+	Status      string                    `json:"status,omitempty"`
+	Replication *chatter.ReplicationStats `json:"replication,omitempty"`
+}
+
+// ServeHTTP routes the request, see Handler
+func (t *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments, err := pathSegments(r.URL)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	switch {
+	case len(segments) == 1 && segments[0] == "namespaces":
+		t.route(w, r, map[string]func(){http.MethodGet: func() { t.namespaces(w) }})
+	case len(segments) == 2 && segments[0] == "namespaces":
+		t.route(w, r, map[string]func(){http.MethodDelete: t.guard(w, r, func() { t.deleteNamespace(w, r, segments[1]) })})
+	case len(segments) == 3 && segments[0] == "namespaces" && segments[2] == "keys":
+		t.route(w, r, map[string]func(){http.MethodGet: func() { t.keys(w, r, segments[1]) }})
+	case len(segments) == 4 && segments[0] == "namespaces" && segments[2] == "keys":
+		t.route(w, r, map[string]func(){
+			http.MethodGet:    func() { t.entry(w, r, segments[1], segments[3]) },
+			http.MethodDelete: t.guard(w, r, func() { t.deleteKey(w, r, segments[1], segments[3]) }),
+		})
+	case len(segments) == 5 && segments[0] == "namespaces" && segments[2] == "keys" && segments[4] == "value":
+		t.route(w, r, map[string]func(){http.MethodGet: t.guard(w, r, func() { t.value(w, r, segments[1], segments[3]) })})
+	case len(segments) == 1 && segments[0] == "snapshot":
+		t.route(w, r, map[string]func(){http.MethodGet: t.guard(w, r, func() { t.snapshot(w) })})
+	case len(segments) == 1 && segments[0] == "cluster":
+		t.route(w, r, map[string]func(){http.MethodGet: func() { t.cluster(w) }})
+	case len(segments) == 1 && segments[0] == "resync":
+		t.route(w, r, map[string]func(){http.MethodPost: t.guard(w, r, func() { t.resync(w, r) })})
+	default:
+		writeError(w, http.StatusNotFound, errors.New("no such endpoint"))
+	}
+}
+
+// route calls the handler for the method, or answers 405
+func (t *Handler) route(w http.ResponseWriter, r *http.Request, methods map[string]func()) {
+	handler, ok := methods[r.Method]
+	if !ok {
+		allowed := make([]string, 0, len(methods))
+		for method := range methods {
+			allowed = append(allowed, method)
+		}
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	handler()
+}
+
+// guard only calls handler when the authorizer lets the request through
+func (t *Handler) guard(w http.ResponseWriter, r *http.Request, handler func()) func() {
+	return func() {
+		if t.authorize == nil || !t.authorize(r) {
+			writeError(w, http.StatusForbidden, errors.New("not authorized"))
+			return
+		}
+		handler()
+	}
+}
+
+func (t *Handler) namespaces(w http.ResponseWriter) {
+	namespaces := t.cache.Namespaces()
+	ret := make([]NamespaceJSON, 0, len(namespaces))
+	for _, ns := range namespaces {
+		ret = append(ret, NamespaceJSON{TenantID: ns.TenantID, CacheName: ns.CacheName, Entries: ns.Entries, Bytes: ns.Bytes})
+	}
+	writeJSON(w, http.StatusOK, ret)
+}
+
+func (t *Handler) keys(w http.ResponseWriter, r *http.Request, cacheName string) {
+	query := r.URL.Query()
+	limit := 0
+	if s := query.Get("limit"); len(s) > 0 {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("bad limit %q", s))
+			return
+		}
+	}
+	keys, err := t.cache.Keys(query.Get("tenant"), cacheName, query.Get("prefix"), limit)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
+
+func (t *Handler) entry(w http.ResponseWriter, r *http.Request, cacheName string, cacheKey string) {
+	info, err := t.cache.Entry(r.URL.Query().Get("tenant"), cacheName, cacheKey)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entryJSON(info))
+}
+
+// snapshot streams the entries one namespace at a time, entries that go away while it runs are left out
+func (t *Handler) snapshot(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	for _, ns := range t.cache.Namespaces() {
+		keys, err := t.cache.Keys(ns.TenantID, ns.CacheName, "", 0)
+		if err != nil {
+			continue
+		}
+		for _, key := range keys {
+			info, err := t.cache.Entry(ns.TenantID, ns.CacheName, key)
+			if err != nil {
+				continue
+			}
+			bits, err := t.cache.RawValue(ns.TenantID, ns.CacheName, key)
+			if err != nil {
+				continue
+			}
+			encoder.Encode(SnapshotEntryJSON{EntryJSON: entryJSON(info), Value: bits})
+		}
+	}
+}
+
+func (t *Handler) value(w http.ResponseWriter, r *http.Request, cacheName string, cacheKey string) {
+	bits, err := t.cache.RawValue(r.URL.Query().Get("tenant"), cacheName, cacheKey)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bits)
+}
+
+func (t *Handler) deleteKey(w http.ResponseWriter, r *http.Request, cacheName string, cacheKey string) {
+	tenantID := r.URL.Query().Get("tenant")
+	var err error
+	if len(tenantID) == 0 {
+		err = t.cache.DeleteCtx(r.Context(), cacheName, cacheKey)
+	} else {
+		var tenant *cache.TenantCache
+		tenant, err = t.cache.Tenant(tenantID)
+		if err == nil {
+			err = tenant.Delete(cacheName, cacheKey)
+		}
+	}
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (t *Handler) deleteNamespace(w http.ResponseWriter, r *http.Request, cacheName string) {
+	deleted, err := t.cache.DeleteNamespace(r.Context(), r.URL.Query().Get("tenant"), cacheName)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"deleted": deleted})
+}
+
+func (t *Handler) cluster(w http.ResponseWriter) {
+	var ret ClusterJSON
+	relay := t.cache.Chatter()
+	if relay != nil {
+		ret.Chatter = fmt.Sprintf("%T", relay)
+	}
+	if nodes, ok := relay.(interface{ NodeID() string }); ok {
+		ret.NodeID = nodes.NodeID()
+	}
+	if members, ok := relay.(interface{ Members() []string }); ok {
+		ret.Members = members.Members()
+	}
+	if status, ok := relay.(chatter.StatusChatter); ok {
+		ret.Status = status.Status()
+	}
+	ret.Replication = t.cache.Stats().Replication
+	writeJSON(w, http.StatusOK, ret)
+}
+
+func (t *Handler) resync(w http.ResponseWriter, r *http.Request) {
+	sent, err := t.cache.Resync(r.Context())
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"sent": sent})
+}
+
+func entryJSON(info *cache.EntryInfo) EntryJSON {
+	var ret EntryJSON
+	ret.TenantID = info.TenantID
+	ret.CacheName = info.CacheName
+	ret.CacheKey = info.CacheKey
+	ret.Size = info.Size
+	ret.CacheTime = info.CacheTime
+	ret.LastTouched = info.LastTouched
+	if !info.Expires.IsZero() {
+		ret.Expires = &info.Expires
+	}
+	ret.Version = info.Version
+	ret.Origin = info.Origin
+	return ret
+}
+
+// pathSegments splits the escaped path so an escaped / stays inside its segment
+func pathSegments(u *url.URL) ([]string, error) {
+	parts := strings.Split(strings.TrimPrefix(u.EscapedPath(), "/"), "/")
+	for i, part := range parts {
+		segment, err := url.PathUnescape(part)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = segment
+	}
+	return parts, nil
+}
+
+// writeCacheError maps the CacheError problem to a status
+func writeCacheError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var cacheErr *cache.CacheError
+	if errors.As(err, &cacheErr) {
+		switch cacheErr.Problem {
+		case cache.NoItem:
+			status = http.StatusNotFound
+		case cache.InvalidTenant:
+			status = http.StatusBadRequest
+		case cache.Closed:
+			status = http.StatusServiceUnavailable
+		case cache.ReplicationFailed:
+			status = http.StatusBadGateway
+		}
+	}
+	writeError(w, status, err)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/theotw/chatty-cache/pkg/cache"
+	"github.com/theotw/chatty-cache/pkg/chatter"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	bus := chatter.NewLocalBus()
+	node1, err := bus.NewChatter("node1")
+	if !assert.Nil(t, err) {
+		return
+	}
+	node2, err := bus.NewChatter("node2")
+	if !assert.Nil(t, err) {
+		return
+	}
+	cache1 := cache.NewInMemCache(0, node1)
+	defer cache1.Close(context.Background())
+	cache2 := cache.NewInMemCache(0, node2)
+	defer cache2.Close(context.Background())
+	assert.Nil(t, cache2.Put("users", "key1", "value"))
+	assert.Nil(t, cache2.Put("users", "a/b", "value"))
+	tenant, _ := cache2.Tenant("acme")
+	assert.Nil(t, tenant.Put("users", "key1", "value"))
+	bus.Settle()
+
+	handler := NewHandler(cache1, WithAuthorizer(func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Bearer secret"
+	}))
+	do := func(method string, target string, authorized bool, out interface{}) int {
+		r := httptest.NewRequest(method, target, nil)
+		if authorized {
+			r.Header.Set("Authorization", "Bearer secret")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if out != nil {
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), out), w.Body.String())
+		}
+		return w.Code
+	}
+
+	var namespaces []NamespaceJSON
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/namespaces", false, &namespaces))
+	assert.Equal(t, []NamespaceJSON{
+		{CacheName: "users", Entries: 2, Bytes: 14},
+		{TenantID: "acme", CacheName: "users", Entries: 1, Bytes: 7},
+	}, namespaces)
+
+	var keys []string
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/namespaces/users/keys?limit=5", false, &keys))
+	assert.Equal(t, []string{"a/b", "key1"}, keys)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodGet, "/namespaces/users/keys?limit=x", false, nil))
+
+	var entry EntryJSON
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/namespaces/users/keys/a%2Fb", false, &entry))
+	assert.Equal(t, "a/b", entry.CacheKey)
+	assert.Equal(t, "node2", entry.Origin)
+	assert.Nil(t, entry.Expires)
+	assert.NotZero(t, entry.Version)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/namespaces/users/keys/missing", false, nil))
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodGet, "/namespaces/users/keys/key1?tenant=a%20b", false, nil))
+
+	var value string
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/namespaces/users/keys/key1/value", false, nil))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/namespaces/users/keys/key1/value?tenant=acme", true, &value))
+	assert.Equal(t, "value", value)
+
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/snapshot", false, nil))
+	r := httptest.NewRequest(http.MethodGet, "/snapshot", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	var snapshot []SnapshotEntryJSON
+	decoder := json.NewDecoder(w.Body)
+	for decoder.More() {
+		var line SnapshotEntryJSON
+		if assert.Nil(t, decoder.Decode(&line)) {
+			snapshot = append(snapshot, line)
+		}
+	}
+	if assert.Equal(t, 3, len(snapshot)) {
+		assert.Equal(t, "a/b", snapshot[0].CacheKey)
+		assert.Equal(t, `"value"`, string(snapshot[0].Value))
+		assert.Equal(t, "acme", snapshot[2].TenantID)
+	}
+
+	var cluster ClusterJSON
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/cluster", false, &cluster))
+	assert.Equal(t, "node1", cluster.NodeID)
+	assert.Equal(t, []string{"node1", "node2"}, cluster.Members)
+	assert.Equal(t, "*chatter.LocalChatter", cluster.Chatter)
+
+	t.Run("Changes", func(t *testing.T) {
+		assert.Equal(t, http.StatusMethodNotAllowed, do(http.MethodPost, "/namespaces", true, nil))
+		assert.Equal(t, http.StatusForbidden, do(http.MethodDelete, "/namespaces/users/keys/key1", false, nil))
+		assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/namespaces/users/keys/key1?tenant=acme", true, nil))
+		bus.Settle()
+		var val string
+		assert.NotNil(t, tenant.Get("users", "key1", &val), "the delete goes to the other nodes")
+
+		var deleted map[string]int
+		assert.Equal(t, http.StatusOK, do(http.MethodDelete, "/namespaces/users", true, &deleted))
+		assert.Equal(t, 2, deleted["deleted"])
+		bus.Settle()
+		assert.NotNil(t, cache2.Get("users", "key1", &val))
+
+		assert.Nil(t, cache1.Put("users", "key2", "value", cache.WithoutReplication()))
+		var sent map[string]int
+		assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/resync", false, nil))
+		assert.Equal(t, http.StatusOK, do(http.MethodPost, "/resync", true, &sent))
+		assert.Equal(t, 1, sent["sent"])
+		bus.Settle()
+		assert.Nil(t, cache2.Get("users", "key2", &val), "the resync catches the other node up")
+	})
+
+	t.Run("NoAuthorizer", func(t *testing.T) {
+		handler := NewHandler(cache1)
+		r := httptest.NewRequest(http.MethodPost, "/resync", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/nothing", false, nil))
+	})
+}
@@ -7,7 +7,7 @@ package cache
 // Cache is a simple abstraction of a multi-named space (cacheName) cache that holds key value pairs
 type Cache interface {
 	// Put  puts an value into the cache, if the type of cache has a size limit, stuff will get tossed out
-	Put(cacheName string, cacheKey string, value interface{}) error
+	Put(cacheName string, cacheKey string, value interface{}, opts ...PutOption) error
 	// Get gets a value from the cache
 	Get(cacheName string, cacheKey string, valueOut interface{}) error
 }
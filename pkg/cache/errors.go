@@ -19,6 +19,15 @@ const ExceedsCacheSize = ProblemType("exceeds cache size")
 const ObjectToLarge = ProblemType("object to large")
 
 const NoItem = ProblemType("no item")
+const OwnerUnreachable = ProblemType("owner unreachable")
+const LoadFailed = ProblemType("load failed")
+const ExceedsTenantQuota = ProblemType("exceeds tenant quota")
+const InvalidTenant = ProblemType("invalid tenant")
+const BackendUnavailable = ProblemType("backend unavailable")
+const Closed = ProblemType("closed")
+const ReplicationFailed = ProblemType("replication failed")
+const SlowConsumer = ProblemType("slow consumer")
+const VersionConflict = ProblemType("version conflict")
 
 func (t *CacheError) Error() string {
 	var wrapped string
@@ -0,0 +1,413 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cache
+
+import (
+	"context"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventType what happened to an entry
+type EventType int
+
+// EventPut a value was stored, on this node or applied from another one
+const EventPut = EventType(0)
+
+// EventEvict an entry was taken out other than by a newer value, Reason says why
+const EventEvict = EventType(1)
+
+// EventExpire the TTL of an entry ran out
+const EventExpire = EventType(2)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPut:
+		return "put"
+	case EventEvict:
+		return "evict"
+	case EventExpire:
+		return "expire"
+	}
+	return "unknown"
+}
+
+// Event a change to an entry of the cache
+type Event struct {
+	Type EventType
+	// CacheName the cache name as it was used, TenantID says which tenant it belongs to
+	CacheName string
+	TenantID  string
+	CacheKey  string
+	Version   int64
+	// NodeID the node the change came from, empty when it was made on this node or the cache does not know
+	NodeID string
+	// Reason why the entry was evicted, empty for other events
+	Reason EvictionReason
+}
+
+// WatchBuffer how many events a Watcher holds for its reader before it is closed as a slow consumer
+const WatchBuffer = 256
+
+// ExpirySweepInterval how often expired entries are looked for.  They are also dropped when they are read
+const ExpirySweepInterval = time.Second
+
+// ExpirySweepBatch how many expired entries a sweep drops each time it takes the lock, it lets go in between so a lot
+// of entries expiring at once does not hold up gets and puts
+const ExpirySweepBatch = 1024
+
+// hooks what OnPut, OnEvict, OnExpire, OnRemoteApply and Watch registered
+type hooks struct {
+	lock     sync.RWMutex
+	put      []func(event Event)
+	evict    []func(event Event, reason EvictionReason)
+	expire   []func(event Event)
+	remote   []func(event Event, nodeID string)
+	watchers map[*Watcher]struct{}
+}
+
+// OnPut calls hook after every value stored, put on this node or applied from another one.  Hooks run on the
+// goroutine making the change after the cache lock is released, they must not block
+func (t *InMemCache) OnPut(hook func(event Event)) {
+	t.hooks.lock.Lock()
+	t.hooks.put = append(t.hooks.put, hook)
+	t.hooks.lock.Unlock()
+}
+
+// OnEvict calls hook for every entry taken out for a reason other than a newer value or its TTL running out
+func (t *InMemCache) OnEvict(hook func(event Event, reason EvictionReason)) {
+	t.hooks.lock.Lock()
+	t.hooks.evict = append(t.hooks.evict, hook)
+	t.hooks.lock.Unlock()
+}
+
+// OnExpire calls hook for every entry dropped because its TTL ran out
+func (t *InMemCache) OnExpire(hook func(event Event)) {
+	t.hooks.lock.Lock()
+	t.hooks.expire = append(t.hooks.expire, hook)
+	t.hooks.lock.Unlock()
+}
+
+// OnRemoteApply calls hook for every message from another node that was applied.  The event is an EventPut for a
+// value and an EventEvict for an invalidation, delete or tenant drop
+func (t *InMemCache) OnRemoteApply(hook func(event Event, nodeID string)) {
+	t.hooks.lock.Lock()
+	t.hooks.remote = append(t.hooks.remote, hook)
+	t.hooks.lock.Unlock()
+}
+
+// Watcher streams the events of one cache name, see Watch
+type Watcher struct {
+	cache     *InMemCache
+	cacheName string
+	keyPrefix string
+	events    chan Event
+
+	lock    sync.Mutex
+	stopped bool
+	err     error
+}
+
+// Watch streams the puts, evictions and expiries of the keys in cacheName starting with keyPrefix, an empty prefix
+// is every key.  Events are never waited on: a reader that lets WatchBuffer events pile up is cut off, Events is
+// closed and Err returns a SlowConsumer CacheError.  Watch again and reread what you need
+func (t *InMemCache) Watch(cacheName string, keyPrefix string) (*Watcher, error) {
+	if !validCacheName(cacheName) {
+		return nil, NewCacheError(InvalidTenant, nil)
+	}
+	return t.watch(cacheName, keyPrefix)
+}
+
+// watch is Watch with a scoped cache name
+func (t *InMemCache) watch(cacheName string, keyPrefix string) (*Watcher, error) {
+	if t.isClosed() {
+		return nil, NewCacheError(Closed, nil)
+	}
+	ret := new(Watcher)
+	ret.cache = t
+	ret.cacheName = cacheName
+	ret.keyPrefix = keyPrefix
+	ret.events = make(chan Event, WatchBuffer)
+	t.hooks.lock.Lock()
+	if t.hooks.watchers == nil {
+		t.hooks.watchers = make(map[*Watcher]struct{})
+	}
+	t.hooks.watchers[ret] = struct{}{}
+	t.hooks.lock.Unlock()
+	return ret, nil
+}
+
+// Events the channel the events come on, it is closed when the watcher stops
+func (t *Watcher) Events() <-chan Event {
+	return t.events
+}
+
+// Err why the watcher stopped, nil while it runs and after Close
+func (t *Watcher) Err() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.err
+}
+
+// Close stops the watcher and closes Events
+func (t *Watcher) Close() {
+	t.cache.unwatch(t)
+	t.stop(nil)
+}
+
+// stop closes the channel once, keeping the first reason
+func (t *Watcher) stop(err error) {
+	t.lock.Lock()
+	if !t.stopped {
+		t.stopped = true
+		t.err = err
+		close(t.events)
+	}
+	t.lock.Unlock()
+}
+
+// send queues the event without waiting, false when the reader is too far behind and the watcher was stopped
+func (t *Watcher) send(event Event) bool {
+	if scopedName(event.TenantID, event.CacheName) != t.cacheName || !strings.HasPrefix(event.CacheKey, t.keyPrefix) {
+		return true
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.stopped {
+		return true
+	}
+	select {
+	case t.events <- event:
+		return true
+	default:
+		t.stopped = true
+		t.err = NewCacheError(SlowConsumer, nil)
+		close(t.events)
+		return false
+	}
+}
+
+func (t *InMemCache) unwatch(watcher *Watcher) {
+	t.hooks.lock.Lock()
+	delete(t.hooks.watchers, watcher)
+	t.hooks.lock.Unlock()
+}
+
+// stopWatchers closes every watcher, for Close
+func (t *InMemCache) stopWatchers() {
+	t.hooks.lock.Lock()
+	watchers := t.hooks.watchers
+	t.hooks.watchers = nil
+	t.hooks.lock.Unlock()
+	for watcher := range watchers {
+		watcher.stop(nil)
+	}
+}
+
+// eventFor the event for an entry, without a type
+func eventFor(entry *cacheEntry) Event {
+	var ret Event
+	ret.TenantID, ret.CacheName = splitScopedName(entry.CacheName)
+	ret.CacheKey = entry.CacheKey
+	ret.Version = entry.version
+	return ret
+}
+
+// sendToWatchers sends to a copy of the watchers so the sends do not hold the hooks lock
+func (t *InMemCache) sendToWatchers(event Event) {
+	t.hooks.lock.RLock()
+	if len(t.hooks.watchers) == 0 {
+		t.hooks.lock.RUnlock()
+		return
+	}
+	watchers := make([]*Watcher, 0, len(t.hooks.watchers))
+	for watcher := range t.hooks.watchers {
+		watchers = append(watchers, watcher)
+	}
+	t.hooks.lock.RUnlock()
+	for _, watcher := range watchers {
+		if !watcher.send(event) {
+			t.Logger().Warnf("Watcher of %s fell %d events behind, stopping it", watcher.cacheName, WatchBuffer)
+			t.unwatch(watcher)
+		}
+	}
+}
+
+// notifyPut tells the hooks and watchers a value was stored, nodeID is where it came from
+func (t *InMemCache) notifyPut(cacheName string, cacheKey string, version int64, nodeID string) {
+	var event Event
+	event.Type = EventPut
+	event.TenantID, event.CacheName = splitScopedName(cacheName)
+	event.CacheKey = cacheKey
+	event.Version = version
+	event.NodeID = nodeID
+	t.hooks.lock.RLock()
+	put := t.hooks.put
+	t.hooks.lock.RUnlock()
+	for _, hook := range put {
+		hook(event)
+	}
+	t.sendToWatchers(event)
+}
+
+// notifyEvicted tells the hooks and watchers an entry was taken out, expiries go to the OnExpire hooks
+func (t *InMemCache) notifyEvicted(entry *cacheEntry, reason EvictionReason) {
+	event := eventFor(entry)
+	t.hooks.lock.RLock()
+	evict := t.hooks.evict
+	expire := t.hooks.expire
+	t.hooks.lock.RUnlock()
+	if reason == EvictedExpired {
+		event.Type = EventExpire
+		for _, hook := range expire {
+			hook(event)
+		}
+	} else {
+		event.Type = EventEvict
+		event.Reason = reason
+		for _, hook := range evict {
+			hook(event, reason)
+		}
+	}
+	t.sendToWatchers(event)
+}
+
+// notifyRemoteApply tells the OnRemoteApply hooks a message from another node was applied
+func (t *InMemCache) notifyRemoteApply(message *model.CacheRelayMessage) {
+	t.hooks.lock.RLock()
+	remote := t.hooks.remote
+	t.hooks.lock.RUnlock()
+	if len(remote) == 0 {
+		return
+	}
+	var event Event
+	event.CacheName = message.CacheName
+	event.TenantID = message.TenantID
+	event.CacheKey = message.CacheKey
+	event.Version = message.Version
+	event.NodeID = message.NodeID
+	switch message.Action {
+	case model.RelayPut:
+		event.Type = EventPut
+	case model.RelayInvalidate:
+		event.Type = EventEvict
+		event.Reason = EvictedInvalidated
+	case model.RelayDelete:
+		event.Type = EventEvict
+		event.Reason = EvictedDeleted
+	case model.RelayDropTenant:
+		event.Type = EventEvict
+		event.Reason = EvictedTenantDropped
+	default:
+		return
+	}
+	for _, hook := range remote {
+		hook(event, message.NodeID)
+	}
+}
+
+// expiresAt the time of an ExpiresAt in a relay message, zero for 0
+func expiresAt(unixNanos int64) time.Time {
+	if unixNanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, unixNanos)
+}
+
+// unixNanos the ExpiresAt of a relay message for expires, 0 for the zero time
+func unixNanos(expires time.Time) int64 {
+	if expires.IsZero() {
+		return 0
+	}
+	return expires.UnixNano()
+}
+
+// expired whether the entry's TTL has run out
+func (t *cacheEntry) expired(now time.Time) bool {
+	return !t.expires.IsZero() && !now.Before(t.expires)
+}
+
+// expireEntry drops entry if it is still the one held for its key, for a read that found it expired
+func (t *InMemCache) expireEntry(entry *cacheEntry) {
+	t.lock.Lock()
+	held := t.caches[entry.CacheName][entry.CacheKey] == entry
+	if held {
+		t.removeLocked(entry.CacheName, entry.CacheKey)
+	}
+	t.lock.Unlock()
+	if held {
+		t.evicted(context.Background(), EvictedExpired, []*cacheEntry{entry})
+	}
+}
+
+// startSweeping starts looking for expired entries, once the first entry with a TTL is stored
+func (t *InMemCache) startSweeping() {
+	t.sweepOnce.Do(func() {
+		go t.sweep()
+	})
+}
+
+// sweep drops expired entries every sweepInterval until the cache is closed
+func (t *InMemCache) sweep() {
+	ticker := time.NewTicker(t.sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.closed:
+			return
+		case now := <-ticker.C:
+			for t.sweepExpired(now) == ExpirySweepBatch {
+			}
+		}
+	}
+}
+
+// sweepExpired drops up to ExpirySweepBatch of the entries expired at now, soonest first, and says how many it dropped
+func (t *InMemCache) sweepExpired(now time.Time) int {
+	var expired []*cacheEntry
+	t.lock.Lock()
+	for len(expired) < ExpirySweepBatch && len(t.expiry) > 0 && t.expiry[0].expired(now) {
+		entry := t.expiry[0]
+		t.removeLocked(entry.CacheName, entry.CacheKey)
+		expired = append(expired, entry)
+	}
+	t.lock.Unlock()
+	t.evicted(context.Background(), EvictedExpired, expired)
+	return len(expired)
+}
+
+// expiryQueue a heap of the entries with a TTL, the one that expires first on top
+type expiryQueue []*cacheEntry
+
+func (t expiryQueue) Len() int {
+	return len(t)
+}
+
+func (t expiryQueue) Less(i, j int) bool {
+	return t[i].expires.Before(t[j].expires)
+}
+
+func (t expiryQueue) Swap(i, j int) {
+	t[i], t[j] = t[j], t[i]
+	t[i].expiryIndex = i + 1
+	t[j].expiryIndex = j + 1
+}
+
+func (t *expiryQueue) Push(x interface{}) {
+	entry := x.(*cacheEntry)
+	*t = append(*t, entry)
+	entry.expiryIndex = len(*t)
+}
+
+func (t *expiryQueue) Pop() interface{} {
+	old := *t
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*t = old[:len(old)-1]
+	entry.expiryIndex = 0
+	return entry
+}
@@ -0,0 +1,203 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cache
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"testing"
+	"time"
+)
+
+func TestHooks(t *testing.T) {
+	relay := new(recordingChatter)
+	cache1 := NewInMemCache(24, relay)
+	defer cache1.Close(context.Background())
+	var puts []Event
+	var evictions []EvictionReason
+	var expiries []Event
+	var remote []string
+	cache1.OnPut(func(event Event) {
+		puts = append(puts, event)
+	})
+	cache1.OnEvict(func(event Event, reason EvictionReason) {
+		evictions = append(evictions, reason)
+		assert.Equal(t, reason, event.Reason)
+	})
+	cache1.OnExpire(func(event Event) {
+		expiries = append(expiries, event)
+	})
+	cache1.OnRemoteApply(func(event Event, nodeID string) {
+		remote = append(remote, nodeID+" "+event.Type.String()+" "+event.CacheKey)
+	})
+
+	assert.Nil(t, cache1.Put("users", "key1", "0123456789"))
+	assert.Nil(t, cache1.Put("users", "key2", "0123456789"))
+	// 12 bytes each, the third pushes out key1
+	assert.Nil(t, cache1.Put("users", "key3", "0123456789"))
+	assert.Nil(t, cache1.Delete("users", "key2"))
+	if assert.Equal(t, 3, len(puts)) {
+		assert.Equal(t, Event{Type: EventPut, CacheName: "users", CacheKey: "key1", Version: puts[0].Version}, puts[0])
+		assert.NotZero(t, puts[0].Version)
+	}
+	assert.Equal(t, []EvictionReason{EvictedForSpace, EvictedDeleted}, evictions)
+
+	message := *relay.sent[2]
+	message.CacheKey = "key4"
+	message.Version = message.Version + 1
+	message.NodeID = "node1"
+	assert.Nil(t, relay.listener(&message))
+	if assert.Equal(t, 4, len(puts)) {
+		assert.Equal(t, "node1", puts[3].NodeID)
+	}
+	assert.Equal(t, []string{"node1 put key4"}, remote)
+
+	t.Run("Expire", func(t *testing.T) {
+		assert.Nil(t, cache1.Put("sessions", "key1", "0", WithTTL(time.Millisecond)))
+		assert.NotZero(t, relay.sent[len(relay.sent)-1].ExpiresAt, "the TTL goes along with the value")
+		time.Sleep(2 * time.Millisecond)
+		var val string
+		err := cache1.Get("sessions", "key1", &val)
+		if assert.NotNil(t, err) {
+			assert.Equal(t, NoItem, err.(*CacheError).Problem)
+		}
+		if assert.Equal(t, 1, len(expiries)) {
+			assert.Equal(t, EventExpire, expiries[0].Type)
+			assert.Equal(t, "key1", expiries[0].CacheKey)
+		}
+		assert.Equal(t, uint64(1), cache1.Stats().Evictions[EvictedExpired])
+	})
+}
+
+func TestSweep(t *testing.T) {
+	cache1 := NewInMemCache(0, nil)
+	cache1.sweepInterval = 5 * time.Millisecond
+	defer cache1.Close(context.Background())
+	expired := make(chan Event, 1)
+	cache1.OnExpire(func(event Event) {
+		expired <- event
+	})
+	assert.Nil(t, cache1.Put("sessions", "key1", "0", WithTTL(time.Millisecond)))
+	select {
+	case event := <-expired:
+		assert.Equal(t, "key1", event.CacheKey)
+	case <-time.After(time.Second):
+		t.Error("not swept")
+	}
+	assert.Equal(t, uint64(0), cache1.Stats().UsedBytes)
+
+	t.Run("Batches", func(t *testing.T) {
+		cache1 := NewInMemCache(0, nil)
+		cache1.sweepInterval = time.Hour
+		defer cache1.Close(context.Background())
+		count := ExpirySweepBatch + 10
+		for i := 0; i < count; i++ {
+			assert.Nil(t, cache1.Put("sessions", fmt.Sprintf("key%d", i), i, WithTTL(time.Duration(count-i)*time.Millisecond)))
+		}
+		assert.Nil(t, cache1.Put("sessions", "forever", 0))
+		assert.Nil(t, cache1.Put("sessions", "key0", 0), "a put without a TTL takes the old one out of the queue")
+		assert.Nil(t, cache1.Put("sessions", "later", 0, WithTTL(time.Hour)))
+		cache1.remove(scopedName("", "sessions"), "key1", EvictedDeleted)
+		assert.Equal(t, count-1, len(cache1.expiry))
+
+		now := time.Now().Add(time.Duration(count) * time.Millisecond)
+		assert.Equal(t, ExpirySweepBatch, cache1.sweepExpired(now), "no more than a batch under one lock")
+		assert.Equal(t, count-2-ExpirySweepBatch, cache1.sweepExpired(now))
+		assert.Equal(t, 0, cache1.sweepExpired(now))
+		var val int
+		assert.Nil(t, cache1.Get("sessions", "forever", &val))
+		assert.Nil(t, cache1.Get("sessions", "key0", &val))
+		assert.Nil(t, cache1.Get("sessions", "later", &val))
+		assert.Equal(t, 1, len(cache1.expiry))
+		assert.Equal(t, uint64(count-2), cache1.Stats().Evictions[EvictedExpired])
+	})
+}
+
+func TestWatch(t *testing.T) {
+	relay := new(recordingChatter)
+	cache1 := NewInMemCache(0, relay)
+	watcher, err := cache1.Watch("users", "team1/")
+	if !assert.Nil(t, err) {
+		return
+	}
+	cache1.Put("users", "team1/alice", "a")
+	cache1.Put("users", "team2/bob", "b")
+	cache1.Put("groups", "team1/admins", "c")
+	cache1.Delete("users", "team1/alice")
+	acme, _ := cache1.Tenant("acme")
+	acme.Put("users", "team1/carol", "d")
+
+	event := <-watcher.Events()
+	assert.Equal(t, EventPut, event.Type)
+	assert.Equal(t, "team1/alice", event.CacheKey)
+	event = <-watcher.Events()
+	assert.Equal(t, EventEvict, event.Type)
+	assert.Equal(t, EvictedDeleted, event.Reason)
+	assert.Equal(t, 0, len(watcher.Events()), "other keys, cache names and tenants are not watched")
+
+	t.Run("Tenant", func(t *testing.T) {
+		tenantWatcher, err := acme.Watch("users", "")
+		if !assert.Nil(t, err) {
+			return
+		}
+		acme.Put("users", "key1", "e")
+		event := <-tenantWatcher.Events()
+		assert.Equal(t, "acme", event.TenantID)
+		assert.Equal(t, "key1", event.CacheKey)
+		tenantWatcher.Close()
+		_, open := <-tenantWatcher.Events()
+		assert.False(t, open)
+		assert.Nil(t, tenantWatcher.Err())
+	})
+	t.Run("Slow consumer", func(t *testing.T) {
+		slow, err := cache1.Watch("sessions", "")
+		if !assert.Nil(t, err) {
+			return
+		}
+		done := make(chan struct{})
+		go func() {
+			// nobody reads, the puts must still go through
+			for i := 0; i <= WatchBuffer; i++ {
+				cache1.Put("sessions", fmt.Sprintf("key%d", i), i)
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("a watcher nobody reads blocked the puts")
+		}
+		count := 0
+		for range slow.Events() {
+			count++
+		}
+		assert.Equal(t, WatchBuffer, count)
+		if assert.NotNil(t, slow.Err()) {
+			assert.Equal(t, SlowConsumer, slow.Err().(*CacheError).Problem)
+		}
+	})
+	t.Run("Remote", func(t *testing.T) {
+		var message model.CacheRelayMessage
+		message.CacheName = "users"
+		message.CacheKey = "team1/dave"
+		message.CacheValue = relay.sent[0].CacheValue
+		message.Version = 1
+		message.NodeID = "node1"
+		assert.Nil(t, relay.listener(&message))
+		event := <-watcher.Events()
+		assert.Equal(t, "team1/dave", event.CacheKey)
+		assert.Equal(t, "node1", event.NodeID)
+	})
+
+	cache1.Close(context.Background())
+	_, open := <-watcher.Events()
+	assert.False(t, open, "closing the cache stops the watchers")
+	_, err = cache1.Watch("users", "")
+	if assert.NotNil(t, err) {
+		assert.Equal(t, Closed, err.(*CacheError).Problem)
+	}
+}
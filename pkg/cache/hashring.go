@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cache
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes how many points each member gets on the ring, more points means a more even spread
+const DefaultVirtualNodes = 64
+
+// HashRing is a consistent hash ring over the cluster members.  It is not thread safe, build a new one when members change
+type HashRing struct {
+	virtualNodes int
+	points       []uint64
+	owners       map[uint64]string
+	members      []string
+}
+
+// NewHashRing builds a ring with virtualNodes points per member, virtualNodes < 1 uses DefaultVirtualNodes
+func NewHashRing(virtualNodes int, members ...string) *HashRing {
+	ret := new(HashRing)
+	if virtualNodes < 1 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	ret.virtualNodes = virtualNodes
+	ret.owners = make(map[uint64]string, len(members)*virtualNodes)
+	ret.members = make([]string, len(members))
+	copy(ret.members, members)
+	sort.Strings(ret.members)
+	for _, m := range ret.members {
+		for i := 0; i < virtualNodes; i++ {
+			point := hashString(m + "#" + strconv.Itoa(i))
+			ret.owners[point] = m
+			ret.points = append(ret.points, point)
+		}
+	}
+	sort.Slice(ret.points, func(i, j int) bool {
+		return ret.points[i] < ret.points[j]
+	})
+	return ret
+}
+
+// Members the members on the ring, sorted
+func (t *HashRing) Members() []string {
+	return t.members
+}
+
+// Owners returns up to count distinct members that own the key, the first one is the primary owner
+func (t *HashRing) Owners(key string, count int) []string {
+	if len(t.points) == 0 || count < 1 {
+		return nil
+	}
+	if count > len(t.members) {
+		count = len(t.members)
+	}
+	h := hashString(key)
+	start := sort.Search(len(t.points), func(i int) bool {
+		return t.points[i] >= h
+	})
+	ret := make([]string, 0, count)
+	for i := 0; i < len(t.points) && len(ret) < count; i++ {
+		owner := t.owners[t.points[(start+i)%len(t.points)]]
+		if !contains(ret, owner) {
+			ret = append(ret, owner)
+		}
+	}
+	return ret
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// fnv has poor avalanche on short similar strings, mix it up so the ring is even
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
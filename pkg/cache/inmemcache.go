@@ -5,17 +5,23 @@
 package cache
 
 import (
+	"container/heap"
+	"context"
 	"encoding/base64"
 	"encoding/json"
-	log "github.com/sirupsen/logrus"
 	"github.com/theotw/chatty-cache/pkg/chatter"
+	"github.com/theotw/chatty-cache/pkg/logging"
 	"github.com/theotw/chatty-cache/pkg/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type cacheEntry struct {
+	// CacheName is scoped to the tenant, see scopedName
 	CacheName string
 	CacheKey  string
 	CacheData []byte
@@ -26,6 +32,26 @@ type cacheEntry struct {
 
 	//cacheSize is size in bytes of this message when jsonified
 	cacheSize uint64
+	// version of the value, the writer stamps it and newer versions win across nodes
+	version int64
+	// tenantID owner of the entry, empty when not put through a TenantCache
+	tenantID string
+	// expires when the TTL runs out, zero for never
+	expires time.Time
+	// origin the node the value came from, empty when it was put on this node
+	origin string
+	// expiryIndex one more than the entry's place in the expiry queue, 0 when it is not in it
+	expiryIndex int
+}
+
+// entryMeta what putVersionedBits needs besides the bits and the version
+type entryMeta struct {
+	// expires zero for no TTL
+	expires time.Time
+	// origin empty for a put on this node
+	origin string
+	// condition what has to be held for the put to go ahead
+	condition putCondition
 }
 
 func (t *cacheEntry) touch() {
@@ -33,11 +59,45 @@ func (t *cacheEntry) touch() {
 }
 
 type InMemCache struct {
+	logging.Holder
+
 	maxCacheSize       uint64
 	caches             map[string]map[string]*cacheEntry
 	totalUsedCacheSize uint64
 	lock               sync.RWMutex
 	chatter            chatter.CacheChatter
+
+	policyLock    sync.RWMutex
+	policies      map[string]ReplicationPolicy
+	defaultPolicy ReplicationPolicy
+	loaders       map[string]ContextLoader
+
+	// tenantQuotas and tenantUsage are guarded by lock
+	tenantQuotas map[string]uint64
+	tenantUsage  map[string]uint64
+
+	// tombstones remembers which node invalidated a key so a later miss can fetch it from that node
+	tombstoneLock sync.Mutex
+	tombstones    map[string]string
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	// statsLock guards the counts Stats reports
+	statsLock       sync.Mutex
+	namespaceCounts map[string]*NamespaceStats
+	evictions       map[EvictionReason]uint64
+	publishLatency  LatencyStats
+
+	// tracer holds a tracerHolder, see SetTracerProvider
+	tracer atomic.Value
+
+	hooks hooks
+	// expiry the entries with a TTL soonest first, guarded by lock
+	expiry    expiryQueue
+	sweepOnce sync.Once
+	// sweepInterval ExpirySweepInterval, tests shorten it
+	sweepInterval time.Duration
 }
 
 // NewInMemCache Creates a new in memory cache with maxh size and an optional chatter relay to share messages across processes
@@ -45,80 +105,488 @@ func NewInMemCache(maxSize uint64, chatter chatter.CacheChatter) *InMemCache {
 	ret := new(InMemCache)
 	ret.maxCacheSize = maxSize
 	ret.caches = make(map[string]map[string]*cacheEntry, 0)
+	ret.policies = make(map[string]ReplicationPolicy)
+	ret.loaders = make(map[string]ContextLoader)
+	ret.tombstones = make(map[string]string)
+	ret.tenantQuotas = make(map[string]uint64)
+	ret.tenantUsage = make(map[string]uint64)
+	ret.closed = make(chan struct{})
+	ret.namespaceCounts = make(map[string]*NamespaceStats)
+	ret.evictions = make(map[EvictionReason]uint64)
+	ret.SetTracerProvider(nil)
+	ret.sweepInterval = ExpirySweepInterval
 	ret.chatter = chatter
 	if ret.chatter != nil {
-		ret.chatter.RegisterListenerForReplicatedObjects(func(message *model.CacheRelayMessage) {
-			ret.listenerForMessages(message)
+		ret.chatter.RegisterListenerForReplicatedObjects(func(message *model.CacheRelayMessage) error {
+			return ret.listenerForMessages(message)
 		})
+		ret.registerFetchHandler()
 	}
 	return ret
 }
-func (t *InMemCache) listenerForMessages(message *model.CacheRelayMessage) {
-	bits, err := base64.StdEncoding.DecodeString(message.CacheValue)
-	if err != nil {
-		log.WithError(err).Error("Unable to base 64 decode a cache relay message")
-		return
+
+// Close stops taking puts and gets and closes the chatter, which sends what it still has queued for as long as ctx
+// allows.  Later calls fail with a Closed CacheError
+func (t *InMemCache) Close(ctx context.Context) error {
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		t.stopWatchers()
+		if t.chatter != nil {
+			err = t.chatter.Close(ctx)
+		}
+	})
+	return err
+}
+
+func (t *InMemCache) isClosed() bool {
+	select {
+	case <-t.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetReplicationPolicy sets how puts to cacheName are shared with the other nodes
+func (t *InMemCache) SetReplicationPolicy(cacheName string, policy ReplicationPolicy) {
+	t.policyLock.Lock()
+	t.policies[cacheName] = policy
+	t.policyLock.Unlock()
+}
+
+// SetDefaultReplicationPolicy sets the policy for cache names that do not have their own, ReplicateAll out of the box
+func (t *InMemCache) SetDefaultReplicationPolicy(policy ReplicationPolicy) {
+	t.policyLock.Lock()
+	t.defaultPolicy = policy
+	t.policyLock.Unlock()
+}
+
+// ReplicationPolicy the policy in effect for cacheName
+func (t *InMemCache) ReplicationPolicy(cacheName string) ReplicationPolicy {
+	t.policyLock.RLock()
+	ret, ok := t.policies[cacheName]
+	if !ok {
+		ret = t.defaultPolicy
+	}
+	t.policyLock.RUnlock()
+	return ret
+}
+
+// listenerForMessages applies a message from another node, messages that can never be applied are logged and dropped
+// rather than returned as errors so they are not redelivered
+func (t *InMemCache) listenerForMessages(message *model.CacheRelayMessage) error {
+	if t.isClosed() {
+		t.PerMessage().Tracef("Cache closed, dropping relay message for %s %s", message.CacheName, message.CacheKey)
+		return nil
+	}
+	// a flush covers every cache name and checks their policies itself
+	if message.Action != model.RelayFlush && t.ReplicationPolicy(message.CacheName) == LocalOnly {
+		t.PerMessage().Tracef("Dropping relay message for local only cache %s", message.CacheName)
+		return nil
+	}
+	if (len(message.TenantID) > 0 && !validTenantID(message.TenantID)) || !validCacheName(message.CacheName) {
+		t.Logger().Errorf("Dropping relay message with invalid tenant ID %q or cache name", message.TenantID)
+		return nil
+	}
+	ctx, span := t.startSpan(extractTrace(message), "cache.apply", trace.SpanKindConsumer,
+		scopedName(message.TenantID, message.CacheName), message.CacheKey,
+		attribute.Int("cache.action", int(message.Action)),
+		attribute.Int64("cache.version", message.Version),
+		attribute.String("cache.sender_node_id", message.NodeID))
+	applied, err := t.apply(ctx, message)
+	endSpan(span, err)
+	if applied {
+		t.notifyRemoteApply(message)
+	}
+	return err
+}
+
+// apply does what a message from another node asks for, false when it had nothing to do
+func (t *InMemCache) apply(ctx context.Context, message *model.CacheRelayMessage) (bool, error) {
+	switch message.Action {
+	case model.RelayInvalidate:
+		t.invalidate(ctx, message)
+	case model.RelayDropTenant:
+		t.dropTenant(ctx, message.TenantID)
+	case model.RelayDelete:
+		t.removeOlder(ctx, scopedName(message.TenantID, message.CacheName), message.CacheKey, message.Version, EvictedDeleted)
+	case model.RelayFlush:
+		t.flushReplicated(ctx, message.NodeID)
+	case model.RelayPut:
+		bits, err := base64.StdEncoding.DecodeString(message.CacheValue)
+		if err != nil {
+			t.Logger().WithError(err).Errorf("Unable to base 64 decode a cache relay message")
+			return false, nil
+		}
+		cacheName := scopedName(message.TenantID, message.CacheName)
+		held, stored, err := t.putVersionedEntry(ctx, cacheName, message.CacheKey, bits, message.Version,
+			entryMeta{expires: expiresAt(message.ExpiresAt), origin: message.NodeID})
+		if stored {
+			t.notifyPut(cacheName, message.CacheKey, held, message.NodeID)
+		}
+		return stored, err
 	}
-	t.putBits(message.CacheName, message.CacheKey, bits)
+	return true, nil
 }
 
-// Put  puts an value into the cache
-func (t *InMemCache) Put(cacheName string, cacheKey string, value interface{}) error {
+// Put  puts an value into the cache and shares it according to the replication policy of the cache name
+func (t *InMemCache) Put(cacheName string, cacheKey string, value interface{}, opts ...PutOption) error {
+	return t.PutCtx(context.Background(), cacheName, cacheKey, value, opts...)
+}
 
+// PutCtx is Put with the replication bounded by ctx when the chatter is a ContextChatter.  The value is kept on this
+// node even when the replication fails, a ReplicationFailed CacheError says the other nodes may not have it
+func (t *InMemCache) PutCtx(ctx context.Context, cacheName string, cacheKey string, value interface{}, opts ...PutOption) error {
+	if !validCacheName(cacheName) {
+		return NewCacheError(InvalidTenant, nil)
+	}
+	return t.put(ctx, "", cacheName, cacheKey, value, opts)
+}
+
+func (t *InMemCache) put(ctx context.Context, tenantID string, cacheName string, cacheKey string, value interface{}, opts []PutOption) (err error) {
+	ctx, span := t.startSpan(ctx, "cache.put", trace.SpanKindInternal, scopedName(tenantID, cacheName), cacheKey)
+	defer func() {
+		endSpan(span, err)
+	}()
+	if t.isClosed() {
+		return NewCacheError(Closed, nil)
+	}
+	options := makePutOptions(opts)
 	jsonBits, err := json.Marshal(value)
 	if err != nil {
 		err := NewCacheError(NotJsonifiable, err)
 		return err
 	}
-	err = t.putBits(cacheName, cacheKey, jsonBits)
-	if t.chatter != nil {
+	expires := options.expires()
+	version, err := t.putVersionedBits(ctx, scopedName(tenantID, cacheName), cacheKey, jsonBits, 0,
+		entryMeta{expires: expires, condition: options.condition})
+	if err == nil {
+		t.counted(scopedName(tenantID, cacheName), func(counts *NamespaceStats) { counts.Puts++ })
+		t.notifyPut(scopedName(tenantID, cacheName), cacheKey, version, "")
+	}
+	// a conditional put that did not happen has nothing to share
+	if t.chatter == nil || options.noReplicate || (err != nil && options.condition.kind != unconditional) {
+		return err
+	}
+	var replicateErr error
+	switch t.ReplicationPolicy(cacheName) {
+	case ReplicateAll:
 		//send a replicate message
 		var replicate model.CacheRelayMessage
 		replicate.CacheName = cacheName
 		replicate.CacheKey = cacheKey
 		replicate.CacheValue = base64.StdEncoding.EncodeToString(jsonBits)
-		t.chatter.ReplicateCachedObject(&replicate)
+		replicate.Version = version
+		replicate.TenantID = tenantID
+		replicate.ExpiresAt = unixNanos(expires)
+		replicateErr = t.replicate(ctx, &replicate)
+	case InvalidateOnly:
+		var invalidate model.CacheRelayMessage
+		invalidate.CacheName = cacheName
+		invalidate.CacheKey = cacheKey
+		invalidate.Action = model.RelayInvalidate
+		invalidate.Version = version
+		invalidate.TenantID = tenantID
+		replicateErr = t.replicate(ctx, &invalidate)
+	}
+	if err == nil && replicateErr != nil {
+		return NewCacheError(ReplicationFailed, replicateErr)
 	}
 	return err
 }
+
+// replicate sends the message with the ctx when the chatter takes one, the span context of ctx goes along with it
+func (t *InMemCache) replicate(ctx context.Context, message *model.CacheRelayMessage) (err error) {
+	ctx, span := t.startSpan(ctx, "cache.publish", trace.SpanKindProducer,
+		scopedName(message.TenantID, message.CacheName), message.CacheKey,
+		attribute.Int("cache.action", int(message.Action)),
+		attribute.Int64("cache.version", message.Version))
+	injectTrace(ctx, message)
+	start := time.Now()
+	defer func() {
+		t.observePublish(time.Since(start))
+		endSpan(span, err)
+	}()
+	if ctxChatter, ok := t.chatter.(chatter.ContextChatter); ok {
+		return ctxChatter.ReplicateCachedObjectCtx(ctx, message)
+	}
+	t.chatter.ReplicateCachedObject(message)
+	return nil
+}
+
+// Delete removes the value from this node and, unless the cache name is LocalOnly, from the other nodes
+func (t *InMemCache) Delete(cacheName string, cacheKey string) error {
+	return t.DeleteCtx(context.Background(), cacheName, cacheKey)
+}
+
+// DeleteCtx is Delete with the replication bounded by ctx when the chatter is a ContextChatter, a ReplicationFailed
+// CacheError says the other nodes may still have the value
+func (t *InMemCache) DeleteCtx(ctx context.Context, cacheName string, cacheKey string) error {
+	if !validCacheName(cacheName) {
+		return NewCacheError(InvalidTenant, nil)
+	}
+	return t.delete(ctx, "", cacheName, cacheKey)
+}
+
+func (t *InMemCache) delete(ctx context.Context, tenantID string, cacheName string, cacheKey string) (err error) {
+	scoped := scopedName(tenantID, cacheName)
+	ctx, span := t.startSpan(ctx, "cache.delete", trace.SpanKindInternal, scoped, cacheKey)
+	defer func() {
+		endSpan(span, err)
+	}()
+	if t.isClosed() {
+		return NewCacheError(Closed, nil)
+	}
+	version := time.Now().UnixNano()
+	t.lock.Lock()
+	if entry := t.caches[scoped][cacheKey]; entry != nil && entry.version >= version {
+		version = entry.version + 1
+	}
+	removed := t.removeLocked(scoped, cacheKey)
+	t.lock.Unlock()
+	if removed != nil {
+		t.evicted(ctx, EvictedDeleted, []*cacheEntry{removed})
+	}
+	if t.chatter == nil || t.ReplicationPolicy(cacheName) == LocalOnly {
+		return nil
+	}
+	var del model.CacheRelayMessage
+	del.CacheName = cacheName
+	del.CacheKey = cacheKey
+	del.Action = model.RelayDelete
+	del.Version = version
+	del.TenantID = tenantID
+	err = t.replicate(ctx, &del)
+	if err != nil {
+		return NewCacheError(ReplicationFailed, err)
+	}
+	return nil
+}
+
+// putBits stores the bits under a new local version
 func (t *InMemCache) putBits(cacheName, cacheKey string, valueJsonBits []byte) error {
+	_, err := t.putVersionedBits(context.Background(), cacheName, cacheKey, valueJsonBits, 0, entryMeta{})
+	return err
+}
+
+// putVersionedBits stores the bits at version, 0 stamps a new version newer than anything held for the key.
+// If we already hold a newer version the bits are dropped, as are those from another node at the version held.  The
+// version held after the call is returned.
+// cacheName is the scoped name, ctx is only used for the spans of any evictions
+func (t *InMemCache) putVersionedBits(ctx context.Context, cacheName, cacheKey string, valueJsonBits []byte, version int64, meta entryMeta) (int64, error) {
+	held, _, err := t.putVersionedEntry(ctx, cacheName, cacheKey, valueJsonBits, version, meta)
+	return held, err
+}
+
+// putVersionedEntry is putVersionedBits also saying whether the bits were stored rather than dropped
+func (t *InMemCache) putVersionedEntry(ctx context.Context, cacheName, cacheKey string, valueJsonBits []byte, version int64, meta entryMeta) (int64, bool, error) {
 	x := new(cacheEntry)
 	x.CacheKey = cacheKey
 	x.CacheName = cacheName
+	x.tenantID, _ = splitScopedName(cacheName)
 	x.cacheTime = time.Now()
+	x.expires = meta.expires
+	x.origin = meta.origin
 	x.touch()
 
 	x.CacheData = valueJsonBits
 	x.cacheSize = uint64(len(valueJsonBits))
-	if x.cacheSize > t.maxCacheSize {
-		return NewCacheError(ExceedsTotalCacheSize, nil)
+	if t.maxCacheSize > 0 && x.cacheSize > t.maxCacheSize {
+		return 0, false, NewCacheError(ExceedsTotalCacheSize, nil)
 	}
 	var ret *CacheError
+	var quotaEvicted, sizeEvicted []*cacheEntry
 	// DO NOT RETURN BETWEEN THESE LOCK/UNLOCK
 	//I dont like defers for unlock, I want it unlocked asap, not sitting as waiting on the stack
 	t.lock.Lock()
+	old := t.caches[cacheName][cacheKey]
+	held := old
+	if held != nil && held.expired(x.cacheTime) {
+		held = nil
+	}
+	if err := meta.condition.check(held); err != nil {
+		t.lock.Unlock()
+		return 0, false, err
+	}
+	// from another node the same version is the same write, a resync or a redelivery, and would only fire the hooks
+	if old != nil && version != 0 && (old.version > version || (old.version == version && len(meta.origin) > 0)) {
+		t.lock.Unlock()
+		t.PerMessage().Tracef("Dropping version %d of %s %s, holding %d", version, cacheName, cacheKey, old.version)
+		return old.version, false, nil
+	}
+	if version == 0 {
+		version = x.cacheTime.UnixNano()
+		if old != nil && version <= old.version {
+			version = old.version + 1
+		}
+	}
+	x.version = version
+	quota := t.tenantQuotas[x.tenantID]
+	if len(x.tenantID) > 0 && quota > 0 && x.cacheSize > quota {
+		t.lock.Unlock()
+		return 0, false, NewCacheError(ExceedsTenantQuota, nil)
+	}
+	// an entry being replaced gives its space back first, and gets it back if the new one does not fit after all
+	replaced := t.removeLocked(cacheName, cacheKey)
+	if newTenantSize := t.tenantUsage[x.tenantID] + x.cacheSize; len(x.tenantID) > 0 && quota > 0 && newTenantSize > quota {
+		quotaEvicted, ret = t.evictTenant(x.tenantID, newTenantSize-quota)
+	}
 	newTotalSize := t.totalUsedCacheSize + x.cacheSize
 	//0 means no size checks
-	if t.maxCacheSize > 0 && newTotalSize > t.maxCacheSize {
-		ret = t.evict(newTotalSize - t.maxCacheSize)
+	if ret == nil && t.maxCacheSize > 0 && newTotalSize > t.maxCacheSize {
+		sizeEvicted, ret = t.evict(newTotalSize - t.maxCacheSize)
 	}
 	if ret == nil {
-		t.totalUsedCacheSize = newTotalSize
-		m, ok := t.caches[cacheName]
-		if !ok {
-			m = make(map[string]*cacheEntry)
-			t.caches[cacheName] = m
-		}
-		m[cacheKey] = x
+		t.insertLocked(x)
+	} else if replaced != nil {
+		t.insertLocked(replaced)
 	}
+	t.lock.Unlock()
+	t.evicted(ctx, EvictedForTenantQuota, quotaEvicted)
+	t.evicted(ctx, EvictedForSpace, sizeEvicted)
+	if !meta.expires.IsZero() && ret == nil {
+		t.startSweeping()
+	}
+
+	if ret != nil {
+		return version, false, ret
+	}
+	return version, true, nil
+}
 
-	defer t.lock.Unlock()
+// remove takes an entry out of the cache for reason, it returns the removed entry or nil if there was none
+func (t *InMemCache) remove(cacheName, cacheKey string, reason EvictionReason) *cacheEntry {
+	t.lock.Lock()
+	ret := t.removeLocked(cacheName, cacheKey)
+	t.lock.Unlock()
+	if ret != nil {
+		t.evicted(context.Background(), reason, []*cacheEntry{ret})
+	}
+	return ret
+}
+
+// insertLocked adds an entry that is not in the cache, caller must hold the write lock
+func (t *InMemCache) insertLocked(entry *cacheEntry) {
+	t.totalUsedCacheSize = t.totalUsedCacheSize + entry.cacheSize
+	t.tenantUsage[entry.tenantID] = t.tenantUsage[entry.tenantID] + entry.cacheSize
+	m, ok := t.caches[entry.CacheName]
+	if !ok {
+		m = make(map[string]*cacheEntry)
+		t.caches[entry.CacheName] = m
+	}
+	m[entry.CacheKey] = entry
+	if !entry.expires.IsZero() {
+		heap.Push(&t.expiry, entry)
+	}
+}
+
+// removeLocked caller must hold the write lock
+func (t *InMemCache) removeLocked(cacheName, cacheKey string) *cacheEntry {
+	cache, ok := t.caches[cacheName]
+	if !ok {
+		return nil
+	}
+	entry, ok := cache[cacheKey]
+	if !ok {
+		return nil
+	}
+	delete(cache, cacheKey)
+	if len(cache) == 0 {
+		delete(t.caches, cacheName)
+	}
+	if entry.expiryIndex > 0 {
+		heap.Remove(&t.expiry, entry.expiryIndex-1)
+	}
+	t.totalUsedCacheSize = t.totalUsedCacheSize - entry.cacheSize
+	t.tenantUsage[entry.tenantID] = t.tenantUsage[entry.tenantID] - entry.cacheSize
+	if t.tenantUsage[entry.tenantID] == 0 {
+		delete(t.tenantUsage, entry.tenantID)
+	}
+	return entry
+}
 
+// entries a snapshot of all the entries in the cache, the entries themselves are shared, do not modify them
+func (t *InMemCache) entries() []*cacheEntry {
+	t.lock.RLock()
+	ret := make([]*cacheEntry, 0)
+	for _, v := range t.caches {
+		for _, vp := range v {
+			ret = append(ret, vp)
+		}
+	}
+	t.lock.RUnlock()
 	return ret
 }
 
-// Get gets a value from the cache, if the item is not found, a CacheError is returned
+// Get gets a value from the cache, if the item is not found, a CacheError is returned.
+// A miss on a key another node invalidated is fetched from that node, otherwise the loader for the cache name is used
 func (t *InMemCache) Get(cacheName string, cacheKey string, valOut interface{}) error {
+	return t.GetCtx(context.Background(), cacheName, cacheKey, valOut)
+}
+
+// GetCtx is Get with the fetch from another node and the loader bounded by ctx
+func (t *InMemCache) GetCtx(ctx context.Context, cacheName string, cacheKey string, valOut interface{}) error {
+	if !validCacheName(cacheName) {
+		return NewCacheError(InvalidTenant, nil)
+	}
+	return t.get(ctx, cacheName, cacheKey, valOut)
+}
+
+// GetVersioned is GetCtx that also returns the version of the value, for a later put with IfVersion
+func (t *InMemCache) GetVersioned(ctx context.Context, cacheName string, cacheKey string, valOut interface{}) (int64, error) {
+	if !validCacheName(cacheName) {
+		return 0, NewCacheError(InvalidTenant, nil)
+	}
+	return t.getVersioned(ctx, cacheName, cacheKey, valOut)
+}
+
+// get is Get with a scoped cache name
+func (t *InMemCache) get(ctx context.Context, cacheName string, cacheKey string, valOut interface{}) error {
+	_, err := t.getVersioned(ctx, cacheName, cacheKey, valOut)
+	return err
+}
+
+func (t *InMemCache) getVersioned(ctx context.Context, cacheName string, cacheKey string, valOut interface{}) (version int64, err error) {
+	ctx, span := t.startSpan(ctx, "cache.get", trace.SpanKindInternal, cacheName, cacheKey)
+	defer func() {
+		endSpan(span, err)
+	}()
+	if t.isClosed() {
+		return 0, NewCacheError(Closed, nil)
+	}
+	var bits []byte
+	entry := t.getEntry(cacheName, cacheKey)
+	span.SetAttributes(attribute.Bool("cache.hit", entry != nil))
+	if entry != nil {
+		t.counted(cacheName, func(counts *NamespaceStats) { counts.Hits++ })
+		bits = entry.CacheData
+		version = entry.version
+	} else {
+		t.counted(cacheName, func(counts *NamespaceStats) { counts.Misses++ })
+		bits, err = t.reload(ctx, cacheName, cacheKey)
+		if err != nil {
+			return 0, err
+		}
+		if bits == nil {
+			return 0, NewCacheError(NoItem, nil)
+		}
+		// the reload put what it found
+		if entry = t.getEntry(cacheName, cacheKey); entry != nil {
+			version = entry.version
+		}
+	}
+	//if you are wondering how we can get an error on a bit stream we made, it is because it
+	//may have been made in another process space and thus mismatched
+	err = json.Unmarshal(bits, valOut)
+	if err != nil {
+		return 0, NewCacheError(NotJsonifiable, err)
+	}
+	return version, nil
+}
+
+// getEntry finds and touches an entry, nil if it is not there
+func (t *InMemCache) getEntry(cacheName string, cacheKey string) *cacheEntry {
 	var entry *cacheEntry
 	t.lock.RLock()
 	cache, ok := t.caches[cacheName]
@@ -126,35 +594,34 @@ func (t *InMemCache) Get(cacheName string, cacheKey string, valOut interface{})
 		entry = cache[cacheKey]
 	}
 	t.lock.RUnlock()
-	if entry == nil {
-		return NewCacheError(NoItem, nil)
+	if entry != nil && entry.expired(time.Now()) {
+		t.expireEntry(entry)
+		return nil
 	}
-	entry.touch()
-	//if you are wondering how we can get an error on a bit stream we made, it is because it
-	//may have been made in another process space and thus mismatched
-	err := json.Unmarshal(entry.CacheData, valOut)
-	if err != nil {
-		NewCacheError(NotJsonifiable, err)
+	if entry != nil {
+		entry.touch()
 	}
-	return err
+	return entry
 }
 
-// evict toss out oldest touch entries until evictCount bytes are freed
-func (t *InMemCache) evict(evictCount uint64) *CacheError {
+// evict toss out oldest touch entries until evictCount bytes are freed, caller must hold the write lock and pass the
+// tossed out entries to evicted once it is released
+func (t *InMemCache) evict(evictCount uint64) ([]*cacheEntry, *CacheError) {
 	last := t.sortLastTouched()
 	var amountFreed uint64
+	var ret []*cacheEntry
 	for _, x := range last {
-		entry := t.caches[x.CacheName][x.CacheKey]
+		entry := t.removeLocked(x.CacheName, x.CacheKey)
 		amountFreed = amountFreed + entry.cacheSize
-		delete(t.caches[x.CacheName], x.CacheKey)
+		ret = append(ret, entry)
 		if amountFreed >= evictCount {
 			break
 		}
 	}
 	if amountFreed < evictCount {
-		return NewCacheError(ObjectToLarge, nil)
+		return ret, NewCacheError(ObjectToLarge, nil)
 	}
-	return nil
+	return ret, nil
 }
 
 func (t *InMemCache) sortLastTouched() []*cacheEntry {
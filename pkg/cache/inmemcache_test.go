@@ -5,8 +5,13 @@
 package cache
 
 import (
+	"context"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/theotw/chatty-cache/pkg/chatter"
+	"github.com/theotw/chatty-cache/pkg/model"
 	"testing"
+	"time"
 )
 
 type SimpleStruct struct {
@@ -87,3 +92,251 @@ func EvictTest(t *testing.T, cache1 *InMemCache) {
 	}
 
 }
+
+// recordingChatter keeps what was sent so tests can look at it and feed messages back in
+type recordingChatter struct {
+	sent     []*model.CacheRelayMessage
+	listener chatter.ObjectListener
+	closes   int
+}
+
+func (t *recordingChatter) ReplicateCachedObject(message *model.CacheRelayMessage) {
+	t.sent = append(t.sent, message)
+}
+func (t *recordingChatter) RegisterListenerForReplicatedObjects(listener chatter.ObjectListener) {
+	t.listener = listener
+}
+func (t *recordingChatter) Close(ctx context.Context) error {
+	t.closes++
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	relay := new(recordingChatter)
+	cache1 := NewInMemCache(0, relay)
+	assert.Nil(t, cache1.Put("users", "key1", "value"))
+	assert.Nil(t, cache1.Close(context.Background()))
+	assert.Nil(t, cache1.Close(context.Background()), "closing again is harmless")
+	assert.Equal(t, 1, relay.closes)
+
+	var val string
+	err := cache1.Put("users", "key2", "value")
+	if assert.NotNil(t, err) {
+		assert.Equal(t, Closed, err.(*CacheError).Problem)
+	}
+	err = cache1.Get("users", "key1", &val)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, Closed, err.(*CacheError).Problem)
+	}
+	assert.Len(t, relay.sent, 1, "nothing is sent after closing")
+	assert.Nil(t, relay.listener(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key3", CacheValue: "InZhbHVlIg=="}))
+	assert.Nil(t, cache1.getEntry("users", "key3"), "messages are ignored after closing")
+}
+
+func TestReplicationPolicy(t *testing.T) {
+	relay := new(recordingChatter)
+	cache1 := NewInMemCache(0, relay)
+	cache1.SetReplicationPolicy("local", LocalOnly)
+	cache1.SetReplicationPolicy("invalidate", InvalidateOnly)
+	assert.Equal(t, ReplicateAll, cache1.ReplicationPolicy("other"))
+
+	cache1.Put("local", "key1", "value")
+	assert.Empty(t, relay.sent, "local only should not be sent")
+
+	cache1.Put("all", "key1", "value")
+	if assert.Equal(t, 1, len(relay.sent)) {
+		assert.Equal(t, model.RelayPut, relay.sent[0].Action)
+		assert.NotEmpty(t, relay.sent[0].CacheValue)
+	}
+
+	cache1.Put("all", "key2", "value", WithoutReplication())
+	assert.Equal(t, 1, len(relay.sent), "per call option should win")
+	var val string
+	assert.Nil(t, cache1.Get("all", "key2", &val), "still stored locally")
+
+	cache1.Put("invalidate", "key1", "value")
+	if assert.Equal(t, 2, len(relay.sent)) {
+		assert.Equal(t, model.RelayInvalidate, relay.sent[1].Action)
+		assert.Empty(t, relay.sent[1].CacheValue)
+	}
+
+	t.Run("Receiving", func(t *testing.T) {
+		relay.listener(&model.CacheRelayMessage{CacheName: "all", CacheKey: "key1", Action: model.RelayInvalidate})
+		assert.NotNil(t, cache1.Get("all", "key1", &val), "invalidated")
+
+		relay.listener(&model.CacheRelayMessage{CacheName: "local", CacheKey: "key1", Action: model.RelayInvalidate})
+		assert.Nil(t, cache1.Get("local", "key1", &val), "local only ignores other nodes")
+
+		cache1.SetDefaultReplicationPolicy(LocalOnly)
+		relay.listener(&model.CacheRelayMessage{CacheName: "new", CacheKey: "key1", CacheValue: "InZhbHVlIg=="})
+		assert.NotNil(t, cache1.Get("new", "key1", &val), "default policy applies to unknown cache names")
+	})
+
+	t.Run("Flush", func(t *testing.T) {
+		cache1.SetDefaultReplicationPolicy(ReplicateAll)
+		relay.listener(&model.CacheRelayMessage{CacheName: "all", CacheKey: "key3", CacheValue: "InZhbHVlIg==", NodeID: "node1"})
+		relay.listener(&model.CacheRelayMessage{CacheName: "invalidate", CacheKey: "key3", CacheValue: "InZhbHVlIg==", NodeID: "node2"})
+		cache1.Put("invalidate", "key2", "value")
+		assert.Nil(t, cache1.Get("all", "key3", &val))
+		assert.Nil(t, cache1.Get("invalidate", "key3", &val))
+		assert.Nil(t, relay.listener(&model.CacheRelayMessage{Action: model.RelayFlush, NodeID: "node1"}))
+		assert.NotNil(t, cache1.Get("all", "key3", &val), "replicated entries may be stale")
+		assert.NotNil(t, cache1.Get("invalidate", "key3", &val))
+		assert.Nil(t, cache1.Get("all", "key2", &val), "what was put here is not stale")
+		assert.Nil(t, cache1.Get("invalidate", "key2", &val))
+		assert.Nil(t, cache1.Get("local", "key1", &val), "local only is not touched by other nodes")
+	})
+}
+
+func TestConditionalPut(t *testing.T) {
+	relay := new(recordingChatter)
+	cache1 := NewInMemCache(0, relay)
+	problem := func(err error) ProblemType {
+		if cacheErr, ok := err.(*CacheError); ok {
+			return cacheErr.Problem
+		}
+		return ""
+	}
+
+	assert.Equal(t, NoItem, problem(cache1.Put("users", "key1", "value", IfPresent())))
+	assert.Nil(t, cache1.Put("users", "key1", "value", IfAbsent()))
+	assert.Equal(t, VersionConflict, problem(cache1.Put("users", "key1", "other", IfAbsent())))
+	assert.Nil(t, cache1.Put("users", "key1", "replaced", IfPresent()))
+	assert.Equal(t, 2, len(relay.sent), "failed conditional puts are not sent")
+
+	var val string
+	version, err := cache1.GetVersioned(context.Background(), "users", "key1", &val)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "replaced", val)
+		assert.Equal(t, relay.sent[1].Version, version)
+	}
+	assert.Nil(t, cache1.Put("users", "key1", "swapped", IfVersion(version)))
+	assert.Equal(t, VersionConflict, problem(cache1.Put("users", "key1", "again", IfVersion(version))), "the swap moved the version on")
+	assert.Equal(t, NoItem, problem(cache1.Put("users", "key2", "value", IfVersion(version))))
+	assert.Nil(t, cache1.Get("users", "key1", &val))
+	assert.Equal(t, "swapped", val)
+
+	assert.Nil(t, cache1.Put("users", "key3", "value", WithTTL(time.Millisecond)))
+	time.Sleep(5 * time.Millisecond)
+	assert.Nil(t, cache1.Put("users", "key3", "value", IfAbsent()), "an expired key is absent")
+}
+
+func TestLocalBusReplication(t *testing.T) {
+	bus := chatter.NewLocalBus()
+	bus.SetSeed(7)
+	caches := make([]*InMemCache, 0, 3)
+	for i := 0; i < 3; i++ {
+		node, err := bus.NewChatter("")
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer node.Close(context.Background())
+		caches = append(caches, NewInMemCache(0, node))
+	}
+
+	caches[0].Put("users", "key1", "value")
+	bus.Settle()
+	var val string
+	for _, c := range caches {
+		if assert.Nil(t, c.Get("users", "key1", &val)) {
+			assert.Equal(t, "value", val)
+		}
+	}
+
+	t.Run("Reordered", func(t *testing.T) {
+		bus.SetLatency(time.Millisecond, 5*time.Millisecond)
+		bus.SetReorderRate(0.5, 10*time.Millisecond)
+		defer bus.SetReorderRate(0, 0)
+		defer bus.SetLatency(0, 0)
+		for i := 0; i < 10; i++ {
+			caches[0].Put("users", "key2", fmt.Sprintf("value%d", i))
+		}
+		bus.Settle()
+		for _, c := range caches {
+			if assert.Nil(t, c.Get("users", "key2", &val)) {
+				assert.Equal(t, "value9", val, "older versions arriving late should be dropped")
+			}
+		}
+	})
+
+	t.Run("Partitioned", func(t *testing.T) {
+		bus.Partition([]string{caches[2].chatter.(*chatter.LocalChatter).NodeID()})
+		caches[0].Put("users", "key3", "value")
+		bus.Settle()
+		assert.Nil(t, caches[1].Get("users", "key3", &val))
+		assert.NotNil(t, caches[2].Get("users", "key3", &val), "the other side of the partition should not hear about it")
+		bus.Heal()
+		caches[0].Put("users", "key3", "value")
+		bus.Settle()
+		assert.Nil(t, caches[2].Get("users", "key3", &val))
+	})
+}
+
+func TestContext(t *testing.T) {
+	bus := chatter.NewLocalBus()
+	caches := make([]*InMemCache, 0, 2)
+	for i := 0; i < 2; i++ {
+		node, err := bus.NewChatter(fmt.Sprintf("node%d", i))
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer node.Close(context.Background())
+		caches = append(caches, NewInMemCache(0, node))
+	}
+	var val string
+
+	t.Run("Delete", func(t *testing.T) {
+		assert.Nil(t, caches[0].PutCtx(context.Background(), "users", "key1", "value"))
+		bus.Settle()
+		assert.Nil(t, caches[1].Get("users", "key1", &val))
+		assert.Nil(t, caches[1].DeleteCtx(context.Background(), "users", "key1"))
+		bus.Settle()
+		assert.NotNil(t, caches[0].Get("users", "key1", &val), "the delete should reach the other nodes")
+		assert.NotNil(t, caches[1].Get("users", "key1", &val))
+		assert.Nil(t, caches[0].Delete("users", "missing"))
+	})
+
+	t.Run("Cancelled put", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := caches[0].PutCtx(ctx, "users", "key2", "value")
+		if assert.NotNil(t, err) {
+			assert.Equal(t, ReplicationFailed, err.(*CacheError).Problem)
+		}
+		assert.Nil(t, caches[0].Get("users", "key2", &val), "the value is still kept here")
+	})
+
+	t.Run("Deadline on a fetch", func(t *testing.T) {
+		caches[0].SetReplicationPolicy("near", InvalidateOnly)
+		caches[1].SetReplicationPolicy("near", InvalidateOnly)
+		assert.Nil(t, caches[0].Put("near", "key3", "value"))
+		bus.Settle()
+		bus.SetLatency(100*time.Millisecond, 0)
+		defer bus.SetLatency(0, 0)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		err := caches[1].GetCtx(ctx, "near", "key3", &val)
+		if assert.NotNil(t, err) {
+			assert.Equal(t, NoItem, err.(*CacheError).Problem)
+		}
+	})
+
+	t.Run("Loader", func(t *testing.T) {
+		caches[0].SetContextLoader("loaded", func(ctx context.Context, cacheName string, cacheKey string) (interface{}, error) {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			return "loaded " + cacheKey, nil
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := caches[0].GetCtx(ctx, "loaded", "key4", &val)
+		if assert.NotNil(t, err) {
+			assert.Equal(t, LoadFailed, err.(*CacheError).Problem)
+			assert.Equal(t, context.Canceled, err.(*CacheError).WrappedError)
+		}
+		if assert.Nil(t, caches[0].GetCtx(context.Background(), "loaded", "key4", &val)) {
+			assert.Equal(t, "loaded key4", val)
+		}
+	})
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cache
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/theotw/chatty-cache/pkg/chatter"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"sort"
+	"strings"
+	"time"
+)
+
+// NamespaceInfo what one cache name holds on this node
+type NamespaceInfo struct {
+	// TenantID empty for a cache name not put through a TenantCache
+	TenantID  string
+	CacheName string
+	Entries   int
+	Bytes     uint64
+}
+
+// EntryInfo what is known about an entry besides its value
+type EntryInfo struct {
+	TenantID    string
+	CacheName   string
+	CacheKey    string
+	Size        uint64
+	CacheTime   time.Time
+	LastTouched time.Time
+	// Expires zero when the entry has no TTL
+	Expires time.Time
+	Version int64
+	// Origin the node the value came from, empty when it was put on this node
+	Origin string
+}
+
+// Chatter the chatter the cache replicates through, nil for a local only cache
+func (t *InMemCache) Chatter() chatter.CacheChatter {
+	return t.chatter
+}
+
+// Namespaces what every cache name holds on this node, sorted by tenant then cache name
+func (t *InMemCache) Namespaces() []NamespaceInfo {
+	t.lock.RLock()
+	ret := make([]NamespaceInfo, 0, len(t.caches))
+	for name, cache := range t.caches {
+		var info NamespaceInfo
+		info.TenantID, info.CacheName = splitScopedName(name)
+		info.Entries = len(cache)
+		for _, entry := range cache {
+			info.Bytes = info.Bytes + entry.cacheSize
+		}
+		ret = append(ret, info)
+	}
+	t.lock.RUnlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].TenantID != ret[j].TenantID {
+			return ret[i].TenantID < ret[j].TenantID
+		}
+		return ret[i].CacheName < ret[j].CacheName
+	})
+	return ret
+}
+
+// Keys the sorted keys of cacheName starting with prefix, no more than limit of them unless limit is 0.
+// tenantID is empty for a cache name not put through a TenantCache
+func (t *InMemCache) Keys(tenantID string, cacheName string, prefix string, limit int) ([]string, error) {
+	if !validNamespace(tenantID, cacheName) {
+		return nil, NewCacheError(InvalidTenant, nil)
+	}
+	t.lock.RLock()
+	ret := make([]string, 0)
+	for key := range t.caches[scopedName(tenantID, cacheName)] {
+		if strings.HasPrefix(key, prefix) {
+			ret = append(ret, key)
+		}
+	}
+	t.lock.RUnlock()
+	sort.Strings(ret)
+	if limit > 0 && len(ret) > limit {
+		ret = ret[:limit]
+	}
+	return ret, nil
+}
+
+// Entry what is known about the entry, without touching it.  A NoItem CacheError when it is not held or expired
+func (t *InMemCache) Entry(tenantID string, cacheName string, cacheKey string) (*EntryInfo, error) {
+	entry, err := t.inspectEntry(tenantID, cacheName, cacheKey)
+	if err != nil {
+		return nil, err
+	}
+	ret := new(EntryInfo)
+	ret.TenantID = tenantID
+	ret.CacheName = cacheName
+	ret.CacheKey = cacheKey
+	ret.Size = entry.cacheSize
+	ret.CacheTime = entry.cacheTime
+	ret.LastTouched = entry.lastTouched
+	ret.Expires = entry.expires
+	ret.Version = entry.version
+	ret.Origin = entry.origin
+	return ret, nil
+}
+
+// RawValue the JSON of the value, without touching it
+func (t *InMemCache) RawValue(tenantID string, cacheName string, cacheKey string) ([]byte, error) {
+	entry, err := t.inspectEntry(tenantID, cacheName, cacheKey)
+	if err != nil {
+		return nil, err
+	}
+	return entry.CacheData, nil
+}
+
+// DeleteNamespace deletes every key of cacheName as Delete would, it returns how many were deleted on this node
+func (t *InMemCache) DeleteNamespace(ctx context.Context, tenantID string, cacheName string) (int, error) {
+	keys, err := t.Keys(tenantID, cacheName, "", 0)
+	if err != nil {
+		return 0, err
+	}
+	var ret error
+	for _, key := range keys {
+		err = t.delete(ctx, tenantID, cacheName, key)
+		if err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return len(keys), ret
+}
+
+// Resync sends every entry of the ReplicateAll cache names to the other nodes again at its current version, so a
+// node that missed messages catches up.  Nodes already holding the version drop it without firing their hooks or
+// watches.  It returns how many were sent
+func (t *InMemCache) Resync(ctx context.Context) (int, error) {
+	if t.isClosed() {
+		return 0, NewCacheError(Closed, nil)
+	}
+	if t.chatter == nil {
+		return 0, nil
+	}
+	now := time.Now()
+	sent := 0
+	for _, entry := range t.entries() {
+		tenantID, cacheName := splitScopedName(entry.CacheName)
+		if entry.expired(now) || t.ReplicationPolicy(cacheName) != ReplicateAll {
+			continue
+		}
+		var put model.CacheRelayMessage
+		put.CacheName = cacheName
+		put.CacheKey = entry.CacheKey
+		put.CacheValue = base64.StdEncoding.EncodeToString(entry.CacheData)
+		put.Version = entry.version
+		put.TenantID = tenantID
+		put.ExpiresAt = unixNanos(entry.expires)
+		err := t.replicate(ctx, &put)
+		if err != nil {
+			return sent, NewCacheError(ReplicationFailed, err)
+		}
+		sent++
+	}
+	t.Logger().Infof("Resync sent %d entries", sent)
+	return sent, nil
+}
+
+// inspectEntry the entry without touching it, or why there is none
+func (t *InMemCache) inspectEntry(tenantID string, cacheName string, cacheKey string) (*cacheEntry, error) {
+	if !validNamespace(tenantID, cacheName) {
+		return nil, NewCacheError(InvalidTenant, nil)
+	}
+	t.lock.RLock()
+	entry := t.caches[scopedName(tenantID, cacheName)][cacheKey]
+	t.lock.RUnlock()
+	if entry == nil || entry.expired(time.Now()) {
+		return nil, NewCacheError(NoItem, nil)
+	}
+	return entry, nil
+}
+
+// validNamespace a plain cache name with an empty tenant or a valid one
+func validNamespace(tenantID string, cacheName string) bool {
+	if len(tenantID) > 0 && !validTenantID(tenantID) {
+		return false
+	}
+	return validCacheName(cacheName)
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cache
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"testing"
+	"time"
+)
+
+func TestInspect(t *testing.T) {
+	relay := new(recordingChatter)
+	cache1 := NewInMemCache(0, relay)
+	defer cache1.Close(context.Background())
+	tenant, err := cache1.Tenant("acme")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, cache1.Put("users", "key1", "value"))
+	assert.Nil(t, cache1.Put("users", "key2", "value"))
+	assert.Nil(t, cache1.Put("users", "other", "value", WithTTL(time.Hour)))
+	assert.Nil(t, tenant.Put("users", "key1", "value"))
+	assert.Nil(t, relay.listener(&model.CacheRelayMessage{CacheName: "remote", CacheKey: "key1", CacheValue: "InZhbHVlIg==", Version: 5, NodeID: "node1"}))
+
+	assert.Equal(t, []NamespaceInfo{
+		{CacheName: "remote", Entries: 1, Bytes: 7},
+		{CacheName: "users", Entries: 3, Bytes: 21},
+		{TenantID: "acme", CacheName: "users", Entries: 1, Bytes: 7},
+	}, cache1.Namespaces())
+
+	keys, err := cache1.Keys("", "users", "key", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"key1", "key2"}, keys)
+	keys, err = cache1.Keys("", "users", "", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"key1"}, keys)
+	_, err = cache1.Keys("bad tenant", "users", "", 0)
+	assert.Equal(t, InvalidTenant, err.(*CacheError).Problem)
+
+	info, err := cache1.Entry("", "remote", "key1")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "node1", info.Origin)
+		assert.Equal(t, int64(5), info.Version)
+		assert.Equal(t, uint64(7), info.Size)
+	}
+	info, err = cache1.Entry("", "users", "other")
+	if assert.Nil(t, err) {
+		assert.Empty(t, info.Origin)
+		assert.False(t, info.Expires.IsZero())
+	}
+	_, err = cache1.Entry("acme", "users", "key2")
+	assert.Equal(t, NoItem, err.(*CacheError).Problem)
+	bits, err := cache1.RawValue("acme", "users", "key1")
+	assert.Nil(t, err)
+	assert.Equal(t, `"value"`, string(bits))
+
+	t.Run("Resync", func(t *testing.T) {
+		cache1.SetReplicationPolicy("remote", InvalidateOnly)
+		relay.sent = nil
+		sent, err := cache1.Resync(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, 4, sent, "the invalidate only cache name is not sent")
+		for _, message := range relay.sent {
+			assert.Equal(t, model.RelayPut, message.Action)
+			assert.Equal(t, "users", message.CacheName)
+		}
+
+		// a node that already holds the versions
+		relay2 := new(recordingChatter)
+		cache2 := NewInMemCache(0, relay2)
+		defer cache2.Close(context.Background())
+		apply := func() {
+			for _, message := range relay.sent {
+				resent := *message
+				resent.NodeID = "node0"
+				assert.Nil(t, relay2.listener(&resent))
+			}
+		}
+		apply()
+		before, err := cache2.Entry("", "users", "key1")
+		if !assert.Nil(t, err) {
+			return
+		}
+		var puts, remotes int
+		cache2.OnPut(func(event Event) { puts++ })
+		cache2.OnRemoteApply(func(event Event, nodeID string) { remotes++ })
+		apply()
+		assert.Equal(t, 0, puts, "the versions held are not put again")
+		assert.Equal(t, 0, remotes)
+		after, _ := cache2.Entry("", "users", "key1")
+		assert.Equal(t, before.CacheTime, after.CacheTime)
+	})
+
+	t.Run("DeleteNamespace", func(t *testing.T) {
+		relay.sent = nil
+		deleted, err := cache1.DeleteNamespace(context.Background(), "", "users")
+		assert.Nil(t, err)
+		assert.Equal(t, 3, deleted)
+		assert.Equal(t, 3, len(relay.sent))
+		keys, _ := cache1.Keys("", "users", "", 0)
+		assert.Empty(t, keys)
+		_, err = cache1.Entry("acme", "users", "key1")
+		assert.Nil(t, err, "the tenant's cache name of the same name stays")
+	})
+}
@@ -0,0 +1,267 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cache
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/theotw/chatty-cache/pkg/logging"
+	"strings"
+	"sync"
+)
+
+// KVBucketPrefixDefault is put in front of the bucket name of every cache name
+const KVBucketPrefixDefault = "CHATTY"
+
+// emptyKVKey stands in for the empty cache key, kv keys cannot be empty and = on its own is never valid base 64
+const emptyKVKey = "="
+
+// KVCache keeps every cache name in its own NATS JetStream key value bucket, with an InMemCache in front as the L1.
+// Puts write through to the bucket, gets that miss the L1 read through to it.  Every node watches the buckets it
+// has used and drops its L1 copy when the bucket gets a newer revision, so there is no replication envelope at all,
+// the bucket is the shared copy.  The version of an L1 entry is the bucket revision it was read at
+type KVCache struct {
+	logging.Holder
+
+	local        *InMemCache
+	js           nats.JetStreamContext
+	bucketPrefix string
+
+	bucketLock sync.Mutex
+	buckets    map[string]nats.KeyValue
+	watchers   map[string]nats.KeyWatcher
+
+	// seen the newest revision the watchers have seen per key, so a read racing an update is not cached.
+	// Guarded by seenLock
+	seenLock sync.Mutex
+	seen     map[string]uint64
+}
+
+// NewKVCache creates a KV backed cache with an L1 of up to maxSize bytes.  bucketPrefix names the buckets,
+// empty uses KVBucketPrefixDefault
+func NewKVCache(maxSize uint64, js nats.JetStreamContext, bucketPrefix string) *KVCache {
+	ret := new(KVCache)
+	ret.local = NewInMemCache(maxSize, nil)
+	ret.js = js
+	if len(bucketPrefix) == 0 {
+		bucketPrefix = KVBucketPrefixDefault
+	}
+	ret.bucketPrefix = bucketPrefix
+	ret.buckets = make(map[string]nats.KeyValue)
+	ret.watchers = make(map[string]nats.KeyWatcher)
+	ret.seen = make(map[string]uint64)
+	return ret
+}
+
+// Put writes the value to the bucket of cacheName and keeps it in the L1.
+// WithoutReplication only puts it in the L1, where it stays until the bucket gets a newer value for the key
+func (t *KVCache) Put(cacheName string, cacheKey string, value interface{}, opts ...PutOption) error {
+	if !validCacheName(cacheName) {
+		return NewCacheError(InvalidTenant, nil)
+	}
+	if t.local.isClosed() {
+		return NewCacheError(Closed, nil)
+	}
+	options := makePutOptions(opts)
+	jsonBits, err := json.Marshal(value)
+	if err != nil {
+		return NewCacheError(NotJsonifiable, err)
+	}
+	if options.noReplicate {
+		// keep the version we had so the next revision from the bucket still replaces it
+		var version int64 = 1
+		if entry := t.local.getEntry(cacheName, cacheKey); entry != nil {
+			version = entry.version
+		}
+		_, err = t.local.putVersionedBits(context.Background(), cacheName, cacheKey, jsonBits, version, entryMeta{})
+		return err
+	}
+	kv, err := t.bucket(cacheName)
+	if err != nil {
+		return err
+	}
+	revision, err := kv.Put(kvKey(cacheKey), jsonBits)
+	if err != nil {
+		return NewCacheError(BackendUnavailable, err)
+	}
+	_, err = t.local.putVersionedBits(context.Background(), cacheName, cacheKey, jsonBits, int64(revision), entryMeta{})
+	return err
+}
+
+// Get gets the value from the L1, or from the bucket of cacheName on a miss
+func (t *KVCache) Get(cacheName string, cacheKey string, valOut interface{}) error {
+	if !validCacheName(cacheName) {
+		return NewCacheError(InvalidTenant, nil)
+	}
+	if t.local.isClosed() {
+		return NewCacheError(Closed, nil)
+	}
+	entry := t.local.getEntry(cacheName, cacheKey)
+	if entry != nil {
+		return unmarshalEntry(entry.CacheData, valOut)
+	}
+	kv, err := t.bucket(cacheName)
+	if err != nil {
+		return err
+	}
+	kvEntry, err := kv.Get(kvKey(cacheKey))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return NewCacheError(NoItem, nil)
+	}
+	if err != nil {
+		return NewCacheError(BackendUnavailable, err)
+	}
+	if kvEntry.Revision() >= t.seenRevision(cacheName, cacheKey) {
+		_, err = t.local.putVersionedBits(context.Background(), cacheName, cacheKey, kvEntry.Value(), int64(kvEntry.Revision()), entryMeta{})
+		if err != nil {
+			t.Logger().WithError(err).Debugf("Unable to keep %s %s in the L1", cacheName, cacheKey)
+		}
+	}
+	return unmarshalEntry(kvEntry.Value(), valOut)
+}
+
+// SetLogger logs through logger, for this cache and its L1
+func (t *KVCache) SetLogger(logger logging.Logger) {
+	t.Holder.SetLogger(logger)
+	t.local.SetLogger(logger)
+}
+
+// Close stops watching the buckets and closes the L1, later calls fail with a Closed CacheError.  The JetStream
+// connection belongs to the caller and is left open
+func (t *KVCache) Close(ctx context.Context) error {
+	t.local.Close(ctx)
+	t.bucketLock.Lock()
+	for name, watcher := range t.watchers {
+		err := watcher.Stop()
+		if err != nil {
+			t.Logger().WithError(err).Debugf("Unable to stop watching %s", name)
+		}
+	}
+	t.watchers = make(map[string]nats.KeyWatcher)
+	t.buckets = make(map[string]nats.KeyValue)
+	t.bucketLock.Unlock()
+	return nil
+}
+
+// BucketName the name of the key value bucket cacheName is kept in
+func (t *KVCache) BucketName(cacheName string) string {
+	return t.bucketPrefix + "_" + bucketToken(cacheName)
+}
+
+// bucket opens, or creates, the bucket of cacheName and starts watching it
+func (t *KVCache) bucket(cacheName string) (nats.KeyValue, error) {
+	t.bucketLock.Lock()
+	defer t.bucketLock.Unlock()
+	if kv, ok := t.buckets[cacheName]; ok {
+		return kv, nil
+	}
+	name := t.BucketName(cacheName)
+	kv, err := t.js.KeyValue(name)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = t.js.CreateKeyValue(&nats.KeyValueConfig{Bucket: name, Storage: nats.FileStorage})
+	}
+	if err != nil {
+		return nil, NewCacheError(BackendUnavailable, err)
+	}
+	// only the revisions are needed, the values are read when they are asked for
+	watcher, err := kv.WatchAll(nats.MetaOnly())
+	if err != nil {
+		return nil, NewCacheError(BackendUnavailable, err)
+	}
+	t.buckets[cacheName] = kv
+	t.watchers[cacheName] = watcher
+	go t.watch(cacheName, watcher)
+	return kv, nil
+}
+
+func (t *KVCache) watch(cacheName string, watcher nats.KeyWatcher) {
+	for update := range watcher.Updates() {
+		// nil marks the end of the values that were there when the watch started
+		if update == nil {
+			continue
+		}
+		cacheKey, err := cacheKeyFromKV(update.Key())
+		if err != nil {
+			t.Logger().WithError(err).Debugf("Ignoring key %s in bucket %s", update.Key(), update.Bucket())
+			continue
+		}
+		t.invalidateOlder(cacheName, cacheKey, update.Revision())
+	}
+}
+
+// invalidateOlder drops the L1 copy if the bucket has moved past it
+func (t *KVCache) invalidateOlder(cacheName string, cacheKey string, revision uint64) {
+	key := ringKey(cacheName, cacheKey)
+	t.seenLock.Lock()
+	if len(t.seen) >= maxTombstones {
+		t.seen = make(map[string]uint64)
+	}
+	if revision > t.seen[key] {
+		t.seen[key] = revision
+	}
+	t.seenLock.Unlock()
+
+	t.local.lock.Lock()
+	entry := t.local.caches[cacheName][cacheKey]
+	if entry != nil && entry.version < int64(revision) {
+		t.local.removeLocked(cacheName, cacheKey)
+	} else {
+		entry = nil
+	}
+	t.local.lock.Unlock()
+	if entry != nil {
+		t.local.evicted(context.Background(), EvictedInvalidated, []*cacheEntry{entry})
+	}
+}
+
+func (t *KVCache) seenRevision(cacheName string, cacheKey string) uint64 {
+	t.seenLock.Lock()
+	ret := t.seen[ringKey(cacheName, cacheKey)]
+	t.seenLock.Unlock()
+	return ret
+}
+
+func unmarshalEntry(bits []byte, valOut interface{}) error {
+	err := json.Unmarshal(bits, valOut)
+	if err != nil {
+		return NewCacheError(NotJsonifiable, err)
+	}
+	return nil
+}
+
+// kvKey kv keys are limited to letters, digits and -/_=. so cache keys are base 64 url encoded
+func kvKey(cacheKey string) string {
+	if len(cacheKey) == 0 {
+		return emptyKVKey
+	}
+	return base64.URLEncoding.EncodeToString([]byte(cacheKey))
+}
+
+func cacheKeyFromKV(key string) (string, error) {
+	if key == emptyKVKey {
+		return "", nil
+	}
+	bits, err := base64.URLEncoding.DecodeString(key)
+	return string(bits), err
+}
+
+// bucketToken bucket names are limited to letters, digits, - and _.  Anything else, _ included, becomes _ and its
+// hex code so two cache names never share a bucket
+func bucketToken(cacheName string) string {
+	var sb strings.Builder
+	for _, b := range []byte(cacheName) {
+		ok := (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') || b == '-'
+		if ok {
+			sb.WriteByte(b)
+		} else {
+			sb.WriteString(fmt.Sprintf("_%02x", b))
+		}
+	}
+	return sb.String()
+}
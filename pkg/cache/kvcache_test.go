@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cache
+
+import (
+	"context"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// connectJetStream opens a connection of its own to s
+func connectJetStream(t *testing.T, s *server.Server) nats.JetStreamContext {
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return js
+}
+
+// runJetStreamServer starts an embedded nats server with jetstream on a random port
+func runJetStreamServer(t *testing.T) *server.Server {
+	opts := &server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	}
+	s, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(10 * time.Second) {
+		t.Fatal("nats server did not start")
+	}
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+func TestKVCache(t *testing.T) {
+	s := runJetStreamServer(t)
+	cache1 := NewKVCache(0, connectJetStream(t, s), "")
+	defer cache1.Close(context.Background())
+	cache2 := NewKVCache(0, connectJetStream(t, s), "")
+	defer cache2.Close(context.Background())
+
+	var val string
+	err := cache2.Get("users", "key1", &val)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, NoItem, err.(*CacheError).Problem)
+	}
+
+	assert.Nil(t, cache1.Put("users", "key1", "value1"))
+	assert.Nil(t, cache2.Get("users", "key1", &val), "read through to the bucket")
+	assert.Equal(t, "value1", val)
+	assert.NotNil(t, cache2.local.getEntry("users", "key1"), "kept in the L1")
+
+	assert.Nil(t, cache1.Put("users", "key1", "value2"))
+	assert.Eventually(t, func() bool {
+		return cache2.local.getEntry("users", "key1") == nil
+	}, 5*time.Second, 10*time.Millisecond, "the watch should drop the old L1 copy")
+	assert.Nil(t, cache2.Get("users", "key1", &val))
+	assert.Equal(t, "value2", val)
+	assert.NotNil(t, cache1.local.getEntry("users", "key1"), "our own put is not invalidated")
+
+	t.Run("Local only put", func(t *testing.T) {
+		assert.Nil(t, cache2.Put("users", "key1", "mine", WithoutReplication()))
+		assert.Nil(t, cache2.Get("users", "key1", &val))
+		assert.Equal(t, "mine", val)
+		assert.Nil(t, cache1.Get("users", "key1", &val))
+		assert.Equal(t, "value2", val, "never written to the bucket")
+
+		assert.Nil(t, cache1.Put("users", "key1", "value3"))
+		assert.Eventually(t, func() bool {
+			return cache2.Get("users", "key1", &val) == nil && val == "value3"
+		}, 5*time.Second, 10*time.Millisecond, "a newer bucket value replaces the local one")
+	})
+
+	t.Run("Names", func(t *testing.T) {
+		assert.Nil(t, cache1.Put("orders.eu", "", "empty key"))
+		assert.Nil(t, cache2.Get("orders.eu", "", &val))
+		assert.Equal(t, "empty key", val)
+		assert.Equal(t, "CHATTY_orders_2eeu", cache1.BucketName("orders.eu"))
+		assert.NotEqual(t, cache1.BucketName("a_2e"), cache1.BucketName("a.e"))
+		assert.Equal(t, "=", kvKey(""))
+		key, err := cacheKeyFromKV(kvKey("some key/1"))
+		assert.Nil(t, err)
+		assert.Equal(t, "some key/1", key)
+	})
+}
@@ -0,0 +1,206 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cache
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/theotw/chatty-cache/pkg/chatter"
+	"github.com/theotw/chatty-cache/pkg/model"
+)
+
+// Loader reads a value from wherever it really lives (the DB) when it is not in the cache.
+// Return nil with no error if there is no such value
+type Loader func(cacheName string, cacheKey string) (interface{}, error)
+
+// ContextLoader is a Loader given the ctx of the GetCtx that missed, so the read can be cancelled
+type ContextLoader func(ctx context.Context, cacheName string, cacheKey string) (interface{}, error)
+
+// maxTombstones caps how many invalidated keys we remember the invalidating node for
+const maxTombstones = 10000
+
+// SetLoader sets the read through loader for cacheName, loaded values are cached on this node only.
+// This is meant to pair with InvalidateOnly so every node reloads from the source after another node changes a value
+func (t *InMemCache) SetLoader(cacheName string, loader Loader) {
+	if loader == nil {
+		t.SetContextLoader(cacheName, nil)
+		return
+	}
+	t.SetContextLoader(cacheName, func(ctx context.Context, cacheName string, cacheKey string) (interface{}, error) {
+		return loader(cacheName, cacheKey)
+	})
+}
+
+// SetContextLoader is SetLoader for a loader that takes the ctx
+func (t *InMemCache) SetContextLoader(cacheName string, loader ContextLoader) {
+	t.policyLock.Lock()
+	if loader == nil {
+		delete(t.loaders, cacheName)
+	} else {
+		t.loaders[cacheName] = loader
+	}
+	t.policyLock.Unlock()
+}
+
+func (t *InMemCache) loader(cacheName string) ContextLoader {
+	t.policyLock.RLock()
+	ret := t.loaders[cacheName]
+	t.policyLock.RUnlock()
+	return ret
+}
+
+// invalidate drops our copy unless it is newer than the invalidation, and remembers who sent it
+func (t *InMemCache) invalidate(ctx context.Context, message *model.CacheRelayMessage) {
+	cacheName := scopedName(message.TenantID, message.CacheName)
+	t.removeOlder(ctx, cacheName, message.CacheKey, message.Version, EvictedInvalidated)
+
+	if len(message.NodeID) > 0 {
+		t.tombstoneLock.Lock()
+		if len(t.tombstones) >= maxTombstones {
+			// no point being clever, a reload from the loader is always correct
+			t.tombstones = make(map[string]string)
+		}
+		t.tombstones[ringKey(cacheName, message.CacheKey)] = message.NodeID
+		t.tombstoneLock.Unlock()
+	}
+}
+
+// flushReplicated drops the entries other nodes sent us for the cache names that are not LocalOnly, any of them may
+// be stale after the chatter lost messages from nodeID.  What was put on this node stays.  The next miss reloads
+func (t *InMemCache) flushReplicated(ctx context.Context, nodeID string) int {
+	var dropped []*cacheEntry
+	t.lock.Lock()
+	for name, cache := range t.caches {
+		_, cacheName := splitScopedName(name)
+		if t.ReplicationPolicy(cacheName) == LocalOnly {
+			continue
+		}
+		for key, entry := range cache {
+			if len(entry.origin) > 0 {
+				dropped = append(dropped, t.removeLocked(name, key))
+			}
+		}
+	}
+	t.lock.Unlock()
+	t.evicted(ctx, EvictedInvalidated, dropped)
+	t.Logger().Warnf("Lost messages from node %s, dropped the %d replicated entries", nodeID, len(dropped))
+	return len(dropped)
+}
+
+// removeOlder drops our copy for reason unless it is newer than version, 0 drops any version.  cacheName is the
+// scoped name
+func (t *InMemCache) removeOlder(ctx context.Context, cacheName string, cacheKey string, version int64, reason EvictionReason) {
+	t.lock.Lock()
+	entry := t.caches[cacheName][cacheKey]
+	if entry != nil && (version == 0 || entry.version <= version) {
+		t.removeLocked(cacheName, cacheKey)
+	} else {
+		entry = nil
+	}
+	t.lock.Unlock()
+	if entry != nil {
+		t.evicted(ctx, reason, []*cacheEntry{entry})
+	}
+}
+
+func (t *InMemCache) takeTombstone(cacheName string, cacheKey string) string {
+	key := ringKey(cacheName, cacheKey)
+	t.tombstoneLock.Lock()
+	ret := t.tombstones[key]
+	delete(t.tombstones, key)
+	t.tombstoneLock.Unlock()
+	return ret
+}
+
+// reload fetches a missing value from the node that invalidated it, or from the loader.  nil bits means not found.
+// cacheName is the scoped name
+func (t *InMemCache) reload(ctx context.Context, cacheName string, cacheKey string) ([]byte, error) {
+	origin := t.takeTombstone(cacheName, cacheKey)
+	if fetcher, ok := t.chatter.(chatter.PartitionChatter); ok && len(origin) > 0 {
+		bits := t.fetchFromPeer(ctx, fetcher, origin, cacheName, cacheKey)
+		if bits != nil {
+			return bits, nil
+		}
+	}
+
+	loader := t.loader(cacheName)
+	if loader == nil {
+		return nil, nil
+	}
+	// a tenant's loader is given the cache name as the tenant knows it
+	_, loaderName := splitScopedName(cacheName)
+	value, err := loader(ctx, loaderName, cacheKey)
+	if err != nil {
+		return nil, NewCacheError(LoadFailed, err)
+	}
+	if value == nil {
+		return nil, nil
+	}
+	bits, err := json.Marshal(value)
+	if err != nil {
+		return nil, NewCacheError(NotJsonifiable, err)
+	}
+	_, err = t.putVersionedBits(ctx, cacheName, cacheKey, bits, 0, entryMeta{})
+	if err != nil {
+		t.Logger().WithError(err).Debugf("Unable to cache loaded value %s %s", cacheName, cacheKey)
+	}
+	return bits, nil
+}
+
+func (t *InMemCache) fetchFromPeer(ctx context.Context, fetcher chatter.PartitionChatter, nodeID string, cacheName string, cacheKey string) []byte {
+	var request model.CacheRelayMessage
+	request.TenantID, request.CacheName = splitScopedName(cacheName)
+	request.CacheKey = cacheKey
+	var reply *model.CacheRelayMessage
+	var err error
+	if ctxFetcher, ok := fetcher.(chatter.ContextPartitionChatter); ok {
+		reply, err = ctxFetcher.FetchFromNodeCtx(ctx, nodeID, &request)
+	} else {
+		reply, err = fetcher.FetchFromNode(nodeID, &request)
+	}
+	if err != nil {
+		t.Logger().WithError(err).Debugf("Unable to fetch %s %s from %s", cacheName, cacheKey, nodeID)
+		return nil
+	}
+	if reply == nil {
+		return nil
+	}
+	bits, err := base64.StdEncoding.DecodeString(reply.CacheValue)
+	if err != nil {
+		t.Logger().WithError(err).Errorf("Unable to base 64 decode a fetch reply")
+		return nil
+	}
+	_, err = t.putVersionedBits(ctx, cacheName, cacheKey, bits, reply.Version, entryMeta{expires: expiresAt(reply.ExpiresAt), origin: nodeID})
+	if err != nil {
+		t.Logger().WithError(err).Debugf("Unable to cache fetched value %s %s", cacheName, cacheKey)
+	}
+	return bits
+}
+
+// registerFetchHandler lets other nodes fetch from us if the chatter can do that
+func (t *InMemCache) registerFetchHandler() {
+	if fetcher, ok := t.chatter.(chatter.PartitionChatter); ok {
+		fetcher.RegisterFetchHandler(func(message *model.CacheRelayMessage) *model.CacheRelayMessage {
+			return t.handleFetch(message)
+		})
+	}
+}
+
+// handleFetch answers another node asking for our copy, LocalOnly cache names are never handed out
+func (t *InMemCache) handleFetch(message *model.CacheRelayMessage) *model.CacheRelayMessage {
+	if t.isClosed() || t.ReplicationPolicy(message.CacheName) == LocalOnly {
+		return nil
+	}
+	entry := t.getEntry(scopedName(message.TenantID, message.CacheName), message.CacheKey)
+	if entry == nil {
+		return nil
+	}
+	ret := relayMessageFor(message.CacheName, entry.CacheKey, entry.CacheData)
+	ret.Version = entry.version
+	ret.TenantID = message.TenantID
+	ret.ExpiresAt = unixNanos(entry.expires)
+	return ret
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cache
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"testing"
+)
+
+func TestInvalidateOnly(t *testing.T) {
+	cluster := &fakeCluster{nodes: make(map[string]*fakeNode)}
+	node0 := cluster.addNode("node0")
+	node1 := cluster.addNode("node1")
+	cache0 := NewInMemCache(0, node0)
+	cache1 := NewInMemCache(0, node1)
+	cache0.SetDefaultReplicationPolicy(InvalidateOnly)
+	cache1.SetDefaultReplicationPolicy(InvalidateOnly)
+
+	loads := 0
+	cache1.SetLoader("entities", func(cacheName string, cacheKey string) (interface{}, error) {
+		loads++
+		if cacheKey == "broken" {
+			return nil, errors.New("db is down")
+		}
+		if cacheKey == "missing" {
+			return nil, nil
+		}
+		return "from the db", nil
+	})
+
+	cache1.Put("entities", "key1", "old value", WithoutReplication())
+	cache0.Put("entities", "key1", "new value")
+	var val string
+	err := cache1.Get("entities", "key1", &val)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "new value", val, "should be fetched from the node that invalidated it")
+	}
+	assert.Equal(t, 0, loads)
+
+	t.Run("Loader", func(t *testing.T) {
+		err := cache1.Get("entities", "key2", &val)
+		if assert.Nil(t, err) {
+			assert.Equal(t, "from the db", val)
+		}
+		cache1.Get("entities", "key2", &val)
+		assert.Equal(t, 1, loads, "second get should be cached")
+		assert.NotNil(t, cache0.Get("entities", "key2", &val), "loaded values are not replicated")
+
+		err = cache1.Get("entities", "broken", &val)
+		if assert.NotNil(t, err) {
+			assert.Equal(t, LoadFailed, err.(*CacheError).Problem)
+		}
+		err = cache1.Get("entities", "missing", &val)
+		if assert.NotNil(t, err) {
+			assert.Equal(t, NoItem, err.(*CacheError).Problem)
+		}
+	})
+
+	t.Run("Versions", func(t *testing.T) {
+		cache1.Put("entities", "key3", "newer", WithoutReplication())
+		held := cache1.getEntry("entities", "key3").version
+		node1.objectListener(&model.CacheRelayMessage{CacheName: "entities", CacheKey: "key3", Action: model.RelayInvalidate, Version: held - 1})
+		assert.Nil(t, cache1.Get("entities", "key3", &val), "older invalidation should not drop a newer value")
+
+		node1.objectListener(&model.CacheRelayMessage{CacheName: "entities", CacheKey: "key3", CacheValue: "Im9sZGVyIg==", Version: held - 1})
+		cache1.Get("entities", "key3", &val)
+		assert.Equal(t, "newer", val, "older put should not replace a newer value")
+
+		cache1.Put("entities", "key3", "newest", WithoutReplication())
+		assert.Greater(t, cache1.getEntry("entities", "key3").version, held, "local puts always move the version forward")
+	})
+
+	t.Run("Local only is not fetched", func(t *testing.T) {
+		cache0.SetReplicationPolicy("secrets", LocalOnly)
+		cache0.Put("secrets", "key1", "mine")
+		reply, err := node1.FetchFromNode("node0", &model.CacheRelayMessage{CacheName: "secrets", CacheKey: "key1"})
+		assert.Nil(t, err)
+		assert.Nil(t, reply, "a local only value stays on its node")
+	})
+}
@@ -0,0 +1,300 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cache
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/theotw/chatty-cache/pkg/chatter"
+	"github.com/theotw/chatty-cache/pkg/logging"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"sync"
+)
+
+// PartitionedCache spreads the keys over the cluster instead of copying every put to every node, so the cluster
+// holds roughly members * maxSize / (replicas + 1) bytes.  Every key has a primary owner plus replicas picked by a
+// consistent hash ring over the members.  Puts go to the owners, gets on any other node are fetched from an owner
+// and kept in the optional hot cache.  Hot copies are not told when the owner gets a new value, they just age out
+// of the hot cache, so keep it small.
+type PartitionedCache struct {
+	logging.Holder
+
+	local    *InMemCache
+	hot      *InMemCache
+	replicas int
+	chatter  chatter.PartitionChatter
+
+	ringLock sync.RWMutex
+	ring     *HashRing
+	// rebalanceLock keeps membership changes from stepping on each other
+	rebalanceLock sync.Mutex
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewPartitionedCache creates a partitioned cache holding up to maxSize bytes of owned entries on this node.
+// hotCacheSize is the size of the local copy of entries owned by other nodes, 0 turns the hot cache off.
+// replicas is how many extra copies of each key are kept on other nodes
+func NewPartitionedCache(maxSize uint64, hotCacheSize uint64, replicas int, chatter chatter.PartitionChatter) *PartitionedCache {
+	ret := new(PartitionedCache)
+	ret.local = NewInMemCache(maxSize, nil)
+	if hotCacheSize > 0 {
+		ret.hot = NewInMemCache(hotCacheSize, nil)
+	}
+	if replicas < 0 {
+		replicas = 0
+	}
+	ret.replicas = replicas
+	ret.closed = make(chan struct{})
+	ret.chatter = chatter
+	ret.ring = NewHashRing(DefaultVirtualNodes, chatter.Members()...)
+	chatter.RegisterListenerForReplicatedObjects(func(message *model.CacheRelayMessage) error {
+		return ret.listenerForMessages(message)
+	})
+	chatter.RegisterFetchHandler(func(message *model.CacheRelayMessage) *model.CacheRelayMessage {
+		return ret.handleFetch(message)
+	})
+	chatter.RegisterMembershipListener(func(members []string) {
+		ret.rebalance(members)
+	})
+	return ret
+}
+
+// Put sends the value to every owner of the key, the first error seen is returned.
+// WithoutReplication keeps the value on this node, in the hot cache when we are not an owner
+func (t *PartitionedCache) Put(cacheName string, cacheKey string, value interface{}, opts ...PutOption) error {
+	if t.isClosed() {
+		return NewCacheError(Closed, nil)
+	}
+	options := makePutOptions(opts)
+	jsonBits, err := json.Marshal(value)
+	if err != nil {
+		return NewCacheError(NotJsonifiable, err)
+	}
+	self := t.chatter.NodeID()
+	owners := t.owners(cacheName, cacheKey)
+	if options.noReplicate {
+		if contains(owners, self) {
+			return t.local.putBits(cacheName, cacheKey, jsonBits)
+		}
+		if t.hot != nil {
+			return t.hot.putBits(cacheName, cacheKey, jsonBits)
+		}
+		return nil
+	}
+	var ret error
+	for _, owner := range owners {
+		if owner == self {
+			err = t.local.putBits(cacheName, cacheKey, jsonBits)
+		} else {
+			err = t.chatter.SendToNode(owner, relayMessageFor(cacheName, cacheKey, jsonBits))
+			if err != nil {
+				err = NewCacheError(OwnerUnreachable, err)
+			}
+		}
+		if err != nil && ret == nil {
+			ret = err
+		}
+	}
+	if t.hot != nil && !contains(owners, self) {
+		t.hot.putBits(cacheName, cacheKey, jsonBits)
+	}
+	return ret
+}
+
+// Get reads owned keys locally, everything else comes from the hot cache or from the owners
+func (t *PartitionedCache) Get(cacheName string, cacheKey string, valOut interface{}) error {
+	if t.isClosed() {
+		return NewCacheError(Closed, nil)
+	}
+	owners := t.owners(cacheName, cacheKey)
+	if contains(owners, t.chatter.NodeID()) {
+		return t.local.Get(cacheName, cacheKey, valOut)
+	}
+	if t.hot != nil && t.hot.Get(cacheName, cacheKey, valOut) == nil {
+		return nil
+	}
+	for _, owner := range owners {
+		var request model.CacheRelayMessage
+		request.CacheName = cacheName
+		request.CacheKey = cacheKey
+		reply, err := t.chatter.FetchFromNode(owner, &request)
+		if err != nil {
+			t.Logger().WithError(err).Debugf("Unable to fetch %s %s from %s", cacheName, cacheKey, owner)
+			continue
+		}
+		if reply == nil {
+			continue
+		}
+		bits, err := base64.StdEncoding.DecodeString(reply.CacheValue)
+		if err != nil {
+			t.Logger().WithError(err).Errorf("Unable to base 64 decode a fetch reply")
+			continue
+		}
+		if t.hot != nil {
+			t.hot.putBits(cacheName, cacheKey, bits)
+		}
+		err = json.Unmarshal(bits, valOut)
+		if err != nil {
+			return NewCacheError(NotJsonifiable, err)
+		}
+		return nil
+	}
+	return NewCacheError(NoItem, nil)
+}
+
+// Close stops taking puts and gets and closes the chatter, which sends what it still has queued for as long as ctx
+// allows.  Entries are not handed to the other owners first, the replicas are what keeps them
+func (t *PartitionedCache) Close(ctx context.Context) error {
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		err = t.chatter.Close(ctx)
+		t.local.Close(ctx)
+		if t.hot != nil {
+			t.hot.Close(ctx)
+		}
+	})
+	return err
+}
+
+// SetLogger logs through logger, for this cache and the in memory caches it keeps its entries in
+func (t *PartitionedCache) SetLogger(logger logging.Logger) {
+	t.Holder.SetLogger(logger)
+	t.local.SetLogger(logger)
+	if t.hot != nil {
+		t.hot.SetLogger(logger)
+	}
+}
+
+func (t *PartitionedCache) isClosed() bool {
+	select {
+	case <-t.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Owners the node IDs owning the key, primary first
+func (t *PartitionedCache) Owners(cacheName string, cacheKey string) []string {
+	return t.owners(cacheName, cacheKey)
+}
+
+func (t *PartitionedCache) owners(cacheName string, cacheKey string) []string {
+	t.ringLock.RLock()
+	ret := t.ring.Owners(ringKey(cacheName, cacheKey), t.replicas+1)
+	t.ringLock.RUnlock()
+	return ret
+}
+
+// listenerForMessages stores puts sent to us as an owner
+func (t *PartitionedCache) listenerForMessages(message *model.CacheRelayMessage) error {
+	if t.isClosed() {
+		return nil
+	}
+	if message.Action == model.RelayInvalidate {
+		t.local.remove(message.CacheName, message.CacheKey, EvictedInvalidated)
+		return nil
+	}
+	bits, err := base64.StdEncoding.DecodeString(message.CacheValue)
+	if err != nil {
+		t.Logger().WithError(err).Errorf("Unable to base 64 decode a cache relay message")
+		return nil
+	}
+	// a handoff carries the version it had on the old owner, so it loses to a put made here since
+	_, err = t.local.putVersionedBits(context.Background(), message.CacheName, message.CacheKey, bits, message.Version,
+		entryMeta{expires: expiresAt(message.ExpiresAt), origin: message.NodeID})
+	if err != nil {
+		t.Logger().WithError(err).Errorf("Unable to store %s %s sent to this owner", message.CacheName, message.CacheKey)
+	}
+	return err
+}
+
+func (t *PartitionedCache) handleFetch(message *model.CacheRelayMessage) *model.CacheRelayMessage {
+	entry := t.local.getEntry(message.CacheName, message.CacheKey)
+	if entry == nil {
+		return nil
+	}
+	return relayMessageForEntry(entry)
+}
+
+// rebalance rebuilds the ring, hands entries to owners that did not have them before and drops what we no longer own
+// once a new owner has it.  An entry no new owner would take stays until the next rebalance hands it to all of them
+func (t *PartitionedCache) rebalance(members []string) {
+	t.rebalanceLock.Lock()
+	defer t.rebalanceLock.Unlock()
+	if t.isClosed() {
+		return
+	}
+
+	newRing := NewHashRing(DefaultVirtualNodes, members...)
+	t.ringLock.Lock()
+	oldRing := t.ring
+	t.ring = newRing
+	t.ringLock.Unlock()
+
+	self := t.chatter.NodeID()
+	moved, dropped, kept := 0, 0, 0
+	for _, entry := range t.local.entries() {
+		key := ringKey(entry.CacheName, entry.CacheKey)
+		oldOwners := oldRing.Owners(key, t.replicas+1)
+		newOwners := newRing.Owners(key, t.replicas+1)
+		// when we were not an owner the entry is one left over from a handoff that failed
+		wasOwner := contains(oldOwners, self)
+		handedOver := false
+		for _, owner := range newOwners {
+			if owner == self {
+				continue
+			}
+			if wasOwner && contains(oldOwners, owner) {
+				handedOver = true
+				continue
+			}
+			err := t.chatter.SendToNode(owner, relayMessageForEntry(entry))
+			if err != nil {
+				t.Logger().WithError(err).Errorf("Unable to hand %s %s to new owner %s", entry.CacheName, entry.CacheKey, owner)
+				continue
+			}
+			handedOver = true
+			moved++
+		}
+		if contains(newOwners, self) {
+			continue
+		}
+		if !handedOver {
+			kept++
+			continue
+		}
+		t.local.remove(entry.CacheName, entry.CacheKey, EvictedNotOwner)
+		dropped++
+	}
+	if kept > 0 {
+		t.Logger().Warnf("Kept %d entries no new owner took, they are handed over again at the next rebalance", kept)
+	}
+	t.Logger().Debugf("Rebalanced over %d members, sent %d entries, dropped %d entries", len(members), moved, dropped)
+}
+
+func ringKey(cacheName string, cacheKey string) string {
+	return cacheName + "\x00" + cacheKey
+}
+
+func relayMessageFor(cacheName string, cacheKey string, jsonBits []byte) *model.CacheRelayMessage {
+	ret := new(model.CacheRelayMessage)
+	ret.CacheName = cacheName
+	ret.CacheKey = cacheKey
+	ret.CacheValue = base64.StdEncoding.EncodeToString(jsonBits)
+	return ret
+}
+
+// relayMessageForEntry the entry as it is held here, with its version and expiry
+func relayMessageForEntry(entry *cacheEntry) *model.CacheRelayMessage {
+	ret := relayMessageFor(entry.CacheName, entry.CacheKey, entry.CacheData)
+	ret.Version = entry.version
+	ret.ExpiresAt = unixNanos(entry.expires)
+	return ret
+}
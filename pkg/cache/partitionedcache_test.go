@@ -0,0 +1,271 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/theotw/chatty-cache/pkg/chatter"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// fakeCluster wires fakeNodes together with direct function calls, like the nats relay a node
+// is only announced to the others once it registers for membership changes
+type fakeCluster struct {
+	lock  sync.Mutex
+	nodes map[string]*fakeNode
+}
+
+type fakeNode struct {
+	cluster            *fakeCluster
+	nodeID             string
+	objectListener     chatter.ObjectListener
+	membershipListener chatter.MembershipListener
+	fetchHandler       chatter.FetchHandler
+	// refusing fails every message sent to the node
+	refusing bool
+}
+
+func (t *fakeCluster) addNode(nodeID string) *fakeNode {
+	ret := &fakeNode{cluster: t, nodeID: nodeID}
+	t.lock.Lock()
+	t.nodes[nodeID] = ret
+	t.lock.Unlock()
+	return ret
+}
+
+func (t *fakeCluster) removeNode(nodeID string) {
+	t.lock.Lock()
+	delete(t.nodes, nodeID)
+	t.lock.Unlock()
+	t.notify()
+}
+
+func (t *fakeCluster) node(nodeID string) *fakeNode {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.nodes[nodeID]
+}
+
+func (t *fakeCluster) members() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ret := make([]string, 0, len(t.nodes))
+	for k := range t.nodes {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (t *fakeCluster) notify() {
+	members := t.members()
+	for _, m := range members {
+		n := t.node(m)
+		if n != nil && n.membershipListener != nil {
+			n.membershipListener(members)
+		}
+	}
+}
+
+func (t *fakeNode) ReplicateCachedObject(message *model.CacheRelayMessage) {
+	for _, m := range t.cluster.members() {
+		if m != t.nodeID {
+			t.SendToNode(m, message)
+		}
+	}
+}
+func (t *fakeNode) RegisterListenerForReplicatedObjects(listener chatter.ObjectListener) {
+	t.objectListener = listener
+}
+func (t *fakeNode) NodeID() string {
+	return t.nodeID
+}
+func (t *fakeNode) Members() []string {
+	return t.cluster.members()
+}
+func (t *fakeNode) RegisterMembershipListener(listener chatter.MembershipListener) {
+	t.membershipListener = listener
+	t.cluster.notify()
+}
+func (t *fakeNode) SendToNode(nodeID string, message *model.CacheRelayMessage) error {
+	n := t.cluster.node(nodeID)
+	if n == nil {
+		return errors.New("no such node")
+	}
+	if n.refusing {
+		return errors.New("refused")
+	}
+	copied := *message
+	copied.NodeID = t.nodeID
+	if n.objectListener != nil {
+		return n.objectListener(&copied)
+	}
+	return nil
+}
+func (t *fakeNode) FetchFromNode(nodeID string, message *model.CacheRelayMessage) (*model.CacheRelayMessage, error) {
+	n := t.cluster.node(nodeID)
+	if n == nil {
+		return nil, errors.New("no such node")
+	}
+	copied := *message
+	copied.NodeID = t.nodeID
+	return n.fetchHandler(&copied), nil
+}
+func (t *fakeNode) RegisterFetchHandler(handler chatter.FetchHandler) {
+	t.fetchHandler = handler
+}
+func (t *fakeNode) Close(ctx context.Context) error {
+	t.cluster.removeNode(t.nodeID)
+	return nil
+}
+
+func TestHashRing(t *testing.T) {
+	ring := NewHashRing(0, "c", "a", "b")
+	assert.Equal(t, []string{"a", "b", "c"}, ring.Members())
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		owners := ring.Owners(fmt.Sprintf("key%d", i), 2)
+		if assert.Equal(t, 2, len(owners)) {
+			assert.NotEqual(t, owners[0], owners[1])
+		}
+		counts[owners[0]]++
+	}
+	for k, v := range counts {
+		assert.Greater(t, v, 500, "member %s owns too few keys", k)
+	}
+	assert.Equal(t, 3, len(ring.Owners("key", 5)), "never more owners than members")
+	assert.Nil(t, NewHashRing(0).Owners("key", 1))
+
+	//adding a member should only move keys to the new member
+	bigger := NewHashRing(0, "a", "b", "c", "d")
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		before := ring.Owners(key, 1)[0]
+		after := bigger.Owners(key, 1)[0]
+		if before != after {
+			assert.Equal(t, "d", after)
+		}
+	}
+}
+
+func TestPartitionedCache(t *testing.T) {
+	cluster := &fakeCluster{nodes: make(map[string]*fakeNode)}
+	caches := make(map[string]*PartitionedCache)
+	for _, id := range []string{"node0", "node1", "node2"} {
+		caches[id] = NewPartitionedCache(0, 1024, 1, cluster.addNode(id))
+	}
+	// the earlier nodes learn about the later ones from the membership listener
+	limit := 100
+	for i := 0; i < limit; i++ {
+		err := caches["node0"].Put("space", fmt.Sprintf("key%d", i), i)
+		assert.Nil(t, err)
+	}
+
+	checkAll := func() {
+		for id, c := range caches {
+			for i := 0; i < limit; i++ {
+				var val int
+				err := c.Get("space", fmt.Sprintf("key%d", i), &val)
+				if assert.Nil(t, err, "node %s key%d", id, i) {
+					assert.Equal(t, i, val)
+				}
+			}
+		}
+	}
+	checkCopies := func() {
+		total := 0
+		for _, c := range caches {
+			total = total + len(c.local.entries())
+		}
+		assert.Equal(t, limit*2, total, "every key should live on exactly one owner and one replica")
+	}
+
+	t.Run("Owned and fetched", func(t *testing.T) {
+		checkAll()
+		checkCopies()
+	})
+
+	t.Run("Node joins", func(t *testing.T) {
+		caches["node3"] = NewPartitionedCache(0, 1024, 1, cluster.addNode("node3"))
+		assert.NotEmpty(t, caches["node3"].local.entries(), "new node should have been handed keys")
+		checkAll()
+		checkCopies()
+	})
+
+	t.Run("Node leaves", func(t *testing.T) {
+		delete(caches, "node1")
+		cluster.removeNode("node1")
+		checkAll()
+		checkCopies()
+	})
+
+	t.Run("Missing key", func(t *testing.T) {
+		var val int
+		err := caches["node0"].Get("space", "notthere", &val)
+		if assert.NotNil(t, err) {
+			assert.Equal(t, NoItem, err.(*CacheError).Problem)
+		}
+	})
+}
+
+func TestPartitionedHandoff(t *testing.T) {
+	cluster := &fakeCluster{nodes: make(map[string]*fakeNode)}
+	caches := make(map[string]*PartitionedCache)
+	for _, id := range []string{"node0", "node1"} {
+		caches[id] = NewPartitionedCache(0, 0, 0, cluster.addNode(id))
+	}
+	limit := 100
+	for i := 0; i < limit; i++ {
+		assert.Nil(t, caches["node0"].Put("space", fmt.Sprintf("key%d", i), i))
+	}
+	total := func() int {
+		ret := 0
+		for _, c := range caches {
+			ret = ret + len(c.local.entries())
+		}
+		return ret
+	}
+
+	t.Run("Refused", func(t *testing.T) {
+		node := cluster.addNode("node2")
+		node.refusing = true
+		caches["node2"] = NewPartitionedCache(0, 0, 0, node)
+		assert.Empty(t, caches["node2"].local.entries())
+		assert.Equal(t, limit, total(), "entries no new owner took are kept")
+
+		node.refusing = false
+		cluster.notify()
+		assert.NotEmpty(t, caches["node2"].local.entries(), "handed over at the next rebalance")
+		assert.Equal(t, limit, total())
+		for i := 0; i < limit; i++ {
+			var val int
+			if assert.Nil(t, caches["node1"].Get("space", fmt.Sprintf("key%d", i), &val)) {
+				assert.Equal(t, i, val)
+			}
+		}
+	})
+
+	t.Run("Late handoff", func(t *testing.T) {
+		owner := caches["node0"].Owners("space", "late")[0]
+		assert.Nil(t, caches[owner].Put("space", "late", "new"))
+		held := caches[owner].local.getEntry("space", "late")
+		if !assert.NotNil(t, held) {
+			return
+		}
+		handoff := relayMessageFor("space", "late", []byte(`"old"`))
+		handoff.Version = held.version - 1
+		handoff.NodeID = "gone"
+		assert.Nil(t, caches[owner].listenerForMessages(handoff))
+		var val string
+		assert.Nil(t, caches[owner].Get("space", "late", &val))
+		assert.Equal(t, "new", val, "an older handoff does not replace a newer put")
+	})
+}
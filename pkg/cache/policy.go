@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cache
+
+import "time"
+
+// ReplicationPolicy says how puts in a cache name are shared with the other nodes
+type ReplicationPolicy int
+
+// ReplicateAll sends the value to every node, this is the default
+const ReplicateAll = ReplicationPolicy(0)
+
+// LocalOnly never leaves this node, and values sent by other nodes for the cache name are ignored
+const LocalOnly = ReplicationPolicy(1)
+
+// InvalidateOnly tells the other nodes to drop their copy instead of sending them the value
+const InvalidateOnly = ReplicationPolicy(2)
+
+func (t ReplicationPolicy) String() string {
+	switch t {
+	case ReplicateAll:
+		return "replicate all"
+	case LocalOnly:
+		return "local only"
+	case InvalidateOnly:
+		return "invalidate only"
+	}
+	return "unknown"
+}
+
+type putOptions struct {
+	noReplicate bool
+	ttl         time.Duration
+	condition   putCondition
+}
+
+// putCondition what has to be held on this node for a conditional put to go ahead
+type putCondition struct {
+	kind    conditionKind
+	version int64
+}
+
+type conditionKind int
+
+const unconditional = conditionKind(0)
+const ifAbsent = conditionKind(1)
+const ifPresent = conditionKind(2)
+const ifVersion = conditionKind(3)
+
+// PutOption changes how a single put is handled
+type PutOption func(options *putOptions)
+
+// WithoutReplication keeps this put on this node no matter what the replication policy of the cache name is
+func WithoutReplication() PutOption {
+	return func(options *putOptions) {
+		options.noReplicate = true
+	}
+}
+
+// WithTTL expires the value ttl after the put, on this node and the nodes it is replicated to
+func WithTTL(ttl time.Duration) PutOption {
+	return func(options *putOptions) {
+		options.ttl = ttl
+	}
+}
+
+// IfAbsent only puts when the key is not held, a VersionConflict CacheError when it is
+func IfAbsent() PutOption {
+	return func(options *putOptions) {
+		options.condition = putCondition{kind: ifAbsent}
+	}
+}
+
+// IfPresent only puts when the key is held, a NoItem CacheError when it is not
+func IfPresent() PutOption {
+	return func(options *putOptions) {
+		options.condition = putCondition{kind: ifPresent}
+	}
+}
+
+// IfVersion only puts when the key is held at version, see GetVersioned.  A NoItem CacheError when the key is not
+// held, a VersionConflict one when it is held at another version.  Like IfAbsent and IfPresent it is checked on this
+// node only, two nodes can both succeed for the same version
+func IfVersion(version int64) PutOption {
+	return func(options *putOptions) {
+		options.condition = putCondition{kind: ifVersion, version: version}
+	}
+}
+
+// check nil when the put may replace held, which is nil when the key is not held
+func (t putCondition) check(held *cacheEntry) *CacheError {
+	switch t.kind {
+	case ifAbsent:
+		if held != nil {
+			return NewCacheError(VersionConflict, nil)
+		}
+	case ifPresent:
+		if held == nil {
+			return NewCacheError(NoItem, nil)
+		}
+	case ifVersion:
+		if held == nil {
+			return NewCacheError(NoItem, nil)
+		}
+		if held.version != t.version {
+			return NewCacheError(VersionConflict, nil)
+		}
+	}
+	return nil
+}
+
+// expires when a value put now with these options expires, zero if it does not
+func (t *putOptions) expires() time.Time {
+	if t.ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(t.ttl)
+}
+
+func makePutOptions(opts []PutOption) *putOptions {
+	ret := new(putOptions)
+	for _, opt := range opts {
+		opt(ret)
+	}
+	return ret
+}
@@ -0,0 +1,180 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cache
+
+import (
+	"context"
+	"github.com/theotw/chatty-cache/pkg/chatter"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// EvictionReason why an entry was taken out of the cache, other than being replaced by a newer value
+type EvictionReason string
+
+// EvictedForSpace made room for a put under maxCacheSize
+const EvictedForSpace = EvictionReason("size")
+
+// EvictedForTenantQuota made room for a put under the tenant's quota
+const EvictedForTenantQuota = EvictionReason("tenant_quota")
+
+// EvictedInvalidated another node changed the value
+const EvictedInvalidated = EvictionReason("invalidated")
+
+// EvictedDeleted deleted on this node or another one
+const EvictedDeleted = EvictionReason("deleted")
+
+// EvictedTenantDropped the tenant was dropped
+const EvictedTenantDropped = EvictionReason("tenant_dropped")
+
+// EvictedNotOwner a partitioned cache handed the key to its new owners
+const EvictedNotOwner = EvictionReason("not_owner")
+
+// EvictedExpired the TTL of the entry ran out, these go to the OnExpire hooks rather than OnEvict
+const EvictedExpired = EvictionReason("expired")
+
+// LatencyBuckets upper bounds of the LatencyStats buckets
+var LatencyBuckets = []time.Duration{
+	100 * time.Microsecond, 250 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second,
+}
+
+// Stats a snapshot of what the cache holds and what it has done since it was made
+type Stats struct {
+	// MaxBytes the maxCacheSize, 0 is no limit
+	MaxBytes  uint64
+	UsedBytes uint64
+	// Namespaces by cache name, the cache names of a tenant are <tenant ID>/<cache name>
+	Namespaces map[string]NamespaceStats
+	Evictions  map[EvictionReason]uint64
+	// PublishLatency how long handing replication messages to the chatter took
+	PublishLatency LatencyStats
+	// Replication the counts kept by the chatter, nil when it is not a chatter.StatsChatter
+	Replication *chatter.ReplicationStats
+}
+
+// NamespaceStats the counts for one cache name
+type NamespaceStats struct {
+	Hits uint64
+	// Misses gets that were not in memory, even if they were then fetched or loaded
+	Misses  uint64
+	Puts    uint64
+	Entries int
+	Bytes   uint64
+}
+
+// LatencyStats a histogram of durations
+type LatencyStats struct {
+	Count uint64
+	Sum   time.Duration
+	// Buckets how many took no longer than each of LatencyBuckets, each count includes the ones before it
+	Buckets []uint64
+}
+
+// observe adds d to the histogram
+func (t *LatencyStats) observe(d time.Duration) {
+	if t.Buckets == nil {
+		t.Buckets = make([]uint64, len(LatencyBuckets))
+	}
+	t.Count++
+	t.Sum += d
+	for i, bound := range LatencyBuckets {
+		if d <= bound {
+			t.Buckets[i]++
+		}
+	}
+}
+
+// Stats a snapshot of the cache and, when the chatter keeps them, the replication counts
+func (t *InMemCache) Stats() Stats {
+	var ret Stats
+	ret.MaxBytes = t.maxCacheSize
+	ret.Namespaces = make(map[string]NamespaceStats)
+	t.lock.RLock()
+	ret.UsedBytes = t.totalUsedCacheSize
+	for name, cache := range t.caches {
+		ns := ret.Namespaces[namespaceName(name)]
+		ns.Entries = ns.Entries + len(cache)
+		for _, entry := range cache {
+			ns.Bytes = ns.Bytes + entry.cacheSize
+		}
+		ret.Namespaces[namespaceName(name)] = ns
+	}
+	t.lock.RUnlock()
+
+	t.statsLock.Lock()
+	for name, counts := range t.namespaceCounts {
+		ns := ret.Namespaces[name]
+		ns.Hits = counts.Hits
+		ns.Misses = counts.Misses
+		ns.Puts = counts.Puts
+		ret.Namespaces[name] = ns
+	}
+	ret.Evictions = make(map[EvictionReason]uint64, len(t.evictions))
+	for k, v := range t.evictions {
+		ret.Evictions[k] = v
+	}
+	ret.PublishLatency = t.publishLatency
+	ret.PublishLatency.Buckets = make([]uint64, len(LatencyBuckets))
+	copy(ret.PublishLatency.Buckets, t.publishLatency.Buckets)
+	t.statsLock.Unlock()
+
+	if statsChatter, ok := t.chatter.(chatter.StatsChatter); ok {
+		replication := statsChatter.ReplicationStats()
+		ret.Replication = &replication
+	}
+	return ret
+}
+
+// namespaceName the name Stats uses for a scoped cache name
+func namespaceName(cacheName string) string {
+	tenantID, name := splitScopedName(cacheName)
+	if len(tenantID) == 0 {
+		return name
+	}
+	return tenantID + "/" + name
+}
+
+// counted bumps one of the counts of a scoped cache name
+func (t *InMemCache) counted(cacheName string, count func(counts *NamespaceStats)) {
+	name := namespaceName(cacheName)
+	t.statsLock.Lock()
+	counts, ok := t.namespaceCounts[name]
+	if !ok {
+		counts = new(NamespaceStats)
+		t.namespaceCounts[name] = counts
+	}
+	count(counts)
+	t.statsLock.Unlock()
+}
+
+// evicted counts entries taken out for reason, records a span for them under the span of ctx and tells the hooks
+// and watchers.  The caller must not hold the lock
+func (t *InMemCache) evicted(ctx context.Context, reason EvictionReason, entries []*cacheEntry) {
+	count := len(entries)
+	if count == 0 {
+		return
+	}
+	t.statsLock.Lock()
+	t.evictions[reason] = t.evictions[reason] + uint64(count)
+	t.statsLock.Unlock()
+	_, span := t.getTracer().Start(ctx, "cache.evict", trace.WithAttributes(
+		attribute.String("cache.evict_reason", string(reason)),
+		attribute.Int("cache.evict_count", count)))
+	span.End()
+	for _, entry := range entries {
+		t.notifyEvicted(entry, reason)
+	}
+}
+
+func (t *InMemCache) observePublish(d time.Duration) {
+	t.statsLock.Lock()
+	t.publishLatency.observe(d)
+	t.statsLock.Unlock()
+}
@@ -0,0 +1,45 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cache
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/theotw/chatty-cache/pkg/chatter"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	bus := chatter.NewLocalBus()
+	node, err := bus.NewChatter("node0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer node.Close(context.Background())
+	cache1 := NewInMemCache(40, node)
+	var val string
+
+	cache1.Put("users", "key1", "0123456789")
+	cache1.Put("users", "key2", "0123456789")
+	cache1.Get("users", "key1", &val)
+	cache1.Get("users", "missing", &val)
+	// 12 bytes each, the third one pushes out the oldest
+	cache1.Put("groups", "key1", "0123456789")
+	cache1.Put("groups", "key2", "0123456789")
+	cache1.Delete("groups", "key2")
+	acme, _ := cache1.Tenant("acme")
+	acme.Put("users", "key1", "0")
+
+	stats := cache1.Stats()
+	assert.Equal(t, uint64(40), stats.MaxBytes)
+	assert.Equal(t, uint64(27), stats.UsedBytes)
+	assert.Equal(t, NamespaceStats{Hits: 1, Misses: 1, Puts: 2, Entries: 1, Bytes: 12}, stats.Namespaces["users"])
+	assert.Equal(t, NamespaceStats{Puts: 2, Entries: 1, Bytes: 12}, stats.Namespaces["groups"])
+	assert.Equal(t, NamespaceStats{Puts: 1, Entries: 1, Bytes: 3}, stats.Namespaces["acme/users"])
+	assert.Equal(t, map[EvictionReason]uint64{EvictedForSpace: 1, EvictedDeleted: 1}, stats.Evictions)
+	assert.Equal(t, uint64(6), stats.PublishLatency.Count, "five puts and a delete")
+	assert.Equal(t, uint64(6), stats.PublishLatency.Buckets[len(LatencyBuckets)-1])
+	assert.Nil(t, stats.Replication, "the local bus does not count envelopes")
+}
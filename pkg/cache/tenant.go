@@ -0,0 +1,192 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cache
+
+import (
+	"context"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"strings"
+)
+
+// tenantSeparator wraps the tenant ID at the front of a scoped cache name.  Plain cache names may not start with it
+// so a tenant can never reach another tenant's entries, or the untenanted ones, by picking a clever cache name
+const tenantSeparator = "\x00"
+
+// MaxTenantIDLength tenant IDs end up in nats subjects, keep them reasonable
+const MaxTenantIDLength = 64
+
+// TenantCache is the view of an InMemCache for a single tenant, every operation is scoped to the tenant.
+// Quotas, replication and the relay encryption keys are all per tenant
+type TenantCache struct {
+	cache    *InMemCache
+	tenantID string
+}
+
+// Tenant returns the view of the cache for tenantID.  Tenant IDs are letters, digits, - and _
+func (t *InMemCache) Tenant(tenantID string) (*TenantCache, error) {
+	if !validTenantID(tenantID) {
+		return nil, NewCacheError(InvalidTenant, nil)
+	}
+	ret := new(TenantCache)
+	ret.cache = t
+	ret.tenantID = tenantID
+	return ret, nil
+}
+
+// SetTenantQuota caps the bytes tenantID can hold on this node, 0 removes the cap.  A tenant over its quota
+// evicts its own least recently touched entries, never another tenant's
+func (t *InMemCache) SetTenantQuota(tenantID string, maxSize uint64) {
+	t.lock.Lock()
+	if maxSize == 0 {
+		delete(t.tenantQuotas, tenantID)
+	} else {
+		t.tenantQuotas[tenantID] = maxSize
+	}
+	t.lock.Unlock()
+}
+
+// TenantUsage bytes held for tenantID on this node
+func (t *InMemCache) TenantUsage(tenantID string) uint64 {
+	t.lock.RLock()
+	ret := t.tenantUsage[tenantID]
+	t.lock.RUnlock()
+	return ret
+}
+
+// DropTenant removes everything held for tenantID on this node and tells the other nodes to do the same.
+// It returns how many entries were dropped here
+func (t *InMemCache) DropTenant(tenantID string) (int, error) {
+	if !validTenantID(tenantID) {
+		return 0, NewCacheError(InvalidTenant, nil)
+	}
+	if t.isClosed() {
+		return 0, NewCacheError(Closed, nil)
+	}
+	ret := t.dropTenant(context.Background(), tenantID)
+	if t.chatter != nil {
+		var drop model.CacheRelayMessage
+		drop.TenantID = tenantID
+		drop.Action = model.RelayDropTenant
+		t.chatter.ReplicateCachedObject(&drop)
+	}
+	return ret, nil
+}
+
+func (t *InMemCache) dropTenant(ctx context.Context, tenantID string) int {
+	if len(tenantID) == 0 {
+		return 0
+	}
+	prefix := scopedName(tenantID, "")
+	var dropped []*cacheEntry
+	t.lock.Lock()
+	for name, cache := range t.caches {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		for key := range cache {
+			dropped = append(dropped, t.removeLocked(name, key))
+		}
+	}
+	t.lock.Unlock()
+	t.evicted(ctx, EvictedTenantDropped, dropped)
+	t.Logger().Debugf("Dropped %d entries for tenant %s", len(dropped), tenantID)
+	return len(dropped)
+}
+
+// evictTenant like evict but only tosses out entries of tenantID
+func (t *InMemCache) evictTenant(tenantID string, evictCount uint64) ([]*cacheEntry, *CacheError) {
+	var amountFreed uint64
+	var ret []*cacheEntry
+	for _, x := range t.sortLastTouched() {
+		if x.tenantID != tenantID {
+			continue
+		}
+		entry := t.removeLocked(x.CacheName, x.CacheKey)
+		amountFreed = amountFreed + entry.cacheSize
+		ret = append(ret, entry)
+		if amountFreed >= evictCount {
+			return ret, nil
+		}
+	}
+	return ret, NewCacheError(ExceedsTenantQuota, nil)
+}
+
+// TenantID the tenant this view is scoped to
+func (t *TenantCache) TenantID() string {
+	return t.tenantID
+}
+
+// Put puts a value into the tenant's cacheName, see InMemCache.Put
+func (t *TenantCache) Put(cacheName string, cacheKey string, value interface{}, opts ...PutOption) error {
+	return t.cache.put(context.Background(), t.tenantID, cacheName, cacheKey, value, opts)
+}
+
+// Get gets a value from the tenant's cacheName, see InMemCache.Get
+func (t *TenantCache) Get(cacheName string, cacheKey string, valOut interface{}) error {
+	return t.cache.get(context.Background(), scopedName(t.tenantID, cacheName), cacheKey, valOut)
+}
+
+// Delete removes the value from the tenant's cacheName, see InMemCache.Delete
+func (t *TenantCache) Delete(cacheName string, cacheKey string) error {
+	return t.cache.delete(context.Background(), t.tenantID, cacheName, cacheKey)
+}
+
+// Watch streams the changes to the tenant's cacheName, see InMemCache.Watch
+func (t *TenantCache) Watch(cacheName string, keyPrefix string) (*Watcher, error) {
+	return t.cache.watch(scopedName(t.tenantID, cacheName), keyPrefix)
+}
+
+// SetLoader sets the read through loader for the tenant's cacheName, it is called with cacheName as given here
+func (t *TenantCache) SetLoader(cacheName string, loader Loader) {
+	t.cache.SetLoader(scopedName(t.tenantID, cacheName), loader)
+}
+
+// Usage bytes held for the tenant on this node
+func (t *TenantCache) Usage() uint64 {
+	return t.cache.TenantUsage(t.tenantID)
+}
+
+// Drop removes everything held for the tenant across the cluster
+func (t *TenantCache) Drop() (int, error) {
+	return t.cache.DropTenant(t.tenantID)
+}
+
+// scopedName is the name entries of a tenant's cache name are held under, untenanted cache names are not changed
+func scopedName(tenantID string, cacheName string) string {
+	if len(tenantID) == 0 {
+		return cacheName
+	}
+	return tenantSeparator + tenantID + tenantSeparator + cacheName
+}
+
+// splitScopedName undoes scopedName
+func splitScopedName(name string) (string, string) {
+	if !strings.HasPrefix(name, tenantSeparator) {
+		return "", name
+	}
+	parts := strings.SplitN(name[len(tenantSeparator):], tenantSeparator, 2)
+	if len(parts) != 2 {
+		return "", name
+	}
+	return parts[0], parts[1]
+}
+
+// validCacheName plain cache names may not look like a scoped one
+func validCacheName(cacheName string) bool {
+	return !strings.HasPrefix(cacheName, tenantSeparator)
+}
+
+func validTenantID(tenantID string) bool {
+	if len(tenantID) == 0 || len(tenantID) > MaxTenantIDLength {
+		return false
+	}
+	for _, r := range tenantID {
+		ok := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_'
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
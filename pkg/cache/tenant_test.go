@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"testing"
+)
+
+func TestTenants(t *testing.T) {
+	relay := new(recordingChatter)
+	cache1 := NewInMemCache(0, relay)
+	acme, err := cache1.Tenant("acme")
+	assert.Nil(t, err)
+	globex, err := cache1.Tenant("globex")
+	assert.Nil(t, err)
+
+	_, err = cache1.Tenant("bad.tenant")
+	assert.NotNil(t, err)
+	_, err = cache1.Tenant("")
+	assert.NotNil(t, err)
+
+	acme.Put("users", "key1", "acme value")
+	globex.Put("users", "key1", "globex value")
+	var val string
+	assert.Nil(t, acme.Get("users", "key1", &val))
+	assert.Equal(t, "acme value", val)
+	assert.Nil(t, globex.Get("users", "key1", &val))
+	assert.Equal(t, "globex value", val)
+	assert.NotNil(t, cache1.Get("users", "key1", &val), "tenant entries are not visible without the tenant")
+	assert.NotNil(t, cache1.Put(scopedName("acme", "users"), "key1", "sneaky"), "no reaching into a tenant by name")
+
+	if assert.Equal(t, 2, len(relay.sent)) {
+		assert.Equal(t, "acme", relay.sent[0].TenantID)
+		assert.Equal(t, "users", relay.sent[0].CacheName)
+	}
+
+	t.Run("Loader", func(t *testing.T) {
+		var loaded []string
+		acme.SetLoader("orders", func(cacheName string, cacheKey string) (interface{}, error) {
+			loaded = append(loaded, cacheName)
+			return "loaded", nil
+		})
+		assert.Nil(t, acme.Get("orders", "key1", &val))
+		assert.Equal(t, "loaded", val)
+		assert.Equal(t, []string{"orders"}, loaded, "the loader sees the name the tenant used")
+		assert.NotNil(t, globex.Get("orders", "key1", &val), "only the tenant's cache name has the loader")
+	})
+
+	t.Run("Quota", func(t *testing.T) {
+		// each value is 12 bytes of json
+		cache1.SetTenantQuota("acme", 30)
+		acme.Put("quota", "key1", "0123456789")
+		acme.Put("quota", "key2", "0123456789")
+		before := globex.Usage()
+		assert.Nil(t, acme.Put("quota", "key3", "0123456789"))
+		assert.LessOrEqual(t, acme.Usage(), uint64(30))
+		assert.Equal(t, before, globex.Usage(), "other tenants are not evicted")
+		assert.Nil(t, globex.Get("users", "key1", &val))
+
+		err := acme.Put("quota", "big", make([]byte, 100))
+		if assert.NotNil(t, err) {
+			assert.Equal(t, ExceedsTenantQuota, err.(*CacheError).Problem)
+		}
+		usage := acme.Usage()
+		err = acme.Put("quota", "key3", make([]byte, 100))
+		if assert.NotNil(t, err) {
+			assert.Equal(t, ExceedsTenantQuota, err.(*CacheError).Problem)
+		}
+		assert.Nil(t, acme.Get("quota", "key3", &val), "a put that does not fit keeps the value it would replace")
+		assert.Equal(t, "0123456789", val)
+		assert.Equal(t, usage, acme.Usage())
+	})
+
+	t.Run("Receiving", func(t *testing.T) {
+		relay.listener(&model.CacheRelayMessage{TenantID: "initech", CacheName: "users", CacheKey: "key1", CacheValue: "InJlbW90ZSI="})
+		initech, _ := cache1.Tenant("initech")
+		assert.Nil(t, initech.Get("users", "key1", &val))
+		assert.Equal(t, "remote", val)
+
+		relay.listener(&model.CacheRelayMessage{TenantID: "initech", Action: model.RelayDropTenant})
+		assert.NotNil(t, initech.Get("users", "key1", &val))
+		assert.Equal(t, uint64(0), initech.Usage())
+	})
+
+	t.Run("Drop", func(t *testing.T) {
+		sent := len(relay.sent)
+		dropped, err := globex.Drop()
+		assert.Nil(t, err)
+		assert.Equal(t, 1, dropped)
+		assert.NotNil(t, globex.Get("users", "key1", &val))
+		assert.Nil(t, acme.Get("quota", "key3", &val), "other tenants untouched")
+		if assert.Equal(t, sent+1, len(relay.sent)) {
+			assert.Equal(t, model.RelayDropTenant, relay.sent[sent].Action)
+			assert.Equal(t, "globex", relay.sent[sent].TenantID)
+		}
+	})
+}
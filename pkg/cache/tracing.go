@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cache
+
+import (
+	"context"
+	"fmt"
+	"github.com/theotw/chatty-cache/pkg/chatter"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName the instrumentation name on the spans the cache makes
+const tracerName = "github.com/theotw/chatty-cache/pkg/cache"
+
+// tracePropagator writes the W3C traceparent into CacheRelayMessage.TraceContext
+var tracePropagator = propagation.TraceContext{}
+
+// tracerHolder atomic.Value needs the same concrete type every time
+type tracerHolder struct {
+	tracer trace.Tracer
+}
+
+// SetTracerProvider makes spans for puts, gets, deletes, evictions, publishes and the applying of messages from other
+// nodes with provider.  nil goes back to the default, which makes no spans
+func (t *InMemCache) SetTracerProvider(provider trace.TracerProvider) {
+	if provider == nil {
+		provider = trace.NewNoopTracerProvider()
+	}
+	t.tracer.Store(tracerHolder{tracer: provider.Tracer(tracerName)})
+}
+
+func (t *InMemCache) getTracer() trace.Tracer {
+	return t.tracer.Load().(tracerHolder).tracer
+}
+
+// startSpan starts a span tagged with the cache name, a hash of the key, so keys holding user data do not leak into
+// the traces, and our node ID when the chatter has one.  cacheName is the scoped name
+func (t *InMemCache) startSpan(ctx context.Context, spanName string, kind trace.SpanKind, cacheName string, cacheKey string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs,
+		attribute.String("cache.name", namespaceName(cacheName)),
+		attribute.String("cache.key_hash", fmt.Sprintf("%016x", hashString(cacheKey))))
+	if nodes, ok := t.chatter.(chatter.PartitionChatter); ok {
+		attrs = append(attrs, attribute.String("cache.node_id", nodes.NodeID()))
+	}
+	return t.getTracer().Start(ctx, spanName, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+}
+
+// endSpan ends the span, marking it failed when err is not nil.  A miss is not a failure
+func endSpan(span trace.Span, err error) {
+	if cacheErr, ok := err.(*CacheError); ok && cacheErr.Problem == NoItem {
+		err = nil
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// injectTrace puts the span context of ctx into the message so the receiver's spans join the trace
+func injectTrace(ctx context.Context, message *model.CacheRelayMessage) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+	message.TraceContext = make(map[string]string)
+	tracePropagator.Inject(ctx, propagation.MapCarrier(message.TraceContext))
+}
+
+// extractTrace a ctx carrying the span context the sender put into the message, if any
+func extractTrace(message *model.CacheRelayMessage) context.Context {
+	ctx := context.Background()
+	if len(message.TraceContext) == 0 {
+		return ctx
+	}
+	return tracePropagator.Extract(ctx, propagation.MapCarrier(message.TraceContext))
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cache
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+)
+
+// endedSpan the last ended span called name, nil if there is none
+func endedSpan(recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	var ret sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			ret = span
+		}
+	}
+	return ret
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracing(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		relay := new(recordingChatter)
+		cache1 := NewInMemCache(0, relay)
+		assert.Nil(t, cache1.Put("users", "key1", "value"))
+		if assert.Equal(t, 1, len(relay.sent)) {
+			assert.Empty(t, relay.sent[0].TraceContext, "no tracer, nothing to propagate")
+		}
+	})
+	t.Run("Across nodes", func(t *testing.T) {
+		senderSpans := tracetest.NewSpanRecorder()
+		senderRelay := new(recordingChatter)
+		sender := NewInMemCache(12, senderRelay)
+		sender.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(senderSpans)))
+		receiverSpans := tracetest.NewSpanRecorder()
+		receiverRelay := new(recordingChatter)
+		receiver := NewInMemCache(0, receiverRelay)
+		receiver.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(receiverSpans)))
+
+		assert.Nil(t, sender.Put("users", "key1", "0123456789"))
+		assert.Nil(t, sender.Put("users", "key2", "0123456789"))
+		if !assert.Equal(t, 2, len(senderRelay.sent)) {
+			return
+		}
+		// the trace context has to survive the trip over the wire
+		bits, err := json.Marshal(senderRelay.sent[1])
+		if !assert.Nil(t, err) {
+			return
+		}
+		message := new(model.CacheRelayMessage)
+		assert.Nil(t, json.Unmarshal(bits, message))
+		message.NodeID = "node0"
+		assert.Nil(t, receiverRelay.listener(message))
+
+		publish := endedSpan(senderSpans, "cache.publish")
+		apply := endedSpan(receiverSpans, "cache.apply")
+		evict := endedSpan(senderSpans, "cache.evict")
+		if !assert.NotNil(t, publish) || !assert.NotNil(t, apply) || !assert.NotNil(t, evict) {
+			return
+		}
+		assert.Equal(t, publish.SpanContext().TraceID(), apply.SpanContext().TraceID())
+		assert.Equal(t, publish.SpanContext().SpanID(), apply.Parent().SpanID())
+		assert.Equal(t, "users", spanAttribute(apply, "cache.name").AsString())
+		assert.Equal(t, "node0", spanAttribute(apply, "cache.sender_node_id").AsString())
+		assert.NotEqual(t, "key2", spanAttribute(apply, "cache.key_hash").AsString())
+		assert.Equal(t, spanAttribute(publish, "cache.key_hash"), spanAttribute(apply, "cache.key_hash"))
+
+		// the second put pushed out the first, under the second put's span
+		assert.Equal(t, string(EvictedForSpace), spanAttribute(evict, "cache.evict_reason").AsString())
+		assert.Equal(t, publish.Parent().SpanID(), evict.Parent().SpanID())
+
+		var val string
+		assert.NotNil(t, receiver.Get("users", "missing", &val))
+		get := endedSpan(receiverSpans, "cache.get")
+		if assert.NotNil(t, get) {
+			assert.False(t, spanAttribute(get, "cache.hit").AsBool())
+			assert.Equal(t, codes.Unset, get.Status().Code, "a miss is not a failure")
+		}
+	})
+}
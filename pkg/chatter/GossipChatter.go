@@ -0,0 +1,824 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package chatter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/theotw/chatty-cache/pkg/logging"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// GossipBindEnvVar the UDP address this node gossips on
+const GossipBindEnvVar = "CHATTY_GOSSIP_BIND"
+
+// GossipAdvertiseEnvVar the address other nodes reach this one on, worked out from the bind address if not set
+const GossipAdvertiseEnvVar = "CHATTY_GOSSIP_ADVERTISE"
+
+// GossipSeedsEnvVar comma separated host:port of nodes to join through, any live member will do
+const GossipSeedsEnvVar = "CHATTY_GOSSIP_SEEDS"
+
+// GossipProbeIntervalEnvVar the SWIM protocol period, every period one member is probed.  Everything else is timed off it
+const GossipProbeIntervalEnvVar = "CHATTY_GOSSIP_PROBE_INTERVAL"
+
+// GossipPushPullIntervalEnvVar how often a node swaps its full state with a random member
+const GossipPushPullIntervalEnvVar = "CHATTY_GOSSIP_PUSH_PULL_INTERVAL"
+
+// GossipBindDefault only this host can gossip with us, binding an address other hosts reach needs a pass phrase
+const GossipBindDefault = "127.0.0.1:30223"
+const GossipProbeIntervalDefault = "1s"
+const GossipPushPullIntervalDefault = "30s"
+
+// GossipFanout how many random members each gossip round goes to
+const GossipFanout = 3
+
+// GossipIndirectChecks how many members are asked to probe a member that did not answer us
+const GossipIndirectChecks = 3
+
+// gossipRetransmitMult a broadcast is sent gossipRetransmitMult * log(members) times
+const gossipRetransmitMult = 4
+
+// gossipSuspicionMult a suspect member is declared dead after gossipSuspicionMult * log(members) protocol periods
+const gossipSuspicionMult = 5
+
+// gossipDeadReapPeriods how many protocol periods a dead member is remembered for, so old news cannot bring it back
+const gossipDeadReapPeriods = 30
+
+// maxGossipPacket keeps packets under the UDP limit, with room to spare
+const maxGossipPacket = 60000
+
+// maxGossipMessage bigger envelopes go out as invalidations, they would not fit in a packet
+const maxGossipMessage = 40000
+
+// gossipRecentMessages how many recent cache messages are kept for push pull
+const gossipRecentMessages = 64
+
+// gossipSeenMessages how many message IDs are remembered to drop the copies that gossip brings
+const gossipSeenMessages = 10000
+
+type memberState int
+
+const (
+	memberAlive   = memberState(0)
+	memberSuspect = memberState(1)
+	memberDead    = memberState(2)
+)
+
+type gossipPacketType int
+
+const (
+	gossipPing          = gossipPacketType(1)
+	gossipAck           = gossipPacketType(2)
+	gossipPingReq       = gossipPacketType(3)
+	gossipGossip        = gossipPacketType(4)
+	gossipPushPull      = gossipPacketType(5)
+	gossipPushPullReply = gossipPacketType(6)
+)
+
+type gossipMember struct {
+	ID          string      `json:"id"`
+	Addr        string      `json:"addr"`
+	Incarnation uint64      `json:"inc"`
+	State       memberState `json:"state"`
+
+	stateChanged time.Time
+}
+
+// gossipMessage a cache relay envelope and an ID to spot copies by
+type gossipMessage struct {
+	ID       string `json:"id"`
+	Envelope []byte `json:"env"`
+}
+
+type gossipBroadcast struct {
+	member    *gossipMember
+	message   *gossipMessage
+	transmits int
+}
+
+type gossipPacket struct {
+	Type       gossipPacketType `json:"t"`
+	Seq        uint64           `json:"seq,omitempty"`
+	From       string           `json:"from"`
+	FromAddr   string           `json:"fromAddr"`
+	TargetID   string           `json:"targetID,omitempty"`
+	TargetAddr string           `json:"targetAddr,omitempty"`
+	// Updates and Messages are piggybacked broadcasts
+	Updates  []*gossipMember  `json:"updates,omitempty"`
+	Messages []*gossipMessage `json:"messages,omitempty"`
+	// Members is the full member list for push pull
+	Members []*gossipMember `json:"members,omitempty"`
+}
+
+// GossipChatterRelay replicates by gossip over UDP, no broker and no full mesh of connections.  Membership and failure
+// detection follow SWIM: every protocol period a member is pinged, directly and then through other members, and one
+// that does not answer is suspected and then declared dead unless it refutes.  Membership changes and cache messages
+// are piggybacked on the probes and pushed to a few random members each round, every node passing on what it hears.
+// Every push pull interval a node also swaps its member list and recent messages with a random member, which heals
+// anything the gossip missed.  Values too big for a packet go out as invalidations.  Like core nats it is best effort
+type GossipChatterRelay struct {
+	logging.Holder
+
+	conn             *net.UDPConn
+	bindAddr         string
+	advertiseAddr    string
+	seeds            []string
+	probeInterval    time.Duration
+	pushPullInterval time.Duration
+	//nodeID random UUID for this process
+	nodeID             string
+	codec              *envelopeCodec
+	objectListener     ObjectListener
+	membershipListener MembershipListener
+
+	lock        sync.Mutex
+	incarnation uint64
+	// members every other node we know about, dead ones until they are reaped
+	members    map[string]*gossipMember
+	probeOrder []string
+	broadcasts []*gossipBroadcast
+	seen       map[string]bool
+	seenOrder  []string
+	recent     []*gossipMessage
+	seq        uint64
+	// acks what to do when the ack for a sequence number comes in
+	acks     map[uint64]func()
+	lastPush time.Time
+	// notifiedMembers the member list the membership listener last got
+	notifiedMembers []string
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewGossipChatterRelay starts gossiping and joins the cluster through the seeds
+func NewGossipChatterRelay() (*GossipChatterRelay, error) {
+	ret := new(GossipChatterRelay)
+	ret.bindAddr = model.GetEnvVarWithDefault(GossipBindEnvVar, GossipBindDefault)
+	ret.advertiseAddr = model.GetEnvVarWithDefault(GossipAdvertiseEnvVar, "")
+	ret.seeds = splitNamespaces(model.GetEnvVarWithDefault(GossipSeedsEnvVar, ""))
+	var err error
+	ret.probeInterval, err = time.ParseDuration(model.GetEnvVarWithDefault(GossipProbeIntervalEnvVar, GossipProbeIntervalDefault))
+	if err != nil || ret.probeInterval <= 0 {
+		return nil, fmt.Errorf("bad %s: %v", GossipProbeIntervalEnvVar, err)
+	}
+	ret.pushPullInterval, err = time.ParseDuration(model.GetEnvVarWithDefault(GossipPushPullIntervalEnvVar, GossipPushPullIntervalDefault))
+	if err != nil || ret.pushPullInterval <= 0 {
+		return nil, fmt.Errorf("bad %s: %v", GossipPushPullIntervalEnvVar, err)
+	}
+	ret.nodeID = uuid.NewString()
+	ret.codec = &envelopeCodec{nodeID: ret.nodeID, masterPassPhrase: model.GetEnvVarWithDefault(MasterPassPhraseEnvVar, "")}
+	err = checkListenAddr(ret.bindAddr, len(ret.codec.masterPassPhrase) > 0)
+	if err != nil {
+		return nil, err
+	}
+	ret.members = make(map[string]*gossipMember)
+	ret.seen = make(map[string]bool)
+	ret.acks = make(map[uint64]func())
+	ret.closed = make(chan struct{})
+	err = ret.init()
+	return ret, err
+}
+
+func (t *GossipChatterRelay) init() error {
+	addr, err := net.ResolveUDPAddr("udp", t.bindAddr)
+	if err != nil {
+		return err
+	}
+	t.conn, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Logger().WithError(err).Errorf("Unable to listen on %s", t.bindAddr)
+		return err
+	}
+	if len(t.advertiseAddr) == 0 {
+		t.advertiseAddr = advertiseAddress(t.conn.LocalAddr().(*net.UDPAddr))
+	}
+	t.notifiedMembers = []string{t.nodeID}
+	go t.receive()
+	go t.probeLoop()
+	go t.gossipLoop()
+	t.join()
+	return nil
+}
+
+// advertiseAddress the bound address, or the first non loopback IPv4 address if bound to all of them
+func advertiseAddress(bound *net.UDPAddr) string {
+	port := strconv.Itoa(bound.Port)
+	if !bound.IP.IsUnspecified() {
+		return net.JoinHostPort(bound.IP.String(), port)
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return net.JoinHostPort(ipNet.IP.String(), port)
+		}
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// Addr the address other nodes reach this one on
+func (t *GossipChatterRelay) Addr() string {
+	return t.advertiseAddr
+}
+
+// NodeID the ID of this node as seen by the other members
+func (t *GossipChatterRelay) NodeID() string {
+	return t.nodeID
+}
+
+// Members the live members, suspects included, this node among them
+func (t *GossipChatterRelay) Members() []string {
+	t.lock.Lock()
+	ret := t.membersLocked()
+	t.lock.Unlock()
+	return ret
+}
+
+func (t *GossipChatterRelay) membersLocked() []string {
+	ret := []string{t.nodeID}
+	for id, m := range t.members {
+		if m.State != memberDead {
+			ret = append(ret, id)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// RegisterMembershipListener the listener is called right away, then every time a member joins or dies
+func (t *GossipChatterRelay) RegisterMembershipListener(listener MembershipListener) {
+	t.lock.Lock()
+	t.membershipListener = listener
+	t.lock.Unlock()
+	if listener != nil {
+		listener(t.Members())
+	}
+}
+
+func (t *GossipChatterRelay) RegisterListenerForReplicatedObjects(listener ObjectListener) {
+	t.lock.Lock()
+	t.objectListener = listener
+	t.lock.Unlock()
+}
+
+// ReplicateCachedObject gossips the message to the cluster
+func (t *GossipChatterRelay) ReplicateCachedObject(message *model.CacheRelayMessage) {
+	bits, err := t.codec.encode(message)
+	if err != nil {
+		t.Logger().WithError(err).Errorf("Unable to encode a replication message")
+		return
+	}
+	if len(bits) > maxGossipMessage && message.Action == model.RelayPut {
+		// too big for a packet, have the others drop their copy instead
+		invalidate := *message
+		invalidate.CacheValue = ""
+		invalidate.Action = model.RelayInvalidate
+		bits, err = t.codec.encode(&invalidate)
+		if err != nil {
+			t.Logger().WithError(err).Errorf("Unable to encode a replication message")
+			return
+		}
+	}
+	if len(bits) > maxGossipMessage {
+		t.Logger().Errorf("Cache sync %s %s is too big to gossip, dropping it", message.CacheName, message.CacheKey)
+		return
+	}
+	msg := &gossipMessage{ID: uuid.NewString(), Envelope: bits}
+	if t.isClosed() {
+		t.PerMessage().Debugf("Relay closed, dropping cache sync %s %s", message.CacheName, message.CacheKey)
+		return
+	}
+	t.lock.Lock()
+	t.markSeenLocked(msg)
+	t.broadcasts = append(t.broadcasts, &gossipBroadcast{message: msg})
+	t.lock.Unlock()
+}
+
+// Close gossips the messages that have not been sent to anyone yet, for as long as ctx allows, then tells the cluster
+// this node is leaving and stops gossiping
+func (t *GossipChatterRelay) Close(ctx context.Context) error {
+	var err error
+	for !t.isClosed() && t.unsentBroadcasts() > 0 {
+		if err = ctx.Err(); err != nil {
+			t.Logger().WithError(err).Warnf("Gossip not sent before closing")
+			break
+		}
+		t.lock.Lock()
+		targets := t.randomMembersLocked(GossipFanout, "")
+		t.lock.Unlock()
+		if len(targets) == 0 {
+			break
+		}
+		for _, m := range targets {
+			t.sendWithPiggyback(m.Addr, &gossipPacket{Type: gossipGossip})
+		}
+	}
+	if stopErr := t.stop(true); stopErr != nil {
+		err = stopErr
+	}
+	return err
+}
+
+// unsentBroadcasts how many broadcasts have not gone out at all
+func (t *GossipChatterRelay) unsentBroadcasts() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ret := 0
+	for _, b := range t.broadcasts {
+		if b.transmits == 0 {
+			ret++
+		}
+	}
+	return ret
+}
+
+// stop closes the socket, leave says goodbye to a few members first
+func (t *GossipChatterRelay) stop(leave bool) error {
+	var err error
+	t.closeOnce.Do(func() {
+		if leave {
+			t.lock.Lock()
+			t.incarnation++
+			t.broadcasts = append(t.broadcasts, &gossipBroadcast{member: t.selfLocked(memberDead)})
+			targets := t.randomMembersLocked(GossipFanout, "")
+			t.lock.Unlock()
+			for _, m := range targets {
+				t.sendWithPiggyback(m.Addr, &gossipPacket{Type: gossipGossip})
+			}
+		}
+		close(t.closed)
+		err = t.conn.Close()
+	})
+	return err
+}
+
+// ReplicationStats counts of the envelopes sent and received so far
+func (t *GossipChatterRelay) ReplicationStats() ReplicationStats {
+	return t.codec.replicationStats()
+}
+
+// Status CONNECTED once another member is known, or when there are no seeds but this node to find one through.
+// JOINING until then
+func (t *GossipChatterRelay) Status() string {
+	if t.isClosed() {
+		return StatusClosed
+	}
+	if len(t.Members()) > 1 {
+		return StatusConnected
+	}
+	for _, seed := range t.seeds {
+		if seed != t.advertiseAddr {
+			return StatusJoining
+		}
+	}
+	return StatusConnected
+}
+
+// Connected whether this node is part of a cluster, or is meant to be on its own
+func (t *GossipChatterRelay) Connected() bool {
+	return t.Status() == StatusConnected
+}
+
+func (t *GossipChatterRelay) isClosed() bool {
+	select {
+	case <-t.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// selfLocked our own member record
+func (t *GossipChatterRelay) selfLocked(state memberState) *gossipMember {
+	return &gossipMember{ID: t.nodeID, Addr: t.advertiseAddr, Incarnation: t.incarnation, State: state}
+}
+
+// join swaps state with every seed
+func (t *GossipChatterRelay) join() {
+	for _, seed := range t.seeds {
+		if seed == t.advertiseAddr {
+			continue
+		}
+		t.send(seed, t.pushPullPacket(gossipPushPull))
+	}
+}
+
+func (t *GossipChatterRelay) pushPullPacket(packetType gossipPacketType) *gossipPacket {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ret := &gossipPacket{Type: packetType}
+	ret.Members = append(ret.Members, t.selfLocked(memberAlive))
+	size := 0
+	for _, m := range t.members {
+		ret.Members = append(ret.Members, m)
+		size = size + len(m.ID) + len(m.Addr) + 64
+	}
+	for i := len(t.recent) - 1; i >= 0; i-- {
+		size = size + messageSize(t.recent[i])
+		if size > maxGossipPacket {
+			break
+		}
+		ret.Messages = append(ret.Messages, t.recent[i])
+	}
+	return ret
+}
+
+func (t *GossipChatterRelay) receive() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			if t.isClosed() {
+				return
+			}
+			t.Logger().WithError(err).Debugf("Error reading gossip")
+			continue
+		}
+		packet := new(gossipPacket)
+		err = json.Unmarshal(buf[:n], packet)
+		if err != nil {
+			t.Logger().WithError(err).Debugf("Dropping a bad gossip packet from %s", from)
+			continue
+		}
+		t.handlePacket(packet)
+	}
+}
+
+func (t *GossipChatterRelay) handlePacket(packet *gossipPacket) {
+	for _, m := range packet.Updates {
+		t.mergeMember(m)
+	}
+	for _, m := range packet.Members {
+		t.mergeMember(m)
+	}
+	for _, msg := range packet.Messages {
+		t.deliver(msg)
+	}
+	switch packet.Type {
+	case gossipPing:
+		if len(packet.TargetID) == 0 || packet.TargetID == t.nodeID {
+			t.sendWithPiggyback(packet.FromAddr, &gossipPacket{Type: gossipAck, Seq: packet.Seq})
+		}
+	case gossipAck:
+		t.lock.Lock()
+		handler := t.acks[packet.Seq]
+		delete(t.acks, packet.Seq)
+		t.lock.Unlock()
+		if handler != nil {
+			handler()
+		}
+	case gossipPingReq:
+		// probe the target for the requester and pass the ack back
+		requester := packet.FromAddr
+		seq := packet.Seq
+		t.ping(packet.TargetID, packet.TargetAddr, func() {
+			t.send(requester, &gossipPacket{Type: gossipAck, Seq: seq})
+		})
+	case gossipPushPull:
+		t.send(packet.FromAddr, t.pushPullPacket(gossipPushPullReply))
+	}
+	t.notifyMembership()
+}
+
+// ping sends a ping and calls onAck if the ack comes back within a protocol period
+func (t *GossipChatterRelay) ping(targetID string, addr string, onAck func()) {
+	t.lock.Lock()
+	t.seq++
+	seq := t.seq
+	t.acks[seq] = onAck
+	t.lock.Unlock()
+	time.AfterFunc(t.probeInterval, func() {
+		t.lock.Lock()
+		delete(t.acks, seq)
+		t.lock.Unlock()
+	})
+	t.sendWithPiggyback(addr, &gossipPacket{Type: gossipPing, Seq: seq, TargetID: targetID})
+}
+
+func (t *GossipChatterRelay) probeLoop() {
+	ticker := time.NewTicker(t.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.closed:
+			return
+		case <-ticker.C:
+		}
+		if len(t.Members()) == 1 {
+			t.join()
+		}
+		if target := t.nextProbeTarget(); target != nil {
+			t.probe(target)
+		}
+		t.checkSuspects()
+		t.pushPull()
+		t.notifyMembership()
+	}
+}
+
+// nextProbeTarget walks the members in a random order, reshuffling every time round
+func (t *GossipChatterRelay) nextProbeTarget() *gossipMember {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for round := 0; round < 2; round++ {
+		for len(t.probeOrder) > 0 {
+			id := t.probeOrder[0]
+			t.probeOrder = t.probeOrder[1:]
+			m, ok := t.members[id]
+			if ok && m.State != memberDead {
+				ret := *m
+				return &ret
+			}
+		}
+		for id, m := range t.members {
+			if m.State != memberDead {
+				t.probeOrder = append(t.probeOrder, id)
+			}
+		}
+		rand.Shuffle(len(t.probeOrder), func(i, j int) {
+			t.probeOrder[i], t.probeOrder[j] = t.probeOrder[j], t.probeOrder[i]
+		})
+	}
+	return nil
+}
+
+// probe pings the target, then has other members ping it, and suspects it if no ack comes back in time
+func (t *GossipChatterRelay) probe(target *gossipMember) {
+	acked := make(chan struct{}, GossipIndirectChecks+1)
+	onAck := func() {
+		acked <- struct{}{}
+	}
+	t.ping(target.ID, target.Addr, onAck)
+	select {
+	case <-acked:
+		return
+	case <-t.closed:
+		return
+	case <-time.After(t.probeInterval / 4):
+	}
+
+	t.lock.Lock()
+	helpers := t.randomMembersLocked(GossipIndirectChecks, target.ID)
+	t.seq++
+	seq := t.seq
+	t.acks[seq] = onAck
+	t.lock.Unlock()
+	for _, helper := range helpers {
+		t.send(helper.Addr, &gossipPacket{Type: gossipPingReq, Seq: seq, TargetID: target.ID, TargetAddr: target.Addr})
+	}
+	select {
+	case <-acked:
+	case <-t.closed:
+	case <-time.After(t.probeInterval / 2):
+		t.Logger().Debugf("Gossip member %s at %s did not answer, suspecting it", target.ID, target.Addr)
+		t.mergeMember(&gossipMember{ID: target.ID, Addr: target.Addr, Incarnation: target.Incarnation, State: memberSuspect})
+	}
+	t.lock.Lock()
+	delete(t.acks, seq)
+	t.lock.Unlock()
+}
+
+// checkSuspects declares suspects that never refuted dead and forgets the long dead
+func (t *GossipChatterRelay) checkSuspects() {
+	t.lock.Lock()
+	suspicionTimeout := time.Duration(gossipSuspicionMult*t.logMembersLocked()) * t.probeInterval
+	reapTimeout := gossipDeadReapPeriods * t.probeInterval
+	dead := make([]*gossipMember, 0)
+	for id, m := range t.members {
+		switch {
+		case m.State == memberSuspect && time.Since(m.stateChanged) > suspicionTimeout:
+			dead = append(dead, &gossipMember{ID: id, Addr: m.Addr, Incarnation: m.Incarnation, State: memberDead})
+		case m.State == memberDead && time.Since(m.stateChanged) > reapTimeout:
+			delete(t.members, id)
+		}
+	}
+	t.lock.Unlock()
+	for _, m := range dead {
+		t.Logger().Debugf("Gossip member %s at %s is dead", m.ID, m.Addr)
+		t.mergeMember(m)
+	}
+}
+
+func (t *GossipChatterRelay) pushPull() {
+	t.lock.Lock()
+	if time.Since(t.lastPush) < t.pushPullInterval {
+		t.lock.Unlock()
+		return
+	}
+	t.lastPush = time.Now()
+	targets := t.randomMembersLocked(1, "")
+	t.lock.Unlock()
+	for _, m := range targets {
+		t.send(m.Addr, t.pushPullPacket(gossipPushPull))
+	}
+}
+
+// gossipLoop sends pending broadcasts to a few random members several times a protocol period
+func (t *GossipChatterRelay) gossipLoop() {
+	ticker := time.NewTicker(t.probeInterval / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.closed:
+			return
+		case <-ticker.C:
+		}
+		t.lock.Lock()
+		pending := len(t.broadcasts) > 0
+		targets := t.randomMembersLocked(GossipFanout, "")
+		t.lock.Unlock()
+		if !pending {
+			continue
+		}
+		for _, m := range targets {
+			t.sendWithPiggyback(m.Addr, &gossipPacket{Type: gossipGossip})
+		}
+	}
+}
+
+// randomMembersLocked up to count live members other than exclude
+func (t *GossipChatterRelay) randomMembersLocked(count int, exclude string) []*gossipMember {
+	ret := make([]*gossipMember, 0, len(t.members))
+	for id, m := range t.members {
+		if id != exclude && m.State != memberDead {
+			c := *m
+			ret = append(ret, &c)
+		}
+	}
+	rand.Shuffle(len(ret), func(i, j int) {
+		ret[i], ret[j] = ret[j], ret[i]
+	})
+	if len(ret) > count {
+		ret = ret[:count]
+	}
+	return ret
+}
+
+// logMembersLocked scales retransmits and timeouts with the size of the cluster
+func (t *GossipChatterRelay) logMembersLocked() int {
+	return int(math.Ceil(math.Log10(float64(len(t.members) + 2))))
+}
+
+// mergeMember applies what another node says about a member, SWIM style: higher incarnations win, and at the same
+// incarnation dead beats suspect beats alive.  News about this node is refuted by going up an incarnation
+func (t *GossipChatterRelay) mergeMember(update *gossipMember) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if update.ID == t.nodeID {
+		if update.State != memberAlive && update.Incarnation >= t.incarnation && !t.isClosed() {
+			t.incarnation = update.Incarnation + 1
+			t.Logger().Debugf("Refuting gossip that this node is %d, now at incarnation %d", update.State, t.incarnation)
+			t.broadcasts = append(t.broadcasts, &gossipBroadcast{member: t.selfLocked(memberAlive)})
+		}
+		return
+	}
+	current, known := t.members[update.ID]
+	if known {
+		newer := update.Incarnation > current.Incarnation ||
+			(update.Incarnation == current.Incarnation && update.State > current.State)
+		if !newer {
+			return
+		}
+	} else if update.State == memberDead {
+		// no point learning about a member only to bury it
+		return
+	}
+	m := &gossipMember{ID: update.ID, Addr: update.Addr, Incarnation: update.Incarnation, State: update.State}
+	m.stateChanged = time.Now()
+	t.members[m.ID] = m
+	c := *m
+	t.broadcasts = append(t.broadcasts, &gossipBroadcast{member: &c})
+}
+
+// deliver hands a message to the listener the first time it is seen, and passes it on
+func (t *GossipChatterRelay) deliver(msg *gossipMessage) {
+	t.lock.Lock()
+	if t.seen[msg.ID] {
+		t.lock.Unlock()
+		return
+	}
+	t.markSeenLocked(msg)
+	t.broadcasts = append(t.broadcasts, &gossipBroadcast{message: msg})
+	listener := t.objectListener
+	t.lock.Unlock()
+
+	relayMsg, nodeID, err := t.codec.decode(msg.Envelope)
+	if err != nil {
+		t.Logger().WithError(err).Errorf("Error decoding a gossip cache sync message")
+		return
+	}
+	if nodeID == t.nodeID || listener == nil {
+		return
+	}
+	t.PerMessage().Tracef("Recieved Cache Sync %s %s", relayMsg.CacheName, relayMsg.CacheKey)
+	err = listener(relayMsg)
+	if err != nil {
+		t.Logger().WithError(err).Debugf("Unable to apply cache sync %s %s", relayMsg.CacheName, relayMsg.CacheKey)
+	}
+}
+
+// markSeenLocked remembers the message ID, and keeps the message for push pull
+func (t *GossipChatterRelay) markSeenLocked(msg *gossipMessage) {
+	t.seen[msg.ID] = true
+	t.seenOrder = append(t.seenOrder, msg.ID)
+	if len(t.seenOrder) > gossipSeenMessages {
+		delete(t.seen, t.seenOrder[0])
+		t.seenOrder = t.seenOrder[1:]
+	}
+	t.recent = append(t.recent, msg)
+	if len(t.recent) > gossipRecentMessages {
+		t.recent = t.recent[1:]
+	}
+}
+
+// sendWithPiggyback fills the packet with as many pending broadcasts as fit and sends it
+func (t *GossipChatterRelay) sendWithPiggyback(addr string, packet *gossipPacket) {
+	t.lock.Lock()
+	limit := gossipRetransmitMult * t.logMembersLocked()
+	size := 0
+	kept := t.broadcasts[:0]
+	for _, b := range t.broadcasts {
+		if b.member != nil {
+			size = size + len(b.member.ID) + len(b.member.Addr) + 64
+		} else {
+			size = size + messageSize(b.message)
+		}
+		if size > maxGossipPacket {
+			kept = append(kept, b)
+			continue
+		}
+		if b.member != nil {
+			packet.Updates = append(packet.Updates, b.member)
+		} else {
+			packet.Messages = append(packet.Messages, b.message)
+		}
+		b.transmits++
+		if b.transmits < limit {
+			kept = append(kept, b)
+		}
+	}
+	t.broadcasts = kept
+	t.lock.Unlock()
+	t.send(addr, packet)
+}
+
+// messageSize roughly what the message takes up in a packet
+func messageSize(msg *gossipMessage) int {
+	return len(msg.Envelope)*4/3 + len(msg.ID) + 32
+}
+
+func (t *GossipChatterRelay) send(addr string, packet *gossipPacket) {
+	packet.From = t.nodeID
+	packet.FromAddr = t.advertiseAddr
+	bits, err := json.Marshal(packet)
+	if err != nil {
+		t.Logger().WithError(err).Errorf("Unable to encode a gossip packet")
+		return
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Logger().WithError(err).Debugf("Unable to resolve gossip member %s", addr)
+		return
+	}
+	_, err = t.conn.WriteToUDP(bits, udpAddr)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		t.Logger().WithError(err).Debugf("Unable to gossip to %s", addr)
+	}
+}
+
+// notifyMembership tells the membership listener if the live members changed since it was last told
+func (t *GossipChatterRelay) notifyMembership() {
+	t.lock.Lock()
+	members := t.membersLocked()
+	listener := t.membershipListener
+	changed := !equalStrings(members, t.notifiedMembers)
+	t.notifiedMembers = members
+	t.lock.Unlock()
+	if changed && listener != nil {
+		listener(members)
+	}
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package chatter
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGossipChatter(t *testing.T) {
+	const nodeCount = 24
+	t.Setenv(MasterPassPhraseEnvVar, "bob")
+	t.Setenv(GossipBindEnvVar, "127.0.0.1:0")
+	t.Setenv(GossipProbeIntervalEnvVar, "50ms")
+	t.Setenv(GossipPushPullIntervalEnvVar, "250ms")
+
+	relays := make([]*GossipChatterRelay, 0, nodeCount)
+	listeners := make([]*collectingListener, 0, nodeCount)
+	for i := 0; i < nodeCount; i++ {
+		relay, err := NewGossipChatterRelay()
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer relay.stop(false)
+		listener := new(collectingListener)
+		relay.RegisterListenerForReplicatedObjects(listener.listen)
+		relays = append(relays, relay)
+		listeners = append(listeners, listener)
+		// everyone joins through the first node
+		t.Setenv(GossipSeedsEnvVar, relays[0].Addr())
+	}
+	allMembers := func(count int) func() bool {
+		return func() bool {
+			for _, relay := range relays {
+				if !relay.isClosed() && len(relay.Members()) != count {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	assert.Eventually(t, allMembers(nodeCount), 10*time.Second, 20*time.Millisecond, "every node should find every other")
+	assert.True(t, relays[1].Connected())
+
+	relays[5].ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key1", CacheValue: "InYi"})
+	assert.Eventually(t, func() bool {
+		for i, listener := range listeners {
+			if i != 5 && len(listener.keys()) == 0 {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 20*time.Millisecond, "the message should reach every node")
+	time.Sleep(200 * time.Millisecond)
+	for i, listener := range listeners {
+		if i == 5 {
+			assert.Empty(t, listener.keys(), "our own message is not delivered to us")
+			continue
+		}
+		assert.Equal(t, []string{"key1"}, listener.keys(), "copies should be dropped")
+	}
+
+	t.Run("Failure detection", func(t *testing.T) {
+		var lock sync.Mutex
+		var lastMembers []string
+		relays[1].RegisterMembershipListener(func(members []string) {
+			lock.Lock()
+			lastMembers = members
+			lock.Unlock()
+		})
+		relays[7].stop(false)
+		assert.Eventually(t, allMembers(nodeCount-1), 10*time.Second, 20*time.Millisecond, "a dead node should be dropped")
+		assert.NotContains(t, relays[1].Members(), relays[7].NodeID())
+		assert.Eventually(t, func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(lastMembers) == nodeCount-1
+		}, time.Second, 10*time.Millisecond)
+
+		relays[8].Close(context.Background())
+		assert.Eventually(t, allMembers(nodeCount-2), 10*time.Second, 20*time.Millisecond, "a node that leaves should be dropped")
+	})
+
+	t.Run("Late joiner", func(t *testing.T) {
+		relay, err := NewGossipChatterRelay()
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer relay.stop(false)
+		listener := new(collectingListener)
+		relay.RegisterListenerForReplicatedObjects(listener.listen)
+		assert.Eventually(t, func() bool {
+			return len(listener.keys()) == 1
+		}, 5*time.Second, 20*time.Millisecond, "push pull should bring recent messages")
+	})
+
+	t.Run("Too big for a packet", func(t *testing.T) {
+		relays[2].ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "big", CacheValue: strings.Repeat("x", maxGossipMessage)})
+		assert.Eventually(t, func() bool {
+			return len(listeners[3].keys()) == 2
+		}, 10*time.Second, 20*time.Millisecond)
+		listeners[3].lock.Lock()
+		big := listeners[3].received[1]
+		listeners[3].lock.Unlock()
+		assert.Equal(t, model.RelayInvalidate, big.Action, "should be sent as an invalidation")
+		assert.Empty(t, big.CacheValue)
+	})
+}
+
+func TestGossipExposed(t *testing.T) {
+	t.Setenv(MasterPassPhraseEnvVar, "")
+	t.Setenv(GossipBindEnvVar, ":0")
+	_, err := NewGossipChatterRelay()
+	assert.NotNil(t, err, "gossip other hosts can reach needs a pass phrase")
+	assert.True(t, isLoopbackAddr(GossipBindDefault), "only this host by default")
+
+	t.Setenv(MasterPassPhraseEnvVar, "bob")
+	relay, err := NewGossipChatterRelay()
+	if assert.Nil(t, err) {
+		assert.True(t, relay.Connected(), "a node with no seeds is on its own")
+		relay.stop(false)
+		assert.Equal(t, StatusClosed, relay.Status())
+	}
+
+	t.Setenv(GossipBindEnvVar, "127.0.0.1:0")
+	t.Setenv(GossipSeedsEnvVar, "127.0.0.1:9")
+	relay, err = NewGossipChatterRelay()
+	if assert.Nil(t, err) {
+		defer relay.stop(false)
+		assert.Equal(t, StatusJoining, relay.Status(), "no seed has answered")
+	}
+}
@@ -0,0 +1,348 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package chatter
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/theotw/chatty-cache/pkg/logging"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"strings"
+	"sync"
+	"time"
+)
+
+const JetStreamNameEnvVar = "CHATTY_JS_STREAM"
+const JetStreamSubjectEnvVar = "CHATTY_JS_SUBJECT"
+
+// JetStreamMaxAgeEnvVar how long the stream keeps messages, a go duration, 0 keeps them until the stream limits toss them
+const JetStreamMaxAgeEnvVar = "CHATTY_JS_MAX_AGE"
+
+// JetStreamRetentionEnvVar age keeps every message up to the max age, last-value only keeps the newest message per key
+const JetStreamRetentionEnvVar = "CHATTY_JS_RETENTION"
+
+// NodeNameEnvVar the stable name of this node, it names the durable consumer so it has to survive restarts.  Defaults
+// to the node ID, which is new every start, so set it for a node to replay what it missed while down
+const NodeNameEnvVar = "CHATTY_NODE_NAME"
+
+const JetStreamNameDefault = "CHATTY"
+const JetStreamSubjectDefault = "chatty.js"
+const JetStreamMaxAgeDefault = "1h"
+const RetentionByAge = "age"
+const RetentionLastValue = "last-value"
+
+// JetStreamMaxDeliver how many times a message the listener keeps failing on is redelivered before giving up on it
+const JetStreamMaxDeliver = 5
+
+// JetStreamFetchBatch how many messages the consumer pulls at a time
+const JetStreamFetchBatch = 64
+
+// JetStreamRedeliveryDelay how long to wait before redelivering a message the listener failed on
+const JetStreamRedeliveryDelay = time.Second
+
+// JetStreamUnnamedInactive how long the server keeps the consumer of a node without a NodeNameEnvVar once it stops
+// pulling, nothing ever binds to it again after a restart
+const JetStreamUnnamedInactive = time.Hour
+
+// noTenantToken is the tenant subject token for untenanted caches, it is not a valid tenant ID so it cannot collide
+const noTenantToken = "~"
+
+// JetStreamChatterRelay replicates through a JetStream stream instead of core nats pub/sub.  Every node has a durable
+// consumer, named after the node, that is only acked once the listener has applied the message, so a node that was
+// down or slow picks up from its last acked message when it comes back
+type JetStreamChatterRelay struct {
+	logging.Holder
+
+	nc            *nats.Conn
+	js            nats.JetStreamContext
+	config        *NatsConfig
+	streamName    string
+	subjectPrefix string
+	nodeName      string
+	// inactive how long the server keeps our consumer once we stop pulling, 0 for ever
+	inactive  time.Duration
+	maxAge    time.Duration
+	lastValue bool
+	//nodeID random UUID for this process, used to skip our own messages
+	nodeID         string
+	codec          *envelopeCodec
+	objectListener ObjectListener
+
+	subscribeOnce sync.Once
+	sub           *nats.Subscription
+	pulling       sync.WaitGroup
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	// stopPulling cancels the fetch the pull loop is waiting on
+	pullCtx     context.Context
+	stopPulling context.CancelFunc
+}
+
+// NewJetStreamChatterRelay connects to nats, with the log in and TLS of NatsConfigFromEnv, and creates the stream if
+// it is not there yet
+func NewJetStreamChatterRelay() (*JetStreamChatterRelay, error) {
+	ret := new(JetStreamChatterRelay)
+	ret.config = NatsConfigFromEnv()
+	ret.streamName = model.GetEnvVarWithDefault(JetStreamNameEnvVar, JetStreamNameDefault)
+	ret.subjectPrefix = model.GetEnvVarWithDefault(JetStreamSubjectEnvVar, JetStreamSubjectDefault)
+	ret.nodeID = uuid.NewString()
+	ret.nodeName = durableName(model.GetEnvVarWithDefault(NodeNameEnvVar, ""))
+	if len(ret.nodeName) == 0 {
+		// unique, two processes on one host must not share a consumer and split the stream between them
+		ret.nodeName = ret.nodeID
+		ret.inactive = JetStreamUnnamedInactive
+	}
+	maxAge, err := time.ParseDuration(model.GetEnvVarWithDefault(JetStreamMaxAgeEnvVar, JetStreamMaxAgeDefault))
+	if err != nil {
+		return nil, fmt.Errorf("bad %s: %w", JetStreamMaxAgeEnvVar, err)
+	}
+	ret.maxAge = maxAge
+	switch retention := model.GetEnvVarWithDefault(JetStreamRetentionEnvVar, RetentionByAge); retention {
+	case RetentionByAge:
+	case RetentionLastValue:
+		ret.lastValue = true
+	default:
+		return nil, fmt.Errorf("bad %s %q, use %s or %s", JetStreamRetentionEnvVar, retention, RetentionByAge, RetentionLastValue)
+	}
+	ret.codec = &envelopeCodec{nodeID: ret.nodeID, masterPassPhrase: model.GetEnvVarWithDefault(MasterPassPhraseEnvVar, "")}
+	ret.closed = make(chan struct{})
+	ret.pullCtx, ret.stopPulling = context.WithCancel(context.Background())
+	err = ret.init()
+	return ret, err
+}
+
+func (t *JetStreamChatterRelay) init() error {
+	nc, err := t.config.Connect()
+	if err != nil {
+		t.Logger().WithError(err).Errorf("Unable to connect to nats %s", strings.Join(t.config.URLs, ","))
+		return err
+	}
+	t.nc = nc
+	t.js, err = nc.JetStream()
+	if err != nil {
+		return err
+	}
+	return t.ensureStream()
+}
+
+// ensureStream creates the stream.  An existing one is used as it is, the stream is shared so one node's settings
+// must not undo another's, or what was set on the server
+func (t *JetStreamChatterRelay) ensureStream() error {
+	cfg := &nats.StreamConfig{
+		Name:     t.streamName,
+		Subjects: []string{t.subjectPrefix + ".>"},
+		MaxAge:   t.maxAge,
+		Storage:  nats.FileStorage,
+	}
+	if t.lastValue {
+		cfg.MaxMsgsPerSubject = 1
+	}
+	info, err := t.js.StreamInfo(t.streamName)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = t.js.AddStream(cfg)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	// the server reports an unset limit as -1
+	perSubject := info.Config.MaxMsgsPerSubject
+	if perSubject < 0 {
+		perSubject = 0
+	}
+	if info.Config.MaxAge != cfg.MaxAge || perSubject != cfg.MaxMsgsPerSubject {
+		t.Logger().Warnf("Stream %s keeps messages for %s with %d per subject, not the %s with %d configured here, using it as is",
+			t.streamName, info.Config.MaxAge, perSubject, cfg.MaxAge, cfg.MaxMsgsPerSubject)
+	}
+	return nil
+}
+
+// ReplicateCachedObject publishes to the stream and waits for the stream to have it
+func (t *JetStreamChatterRelay) ReplicateCachedObject(message *model.CacheRelayMessage) {
+	err := t.ReplicateCachedObjectCtx(context.Background(), message)
+	if errors.Is(err, ErrClosed) {
+		t.PerMessage().Debugf("Relay closed, dropping cache sync %s %s", message.CacheName, message.CacheKey)
+	} else if err != nil {
+		t.Logger().WithError(err).Errorf("Error publishing cache relay message to jetstream")
+	}
+}
+
+// ReplicateCachedObjectCtx publishes to the stream and waits for the stream to have it, no longer than ctx allows.  A
+// ctx with no deadline waits as long as the JetStream context does
+func (t *JetStreamChatterRelay) ReplicateCachedObjectCtx(ctx context.Context, message *model.CacheRelayMessage) error {
+	if t.isClosed() {
+		return ErrClosed
+	}
+	bits, err := t.codec.encode(message)
+	if err != nil {
+		return err
+	}
+	if _, ok := ctx.Deadline(); ok {
+		_, err = t.js.Publish(t.SubjectFor(message), bits, nats.Context(ctx))
+	} else {
+		_, err = t.js.Publish(t.SubjectFor(message), bits)
+	}
+	return err
+}
+
+// RegisterListenerForReplicatedObjects registers the listener and starts pulling from the durable consumer,
+// replaying everything not acked yet
+func (t *JetStreamChatterRelay) RegisterListenerForReplicatedObjects(listener ObjectListener) {
+	t.objectListener = listener
+	t.subscribeOnce.Do(func() {
+		if t.isClosed() {
+			return
+		}
+		// a pull consumer, a push consumer keeps delivering to the inbox of a dead connection until the ack wait runs out.
+		// It is made here and bound to, a consumer the library makes is deleted when Close drains the connection
+		_, err := t.js.AddConsumer(t.streamName, &nats.ConsumerConfig{
+			Durable:       t.nodeName,
+			FilterSubject: t.subjectPrefix + ".>",
+			AckPolicy:     nats.AckExplicitPolicy,
+			DeliverPolicy: nats.DeliverAllPolicy,
+			MaxDeliver:    JetStreamMaxDeliver,
+			// an unnamed node's consumer would otherwise be left on the server after every restart
+			InactiveThreshold: t.inactive,
+		})
+		if err != nil {
+			t.Logger().WithError(err).Errorf("Unable to create the durable consumer %s", t.nodeName)
+			return
+		}
+		sub, err := t.js.PullSubscribe(t.subjectPrefix+".>", t.nodeName, nats.Bind(t.streamName, t.nodeName))
+		if err != nil {
+			t.Logger().WithError(err).Errorf("Unable to create the durable consumer %s", t.nodeName)
+			return
+		}
+		t.sub = sub
+		t.pulling.Add(1)
+		go t.pullLoop()
+	})
+}
+
+// Close stops pulling once the batch in hand is applied and acked, then drains the connection, waiting no longer
+// than ctx allows
+func (t *JetStreamChatterRelay) Close(ctx context.Context) error {
+	first := false
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		t.stopPulling()
+		first = true
+	})
+	if !first {
+		return nil
+	}
+	err := waitContext(ctx, &t.pulling)
+	if t.nc == nil {
+		return err
+	}
+	drainErr := drainConn(ctx, t.nc)
+	if err == nil {
+		err = drainErr
+	}
+	return err
+}
+
+// ReplicationStats counts of the envelopes sent and received so far
+func (t *JetStreamChatterRelay) ReplicationStats() ReplicationStats {
+	return t.codec.replicationStats()
+}
+
+// Status the state of the NATS connection
+func (t *JetStreamChatterRelay) Status() string {
+	if t.nc == nil {
+		return nats.DISCONNECTED.String()
+	}
+	return t.nc.Status().String()
+}
+
+// Connected whether the NATS connection is up
+func (t *JetStreamChatterRelay) Connected() bool {
+	return t.nc != nil && t.nc.IsConnected()
+}
+
+func (t *JetStreamChatterRelay) isClosed() bool {
+	select {
+	case <-t.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *JetStreamChatterRelay) pullLoop() {
+	defer t.pulling.Done()
+	for !t.nc.IsClosed() && !t.isClosed() {
+		fetchCtx, cancel := context.WithTimeout(t.pullCtx, time.Second)
+		msgs, err := t.sub.Fetch(JetStreamFetchBatch, nats.Context(fetchCtx))
+		cancel()
+		if err != nil && !errors.Is(err, nats.ErrTimeout) && !errors.Is(err, context.DeadlineExceeded) {
+			if t.nc.IsClosed() || t.isClosed() || errors.Is(err, nats.ErrConnectionClosed) || errors.Is(err, nats.ErrBadSubscription) {
+				return
+			}
+			t.Logger().WithError(err).Debugf("Error pulling from the durable consumer %s", t.nodeName)
+			time.Sleep(JetStreamRedeliveryDelay)
+		}
+		for _, msg := range msgs {
+			t.handleMessage(msg)
+		}
+	}
+}
+
+// NodeName the name of the durable consumer of this node
+func (t *JetStreamChatterRelay) NodeName() string {
+	return t.nodeName
+}
+
+// SubjectFor the stream subject of a message, <prefix>.<tenant>.<cacheName>.<key>.  Each key gets its own subject
+// so last-value retention keeps the newest message per key
+func (t *JetStreamChatterRelay) SubjectFor(message *model.CacheRelayMessage) string {
+	tenant := noTenantToken
+	if len(message.TenantID) > 0 {
+		tenant = subjectTokens(message.TenantID, false)
+	}
+	key := base64.RawURLEncoding.EncodeToString([]byte(message.CacheKey))
+	return strings.Join([]string{t.subjectPrefix, tenant, subjectTokens(message.CacheName, false), subjectTokens(key, false)}, ".")
+}
+
+func (t *JetStreamChatterRelay) handleMessage(msg *nats.Msg) {
+	relayMsg, nodeID, err := t.codec.decode(msg.Data)
+	if err != nil {
+		// it will never decode any better, do not have it redelivered
+		t.Logger().WithError(err).Errorf("Error decoding a jetstream cache sync message")
+		msg.Term()
+		return
+	}
+	if nodeID == t.nodeID {
+		msg.Ack()
+		return
+	}
+	if t.objectListener == nil {
+		msg.NakWithDelay(JetStreamRedeliveryDelay)
+		return
+	}
+	t.PerMessage().Tracef("Recieved Cache Sync %s %s", relayMsg.CacheName, relayMsg.CacheKey)
+	err = t.objectListener(relayMsg)
+	if err != nil {
+		t.Logger().WithError(err).Debugf("Unable to apply cache sync %s %s, asking for redelivery", relayMsg.CacheName, relayMsg.CacheKey)
+		msg.NakWithDelay(JetStreamRedeliveryDelay)
+		return
+	}
+	msg.Ack()
+}
+
+// durableName consumer names cannot have dots, spaces or wildcards
+func durableName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == '*' || r == '>' || r == ' ' || r == '\t' {
+			return '_'
+		}
+		return r
+	}, name)
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package chatter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runJetStreamServer starts an embedded nats server with jetstream on a random port and points NATS_SERVER at it
+func runJetStreamServer(t *testing.T, configure ...func(opts *server.Options)) *server.Server {
+	opts := &server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	}
+	for _, c := range configure {
+		c(opts)
+	}
+	s, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(10 * time.Second) {
+		t.Fatal("nats server did not start")
+	}
+	t.Cleanup(s.Shutdown)
+	t.Setenv(NatsURLEnvVar, s.ClientURL())
+	return s
+}
+
+// collectingListener gathers what it is given, failing the first failures calls
+type collectingListener struct {
+	lock     sync.Mutex
+	received []*model.CacheRelayMessage
+	failures int
+}
+
+func (t *collectingListener) listen(message *model.CacheRelayMessage) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.failures > 0 {
+		t.failures--
+		return errors.New("not today")
+	}
+	t.received = append(t.received, message)
+	return nil
+}
+
+func (t *collectingListener) keys() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ret := make([]string, 0, len(t.received))
+	for _, m := range t.received {
+		ret = append(ret, m.CacheKey)
+	}
+	return ret
+}
+
+func TestJetStreamChatter(t *testing.T) {
+	runJetStreamServer(t)
+	t.Setenv(MasterPassPhraseEnvVar, "bob")
+
+	t.Setenv(NodeNameEnvVar, "node.a")
+	relayA, err := NewJetStreamChatterRelay()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer relayA.Close(context.Background())
+	assert.Equal(t, "node_a", relayA.NodeName())
+	assert.True(t, relayA.Connected())
+	relayA.RegisterListenerForReplicatedObjects(new(collectingListener).listen)
+
+	t.Setenv(NodeNameEnvVar, "node-b")
+	relayB, err := NewJetStreamChatterRelay()
+	if !assert.Nil(t, err) {
+		return
+	}
+	listenerB := &collectingListener{failures: 1}
+	relayB.RegisterListenerForReplicatedObjects(listenerB.listen)
+
+	relayA.ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key1", CacheValue: "InYi"})
+	assert.Eventually(t, func() bool {
+		return len(listenerB.keys()) == 1
+	}, 10*time.Second, 50*time.Millisecond, "a failed apply should be redelivered")
+
+	t.Run("Replay after restart", func(t *testing.T) {
+		assert.Nil(t, relayB.Close(context.Background()))
+		relayA.ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key2"})
+		relayA.ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key3", TenantID: "acme"})
+
+		relayB2, err := NewJetStreamChatterRelay()
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer relayB2.Close(context.Background())
+		listenerB2 := new(collectingListener)
+		relayB2.RegisterListenerForReplicatedObjects(listenerB2.listen)
+		assert.Eventually(t, func() bool {
+			return len(listenerB2.keys()) == 2
+		}, 10*time.Second, 50*time.Millisecond)
+		assert.Equal(t, []string{"key2", "key3"}, listenerB2.keys(), "only what was missed, in order")
+	})
+
+	t.Run("Subjects and retention", func(t *testing.T) {
+		assert.Equal(t, "chatty.js.~.users.a2V5MQ", relayA.SubjectFor(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key1"}))
+		assert.Equal(t, "chatty.js.acme.users._", relayA.SubjectFor(&model.CacheRelayMessage{CacheName: "users", TenantID: "acme"}))
+
+		// a node configured differently joining the shared stream leaves it alone
+		t.Setenv(JetStreamRetentionEnvVar, RetentionLastValue)
+		t.Setenv(JetStreamMaxAgeEnvVar, "5m")
+		t.Setenv(NodeNameEnvVar, "node-c")
+		relayC, err := NewJetStreamChatterRelay()
+		if assert.Nil(t, err) {
+			defer relayC.Close(context.Background())
+			info, err := relayC.js.StreamInfo(JetStreamNameDefault)
+			if assert.Nil(t, err) {
+				assert.LessOrEqual(t, info.Config.MaxMsgsPerSubject, int64(0))
+				assert.Equal(t, time.Hour, info.Config.MaxAge)
+			}
+		}
+
+		// a new stream gets the settings of the node that makes it
+		t.Setenv(JetStreamNameEnvVar, "CHATTY_LV")
+		t.Setenv(JetStreamSubjectEnvVar, "chatty.lv")
+		relayD, err := NewJetStreamChatterRelay()
+		if assert.Nil(t, err) {
+			defer relayD.Close(context.Background())
+			info, err := relayD.js.StreamInfo("CHATTY_LV")
+			if assert.Nil(t, err) {
+				assert.Equal(t, int64(1), info.Config.MaxMsgsPerSubject)
+				assert.Equal(t, 5*time.Minute, info.Config.MaxAge)
+			}
+		}
+		t.Setenv(JetStreamRetentionEnvVar, "forever")
+		_, err = NewJetStreamChatterRelay()
+		assert.NotNil(t, err)
+	})
+}
+
+func TestJetStreamUnnamedNodes(t *testing.T) {
+	runJetStreamServer(t, func(opts *server.Options) {
+		opts.Username = "chatty"
+		opts.Password = "secret"
+	})
+	t.Setenv(NodeNameEnvVar, "")
+	_, err := NewJetStreamChatterRelay()
+	assert.NotNil(t, err, "the server wants a log in")
+
+	t.Setenv(NatsUserEnvVar, "chatty")
+	t.Setenv(NatsPasswordEnvVar, "secret")
+	relays := make([]*JetStreamChatterRelay, 0, 3)
+	listeners := make([]*collectingListener, 0, 3)
+	for i := 0; i < 3; i++ {
+		relay, err := NewJetStreamChatterRelay()
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer relay.Close(context.Background())
+		listener := new(collectingListener)
+		relay.RegisterListenerForReplicatedObjects(listener.listen)
+		relays = append(relays, relay)
+		listeners = append(listeners, listener)
+	}
+	assert.Equal(t, relays[1].nodeID, relays[1].NodeName())
+	assert.NotEqual(t, relays[1].NodeName(), relays[2].NodeName(), "processes on one host do not share a consumer")
+	info, err := relays[1].js.ConsumerInfo(JetStreamNameDefault, relays[1].NodeName())
+	if assert.Nil(t, err) {
+		assert.Equal(t, JetStreamUnnamedInactive, info.Config.InactiveThreshold)
+	}
+
+	for i := 0; i < 4; i++ {
+		relays[0].ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: fmt.Sprintf("key%d", i)})
+	}
+	assert.Eventually(t, func() bool {
+		return len(listeners[1].keys()) == 4 && len(listeners[2].keys()) == 4
+	}, 10*time.Second, 50*time.Millisecond, "every node sees every message")
+}
@@ -0,0 +1,458 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package chatter
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/theotw/chatty-cache/pkg/logging"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrUnreachable the target node is not on the bus or is on the other side of a partition
+var ErrUnreachable = errors.New("node unreachable")
+
+// ErrDropped the bus dropped the fetch on purpose
+var ErrDropped = errors.New("message dropped")
+
+// LocalBus connects chatters in the same process, for tests and single binary deployments.  Out of the box messages
+// are delivered in order with no delay, the knobs make it behave like a worse network: latency with jitter, a drop
+// rate, reordering and partitions.  Delivery is asynchronous like a real chatter, Settle waits for it
+type LocalBus struct {
+	lock  sync.Mutex
+	nodes map[string]*LocalChatter
+	// groups the partition each node is in, nodes not listed are all in group 0
+	groups map[string]int
+	random *rand.Rand
+	seq    uint64
+
+	latency       time.Duration
+	jitter        time.Duration
+	dropRate      float64
+	reorderRate   float64
+	reorderDelay  time.Duration
+	inFlight      int
+	inFlightEmpty *sync.Cond
+}
+
+// LocalChatter one node on a LocalBus, it is a PartitionChatter
+type LocalChatter struct {
+	logging.Holder
+
+	bus                *LocalBus
+	nodeID             string
+	objectListener     ObjectListener
+	membershipListener MembershipListener
+	fetchHandler       FetchHandler
+	// pending, outgoing and leaving guarded by the bus lock
+	pending localQueue
+	// outgoing messages sent by this node and not yet delivered or dropped
+	outgoing int
+	// leaving Close has been called, nothing more is sent
+	leaving bool
+	wake    chan struct{}
+	closed  chan struct{}
+}
+
+// localDelivery a message waiting for its time to be delivered
+type localDelivery struct {
+	due     time.Time
+	seq     uint64
+	sender  *LocalChatter
+	message *model.CacheRelayMessage
+}
+
+// localQueue a heap of deliveries, soonest first and in send order when due at the same time
+type localQueue []*localDelivery
+
+func (t localQueue) Len() int { return len(t) }
+func (t localQueue) Less(i, j int) bool {
+	if t[i].due.Equal(t[j].due) {
+		return t[i].seq < t[j].seq
+	}
+	return t[i].due.Before(t[j].due)
+}
+func (t localQueue) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t *localQueue) Push(x interface{}) {
+	*t = append(*t, x.(*localDelivery))
+}
+func (t *localQueue) Pop() interface{} {
+	old := *t
+	ret := old[len(old)-1]
+	*t = old[:len(old)-1]
+	return ret
+}
+
+// NewLocalBus an empty bus with no latency, drops or partitions
+func NewLocalBus() *LocalBus {
+	ret := new(LocalBus)
+	ret.nodes = make(map[string]*LocalChatter)
+	ret.groups = make(map[string]int)
+	ret.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	ret.inFlightEmpty = sync.NewCond(&ret.lock)
+	return ret
+}
+
+// NewChatter adds a node to the bus, an empty nodeID gets a generated one
+func (t *LocalBus) NewChatter(nodeID string) (*LocalChatter, error) {
+	if len(nodeID) == 0 {
+		nodeID = uuid.New().String()
+	}
+	ret := new(LocalChatter)
+	ret.bus = t
+	ret.nodeID = nodeID
+	ret.wake = make(chan struct{}, 1)
+	ret.closed = make(chan struct{})
+	t.lock.Lock()
+	if _, ok := t.nodes[nodeID]; ok {
+		t.lock.Unlock()
+		return nil, fmt.Errorf("node %s is already on the bus", nodeID)
+	}
+	t.nodes[nodeID] = ret
+	t.lock.Unlock()
+	go ret.deliverLoop()
+	t.notify()
+	return ret, nil
+}
+
+// SetSeed makes the drops, jitter and reordering repeatable
+func (t *LocalBus) SetSeed(seed int64) {
+	t.lock.Lock()
+	t.random = rand.New(rand.NewSource(seed))
+	t.lock.Unlock()
+}
+
+// SetLatency delays every message by latency plus a random amount up to jitter
+func (t *LocalBus) SetLatency(latency time.Duration, jitter time.Duration) {
+	t.lock.Lock()
+	t.latency = latency
+	t.jitter = jitter
+	t.lock.Unlock()
+}
+
+// SetDropRate the fraction of messages, 0 to 1, that are lost
+func (t *LocalBus) SetDropRate(rate float64) {
+	t.lock.Lock()
+	t.dropRate = rate
+	t.lock.Unlock()
+}
+
+// SetReorderRate the fraction of messages, 0 to 1, held back an extra delay so the ones after them overtake them
+func (t *LocalBus) SetReorderRate(rate float64, delay time.Duration) {
+	t.lock.Lock()
+	t.reorderRate = rate
+	t.reorderDelay = delay
+	t.lock.Unlock()
+}
+
+// Partition splits the bus, nodes only reach nodes in the same group.  Nodes not in any group form one more group.
+// Members and the membership listeners only see their own side
+func (t *LocalBus) Partition(groups ...[]string) {
+	t.lock.Lock()
+	t.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, nodeID := range group {
+			t.groups[nodeID] = i + 1
+		}
+	}
+	t.lock.Unlock()
+	t.notify()
+}
+
+// Heal removes any partition
+func (t *LocalBus) Heal() {
+	t.Partition()
+}
+
+// Settle waits until every message sent so far has been delivered or dropped
+func (t *LocalBus) Settle() {
+	t.lock.Lock()
+	for t.inFlight > 0 {
+		t.inFlightEmpty.Wait()
+	}
+	t.lock.Unlock()
+}
+
+// reachableLocked caller holds the lock
+func (t *LocalBus) reachableLocked(from string, to string) bool {
+	_, ok := t.nodes[to]
+	return ok && t.groups[from] == t.groups[to]
+}
+
+// membersLocked the nodes nodeID can reach, including itself, caller holds the lock
+func (t *LocalBus) membersLocked(nodeID string) []string {
+	ret := make([]string, 0, len(t.nodes))
+	for k := range t.nodes {
+		if t.groups[k] == t.groups[nodeID] {
+			ret = append(ret, k)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// notify tells every node with a membership listener who it can see
+func (t *LocalBus) notify() {
+	t.lock.Lock()
+	type call struct {
+		listener MembershipListener
+		members  []string
+	}
+	calls := make([]call, 0, len(t.nodes))
+	for k, n := range t.nodes {
+		if n.membershipListener != nil {
+			calls = append(calls, call{listener: n.membershipListener, members: t.membersLocked(k)})
+		}
+	}
+	t.lock.Unlock()
+	for _, c := range calls {
+		c.listener(c.members)
+	}
+}
+
+// sendLocked queues a copy of the message for the target, applying the knobs, caller holds the lock
+func (t *LocalBus) sendLocked(sender *LocalChatter, to string, message *model.CacheRelayMessage) error {
+	from := sender.nodeID
+	if !t.reachableLocked(from, to) {
+		return ErrUnreachable
+	}
+	if t.dropRate > 0 && t.random.Float64() < t.dropRate {
+		sender.PerMessage().Tracef("Local bus dropping %s %s for %s", message.CacheName, message.CacheKey, to)
+		return nil
+	}
+	delay := t.latency
+	if t.jitter > 0 {
+		delay += time.Duration(t.random.Int63n(int64(t.jitter)))
+	}
+	if t.reorderRate > 0 && t.random.Float64() < t.reorderRate {
+		delay += t.reorderDelay
+	}
+	copied := *message
+	copied.NodeID = from
+	t.seq++
+	target := t.nodes[to]
+	heap.Push(&target.pending, &localDelivery{due: time.Now().Add(delay), seq: t.seq, sender: t.nodes[from], message: &copied})
+	t.inFlight++
+	t.nodes[from].outgoing++
+	select {
+	case target.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// deliveredLocked marks a message as no longer in flight, caller holds the lock
+func (t *LocalBus) deliveredLocked(delivery *localDelivery) {
+	t.inFlight--
+	delivery.sender.outgoing--
+	if t.inFlight == 0 || (delivery.sender.leaving && delivery.sender.outgoing == 0) {
+		t.inFlightEmpty.Broadcast()
+	}
+}
+
+// deliverLoop hands messages to the listener as they come due
+func (t *LocalChatter) deliverLoop() {
+	for {
+		var ready *localDelivery
+		wait := time.Duration(-1)
+		t.bus.lock.Lock()
+		if len(t.pending) > 0 {
+			wait = time.Until(t.pending[0].due)
+			if wait <= 0 {
+				ready = heap.Pop(&t.pending).(*localDelivery)
+			}
+		}
+		reachable := ready != nil && t.bus.reachableLocked(ready.message.NodeID, t.nodeID)
+		listener := t.objectListener
+		t.bus.lock.Unlock()
+
+		if ready != nil {
+			if reachable && listener != nil {
+				err := listener(ready.message)
+				if err != nil {
+					t.Logger().WithError(err).Debugf("Unable to apply cache sync %s %s", ready.message.CacheName, ready.message.CacheKey)
+				}
+			}
+			t.bus.lock.Lock()
+			t.bus.deliveredLocked(ready)
+			t.bus.lock.Unlock()
+			continue
+		}
+		var timer <-chan time.Time
+		if wait > 0 {
+			timer = time.After(wait)
+		}
+		select {
+		case <-t.closed:
+			t.bus.lock.Lock()
+			for _, dropped := range t.pending {
+				t.bus.deliveredLocked(dropped)
+			}
+			t.pending = nil
+			t.bus.lock.Unlock()
+			return
+		case <-t.wake:
+		case <-timer:
+		}
+	}
+}
+
+// NodeID the ID of this node on the bus
+func (t *LocalChatter) NodeID() string {
+	return t.nodeID
+}
+
+// Members the nodes this one can reach, including itself
+func (t *LocalChatter) Members() []string {
+	t.bus.lock.Lock()
+	defer t.bus.lock.Unlock()
+	return t.bus.membersLocked(t.nodeID)
+}
+
+// RegisterMembershipListener the listener is called straight away with the current members
+func (t *LocalChatter) RegisterMembershipListener(listener MembershipListener) {
+	t.bus.lock.Lock()
+	t.membershipListener = listener
+	t.bus.lock.Unlock()
+	t.bus.notify()
+}
+
+func (t *LocalChatter) RegisterListenerForReplicatedObjects(listener ObjectListener) {
+	t.bus.lock.Lock()
+	t.objectListener = listener
+	t.bus.lock.Unlock()
+}
+
+func (t *LocalChatter) RegisterFetchHandler(handler FetchHandler) {
+	t.bus.lock.Lock()
+	t.fetchHandler = handler
+	t.bus.lock.Unlock()
+}
+
+// ReplicateCachedObject sends the message to every node this one can reach
+func (t *LocalChatter) ReplicateCachedObject(message *model.CacheRelayMessage) {
+	if t.ReplicateCachedObjectCtx(context.Background(), message) == ErrClosed {
+		t.PerMessage().Debugf("Chatter closed, dropping cache sync %s %s", message.CacheName, message.CacheKey)
+	}
+}
+
+// ReplicateCachedObjectCtx sends the message to every node this one can reach unless ctx is already done, sending
+// never waits
+func (t *LocalChatter) ReplicateCachedObjectCtx(ctx context.Context, message *model.CacheRelayMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	t.bus.lock.Lock()
+	defer t.bus.lock.Unlock()
+	if t.leaving {
+		return ErrClosed
+	}
+	for k := range t.bus.nodes {
+		if k != t.nodeID {
+			t.bus.sendLocked(t, k, message)
+		}
+	}
+	return nil
+}
+
+// SendToNode sends the message to a single node, ErrUnreachable if it is not on this side of a partition
+func (t *LocalChatter) SendToNode(nodeID string, message *model.CacheRelayMessage) error {
+	return t.SendToNodeCtx(context.Background(), nodeID, message)
+}
+
+// SendToNodeCtx is SendToNode unless ctx is already done
+func (t *LocalChatter) SendToNodeCtx(ctx context.Context, nodeID string, message *model.CacheRelayMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	t.bus.lock.Lock()
+	defer t.bus.lock.Unlock()
+	if t.leaving {
+		return ErrClosed
+	}
+	return t.bus.sendLocked(t, nodeID, message)
+}
+
+// FetchFromNode asks a single node, waiting out the latency, a nil message and nil error means the node does not
+// have it
+func (t *LocalChatter) FetchFromNode(nodeID string, message *model.CacheRelayMessage) (*model.CacheRelayMessage, error) {
+	return t.FetchFromNodeCtx(context.Background(), nodeID, message)
+}
+
+// FetchFromNodeCtx is FetchFromNode giving up when ctx is done before the latency has passed
+func (t *LocalChatter) FetchFromNodeCtx(ctx context.Context, nodeID string, message *model.CacheRelayMessage) (*model.CacheRelayMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	t.bus.lock.Lock()
+	if t.leaving {
+		t.bus.lock.Unlock()
+		return nil, ErrClosed
+	}
+	if !t.bus.reachableLocked(t.nodeID, nodeID) {
+		t.bus.lock.Unlock()
+		return nil, ErrUnreachable
+	}
+	if t.bus.dropRate > 0 && t.bus.random.Float64() < t.bus.dropRate {
+		t.bus.lock.Unlock()
+		return nil, ErrDropped
+	}
+	delay := t.bus.latency
+	handler := t.bus.nodes[nodeID].fetchHandler
+	t.bus.lock.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(delay):
+	}
+	if handler == nil {
+		return nil, nil
+	}
+	copied := *message
+	copied.NodeID = t.nodeID
+	return handler(&copied), nil
+}
+
+// Close waits, no longer than ctx allows, for the messages this node sent to be delivered, then takes the node off the
+// bus.  Anything still queued for it is dropped
+func (t *LocalChatter) Close(ctx context.Context) error {
+	t.bus.lock.Lock()
+	if t.leaving {
+		t.bus.lock.Unlock()
+		return nil
+	}
+	t.leaving = true
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			t.bus.lock.Lock()
+			t.bus.inFlightEmpty.Broadcast()
+			t.bus.lock.Unlock()
+		case <-done:
+		}
+	}()
+	for t.outgoing > 0 && ctx.Err() == nil {
+		t.bus.inFlightEmpty.Wait()
+	}
+	var err error
+	if t.outgoing > 0 {
+		err = ctx.Err()
+	}
+	delete(t.bus.nodes, t.nodeID)
+	t.bus.lock.Unlock()
+	close(t.closed)
+	t.bus.notify()
+	return err
+}
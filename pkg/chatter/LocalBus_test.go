@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package chatter
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLocalBus(t *testing.T) {
+	bus := NewLocalBus()
+	bus.SetSeed(42)
+	nodes := make([]*LocalChatter, 0, 3)
+	listeners := make([]*collectingListener, 0, 3)
+	for i := 0; i < 3; i++ {
+		node, err := bus.NewChatter(fmt.Sprintf("node%d", i))
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer node.Close(context.Background())
+		listener := new(collectingListener)
+		node.RegisterListenerForReplicatedObjects(listener.listen)
+		nodes = append(nodes, node)
+		listeners = append(listeners, listener)
+	}
+	_, err := bus.NewChatter("node1")
+	assert.NotNil(t, err, "node IDs are unique")
+	reset := func() {
+		for _, l := range listeners {
+			l.lock.Lock()
+			l.received = nil
+			l.lock.Unlock()
+		}
+	}
+
+	nodes[0].ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key1", CacheValue: "InYi"})
+	bus.Settle()
+	assert.Empty(t, listeners[0].keys(), "our own message is not delivered to us")
+	assert.Equal(t, []string{"key1"}, listeners[1].keys())
+	assert.Equal(t, []string{"key1"}, listeners[2].keys())
+	assert.Equal(t, "node0", listeners[1].received[0].NodeID)
+
+	t.Run("Latency", func(t *testing.T) {
+		reset()
+		bus.SetLatency(50*time.Millisecond, 10*time.Millisecond)
+		defer bus.SetLatency(0, 0)
+		start := time.Now()
+		nodes[0].ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key2"})
+		assert.Empty(t, listeners[1].keys())
+		bus.Settle()
+		assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+		assert.Equal(t, []string{"key2"}, listeners[1].keys())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := nodes[0].FetchFromNodeCtx(ctx, "node1", &model.CacheRelayMessage{CacheName: "users", CacheKey: "key2"})
+		assert.Equal(t, context.DeadlineExceeded, err, "the fetch should not outlast the ctx")
+		assert.Equal(t, context.DeadlineExceeded, nodes[0].SendToNodeCtx(ctx, "node1", &model.CacheRelayMessage{CacheName: "users", CacheKey: "key2"}))
+	})
+
+	t.Run("Drop", func(t *testing.T) {
+		reset()
+		bus.SetDropRate(0.5)
+		defer bus.SetDropRate(0)
+		for i := 0; i < 200; i++ {
+			nodes[0].SendToNode("node1", &model.CacheRelayMessage{CacheName: "users", CacheKey: fmt.Sprintf("key%d", i)})
+		}
+		bus.Settle()
+		received := len(listeners[1].keys())
+		assert.Greater(t, received, 50)
+		assert.Less(t, received, 150)
+	})
+
+	t.Run("Reorder", func(t *testing.T) {
+		reset()
+		bus.SetReorderRate(0.3, 20*time.Millisecond)
+		defer bus.SetReorderRate(0, 0)
+		sent := make([]string, 0, 20)
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("key%d", i)
+			sent = append(sent, key)
+			nodes[0].SendToNode("node1", &model.CacheRelayMessage{CacheName: "users", CacheKey: key})
+		}
+		bus.Settle()
+		assert.ElementsMatch(t, sent, listeners[1].keys())
+		assert.NotEqual(t, sent, listeners[1].keys(), "some messages should be overtaken")
+	})
+
+	t.Run("Partition", func(t *testing.T) {
+		reset()
+		var lock sync.Mutex
+		var seen []string
+		nodes[2].RegisterMembershipListener(func(members []string) {
+			lock.Lock()
+			seen = members
+			lock.Unlock()
+		})
+		bus.Partition([]string{"node2"})
+		lock.Lock()
+		assert.Equal(t, []string{"node2"}, seen)
+		lock.Unlock()
+		assert.Equal(t, []string{"node0", "node1"}, nodes[0].Members())
+
+		nodes[0].ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key3"})
+		assert.Equal(t, ErrUnreachable, nodes[0].SendToNode("node2", &model.CacheRelayMessage{CacheName: "users", CacheKey: "key4"}))
+		_, err := nodes[2].FetchFromNode("node0", &model.CacheRelayMessage{CacheName: "users", CacheKey: "key3"})
+		assert.Equal(t, ErrUnreachable, err)
+		bus.Settle()
+		assert.Equal(t, []string{"key3"}, listeners[1].keys())
+		assert.Empty(t, listeners[2].keys())
+
+		bus.Heal()
+		lock.Lock()
+		assert.Equal(t, []string{"node0", "node1", "node2"}, seen)
+		lock.Unlock()
+		nodes[1].RegisterFetchHandler(func(message *model.CacheRelayMessage) *model.CacheRelayMessage {
+			assert.Equal(t, "node2", message.NodeID)
+			return &model.CacheRelayMessage{CacheName: message.CacheName, CacheKey: message.CacheKey, CacheValue: "InYi"}
+		})
+		answer, err := nodes[2].FetchFromNode("node1", &model.CacheRelayMessage{CacheName: "users", CacheKey: "key3"})
+		if assert.Nil(t, err) {
+			assert.Equal(t, "InYi", answer.CacheValue)
+		}
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		bus.SetLatency(time.Hour, 0)
+		defer bus.SetLatency(0, 0)
+		nodes[0].SendToNode("node2", &model.CacheRelayMessage{CacheName: "users", CacheKey: "key5"})
+		nodes[2].Close(context.Background())
+		bus.Settle()
+		assert.Equal(t, []string{"node0", "node1"}, nodes[0].Members())
+		assert.Equal(t, ErrUnreachable, nodes[0].SendToNode("node2", &model.CacheRelayMessage{CacheName: "users", CacheKey: "key6"}))
+
+		nodes[1].SendToNode("node0", &model.CacheRelayMessage{CacheName: "users", CacheKey: "key7"})
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, nodes[1].Close(ctx), "a message still in flight")
+		assert.Nil(t, nodes[1].Close(ctx), "closing again is harmless")
+		assert.Equal(t, ErrClosed, nodes[1].SendToNode("node0", &model.CacheRelayMessage{CacheName: "users", CacheKey: "key8"}))
+		_, err := nodes[1].FetchFromNode("node0", &model.CacheRelayMessage{CacheName: "users", CacheKey: "key8"})
+		assert.Equal(t, ErrClosed, err)
+	})
+}
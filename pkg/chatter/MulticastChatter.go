@@ -0,0 +1,535 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package chatter
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/theotw/chatty-cache/pkg/logging"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"golang.org/x/net/ipv4"
+	"net"
+	"sync"
+	"time"
+)
+
+// MulticastGroupEnvVar the multicast group:port the nodes share
+const MulticastGroupEnvVar = "CHATTY_MULTICAST_GROUP"
+
+// MulticastInterfaceEnvVar the name of the network interface to multicast on, the system picks one if not set
+const MulticastInterfaceEnvVar = "CHATTY_MULTICAST_INTERFACE"
+
+// MulticastHeartbeatEnvVar how often a node that has sent something says what its last sequence number was and
+// re-sends invalidations for its latest messages
+const MulticastHeartbeatEnvVar = "CHATTY_MULTICAST_HEARTBEAT"
+
+const MulticastGroupDefault = "239.255.42.99:30224"
+const MulticastHeartbeatDefault = "1s"
+
+// MulticastDatagramSize the biggest datagram sent, under a 1500 byte ethernet MTU once the IP and UDP headers are on
+const MulticastDatagramSize = 1400
+
+// MulticastRecentNotices how many of its latest messages a heartbeat carries an invalidation for, a gap longer than
+// this cannot be covered
+const MulticastRecentNotices = 32
+
+// multicastNoticeHeartbeats how many heartbeats an invalidation is repeated on, after that the message is old news
+const multicastNoticeHeartbeats = 3
+
+// maxMulticastMissing how many missed messages are tracked per sender, a bigger gap flushes what is replicated
+const maxMulticastMissing = 1024
+
+// maxMulticastMessage the biggest message that will be fragmented and sent
+const maxMulticastMessage = 8 * 1024 * 1024
+
+// multicastReassemblyTimeout how long the fragments of a frame are waited on before it is given up on
+const multicastReassemblyTimeout = 2 * time.Second
+
+// multicastMagic starts every datagram
+const multicastMagic = "CM"
+const multicastVersion = 1
+
+// datagram header: magic, version, sender ID, frame ID, fragment index, fragment count
+const multicastHeaderSize = len(multicastMagic) + 1 + 16 + 8 + 2 + 2
+
+// multicastFrame what goes out, fragmented when it is bigger than a datagram.  Seq numbers the messages of a sender,
+// 0 on a heartbeat.  A heartbeat's Notices hold invalidations for the sender's latest messages so a receiver that
+// missed some can drop what it may have got wrong
+type multicastFrame struct {
+	Seq      uint64             `json:"seq,omitempty"`
+	LastSeq  uint64             `json:"lastSeq"`
+	Envelope []byte             `json:"env,omitempty"`
+	Notices  []*multicastNotice `json:"notices,omitempty"`
+}
+
+// multicastNotice the invalidation envelope for message Seq
+type multicastNotice struct {
+	Seq      uint64 `json:"seq"`
+	Envelope []byte `json:"env"`
+	sent     time.Time
+}
+
+// multicastSender what a receiver tracks per sender
+type multicastSender struct {
+	// nodeID the sender's ID in the form the envelopes carry it
+	nodeID string
+	// next the seq expected next, 0 until the first frame from the sender
+	next uint64
+	// missing the seqs skipped over, waiting on a heartbeat to invalidate them
+	missing map[uint64]bool
+	partial map[uint64]*multicastPartial
+}
+
+type multicastPartial struct {
+	fragments [][]byte
+	received  int
+	started   time.Time
+}
+
+// MulticastChatterRelay replicates with UDP multicast, for a LAN with nothing else to lean on.  Messages bigger than a
+// datagram are fragmented.  Every message has a sequence number and the heartbeats carry invalidations for the sender's
+// latest messages, so when a receiver sees a gap it invalidates the keys it missed at the next heartbeat rather than
+// keep stale values.  A gap the heartbeats do not cover has the listener flush everything replicated, see
+// model.RelayFlush.  The invalidations are encrypted like the messages themselves
+type MulticastChatterRelay struct {
+	logging.Holder
+
+	group      *net.UDPAddr
+	iface      *net.Interface
+	heartbeat  time.Duration
+	recvConn   *net.UDPConn
+	sendConn   *net.UDPConn
+	nodeID     string
+	senderID   [16]byte
+	codec      *envelopeCodec
+	listenLock sync.RWMutex
+	// objectListener guarded by listenLock
+	objectListener ObjectListener
+	// drop lets the tests lose datagrams, guarded by listenLock
+	drop func(datagram []byte) bool
+
+	sendLock sync.Mutex
+	seq      uint64
+	frameID  uint64
+	recent   []*multicastNotice
+	// sendErr the error of the last datagram sent, nil when it went out.  Guarded by sendLock
+	sendErr error
+
+	// senders only touched by the receive loop
+	senders map[[16]byte]*multicastSender
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewMulticastChatterRelay joins the multicast group
+func NewMulticastChatterRelay() (*MulticastChatterRelay, error) {
+	ret := new(MulticastChatterRelay)
+	group, err := net.ResolveUDPAddr("udp4", model.GetEnvVarWithDefault(MulticastGroupEnvVar, MulticastGroupDefault))
+	if err != nil {
+		return nil, err
+	}
+	if !group.IP.IsMulticast() {
+		return nil, fmt.Errorf("%s is not a multicast address", group)
+	}
+	ret.group = group
+	if name := model.GetEnvVarWithDefault(MulticastInterfaceEnvVar, ""); len(name) > 0 {
+		ret.iface, err = net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ret.heartbeat, err = time.ParseDuration(model.GetEnvVarWithDefault(MulticastHeartbeatEnvVar, MulticastHeartbeatDefault))
+	if err != nil || ret.heartbeat <= 0 {
+		return nil, fmt.Errorf("bad %s: %v", MulticastHeartbeatEnvVar, err)
+	}
+	id := uuid.New()
+	ret.nodeID = id.String()
+	ret.senderID = id
+	ret.codec = &envelopeCodec{nodeID: ret.nodeID, masterPassPhrase: model.GetEnvVarWithDefault(MasterPassPhraseEnvVar, "")}
+	// anyone on the LAN can send to the group, only a loopback interface keeps it to this host
+	loopback := ret.iface != nil && ret.iface.Flags&net.FlagLoopback != 0
+	if !loopback && len(ret.codec.masterPassPhrase) == 0 {
+		return nil, fmt.Errorf("refusing to join %s without %s, any host on the network could write to the cache", group, MasterPassPhraseEnvVar)
+	}
+	ret.senders = make(map[[16]byte]*multicastSender)
+	ret.closed = make(chan struct{})
+	err = ret.init()
+	return ret, err
+}
+
+func (t *MulticastChatterRelay) init() error {
+	var err error
+	t.recvConn, err = net.ListenMulticastUDP("udp4", t.iface, t.group)
+	if err != nil {
+		t.Logger().WithError(err).Errorf("Unable to join multicast group %s", t.group)
+		return err
+	}
+	t.sendConn, err = net.ListenUDP("udp4", nil)
+	if err != nil {
+		t.recvConn.Close()
+		return err
+	}
+	packetConn := ipv4.NewPacketConn(t.sendConn)
+	if t.iface != nil {
+		err = packetConn.SetMulticastInterface(t.iface)
+		if err != nil {
+			t.recvConn.Close()
+			t.sendConn.Close()
+			return err
+		}
+	}
+	// other nodes on this host have to hear us too
+	err = packetConn.SetMulticastLoopback(true)
+	if err != nil {
+		t.Logger().WithError(err).Debugf("Unable to turn on multicast loopback")
+	}
+	go t.receive()
+	go t.heartbeatLoop()
+	return nil
+}
+
+// NodeID the ID of this node
+func (t *MulticastChatterRelay) NodeID() string {
+	return t.nodeID
+}
+
+func (t *MulticastChatterRelay) RegisterListenerForReplicatedObjects(listener ObjectListener) {
+	t.listenLock.Lock()
+	t.objectListener = listener
+	t.listenLock.Unlock()
+}
+
+// ReplicateCachedObject multicasts the message and keeps its invalidation for the heartbeats
+func (t *MulticastChatterRelay) ReplicateCachedObject(message *model.CacheRelayMessage) {
+	bits, err := t.codec.encode(message)
+	if err != nil {
+		t.Logger().WithError(err).Errorf("Unable to encode a replication message")
+		return
+	}
+	if len(bits) > maxMulticastMessage {
+		t.Logger().Errorf("Cache sync %s %s is too big to multicast, dropping it", message.CacheName, message.CacheKey)
+		return
+	}
+	notice := bits
+	if message.Action == model.RelayPut {
+		invalidate := *message
+		invalidate.CacheValue = ""
+		invalidate.Action = model.RelayInvalidate
+		notice, err = t.codec.encode(&invalidate)
+		if err != nil {
+			t.Logger().WithError(err).Errorf("Unable to encode a replication message")
+			return
+		}
+	}
+
+	t.sendLock.Lock()
+	defer t.sendLock.Unlock()
+	if t.isClosed() {
+		t.PerMessage().Debugf("Relay closed, dropping cache sync %s %s", message.CacheName, message.CacheKey)
+		return
+	}
+	t.seq++
+	t.sendFrameLocked(&multicastFrame{Seq: t.seq, LastSeq: t.seq, Envelope: bits})
+	t.recent = append(t.recent, &multicastNotice{Seq: t.seq, Envelope: notice, sent: time.Now()})
+	if len(t.recent) > MulticastRecentNotices {
+		t.recent = t.recent[1:]
+	}
+}
+
+// Close sends a last heartbeat so a lost final message is still noticed, then leaves the group.  Sends never wait on
+// the others so ctx is not needed
+func (t *MulticastChatterRelay) Close(ctx context.Context) error {
+	var err error
+	t.closeOnce.Do(func() {
+		t.sendLock.Lock()
+		close(t.closed)
+		if t.seq > 0 {
+			t.sendFrameLocked(&multicastFrame{LastSeq: t.seq, Notices: t.recent})
+		}
+		t.sendLock.Unlock()
+		err = t.recvConn.Close()
+		t.sendConn.Close()
+	})
+	return err
+}
+
+// ReplicationStats counts of the envelopes sent and received so far
+func (t *MulticastChatterRelay) ReplicationStats() ReplicationStats {
+	return t.codec.replicationStats()
+}
+
+// Status CONNECTED unless the last datagram could not be sent
+func (t *MulticastChatterRelay) Status() string {
+	if t.isClosed() {
+		return StatusClosed
+	}
+	t.sendLock.Lock()
+	failing := t.sendErr != nil
+	t.sendLock.Unlock()
+	if failing {
+		return StatusDisconnected
+	}
+	return StatusConnected
+}
+
+// Connected whether datagrams are going out to the group
+func (t *MulticastChatterRelay) Connected() bool {
+	return t.Status() == StatusConnected
+}
+
+func (t *MulticastChatterRelay) isClosed() bool {
+	select {
+	case <-t.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *MulticastChatterRelay) heartbeatLoop() {
+	ticker := time.NewTicker(t.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.closed:
+			return
+		case <-ticker.C:
+		}
+		t.sendLock.Lock()
+		if t.seq > 0 {
+			// an idle node only repeats its sequence number
+			cutoff := time.Now().Add(-multicastNoticeHeartbeats * t.heartbeat)
+			notices := t.recent
+			for len(notices) > 0 && notices[0].sent.Before(cutoff) {
+				notices = notices[1:]
+			}
+			t.sendFrameLocked(&multicastFrame{LastSeq: t.seq, Notices: notices})
+		}
+		t.sendLock.Unlock()
+	}
+}
+
+// sendFrameLocked fragments and sends the frame, caller holds sendLock
+func (t *MulticastChatterRelay) sendFrameLocked(frame *multicastFrame) {
+	bits, err := json.Marshal(frame)
+	if err != nil {
+		t.Logger().WithError(err).Errorf("Unable to encode a multicast frame")
+		return
+	}
+	t.frameID++
+	fragments := fragment(bits, MulticastDatagramSize-multicastHeaderSize)
+	for i, f := range fragments {
+		datagram := make([]byte, multicastHeaderSize, MulticastDatagramSize)
+		header := datagram[copy(datagram, multicastMagic):]
+		header[0] = multicastVersion
+		copy(header[1:], t.senderID[:])
+		binary.BigEndian.PutUint64(header[17:], t.frameID)
+		binary.BigEndian.PutUint16(header[25:], uint16(i))
+		binary.BigEndian.PutUint16(header[27:], uint16(len(fragments)))
+		datagram = append(datagram, f...)
+		_, err = t.sendConn.WriteToUDP(datagram, t.group)
+		t.sendErr = err
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			t.Logger().WithError(err).Debugf("Unable to multicast a datagram")
+			return
+		}
+	}
+}
+
+// fragment splits bits into pieces of up to size bytes, always at least one
+func fragment(bits []byte, size int) [][]byte {
+	ret := make([][]byte, 0, len(bits)/size+1)
+	for len(bits) >= size {
+		ret = append(ret, bits[:size])
+		bits = bits[size:]
+	}
+	return append(ret, bits)
+}
+
+func (t *MulticastChatterRelay) receive() {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := t.recvConn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-t.closed:
+				return
+			default:
+			}
+			t.Logger().WithError(err).Debugf("Error reading multicast")
+			continue
+		}
+		t.listenLock.RLock()
+		drop := t.drop
+		t.listenLock.RUnlock()
+		if drop != nil && drop(buf[:n]) {
+			continue
+		}
+		frame := t.reassemble(buf[:n])
+		if frame != nil {
+			t.handleFrame(frame)
+		}
+	}
+}
+
+// reassemble adds the datagram to its frame, returning the frame once every fragment is in
+func (t *MulticastChatterRelay) reassemble(datagram []byte) *senderFrame {
+	if len(datagram) < multicastHeaderSize || string(datagram[:len(multicastMagic)]) != multicastMagic ||
+		datagram[len(multicastMagic)] != multicastVersion {
+		t.PerMessage().Debugf("Dropping a datagram that is not ours")
+		return nil
+	}
+	header := datagram[len(multicastMagic)+1 : multicastHeaderSize]
+	var senderID [16]byte
+	copy(senderID[:], header[:16])
+	if senderID == t.senderID {
+		return nil
+	}
+	frameID := binary.BigEndian.Uint64(header[16:24])
+	index := int(binary.BigEndian.Uint16(header[24:26]))
+	count := int(binary.BigEndian.Uint16(header[26:28]))
+	if index >= count {
+		return nil
+	}
+	sender, ok := t.senders[senderID]
+	if !ok {
+		sender = &multicastSender{nodeID: uuid.UUID(senderID).String(), missing: make(map[uint64]bool), partial: make(map[uint64]*multicastPartial)}
+		t.senders[senderID] = sender
+	}
+	payload := append([]byte(nil), datagram[multicastHeaderSize:]...)
+	var bits []byte
+	if count == 1 {
+		bits = payload
+	} else {
+		partial, ok := sender.partial[frameID]
+		if !ok {
+			// a good time to give up on frames that are never going to complete
+			for id, p := range sender.partial {
+				if time.Since(p.started) > multicastReassemblyTimeout {
+					delete(sender.partial, id)
+				}
+			}
+			partial = &multicastPartial{fragments: make([][]byte, count), started: time.Now()}
+			sender.partial[frameID] = partial
+		}
+		if len(partial.fragments) != count || partial.fragments[index] != nil {
+			return nil
+		}
+		partial.fragments[index] = payload
+		partial.received++
+		if partial.received < count {
+			return nil
+		}
+		delete(sender.partial, frameID)
+		for _, f := range partial.fragments {
+			bits = append(bits, f...)
+		}
+	}
+	frame := new(multicastFrame)
+	err := json.Unmarshal(bits, frame)
+	if err != nil {
+		t.Logger().WithError(err).Debugf("Dropping a bad multicast frame")
+		return nil
+	}
+	return &senderFrame{sender: sender, frame: frame}
+}
+
+type senderFrame struct {
+	sender *multicastSender
+	frame  *multicastFrame
+}
+
+// handleFrame applies a message and notes any gap before it, a heartbeat invalidates what was missed
+func (t *MulticastChatterRelay) handleFrame(sf *senderFrame) {
+	sender, frame := sf.sender, sf.frame
+	if sender.next == 0 {
+		// first we have heard from it, nothing before this counts as missed
+		sender.next = frame.LastSeq
+		if frame.Seq == 0 {
+			sender.next++
+		}
+	}
+	if frame.Seq > 0 {
+		if frame.Seq < sender.next {
+			if !sender.missing[frame.Seq] {
+				return
+			}
+			// late rather than lost
+			delete(sender.missing, frame.Seq)
+		} else {
+			t.noteMissing(sender, frame.Seq)
+			sender.next = frame.Seq + 1
+		}
+		t.apply(frame.Envelope)
+		return
+	}
+	t.noteMissing(sender, frame.LastSeq+1)
+	for _, notice := range frame.Notices {
+		if sender.missing[notice.Seq] {
+			t.apply(notice.Envelope)
+			delete(sender.missing, notice.Seq)
+		}
+	}
+	if len(sender.missing) > 0 {
+		t.lost(sender, uint64(len(sender.missing)))
+	}
+}
+
+// noteMissing marks the seqs from the one expected up to before next as missing
+func (t *MulticastChatterRelay) noteMissing(sender *multicastSender, next uint64) {
+	if next <= sender.next {
+		return
+	}
+	if next-sender.next > maxMulticastMissing {
+		t.lost(sender, next-sender.next)
+		sender.next = next
+		return
+	}
+	for seq := sender.next; seq < next; seq++ {
+		sender.missing[seq] = true
+	}
+	sender.next = next
+}
+
+// lost the messages missed from sender cannot be invalidated one by one, so the listener is told to flush everything
+// that is replicated rather than keep what may be stale
+func (t *MulticastChatterRelay) lost(sender *multicastSender, count uint64) {
+	t.Logger().Warnf("Lost %d multicast messages from %s that could not be invalidated, flushing", count, sender.nodeID)
+	sender.missing = make(map[uint64]bool)
+	t.listenLock.RLock()
+	listener := t.objectListener
+	t.listenLock.RUnlock()
+	if listener == nil {
+		return
+	}
+	err := listener(&model.CacheRelayMessage{Action: model.RelayFlush, NodeID: sender.nodeID})
+	if err != nil {
+		t.Logger().WithError(err).Errorf("Unable to flush after losing messages from %s", sender.nodeID)
+	}
+}
+
+func (t *MulticastChatterRelay) apply(envelope []byte) {
+	relayMsg, nodeID, err := t.codec.decode(envelope)
+	if err != nil {
+		t.Logger().WithError(err).Errorf("Error decoding a multicast cache sync message")
+		return
+	}
+	t.listenLock.RLock()
+	listener := t.objectListener
+	t.listenLock.RUnlock()
+	if nodeID == t.nodeID || listener == nil {
+		return
+	}
+	t.PerMessage().Tracef("Recieved Cache Sync %s %s", relayMsg.CacheName, relayMsg.CacheKey)
+	err = listener(relayMsg)
+	if err != nil {
+		t.Logger().WithError(err).Debugf("Unable to apply cache sync %s %s", relayMsg.CacheName, relayMsg.CacheKey)
+	}
+}
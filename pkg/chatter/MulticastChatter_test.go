@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package chatter
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMulticastChatter(t *testing.T) {
+	t.Setenv(MasterPassPhraseEnvVar, "bob")
+	t.Setenv(MulticastGroupEnvVar, "239.255.42.98:30225")
+	t.Setenv(MulticastInterfaceEnvVar, "lo")
+	t.Setenv(MulticastHeartbeatEnvVar, "100ms")
+
+	relayA, err := NewMulticastChatterRelay()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer relayA.Close(context.Background())
+	relayB, err := NewMulticastChatterRelay()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer relayB.Close(context.Background())
+	listenerA := new(collectingListener)
+	relayA.RegisterListenerForReplicatedObjects(listenerA.listen)
+	listenerB := new(collectingListener)
+	relayB.RegisterListenerForReplicatedObjects(listenerB.listen)
+
+	var dropping, dropped int32
+	relayB.listenLock.Lock()
+	relayB.drop = func(datagram []byte) bool {
+		switch atomic.LoadInt32(&dropping) {
+		case 1:
+			atomic.AddInt32(&dropped, 1)
+			return true
+		case 2:
+			// only the second fragment of a fragmented frame
+			return binary.BigEndian.Uint16(datagram[multicastHeaderSize-4:]) == 1
+		}
+		return false
+	}
+	relayB.listenLock.Unlock()
+
+	received := func(count int) func() bool {
+		return func() bool {
+			return len(listenerB.keys()) == count
+		}
+	}
+	last := func(n int) []*model.CacheRelayMessage {
+		listenerB.lock.Lock()
+		defer listenerB.lock.Unlock()
+		return append([]*model.CacheRelayMessage(nil), listenerB.received[len(listenerB.received)-n:]...)
+	}
+
+	relayA.ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key1", CacheValue: "InYi"})
+	assert.Eventually(t, received(1), 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, model.RelayPut, last(1)[0].Action)
+	assert.Equal(t, "InYi", last(1)[0].CacheValue)
+	assert.Empty(t, listenerA.keys(), "our own message is not delivered to us")
+
+	t.Run("Fragmented", func(t *testing.T) {
+		value := strings.Repeat("x", 10*MulticastDatagramSize)
+		relayA.ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "big", CacheValue: value})
+		assert.Eventually(t, received(2), 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, value, last(1)[0].CacheValue)
+	})
+
+	t.Run("Lost message", func(t *testing.T) {
+		atomic.StoreInt32(&dropping, 1)
+		relayA.ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key2", CacheValue: "InYi"})
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&dropping, 0)
+		relayA.ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key3", CacheValue: "InYi"})
+		assert.Eventually(t, received(4), 5*time.Second, 10*time.Millisecond)
+		assert.ElementsMatch(t, []string{"key2", "key3"}, []string{last(2)[0].CacheKey, last(2)[1].CacheKey})
+		for _, m := range last(2) {
+			if m.CacheKey == "key2" {
+				assert.Equal(t, model.RelayInvalidate, m.Action, "a lost put becomes an invalidation")
+				assert.Empty(t, m.CacheValue)
+			} else {
+				assert.Equal(t, model.RelayPut, m.Action)
+			}
+		}
+	})
+
+	t.Run("Lost last message", func(t *testing.T) {
+		atomic.StoreInt32(&dropping, 1)
+		relayA.ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key4", CacheValue: "InYi"})
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&dropping, 0)
+		assert.Eventually(t, received(5), 5*time.Second, 10*time.Millisecond, "the heartbeat should show the gap")
+		assert.Equal(t, "key4", last(1)[0].CacheKey)
+		assert.Equal(t, model.RelayInvalidate, last(1)[0].Action)
+	})
+
+	t.Run("Lost fragment", func(t *testing.T) {
+		atomic.StoreInt32(&dropping, 2)
+		relayA.ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key5", CacheValue: strings.Repeat("x", 10*MulticastDatagramSize)})
+		assert.Eventually(t, received(6), 5*time.Second, 10*time.Millisecond)
+		atomic.StoreInt32(&dropping, 0)
+		assert.Equal(t, "key5", last(1)[0].CacheKey)
+		assert.Equal(t, model.RelayInvalidate, last(1)[0].Action)
+	})
+
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 6, len(listenerB.keys()), "heartbeats should not repeat what was applied")
+
+	t.Run("Lost more than the heartbeat covers", func(t *testing.T) {
+		atomic.StoreInt32(&dropped, 0)
+		atomic.StoreInt32(&dropping, 1)
+		count := MulticastRecentNotices + 8
+		for i := 0; i < count; i++ {
+			relayA.ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "lost", CacheValue: "InYi"})
+		}
+		// the receive loop may not have read them all yet
+		assert.Eventually(t, func() bool {
+			return atomic.LoadInt32(&dropped) >= int32(count)
+		}, 5*time.Second, 10*time.Millisecond)
+		atomic.StoreInt32(&dropping, 0)
+		flushed := func() *model.CacheRelayMessage {
+			listenerB.lock.Lock()
+			defer listenerB.lock.Unlock()
+			for _, m := range listenerB.received {
+				if m.Action == model.RelayFlush {
+					return m
+				}
+			}
+			return nil
+		}
+		assert.Eventually(t, func() bool {
+			return flushed() != nil
+		}, 5*time.Second, 10*time.Millisecond, "a gap that cannot be invalidated key by key flushes")
+		if flush := flushed(); flush != nil {
+			assert.Equal(t, relayA.nodeID, flush.NodeID, "the flush says who was lost")
+		}
+	})
+}
+
+func TestMulticastExposed(t *testing.T) {
+	t.Setenv(MasterPassPhraseEnvVar, "")
+	t.Setenv(MulticastGroupEnvVar, "239.255.42.98:30226")
+	t.Setenv(MulticastInterfaceEnvVar, "")
+	_, err := NewMulticastChatterRelay()
+	assert.NotNil(t, err, "a group the network can send to needs a pass phrase")
+
+	t.Setenv(MulticastInterfaceEnvVar, "lo")
+	relay, err := NewMulticastChatterRelay()
+	if assert.Nil(t, err, "the loopback interface stays on this host") {
+		assert.True(t, relay.Connected())
+		relay.Close(context.Background())
+		assert.Equal(t, StatusClosed, relay.Status())
+	}
+}
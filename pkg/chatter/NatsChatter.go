@@ -5,223 +5,685 @@
 package chatter
 
 import (
-	"encoding/base64"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/google/uuid"
+	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
-	log "github.com/sirupsen/logrus"
+	"github.com/theotw/chatty-cache/pkg/logging"
 	"github.com/theotw/chatty-cache/pkg/model"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
 )
 
 const MessageReplicateChannelEnvVar = "CHATTY_NATS_SUBJECT"
 const NatsURLEnvVar = "NATS_SERVER"
 const MasterPassPhraseEnvVar = "CHATTY_PASSPHRASE"
+const MemberSubjectEnvVar = "CHATTY_NATS_MEMBER_SUBJECT"
+const NodeSubjectEnvVar = "CHATTY_NATS_NODE_SUBJECT"
+
+// TenantSubjectEnvVar prefix for tenant traffic, each tenant cache name is published on <prefix>.<tenantID>.<cacheName>
+const TenantSubjectEnvVar = "CHATTY_NATS_TENANT_SUBJECT"
+
+// TenantsEnvVar comma separated tenant IDs this node listens to, * for all of them which is the default
+const TenantsEnvVar = "CHATTY_TENANTS"
+
+// LegacySubjectEnvVar true also publishes untenanted replication on the bare subject, for nodes from before per cache
+// name subjects while a rolling upgrade has some left
+const LegacySubjectEnvVar = "CHATTY_NATS_LEGACY_SUBJECT"
+
+// LegacyCopyHeader marks the copy published on the bare subject, nodes that got it on its cache name subject drop it
+const LegacyCopyHeader = "Chatty-Legacy-Copy"
+
+// NamespacesEnvVar comma separated cache names (nats wildcards allowed) this node listens to, all of them if not set
+const NamespacesEnvVar = "CHATTY_NAMESPACES"
 const MessageReplicationSubject = "chatty.replicate"
+const MemberSubjectDefault = "chatty.members"
+const NodeSubjectDefault = "chatty.node"
+const TenantSubjectDefault = "chatty.tenant"
 const NatsServerURLDefault = "localhost:30221"
 
-type encryptedRelayMessage struct {
-	//MessageKey base 64 encoded message key
-	MessageKey string `json:"messageKey"`
-	//CipherData base64 encoded cipher data of the jsonified model.CacheRelayMessag
-	CipherData string `json:"cipherData"`
-}
+// AllNamespaces the wildcard that matches every cache name
+const AllNamespaces = ">"
+
+// HeartbeatInterval how often a node announces itself, a node is considered gone after 3 missed heartbeats
+const HeartbeatInterval = 2 * time.Second
+
+// FetchTimeout how long to wait on another node to answer a fetch
+const FetchTimeout = 2 * time.Second
+
 type NatMessagesChatterRelay struct {
-	nc               *nats.Conn
+	logging.Holder
+
+	nc *nats.Conn
+	// ownConn false when the connection was handed to us, it is left open on Close
+	ownConn bool
+	// server the embedded nats server, nil when connecting to an outside one
+	server *server.Server
+	config *NatsConfig
+	// replicateSubject is the prefix, each cache name is published on replicateSubject.<cacheName>
 	replicateSubject string
+	memberSubject    string
+	tenantSubject    string
+	nodeSubject      string
 	natsURL          string
 	objectListener   ObjectListener
 	//NodeID random UUID to self reference the node
 	nodeID           string
 	masterPassPhrase string
-}
+	codec            *envelopeCodec
+	namespaces       []string
+	tenants          []string
 
-type protocolVersion int
+	subscriptionLock sync.Mutex
+	subscriptions    map[string]*nats.Subscription
+	// fixedSubscriptions the ones made at start up that are not namespaces or tenants
+	fixedSubscriptions []*nats.Subscription
 
-const noEncryption0 = protocolVersion(0)
-const encryption0 = protocolVersion(1)
+	membershipOnce     sync.Once
+	membersLock        sync.Mutex
+	members            map[string]time.Time
+	membershipListener MembershipListener
+	fetchHandler       FetchHandler
 
-type replicateCacheMessage struct {
-	ProtocolVersion protocolVersion `json:"protocolVersion"`
-	MessageData     string          `json:"messageData"`
-	NodeID          string          `json:"nodeID"`
+	closeOnce sync.Once
+	closed    chan struct{}
 }
 
-func NewNatsMessageChatterRelay() (*NatMessagesChatterRelay, error) {
-	ret := new(NatMessagesChatterRelay)
+type memberHeartbeat struct {
+	NodeID  string `json:"nodeID"`
+	Leaving bool   `json:"leaving,omitempty"`
+}
 
-	ret.replicateSubject = model.GetEnvVarWithDefault(MessageReplicateChannelEnvVar, MessageReplicationSubject)
-	ret.natsURL = model.GetEnvVarWithDefault(NatsURLEnvVar, NatsServerURLDefault)
-	ret.masterPassPhrase = model.GetEnvVarWithDefault(MasterPassPhraseEnvVar, "")
-	u, uuidErr := uuid.NewUUID()
-	if uuidErr != nil {
-		log.WithError(uuidErr).Errorf("Unable to generate a node UUID.  Defaulting UUID 42")
-		ret.nodeID = "42"
-	} else {
-		ret.nodeID = u.String()
+// NewNatsMessageChatterRelay connects to nats configured by the environment, with opts applied on top
+func NewNatsMessageChatterRelay(opts ...NatsOption) (*NatMessagesChatterRelay, error) {
+	config := NatsConfigFromEnv()
+	for _, opt := range opts {
+		opt(config)
+	}
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+	ret := new(NatMessagesChatterRelay)
+	ret.SetLogger(config.Logger)
+	ret.config = config
+	ret.replicateSubject = config.ReplicateSubject
+	ret.memberSubject = config.MemberSubject
+	ret.nodeSubject = config.NodeSubject
+	ret.natsURL = strings.Join(config.URLs, ",")
+	ret.masterPassPhrase = config.MasterPassPhrase
+	ret.tenantSubject = config.TenantSubject
+	ret.namespaces = config.Namespaces
+	ret.tenants = config.Tenants
+	ret.subscriptions = make(map[string]*nats.Subscription)
+	ret.nodeID = config.NodeID
+	if len(ret.nodeID) == 0 {
+		u, uuidErr := uuid.NewUUID()
+		if uuidErr != nil {
+			ret.Logger().WithError(uuidErr).Errorf("Unable to generate a node UUID.  Defaulting UUID 42")
+			ret.nodeID = "42"
+		} else {
+			ret.nodeID = u.String()
+		}
+	}
+	ret.codec = &envelopeCodec{nodeID: ret.nodeID, masterPassPhrase: ret.masterPassPhrase}
+	ret.members = make(map[string]time.Time)
+	ret.closed = make(chan struct{})
+	if config.Embedded && config.Conn == nil {
+		ret.server, err = startEmbeddedNats(ret.Logger(), ret.nodeID, config)
+		if err != nil {
+			return nil, err
+		}
+		ret.natsURL = ret.server.ClientURL()
+	}
+	err = ret.init()
+	if err != nil && ret.server != nil {
+		ret.server.Shutdown()
 	}
-	err := ret.init()
 	return ret, err
 }
 
-func (t *NatMessagesChatterRelay) ReplicateCachedObject(message *model.CacheRelayMessage) {
-	if len(t.masterPassPhrase) == 0 {
-		t.sendReplicateMessageNoEncrypt0(message)
-	} else {
-		t.sendReplicateMessageEncrypt0(message)
+// Close tells the other nodes we are leaving and drains the connection, waiting no longer than ctx allows.  A shared
+// connection is only unsubscribed from.  The embedded server, if there is one, is stopped last
+func (t *NatMessagesChatterRelay) Close(ctx context.Context) error {
+	first := false
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		first = true
+	})
+	if !first {
+		return nil
+	}
+	var err error
+	if t.nc != nil && !t.nc.IsClosed() {
+		t.membersLock.Lock()
+		_, started := t.members[t.nodeID]
+		t.membersLock.Unlock()
+		if started {
+			bits, _ := json.Marshal(&memberHeartbeat{NodeID: t.nodeID, Leaving: true})
+			t.nc.Publish(t.memberSubject, bits)
+		}
+		if t.ownConn {
+			err = drainConn(ctx, t.nc)
+		} else {
+			t.unsubscribeAll()
+			err = flushConn(ctx, t.nc)
+		}
 	}
+	if t.server != nil {
+		t.server.Shutdown()
+	}
+	return err
 }
 
-func (t *NatMessagesChatterRelay) sendReplicateMessageNoEncrypt0(message *model.CacheRelayMessage) {
-	var syncMsg replicateCacheMessage
-	syncMsg.NodeID = t.nodeID
-	bits, err := json.Marshal(message)
-	if err != nil {
-		log.WithError(err).Errorf("Unable to encode a cache releay message")
-		return
+// ReplicationStats counts of the envelopes sent and received so far
+func (t *NatMessagesChatterRelay) ReplicationStats() ReplicationStats {
+	return t.codec.replicationStats()
+}
+
+// Status the state of the NATS connection
+func (t *NatMessagesChatterRelay) Status() string {
+	if t.nc == nil {
+		return nats.DISCONNECTED.String()
 	}
+	return t.nc.Status().String()
+}
 
-	syncMsg.MessageData = base64.StdEncoding.EncodeToString(bits)
-	syncMsg.ProtocolVersion = noEncryption0
-	bits, err = json.Marshal(&syncMsg)
-	if err != nil {
-		log.WithError(err).Errorf("Unable to encode a replication message")
-		return
+// Connected whether the NATS connection is up
+func (t *NatMessagesChatterRelay) Connected() bool {
+	return t.nc != nil && t.nc.IsConnected()
+}
+
+func (t *NatMessagesChatterRelay) isClosed() bool {
+	select {
+	case <-t.closed:
+		return true
+	default:
+		return false
 	}
+}
 
-	err = t.nc.Publish(t.replicateSubject, bits)
+// drainConn lets the subscriptions finish what they have, sends what is buffered and closes the connection.  When ctx
+// is done first the connection is closed there and then
+func drainConn(ctx context.Context, nc *nats.Conn) error {
+	err := nc.Drain()
 	if err != nil {
-		log.WithError(err).Error("Error publishing cache relay message to nats")
+		nc.Close()
+		return err
 	}
-	t.nc.Flush()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for !nc.IsClosed() {
+		select {
+		case <-ctx.Done():
+			nc.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
 }
-func (t *NatMessagesChatterRelay) sendReplicateMessageEncrypt0(message *model.CacheRelayMessage) {
-	var syncMsg replicateCacheMessage
-	syncMsg.NodeID = t.nodeID
-	bits, err := json.Marshal(message)
-	if err != nil {
-		log.WithError(err).Errorf("Unable to encode a cache releay message")
-		return
+
+// flushConn waits for the server to have everything sent so far, nats only takes a context with a deadline
+func flushConn(ctx context.Context, nc *nats.Conn) error {
+	if _, ok := ctx.Deadline(); ok {
+		return nc.FlushWithContext(ctx)
 	}
+	return nc.Flush()
+}
 
-	var cipherMessage encryptedRelayMessage
-	masterKey := makeAesKey(t.masterPassPhrase)
-	messageKeyPlainText := makeRandom256AesKey()
-	messageKeyCipherText, _ := DoAesCBCEncrypt(messageKeyPlainText, masterKey)
-	cipherMessage.MessageKey = base64.StdEncoding.EncodeToString(messageKeyCipherText)
-	messageCipherText, _ := DoAesCBCEncrypt(bits, messageKeyPlainText)
-	cipherMessage.CipherData = base64.StdEncoding.EncodeToString(messageCipherText)
-	bits, err = json.Marshal(cipherMessage)
-	if err != nil {
-		log.WithError(err).Errorf("Unable to encode a cipher cache releay message")
-		return
+func (t *NatMessagesChatterRelay) ReplicateCachedObject(message *model.CacheRelayMessage) {
+	err := t.ReplicateCachedObjectCtx(context.Background(), message)
+	if errors.Is(err, ErrClosed) {
+		t.PerMessage().Debugf("Relay closed, dropping cache sync %s %s", message.CacheName, message.CacheKey)
+	} else if err != nil {
+		t.Logger().WithError(err).Errorf("Error publishing cache relay message to nats")
 	}
+}
 
-	syncMsg.MessageData = base64.StdEncoding.EncodeToString(bits)
-	syncMsg.ProtocolVersion = encryption0
-	bits, err = json.Marshal(&syncMsg)
+// ReplicateCachedObjectCtx publishes the message and waits for the server to have it, no longer than ctx allows
+func (t *NatMessagesChatterRelay) ReplicateCachedObjectCtx(ctx context.Context, message *model.CacheRelayMessage) error {
+	if t.isClosed() {
+		return ErrClosed
+	}
+	bits, err := t.codec.encode(message)
 	if err != nil {
-		log.WithError(err).Errorf("Unable to encode a replication message")
-		return
+		return err
 	}
 
-	err = t.nc.Publish(t.replicateSubject, bits)
+	err = t.nc.Publish(t.config.SubjectForCache(message.TenantID, message.CacheName), bits)
 	if err != nil {
-		log.WithError(err).Error("Error publishing cache relay message to nats")
+		return err
 	}
-	t.nc.Flush()
+	// older nodes only listen on the bare subject and have no tenants
+	if t.config.LegacySubject && len(message.TenantID) == 0 {
+		legacy := nats.NewMsg(t.replicateSubject)
+		legacy.Header.Set(LegacyCopyHeader, "true")
+		legacy.Data = bits
+		err = t.nc.PublishMsg(legacy)
+		if err != nil {
+			return err
+		}
+	}
+	return flushConn(ctx, t.nc)
 }
+
 func (t *NatMessagesChatterRelay) RegisterListenerForReplicatedObjects(listener ObjectListener) {
 	t.objectListener = listener
 }
 func (t *NatMessagesChatterRelay) init() error {
+	var err error
+	t.nc = t.config.Conn
+	if t.nc == nil {
+		var opts []nats.Option
+		opts, err = t.config.connectOptions()
+		if err != nil {
+			return err
+		}
+		t.nc, err = nats.Connect(t.natsURL, opts...)
+		if err != nil {
+			t.Logger().WithError(err).Errorf("Unable to connect to nats %s", t.natsURL)
+			return err
+		}
+		t.ownConn = true
+	}
+	// nodes from before per cache name subjects publish everything on the bare subject
+	err = t.subscribeFixed(t.replicateSubject, t.handleLegacyCacheSync)
+	if err != nil {
+		return err
+	}
+	for _, ns := range t.namespaces {
+		err = t.SubscribeNamespace(ns)
+		if err != nil {
+			return err
+		}
+	}
+	for _, tenant := range t.tenants {
+		err = t.SubscribeTenant(tenant)
+		if err != nil {
+			return err
+		}
+	}
+	return t.subscribeFixed(t.subjectForNode(t.nodeID), t.handleDirectMessage)
+}
 
-	nc, err := nats.Connect(t.natsURL)
+// subscribeFixed subscribes for the life of the relay
+func (t *NatMessagesChatterRelay) subscribeFixed(subject string, handler nats.MsgHandler) error {
+	sub, err := t.nc.Subscribe(subject, handler)
 	if err != nil {
-		log.Error(err)
 		return err
 	}
-	t.nc = nc
-	t.nc.Subscribe(t.replicateSubject, func(msg *nats.Msg) {
+	t.subscriptionLock.Lock()
+	t.fixedSubscriptions = append(t.fixedSubscriptions, sub)
+	t.subscriptionLock.Unlock()
+	return nil
+}
+
+// unsubscribeAll drops every subscription, for a shared connection that stays open
+func (t *NatMessagesChatterRelay) unsubscribeAll() {
+	t.subscriptionLock.Lock()
+	defer t.subscriptionLock.Unlock()
+	for _, sub := range t.fixedSubscriptions {
+		sub.Unsubscribe()
+	}
+	t.fixedSubscriptions = nil
+	for k, sub := range t.subscriptions {
+		sub.Unsubscribe()
+		delete(t.subscriptions, k)
+	}
+}
+
+// SubjectForCache the subject replication for cacheName is published on.  Dots in the cache name become subject
+// levels so related caches (orders.eu, orders.us) can be picked up with one wildcard
+func (t *NatMessagesChatterRelay) SubjectForCache(cacheName string) string {
+	return t.config.SubjectForCache("", cacheName)
+}
+
+// SubjectForTenantCache the subject replication for a tenant's cacheName is published on
+func (t *NatMessagesChatterRelay) SubjectForTenantCache(tenantID string, cacheName string) string {
+	return t.config.SubjectForCache(tenantID, cacheName)
+}
+
+// SetTenantPassPhrase encrypts traffic for tenantID with its own pass phrase instead of the master one.
+// Once set, unencrypted messages for the tenant are refused
+func (t *NatMessagesChatterRelay) SetTenantPassPhrase(tenantID string, phrase string) {
+	t.codec.setTenantPassPhrase(tenantID, phrase)
+}
+
+// SubscribeTenant starts listening to all the cache names of tenantID, * listens to every tenant
+func (t *NatMessagesChatterRelay) SubscribeTenant(tenantID string) error {
+	return t.subscribe(t.tenantSubjectPattern(tenantID))
+}
+
+// UnsubscribeTenant stops listening to a tenant given to SubscribeTenant
+func (t *NatMessagesChatterRelay) UnsubscribeTenant(tenantID string) error {
+	return t.unsubscribe(t.tenantSubjectPattern(tenantID))
+}
+
+func (t *NatMessagesChatterRelay) tenantSubjectPattern(tenantID string) string {
+	if tenantID != "*" {
+		tenantID = subjectTokens(tenantID, false)
+	}
+	return t.tenantSubject + "." + tenantID + ".>"
+}
+
+// SubscribeNamespace starts listening to the cache names matching pattern, which may use the nats * and > wildcards.
+// Overlapping patterns deliver a message once per pattern, which is harmless but wasteful
+func (t *NatMessagesChatterRelay) SubscribeNamespace(pattern string) error {
+	return t.subscribe(t.replicateSubject + "." + subjectTokens(pattern, true))
+}
+
+// UnsubscribeNamespace stops listening to a pattern given to SubscribeNamespace
+func (t *NatMessagesChatterRelay) UnsubscribeNamespace(pattern string) error {
+	return t.unsubscribe(t.replicateSubject + "." + subjectTokens(pattern, true))
+}
+
+func (t *NatMessagesChatterRelay) subscribe(subject string) error {
+	t.subscriptionLock.Lock()
+	defer t.subscriptionLock.Unlock()
+	if _, ok := t.subscriptions[subject]; ok {
+		return nil
+	}
+	sub, err := t.nc.Subscribe(subject, func(msg *nats.Msg) {
 		t.handleCacheSync(msg)
 	})
-
+	if err != nil {
+		return err
+	}
+	t.subscriptions[subject] = sub
 	return nil
 }
 
-func (t *NatMessagesChatterRelay) handleCacheSync(msg *nats.Msg) {
-	var x replicateCacheMessage
-	err := json.Unmarshal(msg.Data, &x)
-	if err != nil {
-		log.WithError(err).Errorf("Error decoding a cache sync message")
+func (t *NatMessagesChatterRelay) unsubscribe(subject string) error {
+	t.subscriptionLock.Lock()
+	defer t.subscriptionLock.Unlock()
+	sub, ok := t.subscriptions[subject]
+	if !ok {
+		return nil
+	}
+	delete(t.subscriptions, subject)
+	return sub.Unsubscribe()
+}
+
+// subjectTokens makes a cache name safe to use as subject tokens, wildcards are only kept for subscribe patterns
+func subjectTokens(cacheName string, allowWildcards bool) string {
+	tokens := strings.Split(cacheName, ".")
+	for i, token := range tokens {
+		if allowWildcards && (token == "*" || (token == ">" && i == len(tokens)-1)) {
+			continue
+		}
+		token = strings.Map(func(r rune) rune {
+			if r == '*' || r == '>' || unicode.IsSpace(r) {
+				return '_'
+			}
+			return r
+		}, token)
+		if len(token) == 0 {
+			token = "_"
+		}
+		tokens[i] = token
+	}
+	return strings.Join(tokens, ".")
+}
+
+func splitNamespaces(list string) []string {
+	ret := make([]string, 0)
+	for _, ns := range strings.Split(list, ",") {
+		ns = strings.TrimSpace(ns)
+		if len(ns) > 0 {
+			ret = append(ret, ns)
+		}
+	}
+	return ret
+}
+
+// handleLegacyCacheSync what older nodes publish, the copies newer nodes make for them were already had on the cache
+// name subject
+func (t *NatMessagesChatterRelay) handleLegacyCacheSync(msg *nats.Msg) {
+	if msg.Header != nil && len(msg.Header.Get(LegacyCopyHeader)) > 0 {
 		return
 	}
-	if x.NodeID == t.nodeID {
-		log.Tracef("Recieved Message for my node %s, dropping it", t.nodeID)
+	t.handleCacheSync(msg)
+}
+
+func (t *NatMessagesChatterRelay) handleCacheSync(msg *nats.Msg) {
+	relayMsg, nodeID, err := t.codec.decode(msg.Data)
+	if nodeID == t.nodeID {
+		t.PerMessage().Tracef("Recieved Message for my node %s, dropping it", t.nodeID)
 		// recieved a message for this node, not point in storing it
 		return
 	}
-	switch x.ProtocolVersion {
-	case noEncryption0:
-		t.processUnencrypted(&x)
-		break
-	case encryption0:
-		t.processEncrypted0(&x)
-		break
-	default:
-		log.Errorf("Recieved a cache relay message with an unknown protocol version %d", x.ProtocolVersion)
+	if err != nil {
+		t.Logger().WithError(err).Errorf("Error decoding a cache sync message")
+		return
 	}
+	t.PerMessage().Tracef("Recieved Cache Sync %s %s", relayMsg.CacheName, relayMsg.CacheKey)
+	if t.objectListener != nil {
+		// core nats cannot redeliver, so all we can do is say so
+		err = t.objectListener(relayMsg)
+		if err != nil {
+			t.Logger().WithError(err).Debugf("Unable to apply cache sync %s %s", relayMsg.CacheName, relayMsg.CacheKey)
+		}
+	}
+}
+
+// NodeID the random ID of this node
+func (t *NatMessagesChatterRelay) NodeID() string {
+	return t.nodeID
+}
+
+// Members the node IDs that have sent a heartbeat recently, sorted, including this node
+func (t *NatMessagesChatterRelay) Members() []string {
+	t.startMembership()
+	t.membersLock.Lock()
+	ret := t.memberListLocked()
+	t.membersLock.Unlock()
+	return ret
+}
+
+// RegisterMembershipListener registers the listener and starts sending heartbeats if we are not already
+func (t *NatMessagesChatterRelay) RegisterMembershipListener(listener MembershipListener) {
+	t.membersLock.Lock()
+	t.membershipListener = listener
+	t.membersLock.Unlock()
+	t.startMembership()
 }
-func (t *NatMessagesChatterRelay) processUnencrypted(msg *replicateCacheMessage) {
-	var relayMsg model.CacheRelayMessage
-	bits, err := base64.StdEncoding.DecodeString(msg.MessageData)
+
+func (t *NatMessagesChatterRelay) RegisterFetchHandler(handler FetchHandler) {
+	t.fetchHandler = handler
+}
+
+// SendToNode publishes the message on the subject of a single node
+func (t *NatMessagesChatterRelay) SendToNode(nodeID string, message *model.CacheRelayMessage) error {
+	return t.SendToNodeCtx(context.Background(), nodeID, message)
+}
+
+// SendToNodeCtx publishes the message on the subject of a single node.  When ctx has a deadline it also waits, no
+// longer than that, for the server to have it
+func (t *NatMessagesChatterRelay) SendToNodeCtx(ctx context.Context, nodeID string, message *model.CacheRelayMessage) error {
+	if t.isClosed() {
+		return ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	bits, err := t.codec.encode(message)
 	if err != nil {
-		log.WithError(err).Errorf("Unable to base 64 decode message data ")
-		return
+		return err
 	}
-	err = json.Unmarshal(bits, &relayMsg)
+	err = t.nc.Publish(t.subjectForNode(nodeID), bits)
+	if _, ok := ctx.Deadline(); ok && err == nil {
+		err = t.nc.FlushWithContext(ctx)
+	}
+	return err
+}
+
+// FetchFromNode does a nats request against a single node, a nil message and nil error means the node does not have it
+func (t *NatMessagesChatterRelay) FetchFromNode(nodeID string, message *model.CacheRelayMessage) (*model.CacheRelayMessage, error) {
+	return t.FetchFromNodeCtx(context.Background(), nodeID, message)
+}
+
+// FetchFromNodeCtx is FetchFromNode waiting no longer than ctx allows, or FetchTimeout when that is sooner
+func (t *NatMessagesChatterRelay) FetchFromNodeCtx(ctx context.Context, nodeID string, message *model.CacheRelayMessage) (*model.CacheRelayMessage, error) {
+	if t.isClosed() {
+		return nil, ErrClosed
+	}
+	message.Action = model.RelayFetch
+	bits, err := t.codec.encode(message)
 	if err != nil {
-		log.WithError(err).Errorf("Unable to unmarshal message data ")
-		return
+		return nil, err
 	}
-	log.Tracef("Recieved Cache Sync %s %s", relayMsg.CacheName, relayMsg.CacheKey)
-	if t.objectListener != nil {
-		t.objectListener(&relayMsg)
+	ctx, cancel := context.WithTimeout(ctx, FetchTimeout)
+	defer cancel()
+	reply, err := t.nc.RequestWithContext(ctx, t.subjectForNode(nodeID), bits)
+	if err != nil {
+		return nil, err
 	}
+	if len(reply.Data) == 0 {
+		return nil, nil
+	}
+	ret, _, err := t.codec.decode(reply.Data)
+	return ret, err
 }
-func (t *NatMessagesChatterRelay) processEncrypted0(msg *replicateCacheMessage) {
-	var cipherMessage encryptedRelayMessage
-	cipherMessageBits, cbError := base64.StdEncoding.DecodeString(msg.MessageData)
-	if cbError != nil {
-		log.WithError(cbError).Errorf("Unable to base 64 decode cipher message data ")
+
+func (t *NatMessagesChatterRelay) subjectForNode(nodeID string) string {
+	return fmt.Sprintf("%s.%s", t.nodeSubject, nodeID)
+}
+
+func (t *NatMessagesChatterRelay) handleDirectMessage(msg *nats.Msg) {
+	relayMsg, nodeID, err := t.codec.decode(msg.Data)
+	if err != nil {
+		t.Logger().WithError(err).Errorf("Error decoding a direct message")
+		if len(msg.Reply) > 0 {
+			msg.Respond(nil)
+		}
 		return
 	}
-	json.Unmarshal(cipherMessageBits, &cipherMessage)
-	masterKey := makeAesKey(t.masterPassPhrase)
-	messageKeyCipherBits, cbError2 := base64.StdEncoding.DecodeString(cipherMessage.MessageKey)
-	if cbError2 != nil {
-		log.WithError(cbError).Errorf("Unable to base 64 decode messageKey")
+	if relayMsg.Action != model.RelayFetch {
+		t.PerMessage().Tracef("Recieved direct message from %s %s %s", nodeID, relayMsg.CacheName, relayMsg.CacheKey)
+		if t.objectListener != nil {
+			err = t.objectListener(relayMsg)
+			if err != nil {
+				t.Logger().WithError(err).Debugf("Unable to apply direct message %s %s", relayMsg.CacheName, relayMsg.CacheKey)
+			}
+		}
 		return
 	}
-	messageKey, _ := DoAesCBCDecrypt(messageKeyCipherBits, masterKey)
-	msgDataCipherBits, mdError := base64.StdEncoding.DecodeString(cipherMessage.CipherData)
-	if mdError != nil {
-		log.WithError(cbError).Errorf("Unable to base 64 decode message cipher data")
+	var answer *model.CacheRelayMessage
+	if t.fetchHandler != nil {
+		answer = t.fetchHandler(relayMsg)
+	}
+	if answer == nil {
+		msg.Respond(nil)
 		return
 	}
-	plainBits, mdDecrError := DoAesCBCDecrypt(msgDataCipherBits, messageKey)
-	if mdDecrError != nil {
-		log.WithError(cbError).Errorf("Unable to decypt message cipher data")
+	answer.Action = model.RelayPut
+	bits, err := t.codec.encode(answer)
+	if err != nil {
+		t.Logger().WithError(err).Errorf("Unable to encode a fetch answer")
+		msg.Respond(nil)
 		return
 	}
+	msg.Respond(bits)
+}
+
+func (t *NatMessagesChatterRelay) startMembership() {
+	t.membershipOnce.Do(func() {
+		t.membersLock.Lock()
+		t.members[t.nodeID] = time.Now()
+		t.membersLock.Unlock()
+		t.subscribeFixed(t.memberSubject, t.handleHeartbeat)
+		t.sendHeartbeat()
+		go t.heartbeatLoop()
+	})
+}
 
-	var relayMsg model.CacheRelayMessage
-	err := json.Unmarshal(plainBits, &relayMsg)
+func (t *NatMessagesChatterRelay) heartbeatLoop() {
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.closed:
+			return
+		case <-ticker.C:
+		}
+		if t.nc.IsClosed() {
+			return
+		}
+		t.sendHeartbeat()
+		t.expireMembers()
+	}
+}
+
+func (t *NatMessagesChatterRelay) sendHeartbeat() {
+	bits, _ := json.Marshal(&memberHeartbeat{NodeID: t.nodeID})
+	err := t.nc.Publish(t.memberSubject, bits)
+	if err != nil {
+		t.Logger().WithError(err).Errorf("Error publishing heartbeat to nats")
+	}
+}
+
+func (t *NatMessagesChatterRelay) handleHeartbeat(msg *nats.Msg) {
+	var hb memberHeartbeat
+	err := json.Unmarshal(msg.Data, &hb)
 	if err != nil {
-		log.WithError(err).Errorf("Unable to unmarshal message data ")
+		t.Logger().WithError(err).Errorf("Error decoding a heartbeat")
 		return
 	}
-	log.Tracef("Recieved Cache Sync %s %s", relayMsg.CacheName, relayMsg.CacheKey)
-	if t.objectListener != nil {
-		t.objectListener(&relayMsg)
+	if hb.NodeID == t.nodeID {
+		return
+	}
+	t.membersLock.Lock()
+	_, known := t.members[hb.NodeID]
+	if hb.Leaving {
+		delete(t.members, hb.NodeID)
+	} else {
+		t.members[hb.NodeID] = time.Now()
+	}
+	changed := known == hb.Leaving
+	listener, members := t.membershipListener, t.memberListLocked()
+	t.membersLock.Unlock()
+
+	if changed {
+		t.Logger().Debugf("Cluster membership changed, %d members", len(members))
+		if !known {
+			// let the new node know about us right away rather than on our next tick
+			t.sendHeartbeat()
+		}
+		if listener != nil {
+			listener(members)
+		}
+	}
+}
+
+func (t *NatMessagesChatterRelay) expireMembers() {
+	cutoff := time.Now().Add(-3 * HeartbeatInterval)
+	changed := false
+	t.membersLock.Lock()
+	for k, v := range t.members {
+		if k != t.nodeID && v.Before(cutoff) {
+			delete(t.members, k)
+			changed = true
+		}
+	}
+	listener, members := t.membershipListener, t.memberListLocked()
+	t.membersLock.Unlock()
+	if changed && listener != nil {
+		listener(members)
+	}
+}
+
+func (t *NatMessagesChatterRelay) memberListLocked() []string {
+	ret := make([]string, 0, len(t.members))
+	for k := range t.members {
+		ret = append(ret, k)
 	}
+	sort.Strings(ret)
+	return ret
 }
@@ -0,0 +1,249 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package chatter
+
+import (
+	"context"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/theotw/chatty-cache/pkg/logging"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"testing"
+	"time"
+)
+
+func TestSubjects(t *testing.T) {
+	relay := new(NatMessagesChatterRelay)
+	relay.config = DefaultNatsConfig()
+	relay.replicateSubject = MessageReplicationSubject
+	relay.tenantSubject = TenantSubjectDefault
+
+	assert.Equal(t, "chatty.replicate.users", relay.SubjectForCache("users"))
+	assert.Equal(t, "chatty.replicate.orders.eu", relay.SubjectForCache("orders.eu"), "dots are subject levels")
+	assert.Equal(t, "chatty.replicate.my_cache._", relay.SubjectForCache("my cache.*"), "no wildcards when publishing")
+	assert.Equal(t, "chatty.replicate._.x", relay.SubjectForCache(".x"), "no empty tokens")
+
+	assert.Equal(t, "orders.*", subjectTokens("orders.*", true))
+	assert.Equal(t, ">", subjectTokens(">", true))
+	assert.Equal(t, "_.x", subjectTokens(">.x", true), "> is only a wildcard at the end")
+
+	assert.Equal(t, "chatty.tenant.acme.users", relay.SubjectForTenantCache("acme", "users"))
+	assert.Equal(t, "chatty.tenant.acme.>", relay.tenantSubjectPattern("acme"))
+	assert.Equal(t, "chatty.tenant.*.>", relay.tenantSubjectPattern("*"))
+
+	assert.Equal(t, []string{"users", "orders.>"}, splitNamespaces(" users, ,orders.>"))
+}
+
+func TestEmbeddedNats(t *testing.T) {
+	t.Setenv(MasterPassPhraseEnvVar, "bob")
+	t.Setenv(NatsEmbeddedEnvVar, "true")
+	t.Setenv(NatsEmbeddedListenEnvVar, "127.0.0.1:-1")
+	t.Setenv(NatsClusterListenEnvVar, "127.0.0.1:-1")
+	t.Setenv(NatsURLEnvVar, "nats://127.0.0.1:1")
+
+	relayA, err := NewNatsMessageChatterRelay()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer relayA.Close(context.Background())
+	t.Setenv(NatsRoutesEnvVar, relayA.server.ClusterAddr().String())
+	relayB, err := NewNatsMessageChatterRelay()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer relayB.Close(context.Background())
+	assert.NotEqual(t, relayA.server.ClientURL(), relayB.server.ClientURL(), "each relay runs its own server")
+	assert.True(t, relayB.Connected())
+	listenerB := new(collectingListener)
+	relayB.RegisterListenerForReplicatedObjects(listenerB.listen)
+	relayB.Members()
+
+	assert.Eventually(t, func() bool {
+		return len(relayA.Members()) == 2
+	}, 10*time.Second, 20*time.Millisecond, "the servers should route to each other")
+	relayA.ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key1", CacheValue: "InYi"})
+	assert.Eventually(t, func() bool {
+		return len(listenerB.keys()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	relayB.RegisterFetchHandler(func(message *model.CacheRelayMessage) *model.CacheRelayMessage {
+		time.Sleep(200 * time.Millisecond)
+		return message
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = relayA.FetchFromNodeCtx(ctx, relayB.NodeID(), &model.CacheRelayMessage{CacheName: "users", CacheKey: "key1"})
+	assert.Equal(t, context.DeadlineExceeded, err, "the fetch should not outlast the ctx")
+	assert.Nil(t, relayA.ReplicateCachedObjectCtx(context.Background(), &model.CacheRelayMessage{CacheName: "users", CacheKey: "key2"}))
+	assert.Eventually(t, func() bool {
+		return len(listenerB.keys()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Nil(t, relayB.Close(context.Background()))
+	assert.Eventually(t, func() bool {
+		return len(relayA.Members()) == 1
+	}, 5*time.Second, 10*time.Millisecond, "a node that closes should say it is leaving")
+	assert.Equal(t, ErrClosed, relayB.SendToNode(relayA.NodeID(), &model.CacheRelayMessage{CacheName: "users", CacheKey: "key2"}))
+	_, err = relayB.FetchFromNode(relayA.NodeID(), &model.CacheRelayMessage{CacheName: "users", CacheKey: "key1"})
+	assert.Equal(t, ErrClosed, err)
+}
+
+func TestEmbeddedNatsClusterAuth(t *testing.T) {
+	config := &NatsConfig{EmbeddedListen: "127.0.0.1:-1", ClusterListen: "127.0.0.1:-1", ClusterName: NatsClusterNameDefault,
+		ClusterUser: "route", ClusterPassword: "secret"}
+	s, err := startEmbeddedNats(logging.Default(), "first", config)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer s.Shutdown()
+
+	stranger := *config
+	stranger.ClusterPassword = "guess"
+	stranger.Routes = []string{s.ClusterAddr().String()}
+	s2, err := startEmbeddedNats(logging.Default(), "stranger", &stranger)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer s2.Shutdown()
+
+	member := *config
+	member.Routes = []string{s.ClusterAddr().String()}
+	s3, err := startEmbeddedNats(logging.Default(), "member", &member)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer s3.Shutdown()
+	assert.Eventually(t, func() bool {
+		return s3.NumRoutes() == 1
+	}, 10*time.Second, 20*time.Millisecond, "the same log in should route")
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 0, s2.NumRoutes(), "a wrong password should not route")
+	assert.Equal(t, 1, s.NumRoutes())
+
+	_, err = startEmbeddedNats(logging.Default(), "alone", &NatsConfig{EmbeddedListen: "127.0.0.1:-1", Routes: member.Routes})
+	assert.NotNil(t, err, "routes without a cluster listen")
+}
+
+func TestNatsConfig(t *testing.T) {
+	t.Setenv(NatsURLEnvVar, "nats://a:4222, nats://b:4222")
+	t.Setenv(MessageReplicateChannelEnvVar, "from.env")
+	t.Setenv(MasterPassPhraseEnvVar, "bob")
+	config := NatsConfigFromEnv()
+	assert.Equal(t, []string{"nats://a:4222", "nats://b:4222"}, config.URLs)
+	assert.Equal(t, "from.env", config.ReplicateSubject)
+	assert.Equal(t, MemberSubjectDefault, config.MemberSubject)
+	assert.Equal(t, "bob", config.MasterPassPhrase)
+	assert.Empty(t, DefaultNatsConfig().MasterPassPhrase, "the defaults ignore the environment")
+
+	s, err := startEmbeddedNats(logging.Default(), "config", &NatsConfig{EmbeddedListen: "127.0.0.1:-1"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer s.Shutdown()
+	nc, err := nats.Connect(s.ClientURL())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer nc.Close()
+
+	// two relays on different subjects and pass phrases in one process, sharing a connection
+	relayA, err := NewNatsMessageChatterRelay(WithNatsConfig(*DefaultNatsConfig()), WithNatsURLs(s.ClientURL()), WithNatsSubject("one"), WithNatsNodeID("a"), WithNatsName("relay a"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer relayA.Close(context.Background())
+	assert.Equal(t, "a", relayA.NodeID())
+	assert.Equal(t, "one.users", relayA.SubjectForCache("users"))
+	partial, err := NewNatsMessageChatterRelay(WithNatsConfig(NatsConfig{URLs: []string{s.ClientURL()}}))
+	if assert.Nil(t, err, "what a partial config leaves out comes from the defaults") {
+		assert.Equal(t, "chatty.replicate.users", partial.SubjectForCache("users"))
+		partial.Close(context.Background())
+	}
+	_, err = NewNatsMessageChatterRelay(WithNatsConn(nc), WithNatsSubject(""))
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "ReplicateSubject")
+	}
+	relayB, err := NewNatsMessageChatterRelay(WithNatsConn(nc), WithNatsSubject("one"), WithNatsPassPhrase(""))
+	if !assert.Nil(t, err) {
+		return
+	}
+	relayC, err := NewNatsMessageChatterRelay(WithNatsConn(nc), WithNatsSubject("two"), WithNatsPassPhrase(""))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer relayC.Close(context.Background())
+	listenerB := new(collectingListener)
+	relayB.RegisterListenerForReplicatedObjects(listenerB.listen)
+	listenerC := new(collectingListener)
+	relayC.RegisterListenerForReplicatedObjects(listenerC.listen)
+
+	relayA.ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key1", CacheValue: "InYi"})
+	assert.Eventually(t, func() bool {
+		return len(listenerB.keys()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, listenerC.keys(), "different subject")
+
+	relayB.Close(context.Background())
+	assert.False(t, nc.IsClosed(), "a shared connection is left open")
+	relayA.ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key2", CacheValue: "InYi"})
+	nc.Flush()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{"key1"}, listenerB.keys(), "a closed relay should be unsubscribed")
+}
+
+func TestLegacySubject(t *testing.T) {
+	s, err := startEmbeddedNats(logging.Default(), "legacy", &NatsConfig{EmbeddedListen: "127.0.0.1:-1"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer s.Shutdown()
+	nc, err := nats.Connect(s.ClientURL())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer nc.Close()
+	// a node from before per cache name subjects only listens on the bare one
+	oldCodec := &envelopeCodec{nodeID: "old"}
+	oldNode, err := nc.SubscribeSync(MessageReplicationSubject)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	relayA, err := NewNatsMessageChatterRelay(WithNatsConfig(*DefaultNatsConfig()), WithNatsURLs(s.ClientURL()), WithNatsLegacySubject(true))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer relayA.Close(context.Background())
+	relayB, err := NewNatsMessageChatterRelay(WithNatsConfig(*DefaultNatsConfig()), WithNatsURLs(s.ClientURL()))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer relayB.Close(context.Background())
+	listenerB := new(collectingListener)
+	relayB.RegisterListenerForReplicatedObjects(listenerB.listen)
+
+	assert.Nil(t, relayA.ReplicateCachedObjectCtx(context.Background(), &model.CacheRelayMessage{CacheName: "users", CacheKey: "key1", CacheValue: "InYi"}))
+	msg, err := oldNode.NextMsg(5 * time.Second)
+	if assert.Nil(t, err, "the old node gets a copy") {
+		decoded, _, err := oldCodec.decode(msg.Data)
+		if assert.Nil(t, err) {
+			assert.Equal(t, "key1", decoded.CacheKey)
+		}
+	}
+	assert.Nil(t, relayA.ReplicateCachedObjectCtx(context.Background(), &model.CacheRelayMessage{TenantID: "acme", CacheName: "users", CacheKey: "key2"}))
+	_, err = oldNode.NextMsg(100 * time.Millisecond)
+	assert.NotNil(t, err, "old nodes know nothing of tenants")
+
+	// what the old node publishes still gets through
+	bits, err := oldCodec.encode(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key3", CacheValue: "InYi"})
+	if assert.Nil(t, err) {
+		nc.Publish(MessageReplicationSubject, bits)
+	}
+	assert.Eventually(t, func() bool {
+		return len(listenerB.keys()) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{"key1", "key2", "key3"}, listenerB.keys(), "the copy for old nodes is not applied twice")
+}
@@ -0,0 +1,631 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package chatter
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/theotw/chatty-cache/pkg/logging"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PeerListenEnvVar the address this node accepts peer connections on
+const PeerListenEnvVar = "CHATTY_PEER_LISTEN"
+
+// PeersEnvVar comma separated host:port of the other nodes, it is fine for this node to be in the list
+const PeersEnvVar = "CHATTY_PEERS"
+
+// PeerDNSEnvVar finds the peers in DNS.  Either an SRV name like _chatty._tcp.cache.svc.cluster.local, or the
+// host:port of a headless service whose A records are the nodes.  It is looked up again every PeerRefreshInterval
+const PeerDNSEnvVar = "CHATTY_PEER_DNS"
+
+// PeerTLSCertEnvVar PeerTLSKeyEnvVar and PeerTLSCAEnvVar are PEM files, with all three set the peers use mutual TLS
+const PeerTLSCertEnvVar = "CHATTY_PEER_TLS_CERT"
+const PeerTLSKeyEnvVar = "CHATTY_PEER_TLS_KEY"
+const PeerTLSCAEnvVar = "CHATTY_PEER_TLS_CA"
+
+// PeerTLSServerNameEnvVar the name to check peer certificates against instead of the host being dialed, handy when
+// every node shares one certificate
+const PeerTLSServerNameEnvVar = "CHATTY_PEER_TLS_SERVER_NAME"
+
+// PeerListenDefault only this host can connect, a node other hosts reach needs TLS or a pass phrase
+const PeerListenDefault = "127.0.0.1:30222"
+
+// PeerQueueSize how many messages are held for a peer that is slow or reconnecting, past that a put waits on it
+const PeerQueueSize = 1024
+
+// PeerQueueTimeout how long a put waits on a peer whose queue is full, after that the peer misses the message and
+// the put gets ErrPeerQueueFull
+const PeerQueueTimeout = time.Second
+
+// ErrPeerQueueFull a peer's queue stayed full for PeerQueueTimeout, the peer did not get the message
+var ErrPeerQueueFull = errors.New("peer queue full")
+
+// PeerRefreshInterval how often the DNS peers are looked up again
+const PeerRefreshInterval = 10 * time.Second
+
+// PeerWriteTimeout how long a write to a peer can take before the connection is given up on
+const PeerWriteTimeout = 5 * time.Second
+
+// maxPeerFrame the biggest frame a peer will read, bigger frames drop the connection
+const maxPeerFrame = 16 * 1024 * 1024
+
+const peerMinBackoff = 100 * time.Millisecond
+const peerMaxBackoff = 5 * time.Second
+
+// lookupSRV and lookupHost are swapped out by the tests
+var lookupSRV = net.LookupSRV
+var lookupHost = net.LookupHost
+
+// PeerChatterRelay replicates straight to the other nodes over TCP, no broker needed.  Every node keeps one outgoing
+// connection to each peer and sends it length prefixed envelopes, the same envelopes the nats relay uses.  A peer that
+// is slow or down gets its messages queued while it catches up or the connection is redialed, up to PeerQueueSize.
+// Past that a put waits for room, and a peer still full after PeerQueueTimeout misses the message, as do the ones
+// after it until it has room again.  Like core nats
+// messages a peer misses are not replayed
+type PeerChatterRelay struct {
+	logging.Holder
+
+	listenAddr  string
+	listener    net.Listener
+	tlsConfig   *tls.Config
+	staticPeers []string
+	peerDNS     string
+	//nodeID random UUID for this process, sent to peers when they connect so a node can spot itself in the peer list
+	nodeID         string
+	codec          *envelopeCodec
+	objectListener ObjectListener
+
+	peersLock sync.Mutex
+	peers     map[string]*peerConn
+	// inbound connections, closed along with the relay
+	inbound map[net.Conn]bool
+
+	// senders one per send loop, Close waits on them to empty their queues
+	senders   sync.WaitGroup
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// peerConn the outgoing side of a single peer
+type peerConn struct {
+	addr  string
+	queue chan []byte
+	stop  chan struct{}
+	// finish the send loop stops once the queue is empty
+	finish chan struct{}
+	// retry a message that failed to write, it goes first on the next connection.  Only touched by the send loop
+	retry []byte
+	// overflowing set once a put gave up waiting on the queue, puts do not wait again until there is room
+	overflowing int32
+	// connected set while the send loop has a connection to the peer
+	connected int32
+}
+
+// NewPeerChatterRelay starts listening for peers and connects to the ones it knows about
+func NewPeerChatterRelay() (*PeerChatterRelay, error) {
+	ret := new(PeerChatterRelay)
+	ret.listenAddr = model.GetEnvVarWithDefault(PeerListenEnvVar, PeerListenDefault)
+	ret.staticPeers = splitNamespaces(model.GetEnvVarWithDefault(PeersEnvVar, ""))
+	ret.peerDNS = model.GetEnvVarWithDefault(PeerDNSEnvVar, "")
+	ret.nodeID = uuid.NewString()
+	ret.codec = &envelopeCodec{nodeID: ret.nodeID, masterPassPhrase: model.GetEnvVarWithDefault(MasterPassPhraseEnvVar, "")}
+	ret.peers = make(map[string]*peerConn)
+	ret.inbound = make(map[net.Conn]bool)
+	ret.closed = make(chan struct{})
+	tlsConfig, err := peerTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	ret.tlsConfig = tlsConfig
+	err = checkListenAddr(ret.listenAddr, tlsConfig != nil || len(ret.codec.masterPassPhrase) > 0)
+	if err != nil {
+		return nil, err
+	}
+	err = ret.init()
+	return ret, err
+}
+
+// peerTLSConfig the mutual TLS config from the env, nil when TLS is not set up
+func peerTLSConfig() (*tls.Config, error) {
+	certFile := model.GetEnvVarWithDefault(PeerTLSCertEnvVar, "")
+	keyFile := model.GetEnvVarWithDefault(PeerTLSKeyEnvVar, "")
+	caFile := model.GetEnvVarWithDefault(PeerTLSCAEnvVar, "")
+	if len(certFile) == 0 && len(keyFile) == 0 && len(caFile) == 0 {
+		return nil, nil
+	}
+	if len(certFile) == 0 || len(keyFile) == 0 || len(caFile) == 0 {
+		return nil, fmt.Errorf("peer TLS needs all of %s, %s and %s", PeerTLSCertEnvVar, PeerTLSKeyEnvVar, PeerTLSCAEnvVar)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	caBits, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBits) {
+		return nil, errors.New("no certificates found in " + caFile)
+	}
+	ret := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ServerName:   model.GetEnvVarWithDefault(PeerTLSServerNameEnvVar, ""),
+		MinVersion:   tls.VersionTLS12,
+	}
+	return ret, nil
+}
+
+func (t *PeerChatterRelay) init() error {
+	var err error
+	if t.tlsConfig != nil {
+		t.listener, err = tls.Listen("tcp", t.listenAddr, t.tlsConfig)
+	} else {
+		t.listener, err = net.Listen("tcp", t.listenAddr)
+	}
+	if err != nil {
+		t.Logger().WithError(err).Errorf("Unable to listen on %s", t.listenAddr)
+		return err
+	}
+	go t.accept()
+	for _, peer := range t.staticPeers {
+		t.AddPeer(peer)
+	}
+	if len(t.peerDNS) > 0 {
+		go t.refreshDNSPeers()
+	}
+	return nil
+}
+
+// ListenAddr the address this node is accepting peers on
+func (t *PeerChatterRelay) ListenAddr() string {
+	return t.listener.Addr().String()
+}
+
+// NodeID the ID of this node
+func (t *PeerChatterRelay) NodeID() string {
+	return t.nodeID
+}
+
+// Peers the addresses this node is sending to
+func (t *PeerChatterRelay) Peers() []string {
+	t.peersLock.Lock()
+	ret := make([]string, 0, len(t.peers))
+	for addr := range t.peers {
+		ret = append(ret, addr)
+	}
+	t.peersLock.Unlock()
+	return ret
+}
+
+// AddPeer starts sending to the node at addr, host:port
+func (t *PeerChatterRelay) AddPeer(addr string) {
+	t.peersLock.Lock()
+	defer t.peersLock.Unlock()
+	if _, ok := t.peers[addr]; ok || t.isClosed() {
+		return
+	}
+	peer := &peerConn{addr: addr, queue: make(chan []byte, PeerQueueSize), stop: make(chan struct{}), finish: make(chan struct{})}
+	t.peers[addr] = peer
+	t.senders.Add(1)
+	go t.sendLoop(peer)
+}
+
+// RemovePeer stops sending to the node at addr
+func (t *PeerChatterRelay) RemovePeer(addr string) {
+	t.peersLock.Lock()
+	peer, ok := t.peers[addr]
+	if ok {
+		delete(t.peers, addr)
+		close(peer.stop)
+	}
+	t.peersLock.Unlock()
+}
+
+// ReplicateCachedObject queues the message for every peer, waiting on full queues no longer than PeerQueueTimeout
+func (t *PeerChatterRelay) ReplicateCachedObject(message *model.CacheRelayMessage) {
+	err := t.ReplicateCachedObjectCtx(context.Background(), message)
+	if errors.Is(err, ErrClosed) {
+		t.PerMessage().Debugf("Relay closed, dropping cache sync %s %s", message.CacheName, message.CacheKey)
+	} else if err != nil {
+		t.Logger().WithError(err).Errorf("Error queueing cache sync %s %s for the peers", message.CacheName, message.CacheKey)
+	}
+}
+
+// ReplicateCachedObjectCtx queues the message for every peer.  A peer whose queue is full is waited on for no longer
+// than PeerQueueTimeout or ctx allow, the first peer that missed the message is in the error
+func (t *PeerChatterRelay) ReplicateCachedObjectCtx(ctx context.Context, message *model.CacheRelayMessage) error {
+	bits, err := t.codec.encode(message)
+	if err != nil {
+		return err
+	}
+	t.peersLock.Lock()
+	if t.isClosed() {
+		t.peersLock.Unlock()
+		return ErrClosed
+	}
+	peers := make([]*peerConn, 0, len(t.peers))
+	for _, peer := range t.peers {
+		peers = append(peers, peer)
+	}
+	t.peersLock.Unlock()
+	var ret error
+	for _, peer := range peers {
+		err = enqueue(ctx, peer, bits)
+		if err != nil {
+			t.codec.countSendFailure()
+			if ret == nil {
+				ret = fmt.Errorf("peer %s: %w", peer.addr, err)
+			}
+		}
+	}
+	return ret
+}
+
+// enqueue waits for room in the queue of peer, a peer removed meanwhile does not need the message.  A peer that is
+// down for good would hold up every put, so once one has waited the full PeerQueueTimeout the others fail at once
+func enqueue(ctx context.Context, peer *peerConn, bits []byte) error {
+	select {
+	case peer.queue <- bits:
+		atomic.StoreInt32(&peer.overflowing, 0)
+		return nil
+	default:
+	}
+	if atomic.LoadInt32(&peer.overflowing) != 0 {
+		return ErrPeerQueueFull
+	}
+	timer := time.NewTimer(PeerQueueTimeout)
+	defer timer.Stop()
+	select {
+	case peer.queue <- bits:
+		return nil
+	case <-peer.stop:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		atomic.StoreInt32(&peer.overflowing, 1)
+		return ErrPeerQueueFull
+	}
+}
+
+func (t *PeerChatterRelay) RegisterListenerForReplicatedObjects(listener ObjectListener) {
+	t.objectListener = listener
+}
+
+// Close stops listening and sends what is queued for each peer, waiting no longer than ctx allows, then drops every
+// peer connection.  A peer that cannot be reached is given up on
+func (t *PeerChatterRelay) Close(ctx context.Context) error {
+	var err error
+	t.closeOnce.Do(func() {
+		t.peersLock.Lock()
+		close(t.closed)
+		for _, peer := range t.peers {
+			close(peer.finish)
+		}
+		t.peersLock.Unlock()
+		err = t.listener.Close()
+		if waitErr := waitContext(ctx, &t.senders); waitErr != nil {
+			t.Logger().WithError(waitErr).Warnf("Peer queues not sent before closing")
+			err = waitErr
+		}
+		t.peersLock.Lock()
+		for addr, peer := range t.peers {
+			delete(t.peers, addr)
+			close(peer.stop)
+		}
+		for conn := range t.inbound {
+			conn.Close()
+		}
+		t.peersLock.Unlock()
+	})
+	return err
+}
+
+// ReplicationStats counts of the envelopes sent and received so far
+func (t *PeerChatterRelay) ReplicationStats() ReplicationStats {
+	return t.codec.replicationStats()
+}
+
+// Status CONNECTED while at least one peer is connected, or there are no peers to connect to
+func (t *PeerChatterRelay) Status() string {
+	if t.isClosed() {
+		return StatusClosed
+	}
+	t.peersLock.Lock()
+	defer t.peersLock.Unlock()
+	if len(t.peers) == 0 {
+		return StatusConnected
+	}
+	for _, peer := range t.peers {
+		if atomic.LoadInt32(&peer.connected) != 0 {
+			return StatusConnected
+		}
+	}
+	return StatusDisconnected
+}
+
+// Connected whether a peer is connected, or there are none
+func (t *PeerChatterRelay) Connected() bool {
+	return t.Status() == StatusConnected
+}
+
+func (t *PeerChatterRelay) isClosed() bool {
+	select {
+	case <-t.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *PeerChatterRelay) accept() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if t.isClosed() {
+				return
+			}
+			t.Logger().WithError(err).Debugf("Error accepting a peer connection")
+			time.Sleep(peerMinBackoff)
+			continue
+		}
+		go t.receive(conn)
+	}
+}
+
+// receive says hello with our node ID then reads messages until the connection drops
+func (t *PeerChatterRelay) receive(conn net.Conn) {
+	t.peersLock.Lock()
+	if t.isClosed() {
+		t.peersLock.Unlock()
+		conn.Close()
+		return
+	}
+	t.inbound[conn] = true
+	t.peersLock.Unlock()
+	defer func() {
+		t.peersLock.Lock()
+		delete(t.inbound, conn)
+		t.peersLock.Unlock()
+		conn.Close()
+	}()
+
+	conn.SetWriteDeadline(time.Now().Add(PeerWriteTimeout))
+	err := writeFrame(conn, []byte(t.nodeID))
+	if err != nil {
+		t.Logger().WithError(err).Debugf("Unable to say hello to %s", conn.RemoteAddr())
+		return
+	}
+	reader := bufio.NewReader(conn)
+	for {
+		bits, err := readFrame(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !t.isClosed() {
+				t.Logger().WithError(err).Debugf("Dropping peer connection from %s", conn.RemoteAddr())
+			}
+			return
+		}
+		t.handleCacheSync(bits)
+	}
+}
+
+func (t *PeerChatterRelay) handleCacheSync(bits []byte) {
+	relayMsg, nodeID, err := t.codec.decode(bits)
+	if err != nil {
+		t.Logger().WithError(err).Errorf("Error decoding a peer cache sync message")
+		return
+	}
+	if nodeID == t.nodeID || t.objectListener == nil {
+		return
+	}
+	t.PerMessage().Tracef("Recieved Cache Sync %s %s", relayMsg.CacheName, relayMsg.CacheKey)
+	err = t.objectListener(relayMsg)
+	if err != nil {
+		// there is no redelivery, the next put of the key will fix it
+		t.Logger().WithError(err).Debugf("Unable to apply cache sync %s %s", relayMsg.CacheName, relayMsg.CacheKey)
+	}
+}
+
+// sendLoop keeps a connection to the peer and drains its queue, redialing with a backoff when the connection drops
+func (t *PeerChatterRelay) sendLoop(peer *peerConn) {
+	defer t.senders.Done()
+	backoff := peerMinBackoff
+	for {
+		conn, err := t.dial(peer.addr)
+		if errors.Is(err, errPeerIsSelf) {
+			t.Logger().Debugf("Peer %s is this node, not sending to it", peer.addr)
+			t.RemovePeer(peer.addr)
+			return
+		}
+		if err != nil {
+			t.Logger().WithError(err).Debugf("Unable to connect to peer %s, retrying in %s", peer.addr, backoff)
+			select {
+			case <-peer.stop:
+				return
+			case <-peer.finish:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = backoff * 2
+			if backoff > peerMaxBackoff {
+				backoff = peerMaxBackoff
+			}
+			continue
+		}
+		backoff = peerMinBackoff
+		atomic.StoreInt32(&peer.connected, 1)
+		stopped := t.drain(peer, conn)
+		atomic.StoreInt32(&peer.connected, 0)
+		conn.Close()
+		if stopped {
+			return
+		}
+	}
+}
+
+// drain writes queued messages to conn until it fails, true means the peer was removed or the relay closed with the
+// queue empty
+func (t *PeerChatterRelay) drain(peer *peerConn, conn net.Conn) bool {
+	// the peer never writes to us after the hello, so a read only returns when the connection is gone
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(gone)
+	}()
+	for {
+		bits := peer.retry
+		peer.retry = nil
+		if bits == nil {
+			select {
+			case <-peer.stop:
+				return true
+			case <-gone:
+				return false
+			case bits = <-peer.queue:
+			case <-peer.finish:
+				select {
+				case bits = <-peer.queue:
+				default:
+					return true
+				}
+			}
+		}
+		conn.SetWriteDeadline(time.Now().Add(PeerWriteTimeout))
+		err := writeFrame(conn, bits)
+		if err != nil {
+			// a write can land in the buffer of a connection the peer already dropped, so only the failed one is retried
+			t.Logger().WithError(err).Debugf("Error sending to peer %s", peer.addr)
+			peer.retry = bits
+			return false
+		}
+	}
+}
+
+var errPeerIsSelf = errors.New("peer is this node")
+
+// dial connects to the peer and reads its hello
+func (t *PeerChatterRelay) dial(addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: PeerWriteTimeout}
+	var conn net.Conn
+	var err error
+	if t.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, t.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(PeerWriteTimeout))
+	hello, err := readFrame(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	if string(hello) == t.nodeID {
+		conn.Close()
+		return nil, errPeerIsSelf
+	}
+	return conn, nil
+}
+
+// refreshDNSPeers keeps the peer list in line with DNS until the relay is closed
+func (t *PeerChatterRelay) refreshDNSPeers() {
+	dnsPeers := make(map[string]bool)
+	for {
+		addrs, err := resolvePeers(t.peerDNS)
+		if err != nil {
+			t.Logger().WithError(err).Warnf("Unable to look up peers %s", t.peerDNS)
+		} else {
+			current := make(map[string]bool)
+			for _, addr := range addrs {
+				current[addr] = true
+				t.AddPeer(addr)
+			}
+			for addr := range dnsPeers {
+				if !current[addr] {
+					t.RemovePeer(addr)
+				}
+			}
+			dnsPeers = current
+		}
+		select {
+		case <-t.closed:
+			return
+		case <-time.After(PeerRefreshInterval):
+		}
+	}
+}
+
+// resolvePeers looks up an SRV name, or the A records of a host:port
+func resolvePeers(name string) ([]string, error) {
+	ret := make([]string, 0)
+	if strings.HasPrefix(name, "_") {
+		_, srvs, err := lookupSRV("", "", name)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range srvs {
+			ret = append(ret, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+		}
+		return ret, nil
+	}
+	host, port, err := net.SplitHostPort(name)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := lookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hosts {
+		ret = append(ret, net.JoinHostPort(h, port))
+	}
+	return ret, nil
+}
+
+// writeFrame writes a 4 byte big endian length then the bits
+func writeFrame(w io.Writer, bits []byte) error {
+	frame := make([]byte, 4+len(bits))
+	binary.BigEndian.PutUint32(frame, uint32(len(bits)))
+	copy(frame[4:], bits)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	_, err := io.ReadFull(r, size[:])
+	if err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxPeerFrame {
+		return nil, fmt.Errorf("peer frame of %d bytes is too big", n)
+	}
+	ret := make([]byte, n)
+	_, err = io.ReadFull(r, ret)
+	return ret, err
+}
@@ -0,0 +1,260 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package chatter
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// writeTestCerts writes a CA and a certificate for 127.0.0.1 signed by it to ca.pem, cert.pem and key.pem in the
+// directory returned
+func writeTestCerts(t *testing.T) string {
+	dir := t.TempDir()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "chatty test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "chatty node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	files := map[string]*pem.Block{
+		"ca.pem":   {Type: "CERTIFICATE", Bytes: caDER},
+		"cert.pem": {Type: "CERTIFICATE", Bytes: der},
+		"key.pem":  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	}
+	for name, block := range files {
+		err = os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestPeerChatter(t *testing.T) {
+	dir := writeTestCerts(t)
+	t.Setenv(PeerTLSCAEnvVar, filepath.Join(dir, "ca.pem"))
+	t.Setenv(PeerTLSCertEnvVar, filepath.Join(dir, "cert.pem"))
+	t.Setenv(PeerTLSKeyEnvVar, filepath.Join(dir, "key.pem"))
+	t.Setenv(MasterPassPhraseEnvVar, "bob")
+	t.Setenv(PeerListenEnvVar, "127.0.0.1:0")
+
+	relayA, err := NewPeerChatterRelay()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer relayA.Close(context.Background())
+	listenerA := new(collectingListener)
+	relayA.RegisterListenerForReplicatedObjects(listenerA.listen)
+
+	t.Setenv(PeersEnvVar, relayA.ListenAddr())
+	relayB, err := NewPeerChatterRelay()
+	if !assert.Nil(t, err) {
+		return
+	}
+	listenerB := new(collectingListener)
+	relayB.RegisterListenerForReplicatedObjects(listenerB.listen)
+	addrB := relayB.ListenAddr()
+	relayA.AddPeer(addrB)
+	relayA.AddPeer(relayA.ListenAddr())
+
+	relayA.ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key1", CacheValue: "InYi"})
+	relayB.ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key2"})
+	assert.Eventually(t, func() bool {
+		return len(listenerB.keys()) == 1 && len(listenerA.keys()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"key1"}, listenerB.keys())
+	assert.Equal(t, []string{"key2"}, listenerA.keys())
+	assert.True(t, relayA.Connected())
+	assert.Eventually(t, func() bool {
+		return len(relayA.Peers()) == 1
+	}, 5*time.Second, 10*time.Millisecond, "a node should drop itself from its peers")
+
+	t.Run("Reconnect", func(t *testing.T) {
+		relayB.Close(context.Background())
+		assert.Equal(t, StatusClosed, relayB.Status())
+		relayA.ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key3"})
+
+		t.Setenv(PeerListenEnvVar, addrB)
+		relayB2, err := NewPeerChatterRelay()
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer relayB2.Close(context.Background())
+		listenerB2 := new(collectingListener)
+		relayB2.RegisterListenerForReplicatedObjects(listenerB2.listen)
+		// what was written to the old connection before A noticed it was gone is lost, so keep putting until one lands
+		assert.Eventually(t, func() bool {
+			relayA.ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key4"})
+			return len(listenerB2.keys()) > 0
+		}, 10*time.Second, 100*time.Millisecond, "A should reconnect once the peer is back")
+	})
+
+	t.Run("No client cert", func(t *testing.T) {
+		t.Setenv(PeerTLSCertEnvVar, "")
+		t.Setenv(PeerTLSKeyEnvVar, "")
+		t.Setenv(PeerTLSCAEnvVar, "")
+		t.Setenv(PeerListenEnvVar, "127.0.0.1:0")
+		t.Setenv(PeersEnvVar, "")
+		plain, err := NewPeerChatterRelay()
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer plain.Close(context.Background())
+		plain.tlsConfig = relayA.tlsConfig.Clone()
+		plain.tlsConfig.Certificates = nil
+		_, err = plain.dial(relayA.ListenAddr())
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Exposed", func(t *testing.T) {
+		t.Setenv(PeerTLSCertEnvVar, "")
+		t.Setenv(PeerTLSKeyEnvVar, "")
+		t.Setenv(PeerTLSCAEnvVar, "")
+		t.Setenv(PeersEnvVar, "")
+		t.Setenv(MasterPassPhraseEnvVar, "")
+		for _, addr := range []string{":0", "0.0.0.0:0", "[::]:0"} {
+			t.Setenv(PeerListenEnvVar, addr)
+			_, err := NewPeerChatterRelay()
+			assert.NotNil(t, err, "%s needs TLS or a pass phrase", addr)
+		}
+		t.Setenv(PeerListenEnvVar, "localhost:0")
+		relay, err := NewPeerChatterRelay()
+		if assert.Nil(t, err) {
+			assert.True(t, relay.Connected(), "a node with no peers has nothing to wait for")
+			relay.Close(context.Background())
+		}
+		t.Setenv(PeerListenEnvVar, "")
+		assert.True(t, isLoopbackAddr(PeerListenDefault), "only this host by default")
+
+		t.Setenv(MasterPassPhraseEnvVar, "bob")
+		t.Setenv(PeerListenEnvVar, ":0")
+		relay, err = NewPeerChatterRelay()
+		if assert.Nil(t, err) {
+			relay.Close(context.Background())
+		}
+	})
+
+	t.Run("Full queue", func(t *testing.T) {
+		// a peer nothing listens on never takes from its queue
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assert.Nil(t, err) {
+			return
+		}
+		deadAddr := listener.Addr().String()
+		listener.Close()
+		t.Setenv(PeersEnvVar, deadAddr)
+		relayD, err := NewPeerChatterRelay()
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer relayD.Close(context.Background())
+		ctx := context.Background()
+		for i := 0; i < PeerQueueSize; i++ {
+			assert.Nil(t, relayD.ReplicateCachedObjectCtx(ctx, &model.CacheRelayMessage{CacheName: "users", CacheKey: "queued"}))
+		}
+		shortCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		err = relayD.ReplicateCachedObjectCtx(shortCtx, &model.CacheRelayMessage{CacheName: "users", CacheKey: "waited"})
+		assert.ErrorIs(t, err, context.DeadlineExceeded, "a full queue is waited on")
+		err = relayD.ReplicateCachedObjectCtx(ctx, &model.CacheRelayMessage{CacheName: "users", CacheKey: "missed"})
+		if assert.ErrorIs(t, err, ErrPeerQueueFull) {
+			assert.Contains(t, err.Error(), deadAddr)
+		}
+		start := time.Now()
+		err = relayD.ReplicateCachedObjectCtx(ctx, &model.CacheRelayMessage{CacheName: "users", CacheKey: "missed"})
+		assert.ErrorIs(t, err, ErrPeerQueueFull)
+		assert.Less(t, time.Since(start), PeerQueueTimeout/2, "a peer that timed out is not waited on again")
+		assert.Equal(t, uint64(3), relayD.ReplicationStats().SendFailures, "every miss is counted")
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		t.Setenv(PeersEnvVar, "")
+		relayC, err := NewPeerChatterRelay()
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer relayC.Close(context.Background())
+		listenerC := new(collectingListener)
+		relayC.RegisterListenerForReplicatedObjects(listenerC.listen)
+		relayA.AddPeer(relayC.ListenAddr())
+		for i := 0; i < 100; i++ {
+			relayA.ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: fmt.Sprintf("key%d", i)})
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.Nil(t, relayA.Close(ctx), "the queue should be sent before the timeout")
+		assert.Nil(t, relayA.Close(ctx), "closing again is harmless")
+		relayA.ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "late"})
+		assert.Eventually(t, func() bool {
+			return len(listenerC.keys()) == 100
+		}, 5*time.Second, 10*time.Millisecond, "everything queued before closing should arrive")
+		assert.NotContains(t, listenerC.keys(), "late")
+	})
+}
+
+func TestResolvePeers(t *testing.T) {
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		return name, []*net.SRV{{Target: "node-0.cache.", Port: 30222}, {Target: "node-1.cache.", Port: 30222}}, nil
+	}
+	lookupHost = func(host string) ([]string, error) {
+		return []string{"10.0.0.2", "10.0.0.1"}, nil
+	}
+	defer func() {
+		lookupSRV = net.LookupSRV
+		lookupHost = net.LookupHost
+	}()
+
+	peers, err := resolvePeers("_chatty._tcp.cache")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"node-0.cache:30222", "node-1.cache:30222"}, peers)
+
+	peers, err = resolvePeers("cache:30222")
+	assert.Nil(t, err)
+	sort.Strings(peers)
+	assert.Equal(t, []string{"10.0.0.1:30222", "10.0.0.2:30222"}, peers)
+
+	_, err = resolvePeers("cache")
+	assert.NotNil(t, err, "a headless service needs a port")
+}
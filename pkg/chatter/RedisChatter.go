@@ -0,0 +1,335 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package chatter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/theotw/chatty-cache/pkg/logging"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const RedisAddrEnvVar = "REDIS_SERVER"
+const RedisPasswordEnvVar = "CHATTY_REDIS_PASSWORD"
+const RedisChannelEnvVar = "CHATTY_REDIS_CHANNEL"
+
+// RedisStreamEnvVar when set replication goes through this redis stream instead of pub/sub, so a node that was down
+// picks up what it missed
+const RedisStreamEnvVar = "CHATTY_REDIS_STREAM"
+
+// RedisStreamMaxLenEnvVar roughly how many messages the stream keeps
+const RedisStreamMaxLenEnvVar = "CHATTY_REDIS_STREAM_MAXLEN"
+
+const RedisAddrDefault = "localhost:6379"
+const RedisChannelDefault = "chatty.replicate"
+const RedisStreamMaxLenDefault = "10000"
+
+// RedisMaxDeliver how many times a stream message the listener keeps failing on is retried before giving up on it
+const RedisMaxDeliver = 5
+
+// redisReadBlock how long a stream read waits for new messages
+const redisReadBlock = time.Second
+
+// redisStatusTimeout how long Status waits on redis to answer a ping
+const redisStatusTimeout = time.Second
+
+// redisMessageField the stream entry field holding the envelope
+const redisMessageField = "m"
+
+// RedisChatterRelay replicates through redis.  By default it uses pub/sub, which like core nats is fire and forget.
+// With a stream set every node reads the stream through a consumer group of its own, named after the node, and only
+// acks a message once the listener has applied it, so a restarted node carries on from where it left off
+type RedisChatterRelay struct {
+	logging.Holder
+
+	client   *redis.Client
+	addr     string
+	channel  string
+	stream   string
+	maxLen   int64
+	nodeName string
+	//nodeID random UUID for this process, used to skip our own messages
+	nodeID         string
+	codec          *envelopeCodec
+	objectListener ObjectListener
+
+	subscribeOnce sync.Once
+	pubsub        *redis.PubSub
+	reading       sync.WaitGroup
+	// failures counts failed applies of pending stream messages, only touched by the read loop
+	failures map[string]int
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	// readCtx is cancelled on Close to stop a stream read that is blocked waiting
+	readCtx     context.Context
+	stopReading context.CancelFunc
+}
+
+// NewRedisChatterRelay connects to redis, and sets up the consumer group of this node when using a stream
+func NewRedisChatterRelay() (*RedisChatterRelay, error) {
+	ret := new(RedisChatterRelay)
+	ret.addr = model.GetEnvVarWithDefault(RedisAddrEnvVar, RedisAddrDefault)
+	ret.channel = model.GetEnvVarWithDefault(RedisChannelEnvVar, RedisChannelDefault)
+	ret.stream = model.GetEnvVarWithDefault(RedisStreamEnvVar, "")
+	maxLen, err := strconv.ParseInt(model.GetEnvVarWithDefault(RedisStreamMaxLenEnvVar, RedisStreamMaxLenDefault), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s: %w", RedisStreamMaxLenEnvVar, err)
+	}
+	ret.maxLen = maxLen
+	hostName, _ := os.Hostname()
+	ret.nodeName = model.GetEnvVarWithDefault(NodeNameEnvVar, hostName)
+	if len(ret.stream) > 0 && len(ret.nodeName) == 0 {
+		return nil, errors.New("unable to work out a node name, set " + NodeNameEnvVar)
+	}
+	ret.nodeID = uuid.NewString()
+	ret.codec = &envelopeCodec{nodeID: ret.nodeID, masterPassPhrase: model.GetEnvVarWithDefault(MasterPassPhraseEnvVar, "")}
+	ret.failures = make(map[string]int)
+	ret.closed = make(chan struct{})
+	ret.readCtx, ret.stopReading = context.WithCancel(context.Background())
+	ret.client = redis.NewClient(&redis.Options{
+		Addr:     ret.addr,
+		Password: model.GetEnvVarWithDefault(RedisPasswordEnvVar, ""),
+	})
+	err = ret.init()
+	return ret, err
+}
+
+func (t *RedisChatterRelay) init() error {
+	ctx := context.Background()
+	err := t.client.Ping(ctx).Err()
+	if err != nil {
+		t.Logger().WithError(err).Errorf("Unable to reach redis")
+		return err
+	}
+	if len(t.stream) == 0 {
+		return nil
+	}
+	// a new node starts from what the stream still has, the versions keep older values from winning
+	err = t.client.XGroupCreateMkStream(ctx, t.stream, t.nodeName, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// ReplicateCachedObject publishes on the channel, or adds to the stream
+func (t *RedisChatterRelay) ReplicateCachedObject(message *model.CacheRelayMessage) {
+	err := t.ReplicateCachedObjectCtx(context.Background(), message)
+	if errors.Is(err, ErrClosed) {
+		t.PerMessage().Debugf("Relay closed, dropping cache sync %s %s", message.CacheName, message.CacheKey)
+	} else if err != nil {
+		t.Logger().WithError(err).Errorf("Error publishing cache relay message to redis")
+	}
+}
+
+// ReplicateCachedObjectCtx publishes on the channel, or adds to the stream, giving up when ctx is done
+func (t *RedisChatterRelay) ReplicateCachedObjectCtx(ctx context.Context, message *model.CacheRelayMessage) error {
+	if t.isClosed() {
+		return ErrClosed
+	}
+	bits, err := t.codec.encode(message)
+	if err != nil {
+		return err
+	}
+	if len(t.stream) > 0 {
+		err = t.client.XAdd(ctx, &redis.XAddArgs{
+			Stream: t.stream,
+			MaxLen: t.maxLen,
+			Approx: true,
+			Values: map[string]interface{}{redisMessageField: bits},
+		}).Err()
+	} else {
+		err = t.client.Publish(ctx, t.channel, bits).Err()
+	}
+	return err
+}
+
+// RegisterListenerForReplicatedObjects registers the listener and starts reading
+func (t *RedisChatterRelay) RegisterListenerForReplicatedObjects(listener ObjectListener) {
+	t.objectListener = listener
+	t.subscribeOnce.Do(func() {
+		if t.isClosed() {
+			return
+		}
+		if len(t.stream) > 0 {
+			t.reading.Add(1)
+			go t.readStream()
+			return
+		}
+		pubsub := t.client.Subscribe(context.Background(), t.channel)
+		// wait for the subscription so nothing published after this returns is missed
+		_, err := pubsub.Receive(context.Background())
+		if err != nil {
+			t.Logger().WithError(err).Errorf("Unable to subscribe to %s", t.channel)
+			return
+		}
+		t.pubsub = pubsub
+		t.reading.Add(1)
+		go func() {
+			defer t.reading.Done()
+			for msg := range pubsub.Channel() {
+				t.handleCacheSync([]byte(msg.Payload))
+			}
+		}()
+	})
+}
+
+// Close stops reading once the message in hand is applied and acked, then closes the client, waiting no longer than
+// ctx allows
+func (t *RedisChatterRelay) Close(ctx context.Context) error {
+	first := false
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		first = true
+	})
+	if !first {
+		return nil
+	}
+	t.stopReading()
+	if t.pubsub != nil {
+		t.pubsub.Close()
+	}
+	err := waitContext(ctx, &t.reading)
+	closeErr := t.client.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ReplicationStats counts of the envelopes sent and received so far
+func (t *RedisChatterRelay) ReplicationStats() ReplicationStats {
+	return t.codec.replicationStats()
+}
+
+// Status CONNECTED while redis answers a ping
+func (t *RedisChatterRelay) Status() string {
+	if t.isClosed() {
+		return StatusClosed
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisStatusTimeout)
+	defer cancel()
+	if t.client.Ping(ctx).Err() != nil {
+		return StatusDisconnected
+	}
+	return StatusConnected
+}
+
+// Connected whether redis answers a ping
+func (t *RedisChatterRelay) Connected() bool {
+	return t.Status() == StatusConnected
+}
+
+func (t *RedisChatterRelay) isClosed() bool {
+	select {
+	case <-t.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// NodeName the name of the consumer group of this node
+func (t *RedisChatterRelay) NodeName() string {
+	return t.nodeName
+}
+
+// handleCacheSync applies a message, the error is only returned for messages worth retrying
+func (t *RedisChatterRelay) handleCacheSync(bits []byte) error {
+	relayMsg, nodeID, err := t.codec.decode(bits)
+	if err != nil {
+		t.Logger().WithError(err).Errorf("Error decoding a redis cache sync message")
+		return nil
+	}
+	if nodeID == t.nodeID {
+		return nil
+	}
+	if t.objectListener == nil {
+		return errors.New("no listener")
+	}
+	t.PerMessage().Tracef("Recieved Cache Sync %s %s", relayMsg.CacheName, relayMsg.CacheKey)
+	err = t.objectListener(relayMsg)
+	if err != nil {
+		t.Logger().WithError(err).Debugf("Unable to apply cache sync %s %s", relayMsg.CacheName, relayMsg.CacheKey)
+	}
+	return err
+}
+
+// readStream retries the messages this node has not acked yet, then waits on new ones.  It stops when the relay or
+// the client is closed
+func (t *RedisChatterRelay) readStream() {
+	defer t.reading.Done()
+	ctx := t.readCtx
+	for !t.isClosed() {
+		// 0 is our pending messages, > is new ones
+		pending, err := t.readGroup(ctx, "0", -1)
+		if err == nil && len(pending) == 0 {
+			_, err = t.readGroup(ctx, ">", redisReadBlock)
+		}
+		if errors.Is(err, redis.ErrClosed) || t.isClosed() {
+			return
+		}
+		if errors.Is(err, redis.Nil) {
+			// nothing new before the block ran out
+			err = nil
+		}
+		if err != nil {
+			t.Logger().WithError(err).Debugf("Error reading redis stream %s", t.stream)
+		}
+		if err != nil || len(pending) > 0 {
+			// either redis is in trouble or the listener is, give it a moment
+			select {
+			case <-t.closed:
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// readGroup reads from our consumer group and applies what it gets, the messages that failed are returned.
+// A negative block does not wait at all, 0 would wait forever
+func (t *RedisChatterRelay) readGroup(ctx context.Context, start string, block time.Duration) ([]string, error) {
+	args := &redis.XReadGroupArgs{
+		Group:    t.nodeName,
+		Consumer: t.nodeName,
+		Streams:  []string{t.stream, start},
+		Count:    64,
+		Block:    block,
+	}
+	streams, err := t.client.XReadGroup(ctx, args).Result()
+	if err != nil {
+		return nil, err
+	}
+	failed := make([]string, 0)
+	for _, stream := range streams {
+		for _, msg := range stream.Messages {
+			bits, _ := msg.Values[redisMessageField].(string)
+			if t.handleCacheSync([]byte(bits)) != nil {
+				t.failures[msg.ID]++
+				if t.failures[msg.ID] < RedisMaxDeliver {
+					failed = append(failed, msg.ID)
+					continue
+				}
+				t.Logger().Errorf("Giving up on redis stream message %s after %d tries", msg.ID, RedisMaxDeliver)
+			}
+			delete(t.failures, msg.ID)
+			// not ctx, a message that was applied while closing still gets acked
+			err = t.client.XAck(context.Background(), t.stream, t.nodeName, msg.ID).Err()
+			if err != nil {
+				t.Logger().WithError(err).Debugf("Unable to ack redis stream message %s", msg.ID)
+			}
+		}
+	}
+	return failed, nil
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package chatter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"testing"
+	"time"
+)
+
+func TestRedisChatter(t *testing.T) {
+	s := miniredis.RunT(t)
+	t.Setenv(RedisAddrEnvVar, s.Addr())
+	t.Setenv(MasterPassPhraseEnvVar, "bob")
+	// closed when the test using it ends so no reader outlives it
+	newRelay := func(t *testing.T) *RedisChatterRelay {
+		relay, err := NewRedisChatterRelay()
+		if !assert.Nil(t, err) {
+			return nil
+		}
+		t.Cleanup(func() { relay.Close(context.Background()) })
+		return relay
+	}
+
+	t.Run("Pub sub", func(t *testing.T) {
+		relayA := newRelay(t)
+		if relayA == nil {
+			return
+		}
+		listenerA := new(collectingListener)
+		relayA.RegisterListenerForReplicatedObjects(listenerA.listen)
+		relayB := newRelay(t)
+		if relayB == nil {
+			return
+		}
+		listenerB := new(collectingListener)
+		relayB.RegisterListenerForReplicatedObjects(listenerB.listen)
+
+		relayA.ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key1", CacheValue: "InYi"})
+		assert.Eventually(t, func() bool {
+			return len(listenerB.keys()) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, "InYi", listenerB.received[0].CacheValue)
+		assert.Equal(t, relayA.nodeID, listenerB.received[0].NodeID)
+		assert.Empty(t, listenerA.keys(), "our own messages are skipped")
+	})
+
+	t.Run("Stream", func(t *testing.T) {
+		t.Setenv(RedisStreamEnvVar, "chatty")
+		t.Setenv(NodeNameEnvVar, "node-a")
+		relayA := newRelay(t)
+		if relayA == nil {
+			return
+		}
+		relayA.RegisterListenerForReplicatedObjects(new(collectingListener).listen)
+
+		t.Setenv(NodeNameEnvVar, "node-b")
+		relayB := newRelay(t)
+		if relayB == nil {
+			return
+		}
+		listenerB := &collectingListener{failures: 1}
+		relayB.RegisterListenerForReplicatedObjects(listenerB.listen)
+
+		relayA.ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key1"})
+		assert.Eventually(t, func() bool {
+			return len(listenerB.keys()) == 1
+		}, 10*time.Second, 10*time.Millisecond, "a failed apply should be retried")
+
+		relayB.client.Close()
+		relayA.ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key2"})
+		relayA.ReplicateCachedObject(&model.CacheRelayMessage{CacheName: "users", CacheKey: "key3", TenantID: "acme"})
+
+		relayB2 := newRelay(t)
+		if relayB2 == nil {
+			return
+		}
+		listenerB2 := new(collectingListener)
+		relayB2.RegisterListenerForReplicatedObjects(listenerB2.listen)
+		assert.Eventually(t, func() bool {
+			return len(listenerB2.keys()) == 2
+		}, 10*time.Second, 10*time.Millisecond)
+		assert.Equal(t, []string{"key2", "key3"}, listenerB2.keys(), "only what was missed, in order")
+	})
+
+	t.Run("Status", func(t *testing.T) {
+		relay := newRelay(t)
+		if relay == nil {
+			return
+		}
+		assert.True(t, relay.Connected())
+		s.Close()
+		assert.Equal(t, StatusDisconnected, relay.Status(), "redis is gone")
+		assert.False(t, relay.Connected())
+	})
+}
@@ -4,10 +4,121 @@
 
 package chatter
 
-import "github.com/theotw/chatty-cache/pkg/model"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"net"
+	"sync"
+)
 
-type ObjectListener func(message *model.CacheRelayMessage)
+// ErrClosed the chatter has been closed
+var ErrClosed = errors.New("chatter closed")
+
+// ObjectListener applies a message from another node, chatters that can redeliver do so when it returns an error
+type ObjectListener func(message *model.CacheRelayMessage) error
 type CacheChatter interface {
 	ReplicateCachedObject(message *model.CacheRelayMessage)
 	RegisterListenerForReplicatedObjects(listener ObjectListener)
+	// Close sends what is still queued, waiting no longer than ctx allows, then disconnects and stops.  Later calls
+	// fail with ErrClosed or do nothing, closing again is harmless
+	Close(ctx context.Context) error
+}
+
+// ContextChatter a CacheChatter whose sends can be cancelled or bounded by a deadline
+type ContextChatter interface {
+	CacheChatter
+	// ReplicateCachedObjectCtx is ReplicateCachedObject returning the reason a message could not be sent before ctx
+	// was done
+	ReplicateCachedObjectCtx(ctx context.Context, message *model.CacheRelayMessage) error
+}
+
+// StatsChatter a chatter that counts the envelopes it sends and receives
+type StatsChatter interface {
+	ReplicationStats() ReplicationStats
+}
+
+// StatusChatter a chatter that can say how its connection is doing, for the admin endpoint and readiness checks
+type StatusChatter interface {
+	// Status a short description such as CONNECTED or RECONNECTING
+	Status() string
+	// Connected whether the relay can reach the rest of the cluster right now
+	Connected() bool
+}
+
+// StatusConnected StatusDisconnected and StatusClosed what the relays without a NATS connection report, named like
+// the NATS states
+const StatusConnected = "CONNECTED"
+const StatusDisconnected = "DISCONNECTED"
+const StatusClosed = "CLOSED"
+
+// StatusJoining a gossip node that has not found another member through its seeds yet
+const StatusJoining = "JOINING"
+
+// MembershipListener is called with the full list of live node IDs every time the membership changes
+type MembershipListener func(members []string)
+
+// FetchHandler answers a RelayFetch from another node, return nil if the item is not held here
+type FetchHandler func(message *model.CacheRelayMessage) *model.CacheRelayMessage
+
+// PartitionChatter is a chatter that knows who is in the cluster and can talk to one node at a time.
+// Messages sent with SendToNode are delivered to the ObjectListener of the target node
+type PartitionChatter interface {
+	CacheChatter
+	// NodeID the ID of this node as seen by the other members
+	NodeID() string
+	// Members the live members of the cluster, including this node
+	Members() []string
+	RegisterMembershipListener(listener MembershipListener)
+	// SendToNode sends a message to a single node
+	SendToNode(nodeID string, message *model.CacheRelayMessage) error
+	// FetchFromNode sends a RelayFetch to a single node and waits for the answer
+	FetchFromNode(nodeID string, message *model.CacheRelayMessage) (*model.CacheRelayMessage, error)
+	RegisterFetchHandler(handler FetchHandler)
+}
+
+// ContextPartitionChatter a PartitionChatter whose sends and fetches can be cancelled or bounded by a deadline
+type ContextPartitionChatter interface {
+	PartitionChatter
+	ContextChatter
+	SendToNodeCtx(ctx context.Context, nodeID string, message *model.CacheRelayMessage) error
+	FetchFromNodeCtx(ctx context.Context, nodeID string, message *model.CacheRelayMessage) (*model.CacheRelayMessage, error)
+}
+
+// waitContext waits on wg, giving up with the ctx error when ctx is done first
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// checkListenAddr refuses to accept traffic from other hosts when nothing keeps them from writing to the cache.
+// secured is whether the relay has TLS or a pass phrase, without either only a loopback address is allowed
+func checkListenAddr(addr string, secured bool) error {
+	if secured || isLoopbackAddr(addr) {
+		return nil
+	}
+	return fmt.Errorf("refusing to listen on %s without TLS or %s, any host reaching it could write to the cache", addr, MasterPassPhraseEnvVar)
+}
+
+// isLoopbackAddr whether the host of a host:port only takes connections from this host
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package chatter
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/theotw/chatty-cache/pkg/logging"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NatsEmbeddedEnvVar true runs a nats server inside the process for the relay to connect to, NATS_SERVER is ignored
+const NatsEmbeddedEnvVar = "CHATTY_NATS_EMBEDDED"
+
+// NatsEmbeddedListenEnvVar host:port the embedded server takes clients on, port -1 picks a free one
+const NatsEmbeddedListenEnvVar = "CHATTY_NATS_EMBEDDED_LISTEN"
+
+// NatsClusterListenEnvVar host:port the embedded server takes routes from the other nodes on, empty for no cluster
+const NatsClusterListenEnvVar = "CHATTY_NATS_CLUSTER_LISTEN"
+
+// NatsRoutesEnvVar comma separated host:port cluster addresses of the other nodes.  Every node can be given the same
+// list, a route to itself is spotted and dropped
+const NatsRoutesEnvVar = "CHATTY_NATS_ROUTES"
+
+// NatsClusterNameEnvVar the nats cluster name, routes are only made between servers with the same name
+const NatsClusterNameEnvVar = "CHATTY_NATS_CLUSTER_NAME"
+
+// NatsClusterUserEnvVar and NatsClusterPasswordEnvVar the log in routes have to give, every node needs the same.  Set
+// them when the cluster listens on anything but loopback, otherwise any server that can reach it can join
+const NatsClusterUserEnvVar = "CHATTY_NATS_CLUSTER_USER"
+const NatsClusterPasswordEnvVar = "CHATTY_NATS_CLUSTER_PASSWORD"
+
+const NatsEmbeddedListenDefault = "127.0.0.1:30221"
+
+// NatsClusterListenDefault no cluster, the embedded server only serves this process
+const NatsClusterListenDefault = ""
+const NatsClusterNameDefault = "chatty"
+
+// embeddedStartTimeout how long to wait on the embedded server to take connections
+const embeddedStartTimeout = 10 * time.Second
+
+// startEmbeddedNats starts a nats server on the embedded and cluster settings of config and waits for it to take
+// connections
+func startEmbeddedNats(logger logging.Logger, serverName string, config *NatsConfig) (*server.Server, error) {
+	opts := &server.Options{
+		ServerName: serverName,
+		NoLog:      true,
+		NoSigs:     true,
+	}
+	var err error
+	opts.Host, opts.Port, err = splitListen(config.EmbeddedListen)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s: %v", NatsEmbeddedListenEnvVar, err)
+	}
+	if len(config.ClusterListen) == 0 {
+		if len(config.Routes) > 0 {
+			return nil, fmt.Errorf("routes need %s", NatsClusterListenEnvVar)
+		}
+		return runEmbeddedNats(logger, opts)
+	}
+	opts.Cluster.Name = config.ClusterName
+	opts.Cluster.Host, opts.Cluster.Port, err = splitListen(config.ClusterListen)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s: %v", NatsClusterListenEnvVar, err)
+	}
+	opts.Cluster.Username = config.ClusterUser
+	opts.Cluster.Password = config.ClusterPassword
+	if len(config.ClusterUser) == 0 && !net.ParseIP(opts.Cluster.Host).IsLoopback() {
+		logger.Warnf("The nats cluster on %s takes routes from any server, set %s and %s", config.ClusterListen,
+			NatsClusterUserEnvVar, NatsClusterPasswordEnvVar)
+	}
+	for _, route := range config.Routes {
+		if !strings.Contains(route, "://") {
+			route = "nats-route://" + route
+		}
+		u, err := url.Parse(route)
+		if err != nil {
+			return nil, fmt.Errorf("bad route %s: %v", route, err)
+		}
+		if u.User == nil && len(config.ClusterUser) > 0 {
+			u.User = url.UserPassword(config.ClusterUser, config.ClusterPassword)
+		}
+		opts.Routes = append(opts.Routes, u)
+	}
+	return runEmbeddedNats(logger, opts)
+}
+
+// runEmbeddedNats starts the server and waits for it to take connections
+func runEmbeddedNats(logger logging.Logger, opts *server.Options) (*server.Server, error) {
+	s, err := server.NewServer(opts)
+	if err != nil {
+		return nil, err
+	}
+	go s.Start()
+	if !s.ReadyForConnections(embeddedStartTimeout) {
+		s.Shutdown()
+		return nil, errors.New("embedded nats server did not start")
+	}
+	if opts.Cluster.Port == 0 {
+		logger.Infof("Embedded nats server on %s, not clustered", s.ClientURL())
+	} else {
+		logger.Infof("Embedded nats server on %s, cluster %s on %s with %d routes", s.ClientURL(), opts.Cluster.Name, s.ClusterAddr(), len(opts.Routes))
+	}
+	return s, nil
+}
+
+// splitListen splits host:port, an empty host listens on every interface
+func splitListen(listen string) (string, int, error) {
+	host, portText, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(host) == 0 {
+		host = "0.0.0.0"
+	}
+	return host, port, nil
+}
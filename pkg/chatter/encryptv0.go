@@ -57,24 +57,44 @@ func DoAesCBCEncrypt(src, key []byte) ([]byte, error) {
 }
 
 func DoAesCBCDecrypt(src, key []byte) ([]byte, error) {
+	out, err := doAesCBCDecryptPadded(src, key)
+	if err != nil {
+		return nil, err
+	}
+	out = unPadTheZeros(out)
+	return out, nil
+}
+
+// doAesCBCDecryptPadded decrypts without taking the zero padding off
+func doAesCBCDecryptPadded(src, key []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
 	bs := block.BlockSize()
-	out := make([]byte, len(src)-bs)
-	iv := src[:bs]
-
-	if len(src)%bs != 0 {
+	if len(src) < bs || len(src)%bs != 0 {
 		return nil, errors.New("not padded properly")
 	}
+	out := make([]byte, len(src)-bs)
+	iv := src[:bs]
 
 	cbcMode := cipher.NewCBCDecrypter(block, iv)
 	cbcMode.CryptBlocks(out, src[bs:])
-
-	out = unPadTheZeros(out)
 	return out, nil
 }
+
+// decryptMessageKey the message key is random so it can start or end with zeros, unpadding would eat them.
+// It is always 32 bytes so just take those
+func decryptMessageKey(src, masterKey []byte) ([]byte, error) {
+	out, err := doAesCBCDecryptPadded(src, masterKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) < 32 {
+		return nil, errors.New("message key is too short")
+	}
+	return out[:32], nil
+}
 func addZeroPadding(ciphertext []byte, blockSize int) []byte {
 	padding := blockSize - len(ciphertext)%blockSize
 	padtext := bytes.Repeat([]byte{0}, padding)
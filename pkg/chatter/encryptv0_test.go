@@ -27,4 +27,13 @@ func TestAesCBC(t *testing.T) {
 	plainText2 := string(plainBits2)
 	assert.Equal(t, plainText, plainText2, "we should get the same things back")
 
+	//message keys are random bytes, zeros at either end have to survive
+	messageKey := makeRandom256AesKey()
+	messageKey[0] = 0
+	messageKey[31] = 0
+	cipherText, err = DoAesCBCEncrypt(messageKey, key0)
+	assert.Nil(t, err)
+	messageKey2, err := decryptMessageKey(cipherText, key0)
+	assert.Nil(t, err)
+	assert.Equal(t, messageKey, messageKey2)
 }
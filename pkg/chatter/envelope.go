@@ -0,0 +1,336 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package chatter
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"sync"
+)
+
+type encryptedRelayMessage struct {
+	//MessageKey base 64 encoded message key
+	MessageKey string `json:"messageKey"`
+	//CipherData base64 encoded cipher data of the jsonified model.CacheRelayMessag
+	CipherData string `json:"cipherData"`
+}
+
+type protocolVersion int
+
+const noEncryption0 = protocolVersion(0)
+const encryption0 = protocolVersion(1)
+
+type replicateCacheMessage struct {
+	ProtocolVersion protocolVersion `json:"protocolVersion"`
+	MessageData     string          `json:"messageData"`
+	NodeID          string          `json:"nodeID"`
+	// TenantID is in the clear so the receiver can pick the tenant's key, it must match the one inside
+	TenantID string `json:"tenantID,omitempty"`
+}
+
+// envelopeCodec turns relay messages into the wire envelope and back, encrypting when a pass phrase is set
+type envelopeCodec struct {
+	nodeID           string
+	masterPassPhrase string
+
+	tenantLock        sync.RWMutex
+	tenantPassPhrases map[string]string
+
+	statsLock sync.Mutex
+	stats     ReplicationStats
+}
+
+// ReplicationStats counts of the envelopes a chatter has sent and received, keyed by protocol version
+type ReplicationStats struct {
+	Sent     map[int]uint64
+	Received map[int]uint64
+	// Dropped received envelopes that could not be decoded or decrypted, a version we do not know shows up here
+	Dropped         map[int]uint64
+	DecodeFailures  uint64
+	DecryptFailures uint64
+	// SendFailures messages a peer did not get because the relay could not hand them on, for relays that queue per peer
+	SendFailures uint64
+}
+
+// countVersion adds one to the count for version, making the map on first use
+func countVersion(counts *map[int]uint64, version protocolVersion) {
+	if *counts == nil {
+		*counts = make(map[int]uint64)
+	}
+	(*counts)[int(version)]++
+}
+
+// copyCounts a copy of counts that is never nil
+func copyCounts(counts map[int]uint64) map[int]uint64 {
+	ret := make(map[int]uint64, len(counts))
+	for k, v := range counts {
+		ret[k] = v
+	}
+	return ret
+}
+
+// replicationStats a snapshot of the counts
+func (t *envelopeCodec) replicationStats() ReplicationStats {
+	t.statsLock.Lock()
+	defer t.statsLock.Unlock()
+	ret := t.stats
+	ret.Sent = copyCounts(t.stats.Sent)
+	ret.Received = copyCounts(t.stats.Received)
+	ret.Dropped = copyCounts(t.stats.Dropped)
+	return ret
+}
+
+// countSendFailure counts a message a peer did not get
+func (t *envelopeCodec) countSendFailure() {
+	t.statsLock.Lock()
+	t.stats.SendFailures++
+	t.statsLock.Unlock()
+}
+
+// setTenantPassPhrase messages for tenantID use phrase instead of the master pass phrase, an empty phrase goes back to the master
+func (t *envelopeCodec) setTenantPassPhrase(tenantID string, phrase string) {
+	t.tenantLock.Lock()
+	if t.tenantPassPhrases == nil {
+		t.tenantPassPhrases = make(map[string]string)
+	}
+	if len(phrase) == 0 {
+		delete(t.tenantPassPhrases, tenantID)
+	} else {
+		t.tenantPassPhrases[tenantID] = phrase
+	}
+	t.tenantLock.Unlock()
+}
+
+func (t *envelopeCodec) passPhraseFor(tenantID string) string {
+	if len(tenantID) > 0 {
+		t.tenantLock.RLock()
+		phrase, ok := t.tenantPassPhrases[tenantID]
+		t.tenantLock.RUnlock()
+		if ok {
+			return phrase
+		}
+	}
+	return t.masterPassPhrase
+}
+
+func (t *envelopeCodec) hasTenantPassPhrase(tenantID string) bool {
+	t.tenantLock.RLock()
+	_, ok := t.tenantPassPhrases[tenantID]
+	t.tenantLock.RUnlock()
+	return ok
+}
+
+// EnvelopeCodec encodes and decodes the envelopes the relays send, for tools that watch or publish replication
+// traffic without being a node
+type EnvelopeCodec struct {
+	codec *envelopeCodec
+}
+
+// EnvelopeHeader what an envelope says in the clear
+type EnvelopeHeader struct {
+	// ProtocolVersion 0 for a message in the clear, 1 for one encrypted with a pass phrase
+	ProtocolVersion int
+	NodeID          string
+	TenantID        string
+}
+
+// NewEnvelopeCodec a codec stamping nodeID on what it encodes, masterPassPhrase empty sends in the clear
+func NewEnvelopeCodec(nodeID string, masterPassPhrase string) *EnvelopeCodec {
+	ret := new(EnvelopeCodec)
+	ret.codec = &envelopeCodec{nodeID: nodeID, masterPassPhrase: masterPassPhrase}
+	return ret
+}
+
+// SetTenantPassPhrase messages for tenantID use phrase instead of the master pass phrase
+func (t *EnvelopeCodec) SetTenantPassPhrase(tenantID string, phrase string) {
+	t.codec.setTenantPassPhrase(tenantID, phrase)
+}
+
+// Encode the envelope for message
+func (t *EnvelopeCodec) Encode(message *model.CacheRelayMessage) ([]byte, error) {
+	return t.codec.encode(message)
+}
+
+// Decode the message in an envelope with the NodeID of the sender filled in.  The header is returned whenever the
+// envelope itself could be read, so a message that does not decrypt can still be told apart from garbage
+func (t *EnvelopeCodec) Decode(bits []byte) (*model.CacheRelayMessage, *EnvelopeHeader, error) {
+	var x replicateCacheMessage
+	err := json.Unmarshal(bits, &x)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error decoding a cache sync message: %w", err)
+	}
+	header := &EnvelopeHeader{ProtocolVersion: int(x.ProtocolVersion), NodeID: x.NodeID, TenantID: x.TenantID}
+	message, err := t.codec.decodeEnvelope(&x)
+	return message, header, err
+}
+
+// Encrypted whether the message was encrypted with a pass phrase
+func (t *EnvelopeHeader) Encrypted() bool {
+	return protocolVersion(t.ProtocolVersion) == encryption0
+}
+
+// encode wraps the message in a replicate envelope stamped with our node ID
+func (t *envelopeCodec) encode(message *model.CacheRelayMessage) ([]byte, error) {
+	var syncMsg replicateCacheMessage
+	syncMsg.NodeID = t.nodeID
+	syncMsg.TenantID = message.TenantID
+	bits, err := json.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode a cache relay message: %w", err)
+	}
+	phrase := t.passPhraseFor(message.TenantID)
+	if len(phrase) == 0 {
+		syncMsg.ProtocolVersion = noEncryption0
+	} else {
+		bits, err = encrypt0(bits, phrase)
+		if err != nil {
+			return nil, err
+		}
+		syncMsg.ProtocolVersion = encryption0
+	}
+	syncMsg.MessageData = base64.StdEncoding.EncodeToString(bits)
+	bits, err = json.Marshal(&syncMsg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode a replication message: %w", err)
+	}
+	t.statsLock.Lock()
+	countVersion(&t.stats.Sent, syncMsg.ProtocolVersion)
+	t.statsLock.Unlock()
+	return bits, nil
+}
+
+func encrypt0(plainBits []byte, phrase string) ([]byte, error) {
+	var cipherMessage encryptedRelayMessage
+	masterKey := makeAesKey(phrase)
+	messageKeyPlainText := makeRandom256AesKey()
+	messageKeyCipherText, err := DoAesCBCEncrypt(messageKeyPlainText, masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encrypt the message key: %w", err)
+	}
+	cipherMessage.MessageKey = base64.StdEncoding.EncodeToString(messageKeyCipherText)
+	messageCipherText, err := DoAesCBCEncrypt(plainBits, messageKeyPlainText)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encrypt the message data: %w", err)
+	}
+	cipherMessage.CipherData = base64.StdEncoding.EncodeToString(messageCipherText)
+	bits, err := json.Marshal(cipherMessage)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode a cipher cache relay message: %w", err)
+	}
+	return bits, nil
+}
+
+// decode unwraps an envelope and returns the relay message and the node ID that sent it
+func (t *envelopeCodec) decode(bits []byte) (*model.CacheRelayMessage, string, error) {
+	var x replicateCacheMessage
+	err := json.Unmarshal(bits, &x)
+	if err != nil {
+		t.statsLock.Lock()
+		t.stats.DecodeFailures++
+		t.statsLock.Unlock()
+		return nil, "", fmt.Errorf("error decoding a cache sync message: %w", err)
+	}
+	relayMsg, err := t.decodeEnvelope(&x)
+	t.statsLock.Lock()
+	countVersion(&t.stats.Received, x.ProtocolVersion)
+	if err != nil {
+		countVersion(&t.stats.Dropped, x.ProtocolVersion)
+		if x.ProtocolVersion == encryption0 {
+			t.stats.DecryptFailures++
+		} else {
+			t.stats.DecodeFailures++
+		}
+	}
+	t.statsLock.Unlock()
+	return relayMsg, x.NodeID, err
+}
+
+// decodeEnvelope the relay message inside an envelope that has been unmarshalled
+func (t *envelopeCodec) decodeEnvelope(x *replicateCacheMessage) (*model.CacheRelayMessage, error) {
+	var relayMsg *model.CacheRelayMessage
+	var err error
+	switch x.ProtocolVersion {
+	case noEncryption0:
+		if t.hasTenantPassPhrase(x.TenantID) {
+			return nil, fmt.Errorf("recieved an unencrypted message for tenant %s which has its own key", x.TenantID)
+		}
+		if len(t.masterPassPhrase) > 0 {
+			// with a key set only someone holding it may write, a message in the clear could come from anyone
+			return nil, errors.New("recieved an unencrypted message but a pass phrase is configured")
+		}
+		relayMsg, err = t.decodeUnencrypted(x)
+	case encryption0:
+		relayMsg, err = t.decodeEncrypted0(x, t.passPhraseFor(x.TenantID))
+	default:
+		err = fmt.Errorf("recieved a cache relay message with an unknown protocol version %d", x.ProtocolVersion)
+	}
+	if err == nil && relayMsg.TenantID != x.TenantID {
+		// someone holding one tenant's key is trying to write into another tenant
+		return nil, fmt.Errorf("envelope tenant %q does not match message tenant %q", x.TenantID, relayMsg.TenantID)
+	}
+	if err == nil && relayMsg.Action == model.RelayFlush {
+		// only a relay that lost messages raises a flush, on its own node.  One off the wire would empty every cache
+		return nil, fmt.Errorf("recieved a %s from node %s, it never comes over the wire", relayMsg.Action, x.NodeID)
+	}
+	if relayMsg != nil {
+		relayMsg.NodeID = x.NodeID
+	}
+	return relayMsg, err
+}
+
+func (t *envelopeCodec) decodeUnencrypted(msg *replicateCacheMessage) (*model.CacheRelayMessage, error) {
+	relayMsg := new(model.CacheRelayMessage)
+	bits, err := base64.StdEncoding.DecodeString(msg.MessageData)
+	if err != nil {
+		return nil, fmt.Errorf("unable to base 64 decode message data: %w", err)
+	}
+	err = json.Unmarshal(bits, relayMsg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal message data: %w", err)
+	}
+	return relayMsg, nil
+}
+
+func (t *envelopeCodec) decodeEncrypted0(msg *replicateCacheMessage, phrase string) (*model.CacheRelayMessage, error) {
+	if len(phrase) == 0 {
+		return nil, errors.New("recieved an encrypted message but no pass phrase is configured")
+	}
+	var cipherMessage encryptedRelayMessage
+	cipherMessageBits, err := base64.StdEncoding.DecodeString(msg.MessageData)
+	if err != nil {
+		return nil, fmt.Errorf("unable to base 64 decode cipher message data: %w", err)
+	}
+	err = json.Unmarshal(cipherMessageBits, &cipherMessage)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal cipher message data: %w", err)
+	}
+	masterKey := makeAesKey(phrase)
+	messageKeyCipherBits, err := base64.StdEncoding.DecodeString(cipherMessage.MessageKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to base 64 decode messageKey: %w", err)
+	}
+	messageKey, err := decryptMessageKey(messageKeyCipherBits, masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt messageKey: %w", err)
+	}
+	msgDataCipherBits, err := base64.StdEncoding.DecodeString(cipherMessage.CipherData)
+	if err != nil {
+		return nil, fmt.Errorf("unable to base 64 decode message cipher data: %w", err)
+	}
+	plainBits, err := DoAesCBCDecrypt(msgDataCipherBits, messageKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decypt message cipher data: %w", err)
+	}
+
+	relayMsg := new(model.CacheRelayMessage)
+	err = json.Unmarshal(plainBits, relayMsg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal message data: %w", err)
+	}
+	return relayMsg, nil
+}
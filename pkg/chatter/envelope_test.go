@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package chatter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"testing"
+)
+
+func TestEnvelope(t *testing.T) {
+	sender := &envelopeCodec{nodeID: "node0", masterPassPhrase: "master"}
+	receiver := &envelopeCodec{nodeID: "node1", masterPassPhrase: "master"}
+	msg := &model.CacheRelayMessage{CacheName: "users", CacheKey: "key1", CacheValue: "dmFsdWU=", Version: 42}
+
+	bits, err := sender.encode(msg)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(bits), "users", "should be encrypted")
+	out, nodeID, err := receiver.decode(bits)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "node0", nodeID)
+		assert.Equal(t, "node0", out.NodeID)
+		assert.Equal(t, msg.CacheValue, out.CacheValue)
+		assert.Equal(t, msg.Version, out.Version)
+	}
+
+	plain := &envelopeCodec{nodeID: "node2"}
+	bits, _ = plain.encode(msg)
+	_, _, err = plain.decode(bits)
+	assert.Nil(t, err)
+	_, _, err = receiver.decode(bits)
+	assert.NotNil(t, err, "no unencrypted messages once a pass phrase is set")
+	_, _, err = plain.decode([]byte("not json"))
+	assert.NotNil(t, err)
+
+	t.Run("Tenant keys", func(t *testing.T) {
+		sender.setTenantPassPhrase("acme", "acme secret")
+		tenantMsg := &model.CacheRelayMessage{TenantID: "acme", CacheName: "users", CacheKey: "key1"}
+		bits, err := sender.encode(tenantMsg)
+		assert.Nil(t, err)
+		_, _, err = receiver.decode(bits)
+		assert.NotNil(t, err, "master key should not open a tenant message")
+
+		receiver.setTenantPassPhrase("acme", "acme secret")
+		out, _, err := receiver.decode(bits)
+		if assert.Nil(t, err) {
+			assert.Equal(t, "acme", out.TenantID)
+		}
+
+		// a message for globex inside an envelope claiming to be acme
+		forged := &model.CacheRelayMessage{TenantID: "globex", CacheName: "users", CacheKey: "key1"}
+		bits, _ = sender.encode(forged)
+		bits = []byte(string(bits[:len(bits)-1]) + `,"tenantID":"acme"}`)
+		_, _, err = receiver.decode(bits)
+		assert.NotNil(t, err, "tenant in the envelope must match the message")
+
+		bits, _ = plain.encode(tenantMsg)
+		_, _, err = receiver.decode(bits)
+		assert.NotNil(t, err, "no unencrypted messages for a tenant with a key")
+	})
+
+	t.Run("Flush", func(t *testing.T) {
+		receiver := &envelopeCodec{nodeID: "node1", masterPassPhrase: "master"}
+		bits, err := sender.encode(&model.CacheRelayMessage{Action: model.RelayFlush})
+		assert.Nil(t, err)
+		out, _, err := receiver.decode(bits)
+		assert.NotNil(t, err, "a flush is raised by the relay, not sent by other nodes")
+		assert.Nil(t, out)
+		assert.Equal(t, map[int]uint64{1: 1}, receiver.replicationStats().Dropped)
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		sender := &envelopeCodec{nodeID: "node0", masterPassPhrase: "master"}
+		receiver := &envelopeCodec{nodeID: "node1", masterPassPhrase: "other"}
+		plain := &envelopeCodec{nodeID: "node2"}
+		bits, _ := sender.encode(msg)
+		receiver.decode(bits)
+		bits, _ = plain.encode(msg)
+		receiver.decode(bits)
+		receiver.decode([]byte(`{"protocolVersion":9}`))
+		receiver.decode([]byte("not json"))
+
+		assert.Equal(t, map[int]uint64{1: 1}, sender.replicationStats().Sent)
+		stats := receiver.replicationStats()
+		assert.Equal(t, map[int]uint64{0: 1, 1: 1, 9: 1}, stats.Received)
+		assert.Equal(t, map[int]uint64{0: 1, 1: 1, 9: 1}, stats.Dropped, "the message in the clear, the wrong key and the unknown version")
+		assert.Equal(t, uint64(1), stats.DecryptFailures)
+		assert.Equal(t, uint64(3), stats.DecodeFailures)
+		assert.Empty(t, stats.Sent)
+	})
+}
+
+func TestEnvelopeCodec(t *testing.T) {
+	sender := NewEnvelopeCodec("node0", "master")
+	bits, err := sender.Encode(&model.CacheRelayMessage{TenantID: "acme", CacheName: "users", CacheKey: "key1"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	message, header, err := NewEnvelopeCodec("", "master").Decode(bits)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "node0", message.NodeID)
+		assert.Equal(t, &EnvelopeHeader{ProtocolVersion: 1, NodeID: "node0", TenantID: "acme"}, header)
+		assert.True(t, header.Encrypted())
+	}
+	_, header, err = NewEnvelopeCodec("", "wrong").Decode(bits)
+	assert.NotNil(t, err)
+	assert.Equal(t, "node0", header.NodeID, "the header is readable without the key")
+	_, header, err = NewEnvelopeCodec("", "master").Decode([]byte("not json"))
+	assert.NotNil(t, err)
+	assert.Nil(t, header)
+}
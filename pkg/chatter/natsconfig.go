@@ -0,0 +1,442 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package chatter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/theotw/chatty-cache/pkg/logging"
+	"github.com/theotw/chatty-cache/pkg/model"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// NatsUserEnvVar and NatsPasswordEnvVar log in with a user and password
+const NatsUserEnvVar = "CHATTY_NATS_USER"
+const NatsPasswordEnvVar = "CHATTY_NATS_PASSWORD"
+
+// NatsTokenEnvVar logs in with a token
+const NatsTokenEnvVar = "CHATTY_NATS_TOKEN"
+
+// NatsNKeySeedEnvVar a file holding the NKey seed to log in with
+const NatsNKeySeedEnvVar = "CHATTY_NATS_NKEY_SEED"
+
+// NatsCredsEnvVar a .creds file holding the user JWT and NKey seed to log in with
+const NatsCredsEnvVar = "CHATTY_NATS_CREDS"
+
+// NatsTLSCAEnvVar the PEM file of the CA the server certificate is checked against, the system roots if not set
+const NatsTLSCAEnvVar = "CHATTY_NATS_TLS_CA"
+
+// NatsTLSCertEnvVar and NatsTLSKeyEnvVar the PEM client certificate and key, for servers that verify clients
+const NatsTLSCertEnvVar = "CHATTY_NATS_TLS_CERT"
+const NatsTLSKeyEnvVar = "CHATTY_NATS_TLS_KEY"
+
+// NatsTLSServerNameEnvVar the name to check the server certificate against instead of the host in the URL
+const NatsTLSServerNameEnvVar = "CHATTY_NATS_TLS_SERVER_NAME"
+
+// NatsConfig how a NatMessagesChatterRelay connects and what it uses on nats.  NatsConfigFromEnv fills it from the
+// environment, which is what NewNatsMessageChatterRelay starts from
+type NatsConfig struct {
+	// URLs the nats servers to connect to, ignored when Conn is set or Embedded is on
+	URLs []string
+	// Conn an existing connection to share, the relay leaves it open on Close
+	Conn *nats.Conn
+	// Name the connection name the nats server shows
+	Name string
+	// NatsOptions more nats.go connect options, anything not covered here
+	NatsOptions []nats.Option
+
+	// User and Password, Token, NKeySeedFile and CredsFile are the nats ways to log in, set the one the server uses
+	User         string
+	Password     string
+	Token        string
+	NKeySeedFile string
+	CredsFile    string
+
+	// TLSCAFile checks the server certificate, TLSCertFile and TLSKeyFile are the client certificate for servers that
+	// verify clients.  Setting any of them turns TLS on
+	TLSCAFile     string
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSServerName string
+	// TLSConfig is used as it is instead of the TLS files
+	TLSConfig *tls.Config
+
+	// NodeID the ID of this node, a random UUID when empty.  It has to be unique across the cluster
+	NodeID string
+	// MasterPassPhrase messages are encrypted with it, they go in the clear when it is empty
+	MasterPassPhrase string
+
+	ReplicateSubject string
+	// LegacySubject also publishes untenanted replication on the bare ReplicateSubject, which is all nodes from before
+	// per cache name subjects listen on.  Turn it on while a rolling upgrade still has some
+	LegacySubject bool
+	MemberSubject string
+	NodeSubject   string
+	TenantSubject string
+	// Namespaces the cache name patterns listened to
+	Namespaces []string
+	// Tenants the tenant IDs listened to, * for all of them
+	Tenants []string
+
+	// Embedded runs a nats server in the process and connects to it, clustered with Routes when ClusterListen is set
+	Embedded       bool
+	EmbeddedListen string
+	ClusterListen  string
+	ClusterName    string
+	Routes         []string
+	// ClusterUser and ClusterPassword the log in routes between the embedded servers use, empty for none
+	ClusterUser     string
+	ClusterPassword string
+
+	// Logger what the relay logs through, logging.Default when nil.  Unlike SetLogger it is in use while connecting
+	Logger logging.Logger
+}
+
+// NatsOption changes the config a relay is made with
+type NatsOption func(config *NatsConfig)
+
+// DefaultNatsConfig the defaults without looking at the environment
+func DefaultNatsConfig() *NatsConfig {
+	ret := new(NatsConfig)
+	ret.URLs = []string{NatsServerURLDefault}
+	ret.ReplicateSubject = MessageReplicationSubject
+	ret.MemberSubject = MemberSubjectDefault
+	ret.NodeSubject = NodeSubjectDefault
+	ret.TenantSubject = TenantSubjectDefault
+	ret.Namespaces = []string{AllNamespaces}
+	ret.Tenants = []string{"*"}
+	ret.EmbeddedListen = NatsEmbeddedListenDefault
+	ret.ClusterListen = NatsClusterListenDefault
+	ret.ClusterName = NatsClusterNameDefault
+	return ret
+}
+
+// NatsConfigFromEnv the defaults with anything set in the environment on top
+func NatsConfigFromEnv() *NatsConfig {
+	ret := DefaultNatsConfig()
+	ret.URLs = splitNamespaces(model.GetEnvVarWithDefault(NatsURLEnvVar, NatsServerURLDefault))
+	ret.MasterPassPhrase = model.GetEnvVarWithDefault(MasterPassPhraseEnvVar, "")
+	ret.ReplicateSubject = model.GetEnvVarWithDefault(MessageReplicateChannelEnvVar, ret.ReplicateSubject)
+	ret.LegacySubject, _ = strconv.ParseBool(model.GetEnvVarWithDefault(LegacySubjectEnvVar, "false"))
+	ret.MemberSubject = model.GetEnvVarWithDefault(MemberSubjectEnvVar, ret.MemberSubject)
+	ret.NodeSubject = model.GetEnvVarWithDefault(NodeSubjectEnvVar, ret.NodeSubject)
+	ret.TenantSubject = model.GetEnvVarWithDefault(TenantSubjectEnvVar, ret.TenantSubject)
+	ret.Namespaces = splitNamespaces(model.GetEnvVarWithDefault(NamespacesEnvVar, AllNamespaces))
+	ret.Tenants = splitNamespaces(model.GetEnvVarWithDefault(TenantsEnvVar, "*"))
+	ret.User = model.GetEnvVarWithDefault(NatsUserEnvVar, "")
+	ret.Password = model.GetEnvVarWithDefault(NatsPasswordEnvVar, "")
+	ret.Token = model.GetEnvVarWithDefault(NatsTokenEnvVar, "")
+	ret.NKeySeedFile = model.GetEnvVarWithDefault(NatsNKeySeedEnvVar, "")
+	ret.CredsFile = model.GetEnvVarWithDefault(NatsCredsEnvVar, "")
+	ret.TLSCAFile = model.GetEnvVarWithDefault(NatsTLSCAEnvVar, "")
+	ret.TLSCertFile = model.GetEnvVarWithDefault(NatsTLSCertEnvVar, "")
+	ret.TLSKeyFile = model.GetEnvVarWithDefault(NatsTLSKeyEnvVar, "")
+	ret.TLSServerName = model.GetEnvVarWithDefault(NatsTLSServerNameEnvVar, "")
+	ret.Embedded, _ = strconv.ParseBool(model.GetEnvVarWithDefault(NatsEmbeddedEnvVar, "false"))
+	ret.EmbeddedListen = model.GetEnvVarWithDefault(NatsEmbeddedListenEnvVar, ret.EmbeddedListen)
+	ret.ClusterListen = model.GetEnvVarWithDefault(NatsClusterListenEnvVar, ret.ClusterListen)
+	ret.ClusterName = model.GetEnvVarWithDefault(NatsClusterNameEnvVar, ret.ClusterName)
+	ret.Routes = splitNamespaces(model.GetEnvVarWithDefault(NatsRoutesEnvVar, ""))
+	ret.ClusterUser = model.GetEnvVarWithDefault(NatsClusterUserEnvVar, "")
+	ret.ClusterPassword = model.GetEnvVarWithDefault(NatsClusterPasswordEnvVar, "")
+	return ret
+}
+
+// WithNatsConfig uses config instead of the environment, with what it leaves empty from DefaultNatsConfig.  It replaces
+// what earlier options set so put it first, later options still apply on top of it
+func WithNatsConfig(config NatsConfig) NatsOption {
+	return func(c *NatsConfig) {
+		*c = config
+		c.fillDefaults()
+	}
+}
+
+// fillDefaults sets what is empty to DefaultNatsConfig, none of them work empty
+func (t *NatsConfig) fillDefaults() {
+	defaults := DefaultNatsConfig()
+	if len(t.URLs) == 0 {
+		t.URLs = defaults.URLs
+	}
+	if len(t.ReplicateSubject) == 0 {
+		t.ReplicateSubject = defaults.ReplicateSubject
+	}
+	if len(t.MemberSubject) == 0 {
+		t.MemberSubject = defaults.MemberSubject
+	}
+	if len(t.NodeSubject) == 0 {
+		t.NodeSubject = defaults.NodeSubject
+	}
+	if len(t.TenantSubject) == 0 {
+		t.TenantSubject = defaults.TenantSubject
+	}
+	if t.Namespaces == nil {
+		t.Namespaces = defaults.Namespaces
+	}
+	if t.Tenants == nil {
+		t.Tenants = defaults.Tenants
+	}
+	if len(t.EmbeddedListen) == 0 {
+		t.EmbeddedListen = defaults.EmbeddedListen
+	}
+	if len(t.ClusterName) == 0 {
+		t.ClusterName = defaults.ClusterName
+	}
+}
+
+// validate an error naming what is missing when the relay cannot work with the config
+func (t *NatsConfig) validate() error {
+	subjects := []struct {
+		name    string
+		subject string
+	}{
+		{"ReplicateSubject", t.ReplicateSubject},
+		{"MemberSubject", t.MemberSubject},
+		{"NodeSubject", t.NodeSubject},
+		{"TenantSubject", t.TenantSubject},
+	}
+	for _, s := range subjects {
+		if len(s.subject) == 0 {
+			return fmt.Errorf("nats config has no %s", s.name)
+		}
+	}
+	if t.Conn == nil && !t.Embedded && len(t.URLs) == 0 {
+		return errors.New("nats config has no URLs, Conn or Embedded")
+	}
+	if t.Embedded && len(t.EmbeddedListen) == 0 {
+		return errors.New("nats config is Embedded with no EmbeddedListen")
+	}
+	return nil
+}
+
+// WithNatsLogger what the relay logs through, from the start
+func WithNatsLogger(logger logging.Logger) NatsOption {
+	return func(config *NatsConfig) {
+		config.Logger = logger
+	}
+}
+
+// WithNatsURLs the servers to connect to
+func WithNatsURLs(urls ...string) NatsOption {
+	return func(config *NatsConfig) {
+		config.URLs = urls
+	}
+}
+
+// WithNatsConn shares an existing connection instead of making one
+func WithNatsConn(nc *nats.Conn) NatsOption {
+	return func(config *NatsConfig) {
+		config.Conn = nc
+	}
+}
+
+// WithNatsName the connection name the nats server shows
+func WithNatsName(name string) NatsOption {
+	return func(config *NatsConfig) {
+		config.Name = name
+	}
+}
+
+// WithNatsOptions adds nats.go connect options
+func WithNatsOptions(opts ...nats.Option) NatsOption {
+	return func(config *NatsConfig) {
+		config.NatsOptions = append(config.NatsOptions, opts...)
+	}
+}
+
+// WithNatsUserInfo logs in with a user and password
+func WithNatsUserInfo(user string, password string) NatsOption {
+	return func(config *NatsConfig) {
+		config.User = user
+		config.Password = password
+	}
+}
+
+// WithNatsToken logs in with a token
+func WithNatsToken(token string) NatsOption {
+	return func(config *NatsConfig) {
+		config.Token = token
+	}
+}
+
+// WithNatsNKeyFile logs in with the NKey seed in seedFile
+func WithNatsNKeyFile(seedFile string) NatsOption {
+	return func(config *NatsConfig) {
+		config.NKeySeedFile = seedFile
+	}
+}
+
+// WithNatsCredsFile logs in with the user JWT and seed in a .creds file
+func WithNatsCredsFile(credsFile string) NatsOption {
+	return func(config *NatsConfig) {
+		config.CredsFile = credsFile
+	}
+}
+
+// WithNatsTLS turns on TLS checking the server against the CA in caFile, certFile and keyFile may be empty when the
+// server does not verify clients
+func WithNatsTLS(caFile string, certFile string, keyFile string) NatsOption {
+	return func(config *NatsConfig) {
+		config.TLSCAFile = caFile
+		config.TLSCertFile = certFile
+		config.TLSKeyFile = keyFile
+	}
+}
+
+// WithNatsTLSServerName checks the server certificate against name instead of the host in the URL
+func WithNatsTLSServerName(name string) NatsOption {
+	return func(config *NatsConfig) {
+		config.TLSServerName = name
+	}
+}
+
+// WithNatsTLSConfig turns on TLS with a config made by the caller
+func WithNatsTLSConfig(tlsConfig *tls.Config) NatsOption {
+	return func(config *NatsConfig) {
+		config.TLSConfig = tlsConfig
+	}
+}
+
+// WithNatsNodeID sets the node ID instead of a random one
+func WithNatsNodeID(nodeID string) NatsOption {
+	return func(config *NatsConfig) {
+		config.NodeID = nodeID
+	}
+}
+
+// WithNatsPassPhrase encrypts with phrase, an empty phrase sends messages in the clear
+func WithNatsPassPhrase(phrase string) NatsOption {
+	return func(config *NatsConfig) {
+		config.MasterPassPhrase = phrase
+	}
+}
+
+// WithNatsSubject the prefix replication is published under
+func WithNatsSubject(subject string) NatsOption {
+	return func(config *NatsConfig) {
+		config.ReplicateSubject = subject
+	}
+}
+
+// WithNatsLegacySubject also publishes on the bare subject for nodes from before per cache name subjects, see
+// NatsConfig.LegacySubject
+func WithNatsLegacySubject(on bool) NatsOption {
+	return func(config *NatsConfig) {
+		config.LegacySubject = on
+	}
+}
+
+// WithNatsEmbedded runs a nats server in the process taking clients on listen and routes on clusterListen, clustered
+// with routes.  An empty clusterListen is a server of its own
+func WithNatsEmbedded(listen string, clusterListen string, routes ...string) NatsOption {
+	return func(config *NatsConfig) {
+		config.Embedded = true
+		config.EmbeddedListen = listen
+		config.ClusterListen = clusterListen
+		config.Routes = routes
+	}
+}
+
+// WithNatsClusterAuth the log in the embedded servers' routes take and give, see NatsClusterUserEnvVar
+func WithNatsClusterAuth(user string, password string) NatsOption {
+	return func(config *NatsConfig) {
+		config.ClusterUser = user
+		config.ClusterPassword = password
+	}
+}
+
+// Connect connects to URLs with the log in and TLS of the config, for tools that talk to the cluster's nats without a
+// relay.  Conn and Embedded are not looked at
+func (t *NatsConfig) Connect() (*nats.Conn, error) {
+	opts, err := t.connectOptions()
+	if err != nil {
+		return nil, err
+	}
+	return nats.Connect(strings.Join(t.URLs, ","), opts...)
+}
+
+// SubjectForCache the subject a relay with this config publishes cacheName on, tenantID empty for an untenanted one
+func (t *NatsConfig) SubjectForCache(tenantID string, cacheName string) string {
+	if len(tenantID) > 0 {
+		return t.TenantSubject + "." + subjectTokens(tenantID, false) + "." + subjectTokens(cacheName, false)
+	}
+	return t.ReplicateSubject + "." + subjectTokens(cacheName, false)
+}
+
+// ReplicationSubjects the subjects every replicated message is published on, bare ones from older nodes included
+func (t *NatsConfig) ReplicationSubjects() []string {
+	return []string{t.ReplicateSubject, t.ReplicateSubject + ".>", t.TenantSubject + ".>"}
+}
+
+// connectOptions the nats.go options for the config
+func (t *NatsConfig) connectOptions() ([]nats.Option, error) {
+	ret := make([]nats.Option, 0, len(t.NatsOptions)+3)
+	if len(t.Name) > 0 {
+		ret = append(ret, nats.Name(t.Name))
+	}
+	if len(t.User) > 0 {
+		ret = append(ret, nats.UserInfo(t.User, t.Password))
+	}
+	if len(t.Token) > 0 {
+		ret = append(ret, nats.Token(t.Token))
+	}
+	if len(t.NKeySeedFile) > 0 {
+		opt, err := nats.NkeyOptionFromSeed(t.NKeySeedFile)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, opt)
+	}
+	if len(t.CredsFile) > 0 {
+		ret = append(ret, nats.UserCredentials(t.CredsFile))
+	}
+	tlsConfig, err := t.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		ret = append(ret, nats.Secure(tlsConfig))
+	}
+	return append(ret, t.NatsOptions...), nil
+}
+
+// tlsConfig the TLS config to connect with, nil when TLS is not set up
+func (t *NatsConfig) tlsConfig() (*tls.Config, error) {
+	if t.TLSConfig != nil {
+		return t.TLSConfig, nil
+	}
+	if len(t.TLSCAFile) == 0 && len(t.TLSCertFile) == 0 && len(t.TLSKeyFile) == 0 && len(t.TLSServerName) == 0 {
+		return nil, nil
+	}
+	ret := &tls.Config{
+		ServerName: t.TLSServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(t.TLSCAFile) > 0 {
+		caBits, err := os.ReadFile(t.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		ret.RootCAs = x509.NewCertPool()
+		if !ret.RootCAs.AppendCertsFromPEM(caBits) {
+			return nil, errors.New("no certificates found in " + t.TLSCAFile)
+		}
+	}
+	if len(t.TLSCertFile) > 0 || len(t.TLSKeyFile) > 0 {
+		if len(t.TLSCertFile) == 0 || len(t.TLSKeyFile) == 0 {
+			return nil, fmt.Errorf("a nats client certificate needs both %s and %s", NatsTLSCertEnvVar, NatsTLSKeyEnvVar)
+		}
+		cert, err := tls.LoadX509KeyPair(t.TLSCertFile, t.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		ret.Certificates = []tls.Certificate{cert}
+	}
+	return ret, nil
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package chatter
+
+import (
+	"context"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// runAuthServer starts an embedded nats server with the auth set up in opts on a random port, returning its URL
+func runAuthServer(t *testing.T, opts *server.Options) string {
+	opts.Host = "127.0.0.1"
+	opts.Port = -1
+	opts.NoLog = true
+	opts.NoSigs = true
+	s, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(10 * time.Second) {
+		t.Fatal("nats server did not start")
+	}
+	t.Cleanup(s.Shutdown)
+	return s.ClientURL()
+}
+
+// connects checks a relay made with opts can connect to url
+func connects(t *testing.T, url string, opts ...NatsOption) bool {
+	opts = append([]NatsOption{WithNatsConfig(*DefaultNatsConfig()), WithNatsURLs(url)}, opts...)
+	relay, err := NewNatsMessageChatterRelay(opts...)
+	if err != nil {
+		return false
+	}
+	relay.Close(context.Background())
+	return true
+}
+
+func TestNatsAuth(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, bits []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, bits, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	t.Run("User and password", func(t *testing.T) {
+		url := runAuthServer(t, &server.Options{Username: "chatty", Password: "secret"})
+		assert.True(t, connects(t, url, WithNatsUserInfo("chatty", "secret")))
+		assert.False(t, connects(t, url, WithNatsUserInfo("chatty", "wrong")))
+		assert.False(t, connects(t, url))
+
+		t.Setenv(NatsURLEnvVar, url)
+		t.Setenv(NatsUserEnvVar, "chatty")
+		t.Setenv(NatsPasswordEnvVar, "secret")
+		relay, err := NewNatsMessageChatterRelay()
+		if assert.Nil(t, err, "from the environment") {
+			relay.Close(context.Background())
+		}
+	})
+
+	t.Run("Token", func(t *testing.T) {
+		url := runAuthServer(t, &server.Options{Authorization: "s3cr3t"})
+		assert.True(t, connects(t, url, WithNatsToken("s3cr3t")))
+		assert.False(t, connects(t, url, WithNatsToken("guess")))
+	})
+
+	t.Run("NKey", func(t *testing.T) {
+		user, _ := nkeys.CreateUser()
+		public, _ := user.PublicKey()
+		seed, _ := user.Seed()
+		other, _ := nkeys.CreateUser()
+		otherSeed, _ := other.Seed()
+		url := runAuthServer(t, &server.Options{Nkeys: []*server.NkeyUser{{Nkey: public}}})
+		assert.True(t, connects(t, url, WithNatsNKeyFile(write("user.nk", seed))))
+		assert.False(t, connects(t, url, WithNatsNKeyFile(write("other.nk", otherSeed))))
+		assert.False(t, connects(t, url, WithNatsNKeyFile(filepath.Join(dir, "missing.nk"))))
+	})
+
+	t.Run("Creds", func(t *testing.T) {
+		operator, _ := nkeys.CreateOperator()
+		operatorPublic, _ := operator.PublicKey()
+		operatorClaims := jwt.NewOperatorClaims(operatorPublic)
+		account, _ := nkeys.CreateAccount()
+		accountPublic, _ := account.PublicKey()
+		accountJWT, err := jwt.NewAccountClaims(accountPublic).Encode(operator)
+		if !assert.Nil(t, err) {
+			return
+		}
+		user, _ := nkeys.CreateUser()
+		userPublic, _ := user.PublicKey()
+		userSeed, _ := user.Seed()
+		userJWT, err := jwt.NewUserClaims(userPublic).Encode(account)
+		if !assert.Nil(t, err) {
+			return
+		}
+		creds, err := jwt.FormatUserConfig(userJWT, userSeed)
+		if !assert.Nil(t, err) {
+			return
+		}
+		resolver := &server.MemAccResolver{}
+		resolver.Store(accountPublic, accountJWT)
+		url := runAuthServer(t, &server.Options{TrustedOperators: []*jwt.OperatorClaims{operatorClaims}, AccountResolver: resolver})
+
+		assert.True(t, connects(t, url, WithNatsCredsFile(write("user.creds", creds))))
+		// a user signed by an account the server does not know
+		stranger, _ := nkeys.CreateAccount()
+		strangerJWT, _ := jwt.NewUserClaims(userPublic).Encode(stranger)
+		strangerCreds, _ := jwt.FormatUserConfig(strangerJWT, userSeed)
+		assert.False(t, connects(t, url, WithNatsCredsFile(write("stranger.creds", strangerCreds))))
+	})
+
+	t.Run("TLS", func(t *testing.T) {
+		certs := writeTestCerts(t)
+		ca, cert, key := filepath.Join(certs, "ca.pem"), filepath.Join(certs, "cert.pem"), filepath.Join(certs, "key.pem")
+		tlsConfig, err := server.GenTLSConfig(&server.TLSConfigOpts{CertFile: cert, KeyFile: key, CaFile: ca, Verify: true})
+		if !assert.Nil(t, err) {
+			return
+		}
+		url := runAuthServer(t, &server.Options{TLSConfig: tlsConfig, TLSVerify: true, TLS: true, TLSTimeout: 2})
+
+		assert.True(t, connects(t, url, WithNatsTLS(ca, cert, key)))
+		assert.False(t, connects(t, url, WithNatsTLS(ca, "", "")), "the server wants a client certificate")
+		assert.False(t, connects(t, url), "TLS is required")
+		assert.False(t, connects(t, url, WithNatsTLS(ca, cert, "")), "a certificate needs its key")
+		assert.False(t, connects(t, url, WithNatsTLS(ca, cert, key), WithNatsTLSServerName("somewhere.else")), "the certificate is not for that name")
+		assert.True(t, connects(t, url, WithNatsTLS(ca, cert, key), WithNatsTLSServerName("127.0.0.1")))
+
+		t.Setenv(NatsURLEnvVar, url)
+		t.Setenv(NatsTLSCAEnvVar, ca)
+		t.Setenv(NatsTLSCertEnvVar, cert)
+		t.Setenv(NatsTLSKeyEnvVar, key)
+		t.Setenv(NatsTLSServerNameEnvVar, "somewhere.else")
+		_, err = NewNatsMessageChatterRelay()
+		assert.NotNil(t, err, "the certificate is not for that name")
+		t.Setenv(NatsTLSServerNameEnvVar, "")
+		relay, err := NewNatsMessageChatterRelay()
+		if assert.Nil(t, err, "from the environment") {
+			relay.Close(context.Background())
+		}
+	})
+}
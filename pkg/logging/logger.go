@@ -0,0 +1,174 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+// Package logging is what the caches and relays log through, so they can log wherever the program using them does
+package logging
+
+import (
+	"github.com/sirupsen/logrus"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Logger the logging the caches and relays do
+type Logger interface {
+	Tracef(format string, args ...interface{})
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+	// WithError a logger that adds err to everything it logs
+	WithError(err error) Logger
+}
+
+// PerMessageLimit how many logs a second PerMessage lets through for each cache or relay
+const PerMessageLimit = 20
+
+var defaultLogger = NewLogrusLogger(logrus.StandardLogger())
+
+// Default the global logrus logger, what everything logs through until SetLogger is called
+func Default() Logger {
+	return defaultLogger
+}
+
+// logrusLogger adapts a logrus entry
+type logrusLogger struct {
+	entry *logrus.Entry
+}
+
+// NewLogrusLogger logs through logger
+func NewLogrusLogger(logger *logrus.Logger) Logger {
+	ret := new(logrusLogger)
+	ret.entry = logrus.NewEntry(logger)
+	return ret
+}
+
+func (t *logrusLogger) Tracef(format string, args ...interface{}) {
+	t.entry.Tracef(format, args...)
+}
+
+func (t *logrusLogger) Debugf(format string, args ...interface{}) {
+	t.entry.Debugf(format, args...)
+}
+
+func (t *logrusLogger) Infof(format string, args ...interface{}) {
+	t.entry.Infof(format, args...)
+}
+
+func (t *logrusLogger) Warnf(format string, args ...interface{}) {
+	t.entry.Warnf(format, args...)
+}
+
+func (t *logrusLogger) Errorf(format string, args ...interface{}) {
+	t.entry.Errorf(format, args...)
+}
+
+func (t *logrusLogger) WithError(err error) Logger {
+	return &logrusLogger{entry: t.entry.WithError(err)}
+}
+
+// loggerHolder atomic.Value needs the same concrete type every time
+type loggerHolder struct {
+	logger Logger
+}
+
+// Holder the logger of a cache or relay, embed it to give the type SetLogger.  The zero value logs through Default
+type Holder struct {
+	logger  atomic.Value
+	limiter limiter
+}
+
+// SetLogger logs through logger from now on, nil goes back to Default.  It is safe to call while the cache or relay
+// is in use
+func (t *Holder) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = Default()
+	}
+	t.logger.Store(loggerHolder{logger: logger})
+}
+
+// Logger the logger in use
+func (t *Holder) Logger() Logger {
+	held, ok := t.logger.Load().(loggerHolder)
+	if !ok {
+		return Default()
+	}
+	return held.logger
+}
+
+// PerMessage the logger for what is logged for every message sent or received, so a busy node does not drown the
+// log.  At most PerMessageLimit logs a second get through, the next one to get through says how many were dropped
+func (t *Holder) PerMessage() Logger {
+	return &limitedLogger{logger: t.Logger(), limiter: &t.limiter}
+}
+
+// limiter counts logs in one second windows
+type limiter struct {
+	lock        sync.Mutex
+	windowStart time.Time
+	inWindow    int
+	dropped     int
+}
+
+// allow whether another log fits in the current window, and if it does how many were dropped before it
+func (t *limiter) allow() (bool, int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	if now.Sub(t.windowStart) >= time.Second {
+		t.windowStart = now
+		t.inWindow = 0
+	}
+	if t.inWindow >= PerMessageLimit {
+		t.dropped++
+		return false, 0
+	}
+	t.inWindow++
+	dropped := t.dropped
+	t.dropped = 0
+	return true, dropped
+}
+
+// limitedLogger drops what the limiter does not allow
+type limitedLogger struct {
+	logger  Logger
+	limiter *limiter
+}
+
+// logf logs through log when the limiter allows it
+func (t *limitedLogger) logf(log func(format string, args ...interface{}), format string, args []interface{}) {
+	ok, dropped := t.limiter.allow()
+	if !ok {
+		return
+	}
+	if dropped > 0 {
+		log("Dropped %d per message logs", dropped)
+	}
+	log(format, args...)
+}
+
+func (t *limitedLogger) Tracef(format string, args ...interface{}) {
+	t.logf(t.logger.Tracef, format, args)
+}
+
+func (t *limitedLogger) Debugf(format string, args ...interface{}) {
+	t.logf(t.logger.Debugf, format, args)
+}
+
+func (t *limitedLogger) Infof(format string, args ...interface{}) {
+	t.logf(t.logger.Infof, format, args)
+}
+
+func (t *limitedLogger) Warnf(format string, args ...interface{}) {
+	t.logf(t.logger.Warnf, format, args)
+}
+
+func (t *limitedLogger) Errorf(format string, args ...interface{}) {
+	t.logf(t.logger.Errorf, format, args)
+}
+
+func (t *limitedLogger) WithError(err error) Logger {
+	return &limitedLogger{logger: t.logger.WithError(err), limiter: t.limiter}
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingLogger keeps the formatted lines
+type recordingLogger struct {
+	lines []string
+}
+
+func (t *recordingLogger) record(level string, format string, args []interface{}) {
+	t.lines = append(t.lines, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (t *recordingLogger) Tracef(format string, args ...interface{}) {
+	t.record("trace", format, args)
+}
+
+func (t *recordingLogger) Debugf(format string, args ...interface{}) {
+	t.record("debug", format, args)
+}
+
+func (t *recordingLogger) Infof(format string, args ...interface{}) {
+	t.record("info", format, args)
+}
+
+func (t *recordingLogger) Warnf(format string, args ...interface{}) {
+	t.record("warn", format, args)
+}
+
+func (t *recordingLogger) Errorf(format string, args ...interface{}) {
+	t.record("error", format, args)
+}
+
+func (t *recordingLogger) WithError(err error) Logger {
+	return t
+}
+
+func TestHolder(t *testing.T) {
+	var holder Holder
+	assert.Equal(t, Default(), holder.Logger(), "the zero value logs through logrus")
+
+	recorder := new(recordingLogger)
+	holder.SetLogger(recorder)
+	holder.Logger().Debugf("hello %s", "there")
+	assert.Equal(t, []string{"debug hello there"}, recorder.lines)
+
+	holder.SetLogger(nil)
+	assert.Equal(t, Default(), holder.Logger())
+}
+
+func TestPerMessage(t *testing.T) {
+	var holder Holder
+	recorder := new(recordingLogger)
+	holder.SetLogger(recorder)
+	for i := 0; i < PerMessageLimit+5; i++ {
+		holder.PerMessage().Tracef("message %d", i)
+	}
+	assert.Equal(t, PerMessageLimit, len(recorder.lines))
+	assert.Equal(t, "trace message 0", recorder.lines[0])
+
+	// the next window says what was dropped
+	holder.limiter.windowStart = holder.limiter.windowStart.Add(-2 * time.Second)
+	holder.PerMessage().WithError(errors.New("bad")).Tracef("next")
+	assert.Equal(t, []string{"trace Dropped 5 per message logs", "trace next"}, recorder.lines[PerMessageLimit:])
+
+	holder.Logger().Errorf("not limited")
+	assert.Equal(t, "error not limited", recorder.lines[len(recorder.lines)-1])
+}
+
+func TestLogrus(t *testing.T) {
+	out := new(bytes.Buffer)
+	logger := logrus.New()
+	logger.SetOutput(out)
+	logger.SetLevel(logrus.DebugLevel)
+	adapter := NewLogrusLogger(logger)
+	adapter.Tracef("hidden")
+	adapter.WithError(errors.New("boom")).Warnf("careful %d", 1)
+	assert.False(t, strings.Contains(out.String(), "hidden"))
+	assert.Contains(t, out.String(), "careful 1")
+	assert.Contains(t, out.String(), "error=boom")
+	assert.Contains(t, out.String(), "level=warning")
+}
@@ -0,0 +1,61 @@
+//go:build go1.21
+
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// LevelTrace the slog level Tracef logs at, below slog.LevelDebug
+const LevelTrace = slog.LevelDebug - 4
+
+// slogLogger adapts a slog logger
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogLogger logs through logger, Tracef logs at LevelTrace
+func NewSlogLogger(logger *slog.Logger) Logger {
+	ret := new(slogLogger)
+	ret.logger = logger
+	return ret
+}
+
+// logf formats only when level is enabled
+func (t *slogLogger) logf(level slog.Level, format string, args []interface{}) {
+	ctx := context.Background()
+	if !t.logger.Enabled(ctx, level) {
+		return
+	}
+	t.logger.Log(ctx, level, fmt.Sprintf(format, args...))
+}
+
+func (t *slogLogger) Tracef(format string, args ...interface{}) {
+	t.logf(LevelTrace, format, args)
+}
+
+func (t *slogLogger) Debugf(format string, args ...interface{}) {
+	t.logf(slog.LevelDebug, format, args)
+}
+
+func (t *slogLogger) Infof(format string, args ...interface{}) {
+	t.logf(slog.LevelInfo, format, args)
+}
+
+func (t *slogLogger) Warnf(format string, args ...interface{}) {
+	t.logf(slog.LevelWarn, format, args)
+}
+
+func (t *slogLogger) Errorf(format string, args ...interface{}) {
+	t.logf(slog.LevelError, format, args)
+}
+
+func (t *slogLogger) WithError(err error) Logger {
+	return &slogLogger{logger: t.logger.With("error", err)}
+}
@@ -0,0 +1,32 @@
+//go:build go1.21
+
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlog(t *testing.T) {
+	out := new(bytes.Buffer)
+	adapter := NewSlogLogger(slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	adapter.Tracef("hidden")
+	adapter.WithError(errors.New("boom")).Errorf("failed %s", "badly")
+	assert.False(t, strings.Contains(out.String(), "hidden"))
+	assert.Contains(t, out.String(), `msg="failed badly"`)
+	assert.Contains(t, out.String(), "error=boom")
+	assert.Contains(t, out.String(), "level=ERROR")
+
+	out.Reset()
+	adapter = NewSlogLogger(slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{Level: LevelTrace})))
+	adapter.Tracef("shown")
+	assert.Contains(t, out.String(), "shown")
+}
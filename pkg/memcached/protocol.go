@@ -0,0 +1,435 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package memcached
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/theotw/chatty-cache/pkg/cache"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Version what the version command answers
+const Version = "chatty-cache"
+
+// MaxKeyLength the longest key memcached takes
+const MaxKeyLength = 250
+
+// maxLineLength the longest command line, enough for a get of a few hundred keys
+const maxLineLength = 64 * 1024
+
+// maxRelativeExpiry expiries up to 30 days are seconds from now, longer ones are unix times
+const maxRelativeExpiry = 30 * 24 * 60 * 60
+
+// touchAttempts how often touch tries again when a put gets in between its get and put
+const touchAttempts = 3
+
+// item what is stored for a memcached key
+type item struct {
+	Flags uint32 `json:"flags,omitempty"`
+	Data  []byte `json:"data"`
+}
+
+// session one client connection
+type session struct {
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// reply writes line unless the client said noreply
+func (t *session) reply(noreply bool, line string) {
+	if noreply {
+		return
+	}
+	t.writer.WriteString(line)
+	t.writer.WriteString("\r\n")
+}
+
+func (t *Server) serveConn(conn net.Conn) {
+	defer t.untrack(conn)
+	defer conn.Close()
+	s := &session{reader: bufio.NewReaderSize(conn, maxLineLength), writer: bufio.NewWriter(conn)}
+	for {
+		line, err := s.reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			s.reply(false, "CLIENT_ERROR line too long")
+			s.writer.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		quit := t.command(s, strings.Fields(string(line)))
+		// pipelined commands get their replies together
+		if s.reader.Buffered() == 0 || quit {
+			if s.writer.Flush() != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// command runs one command line, true when the client is done
+func (t *Server) command(s *session, fields []string) bool {
+	if len(fields) == 0 {
+		s.reply(false, "ERROR")
+		return false
+	}
+	ctx := t.ctx
+	args := fields[1:]
+	switch fields[0] {
+	case "get":
+		t.get(ctx, s, args, false)
+	case "gets":
+		t.get(ctx, s, args, true)
+	case "set", "add", "replace", "cas":
+		t.store(ctx, s, fields[0], args)
+	case "delete":
+		t.delete(ctx, s, args)
+	case "touch":
+		t.touch(ctx, s, args)
+	case "flush_all":
+		t.flushAll(ctx, s, args)
+	case "stats":
+		t.stats(s, args)
+	case "version":
+		s.reply(false, "VERSION "+Version)
+	case "verbosity":
+		s.reply(noreply(args, 2), "OK")
+	case "quit":
+		return true
+	default:
+		s.reply(false, "ERROR")
+	}
+	return false
+}
+
+func (t *Server) get(ctx context.Context, s *session, keys []string, withCas bool) {
+	if len(keys) == 0 {
+		s.reply(false, "ERROR")
+		return
+	}
+	for _, key := range keys {
+		if !validKey(key) {
+			s.reply(false, "CLIENT_ERROR bad key")
+			return
+		}
+	}
+	for _, key := range keys {
+		atomic.AddUint64(&t.gets, 1)
+		cacheName, cacheKey := t.cacheNameAndKey(key)
+		var value item
+		version, err := t.cache.GetVersioned(ctx, cacheName, cacheKey, &value)
+		switch problem(err) {
+		case "":
+		case cache.NoItem, cache.NotJsonifiable:
+			// not jsonifiable is a value some other client put, which is not an item
+			atomic.AddUint64(&t.misses, 1)
+			continue
+		default:
+			s.reply(false, "SERVER_ERROR "+err.Error())
+			return
+		}
+		atomic.AddUint64(&t.hits, 1)
+		if withCas {
+			fmt.Fprintf(s.writer, "VALUE %s %d %d %d\r\n", key, value.Flags, len(value.Data), version)
+		} else {
+			fmt.Fprintf(s.writer, "VALUE %s %d %d\r\n", key, value.Flags, len(value.Data))
+		}
+		s.writer.Write(value.Data)
+		s.writer.WriteString("\r\n")
+	}
+	s.reply(false, "END")
+}
+
+// store set, add, replace and cas: <command> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]
+func (t *Server) store(ctx context.Context, s *session, command string, args []string) {
+	want := 4
+	if command == "cas" {
+		want = 5
+	}
+	var casUnique int64
+	flags, flagsErr := strconv.ParseUint(arg(args, 1), 10, 32)
+	exptime, exptimeErr := strconv.ParseInt(arg(args, 2), 10, 64)
+	size, sizeErr := strconv.Atoi(arg(args, 3))
+	var casErr error
+	if command == "cas" {
+		casUnique, casErr = strconv.ParseInt(arg(args, 4), 10, 64)
+	}
+	if len(args) < want || len(args) > want+1 || (len(args) == want+1 && args[want] != "noreply") ||
+		flagsErr != nil || exptimeErr != nil || sizeErr != nil || size < 0 || casErr != nil {
+		s.reply(false, "CLIENT_ERROR bad command line format")
+		return
+	}
+	quiet := len(args) == want+1
+	if size > t.maxItemSize {
+		io.CopyN(io.Discard, s.reader, int64(size)+2)
+		s.reply(quiet, "SERVER_ERROR object too large for cache")
+		return
+	}
+	data := make([]byte, size+2)
+	_, err := io.ReadFull(s.reader, data)
+	if err != nil || !bytes.HasSuffix(data, []byte("\r\n")) {
+		// the rest of the line is data too long for the size given, not a command
+		if err == nil && !bytes.HasSuffix(data, []byte("\n")) {
+			s.reader.ReadSlice('\n')
+		}
+		s.reply(false, "CLIENT_ERROR bad data chunk")
+		return
+	}
+	if !validKey(args[0]) {
+		s.reply(false, "CLIENT_ERROR bad key")
+		return
+	}
+	atomic.AddUint64(&t.sets, 1)
+
+	opts := ttlOptions(exptime, time.Now())
+	switch command {
+	case "add":
+		opts = append(opts, cache.IfAbsent())
+	case "replace":
+		opts = append(opts, cache.IfPresent())
+	case "cas":
+		opts = append(opts, cache.IfVersion(casUnique))
+	}
+	cacheName, cacheKey := t.cacheNameAndKey(args[0])
+	err = t.cache.PutCtx(ctx, cacheName, cacheKey, item{Flags: uint32(flags), Data: data[:size]}, opts...)
+	switch problem(err) {
+	case "":
+		s.reply(quiet, "STORED")
+	case cache.VersionConflict:
+		if command == "cas" {
+			s.reply(quiet, "EXISTS")
+		} else {
+			s.reply(quiet, "NOT_STORED")
+		}
+	case cache.NoItem:
+		if command == "cas" {
+			s.reply(quiet, "NOT_FOUND")
+		} else {
+			s.reply(quiet, "NOT_STORED")
+		}
+	case cache.ExceedsTotalCacheSize, cache.ExceedsCacheSize, cache.ObjectToLarge, cache.ExceedsTenantQuota:
+		s.reply(quiet, "SERVER_ERROR out of memory storing object")
+	default:
+		s.reply(quiet, "SERVER_ERROR "+err.Error())
+	}
+}
+
+// delete <key> [noreply]
+func (t *Server) delete(ctx context.Context, s *session, args []string) {
+	if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[1] != "noreply") {
+		s.reply(false, "CLIENT_ERROR bad command line format")
+		return
+	}
+	if !validKey(args[0]) {
+		s.reply(false, "CLIENT_ERROR bad key")
+		return
+	}
+	quiet := len(args) == 2
+	cacheName, cacheKey := t.cacheNameAndKey(args[0])
+	_, err := t.cache.Entry("", cacheName, cacheKey)
+	found := err == nil
+	// deleted anyway, other nodes may hold what this one does not
+	err = t.cache.DeleteCtx(ctx, cacheName, cacheKey)
+	if err != nil {
+		s.reply(quiet, "SERVER_ERROR "+err.Error())
+		return
+	}
+	if found {
+		s.reply(quiet, "DELETED")
+	} else {
+		s.reply(quiet, "NOT_FOUND")
+	}
+}
+
+// touch <key> <exptime> [noreply], the value is put again with the new expiry
+func (t *Server) touch(ctx context.Context, s *session, args []string) {
+	exptime, err := strconv.ParseInt(arg(args, 1), 10, 64)
+	if len(args) < 2 || len(args) > 3 || (len(args) == 3 && args[2] != "noreply") || err != nil {
+		s.reply(false, "CLIENT_ERROR bad command line format")
+		return
+	}
+	if !validKey(args[0]) {
+		s.reply(false, "CLIENT_ERROR bad key")
+		return
+	}
+	quiet := len(args) == 3
+	cacheName, cacheKey := t.cacheNameAndKey(args[0])
+	for attempt := 0; attempt < touchAttempts; attempt++ {
+		var value json.RawMessage
+		version, err := t.cache.GetVersioned(ctx, cacheName, cacheKey, &value)
+		if err == nil {
+			opts := append(ttlOptions(exptime, time.Now()), cache.IfVersion(version))
+			err = t.cache.PutCtx(ctx, cacheName, cacheKey, value, opts...)
+		}
+		switch problem(err) {
+		case "":
+			s.reply(quiet, "TOUCHED")
+			return
+		case cache.NoItem:
+			s.reply(quiet, "NOT_FOUND")
+			return
+		case cache.VersionConflict:
+			continue
+		default:
+			s.reply(quiet, "SERVER_ERROR "+err.Error())
+			return
+		}
+	}
+	s.reply(quiet, "SERVER_ERROR busy, try again")
+}
+
+// flushAll flush_all [delay] [noreply], deletes every key of the mapped cache names across the cluster
+func (t *Server) flushAll(ctx context.Context, s *session, args []string) {
+	quiet := len(args) > 0 && args[len(args)-1] == "noreply"
+	if quiet {
+		args = args[:len(args)-1]
+	}
+	var delay int64
+	var err error
+	if len(args) == 1 {
+		delay, err = strconv.ParseInt(args[0], 10, 64)
+	}
+	if len(args) > 1 || err != nil || delay < 0 {
+		s.reply(false, "CLIENT_ERROR bad command line format")
+		return
+	}
+	if delay > 0 {
+		time.AfterFunc(time.Duration(delay)*time.Second, func() {
+			if !t.isClosed() {
+				t.flush(t.ctx)
+			}
+		})
+		s.reply(quiet, "OK")
+		return
+	}
+	err = t.flush(ctx)
+	if err != nil {
+		s.reply(quiet, "SERVER_ERROR "+err.Error())
+		return
+	}
+	s.reply(quiet, "OK")
+}
+
+func (t *Server) flush(ctx context.Context) error {
+	var ret error
+	for _, cacheName := range t.cacheNames() {
+		count, err := t.cache.DeleteNamespace(ctx, "", cacheName)
+		if err != nil {
+			t.Logger().WithError(err).Errorf("Unable to flush %s", cacheName)
+			if ret == nil {
+				ret = err
+			}
+			continue
+		}
+		t.Logger().Debugf("Flushed %d keys of %s", count, cacheName)
+	}
+	return ret
+}
+
+// stats the general stats, the items and bytes are those of the mapped cache names
+func (t *Server) stats(s *session, args []string) {
+	if len(args) > 0 {
+		// no settings, slabs or items to tell of
+		s.reply(false, "END")
+		return
+	}
+	cacheStats := t.cache.Stats()
+	var items int
+	var used uint64
+	for _, cacheName := range t.cacheNames() {
+		ns := cacheStats.Namespaces[cacheName]
+		items = items + ns.Entries
+		used = used + ns.Bytes
+	}
+	now := time.Now()
+	stat := func(name string, value interface{}) {
+		fmt.Fprintf(s.writer, "STAT %s %v\r\n", name, value)
+	}
+	stat("pid", os.Getpid())
+	stat("uptime", int64(now.Sub(t.started).Seconds()))
+	stat("time", now.Unix())
+	stat("version", Version)
+	stat("curr_connections", atomic.LoadInt64(&t.currConnections))
+	stat("total_connections", atomic.LoadUint64(&t.totalConnections))
+	stat("cmd_get", atomic.LoadUint64(&t.gets))
+	stat("cmd_set", atomic.LoadUint64(&t.sets))
+	stat("get_hits", atomic.LoadUint64(&t.hits))
+	stat("get_misses", atomic.LoadUint64(&t.misses))
+	stat("curr_items", items)
+	stat("bytes", used)
+	stat("limit_maxbytes", cacheStats.MaxBytes)
+	stat("evictions", cacheStats.Evictions[cache.EvictedForSpace]+cacheStats.Evictions[cache.EvictedForTenantQuota])
+	s.reply(false, "END")
+}
+
+// ttlOptions the TTL of a memcached expiry, none for 0.  An expiry in the past still puts, so it replicates, with the
+// shortest TTL there is
+func ttlOptions(exptime int64, now time.Time) []cache.PutOption {
+	var ttl time.Duration
+	switch {
+	case exptime == 0:
+		return nil
+	case exptime < 0:
+		ttl = time.Nanosecond
+	case exptime <= maxRelativeExpiry:
+		ttl = time.Duration(exptime) * time.Second
+	default:
+		ttl = time.Unix(exptime, 0).Sub(now)
+		if ttl <= 0 {
+			ttl = time.Nanosecond
+		}
+	}
+	return []cache.PutOption{cache.WithTTL(ttl)}
+}
+
+// validKey no longer than MaxKeyLength with no spaces or control characters
+func validKey(key string) bool {
+	if len(key) == 0 || len(key) > MaxKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// noreply whether args ends in noreply at position n or before
+func noreply(args []string, n int) bool {
+	return len(args) > 0 && len(args) <= n && args[len(args)-1] == "noreply"
+}
+
+// arg the nth arg, empty when there are fewer
+func arg(args []string, n int) string {
+	if n < len(args) {
+		return args[n]
+	}
+	return ""
+}
+
+// problem the ProblemType of err, empty for nil and the error text for an error that is not a CacheError
+func problem(err error) cache.ProblemType {
+	var cacheErr *cache.CacheError
+	if errors.As(err, &cacheErr) {
+		return cacheErr.Problem
+	}
+	if err != nil {
+		return cache.ProblemType(err.Error())
+	}
+	return ""
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+// Package memcached serves an InMemCache over the memcached text protocol, so services with a memcached client get
+// the replication of the cache without code changes.  Keys are mapped to cache names by prefix, see WithPrefix
+package memcached
+
+import (
+	"context"
+	"errors"
+	"github.com/theotw/chatty-cache/pkg/cache"
+	"github.com/theotw/chatty-cache/pkg/logging"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultCacheName the cache name of keys that match no prefix
+const DefaultCacheName = "memcached"
+
+// DefaultMaxItemSize the largest value a client may store, as memcached's -I default
+const DefaultMaxItemSize = 1024 * 1024
+
+// ErrServerClosed is returned by Serve after Close
+var ErrServerClosed = errors.New("memcached: server closed")
+
+// Option configures the server
+type Option func(s *Server)
+
+// WithPrefix keys starting with prefix go to cacheName with the prefix taken off.  The longest matching prefix wins
+func WithPrefix(prefix string, cacheName string) Option {
+	return func(s *Server) {
+		s.prefixes = append(s.prefixes, prefixMapping{prefix: prefix, cacheName: cacheName})
+	}
+}
+
+// WithDefaultCacheName the cache name of keys that match no prefix, DefaultCacheName if not given
+func WithDefaultCacheName(cacheName string) Option {
+	return func(s *Server) {
+		s.defaultCacheName = cacheName
+	}
+}
+
+// WithMaxItemSize the largest value a client may store, DefaultMaxItemSize if not given
+func WithMaxItemSize(size int) Option {
+	return func(s *Server) {
+		s.maxItemSize = size
+	}
+}
+
+// prefixMapping the cache name of the keys starting with prefix
+type prefixMapping struct {
+	prefix    string
+	cacheName string
+}
+
+// Server speaks the memcached text protocol on the listeners given to Serve:
+//
+//	get/gets, set/add/replace/cas, delete, touch, flush_all, stats, version, verbosity and quit
+//
+// The flags and data of an item are stored as JSON, the expiry becomes the TTL of the put and the cas unique is the
+// version of the entry.  add, replace, cas and touch are checked against this node only
+type Server struct {
+	// the counts are first so they stay 64 bit aligned
+	gets             uint64
+	sets             uint64
+	hits             uint64
+	misses           uint64
+	totalConnections uint64
+	currConnections  int64
+
+	logging.Holder
+	cache            *cache.InMemCache
+	prefixes         []prefixMapping
+	defaultCacheName string
+	maxItemSize      int
+	started          time.Time
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	lock      sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+}
+
+// NewServer a server over c, call Serve to start taking connections
+func NewServer(c *cache.InMemCache, opts ...Option) *Server {
+	ret := new(Server)
+	ret.cache = c
+	ret.defaultCacheName = DefaultCacheName
+	ret.maxItemSize = DefaultMaxItemSize
+	for _, opt := range opts {
+		opt(ret)
+	}
+	sort.SliceStable(ret.prefixes, func(i, j int) bool {
+		return len(ret.prefixes[i].prefix) > len(ret.prefixes[j].prefix)
+	})
+	ret.started = time.Now()
+	ret.ctx, ret.cancel = context.WithCancel(context.Background())
+	ret.listeners = make(map[net.Listener]struct{})
+	ret.conns = make(map[net.Conn]struct{})
+	return ret
+}
+
+// Serve takes connections on listener until Close, it always returns an error, ErrServerClosed after Close
+func (t *Server) Serve(listener net.Listener) error {
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return ErrServerClosed
+	}
+	t.listeners[listener] = struct{}{}
+	t.lock.Unlock()
+	defer func() {
+		t.lock.Lock()
+		delete(t.listeners, listener)
+		t.lock.Unlock()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if t.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !t.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go t.serveConn(conn)
+	}
+}
+
+// Close stops the listeners and drops the connections, commands in flight finish first
+func (t *Server) Close() error {
+	t.lock.Lock()
+	t.closed = true
+	for listener := range t.listeners {
+		listener.Close()
+	}
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.lock.Unlock()
+	t.cancel()
+	t.wg.Wait()
+	return nil
+}
+
+func (t *Server) isClosed() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.closed
+}
+
+// track adds conn to the connections Close drops, false once closed
+func (t *Server) track(conn net.Conn) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return false
+	}
+	t.conns[conn] = struct{}{}
+	t.wg.Add(1)
+	atomic.AddUint64(&t.totalConnections, 1)
+	atomic.AddInt64(&t.currConnections, 1)
+	return true
+}
+
+func (t *Server) untrack(conn net.Conn) {
+	t.lock.Lock()
+	delete(t.conns, conn)
+	t.lock.Unlock()
+	atomic.AddInt64(&t.currConnections, -1)
+	t.wg.Done()
+}
+
+// cacheNameAndKey the cache name and cache key of a memcached key
+func (t *Server) cacheNameAndKey(key string) (string, string) {
+	for _, mapping := range t.prefixes {
+		if strings.HasPrefix(key, mapping.prefix) {
+			return mapping.cacheName, key[len(mapping.prefix):]
+		}
+	}
+	return t.defaultCacheName, key
+}
+
+// cacheNames every cache name keys are mapped to, what flush_all empties
+func (t *Server) cacheNames() []string {
+	seen := map[string]bool{t.defaultCacheName: true}
+	ret := []string{t.defaultCacheName}
+	for _, mapping := range t.prefixes {
+		if !seen[mapping.cacheName] {
+			seen[mapping.cacheName] = true
+			ret = append(ret, mapping.cacheName)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package memcached
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/theotw/chatty-cache/pkg/cache"
+	"github.com/theotw/chatty-cache/pkg/chatter"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// client a memcached text protocol client over TCP
+type client struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *client {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &client{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// do sends lines and reads back the reply up to and including a line that is one of until
+func (t *client) do(send string, until ...string) []string {
+	_, err := t.conn.Write([]byte(send))
+	if err != nil {
+		t.t.Fatal(err)
+	}
+	var ret []string
+	for {
+		line, err := t.reader.ReadString('\n')
+		if err != nil {
+			t.t.Fatalf("reading the reply to %q: %v", send, err)
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		ret = append(ret, line)
+		for _, u := range until {
+			if line == u || strings.HasPrefix(line, u+" ") {
+				return ret
+			}
+		}
+	}
+}
+
+// serve a server over c on a local port
+func serve(t *testing.T, c *cache.InMemCache, opts ...Option) (*Server, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(c, opts...)
+	go srv.Serve(listener)
+	return srv, listener.Addr().String()
+}
+
+func TestServer(t *testing.T) {
+	c := cache.NewInMemCache(0, nil)
+	srv, addr := serve(t, c, WithPrefix("user:", "users"), WithPrefix("user:admin:", "admins"), WithMaxItemSize(16))
+	defer srv.Close()
+	client := dial(t, addr)
+	defer client.conn.Close()
+	replies := []string{"STORED", "NOT_STORED", "EXISTS", "NOT_FOUND", "DELETED", "TOUCHED", "OK", "END", "ERROR", "CLIENT_ERROR", "SERVER_ERROR"}
+
+	assert.Equal(t, []string{"STORED"}, client.do("set user:bob 42 0 5\r\nhello\r\n", replies...))
+	assert.Equal(t, []string{"VALUE user:bob 42 5", "hello", "END"}, client.do("get user:bob nobody\r\n", replies...))
+	var value item
+	assert.Nil(t, c.Get("users", "bob", &value), "the prefix picks the cache name and is taken off")
+	assert.Equal(t, []byte("hello"), value.Data)
+	assert.Equal(t, []string{"STORED"}, client.do("set user:admin:root 0 0 1\r\nx\r\n", replies...))
+	assert.Nil(t, c.Get("admins", "root", &value), "the longest prefix wins")
+	assert.Equal(t, []string{"STORED"}, client.do("set other 0 0 1\r\ny\r\n", replies...))
+	assert.Nil(t, c.Get(DefaultCacheName, "other", &value))
+
+	t.Run("Conditional", func(t *testing.T) {
+		assert.Equal(t, []string{"NOT_STORED"}, client.do("add user:bob 0 0 1\r\nz\r\n", replies...))
+		assert.Equal(t, []string{"STORED"}, client.do("add user:carol 0 0 1\r\nz\r\n", replies...))
+		assert.Equal(t, []string{"NOT_STORED"}, client.do("replace user:dave 0 0 1\r\nz\r\n", replies...))
+		assert.Equal(t, []string{"STORED"}, client.do("replace user:carol 7 0 2\r\nzz\r\n", replies...))
+
+		lines := client.do("gets user:carol\r\n", replies...)
+		if !assert.Equal(t, 3, len(lines)) {
+			return
+		}
+		var flags, size int
+		var casUnique int64
+		fmt.Sscanf(lines[0], "VALUE user:carol %d %d %d", &flags, &size, &casUnique)
+		assert.Equal(t, 7, flags)
+		assert.NotZero(t, casUnique)
+		assert.Equal(t, []string{"STORED"}, client.do(fmt.Sprintf("cas user:carol 0 0 1 %d\r\na\r\n", casUnique), replies...))
+		assert.Equal(t, []string{"EXISTS"}, client.do(fmt.Sprintf("cas user:carol 0 0 1 %d\r\nb\r\n", casUnique), replies...))
+		assert.Equal(t, []string{"NOT_FOUND"}, client.do("cas user:dave 0 0 1 1\r\nb\r\n", replies...))
+		assert.Equal(t, []string{"VALUE user:carol 0 1", "a", "END"}, client.do("get user:carol\r\n", replies...))
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		assert.Equal(t, []string{"STORED"}, client.do("set user:eve 0 100 1\r\ne\r\n", replies...))
+		info, err := c.Entry("", "users", "eve")
+		if assert.Nil(t, err) {
+			assert.WithinDuration(t, time.Now().Add(100*time.Second), info.Expires, 5*time.Second)
+		}
+		assert.Equal(t, []string{"STORED"}, client.do(fmt.Sprintf("set user:eve 0 %d 1\r\ne\r\n", time.Now().Add(time.Hour).Unix()), replies...))
+		info, err = c.Entry("", "users", "eve")
+		if assert.Nil(t, err) {
+			assert.WithinDuration(t, time.Now().Add(time.Hour), info.Expires, 5*time.Second, "past 30 days it is a unix time")
+		}
+		assert.Equal(t, []string{"TOUCHED"}, client.do("touch user:eve 0\r\n", replies...))
+		info, err = c.Entry("", "users", "eve")
+		if assert.Nil(t, err) {
+			assert.True(t, info.Expires.IsZero(), "touch with 0 keeps it for ever")
+		}
+		assert.Equal(t, []string{"NOT_FOUND"}, client.do("touch user:nobody 10\r\n", replies...))
+		assert.Equal(t, []string{"STORED"}, client.do("set user:eve 0 -1 1\r\ne\r\n", replies...))
+		assert.Equal(t, []string{"END"}, client.do("get user:eve\r\n", replies...), "a negative expiry has already expired")
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		assert.Equal(t, []string{"DELETED"}, client.do("delete user:bob\r\n", replies...))
+		assert.Equal(t, []string{"NOT_FOUND"}, client.do("delete user:bob\r\n", replies...))
+		// noreply gets nothing back, so the get answers first
+		assert.Equal(t, []string{"END"}, client.do("set user:bob 0 0 1 noreply\r\nb\r\ndelete user:bob noreply\r\nget user:bob\r\n", replies...))
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		assert.Equal(t, []string{"ERROR"}, client.do("incr user:bob 1\r\n", replies...))
+		assert.Equal(t, []string{"CLIENT_ERROR bad command line format"}, client.do("set user:bob 0 0\r\n", replies...))
+		assert.Equal(t, []string{"CLIENT_ERROR bad data chunk"}, client.do("set user:bob 0 0 1\r\nxx\r\n", replies...))
+		assert.Equal(t, []string{"ERROR"}, client.do("\r\n", replies...), "the rest of the bad chunk is not a command")
+		assert.Equal(t, []string{"SERVER_ERROR object too large for cache"}, client.do("set user:bob 0 0 17\r\n"+strings.Repeat("x", 17)+"\r\n", replies...))
+		assert.Equal(t, []string{"CLIENT_ERROR bad key"}, client.do("get "+strings.Repeat("k", MaxKeyLength+1)+"\r\n", replies...))
+		assert.Equal(t, []string{"VERSION " + Version}, client.do("version\r\n", "VERSION"))
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		lines := client.do("stats\r\n", replies...)
+		stats := make(map[string]string)
+		for _, line := range lines {
+			parts := strings.SplitN(line, " ", 3)
+			if len(parts) == 3 {
+				stats[parts[1]] = parts[2]
+			}
+		}
+		assert.Equal(t, "1", stats["curr_connections"])
+		assert.Equal(t, "3", stats["curr_items"], "carol, root and other")
+		assert.NotEmpty(t, stats["cmd_get"])
+		assert.NotEmpty(t, stats["get_hits"])
+	})
+
+	t.Run("FlushAll", func(t *testing.T) {
+		assert.Equal(t, []string{"OK"}, client.do("flush_all\r\n", replies...))
+		assert.Equal(t, []string{"END"}, client.do("get user:carol user:admin:root other\r\n", replies...))
+	})
+
+	assert.Nil(t, srv.Close())
+	_, err := client.reader.ReadString('\n')
+	assert.NotNil(t, err, "the connection is dropped")
+}
+
+func TestReplication(t *testing.T) {
+	bus := chatter.NewLocalBus()
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		node, err := bus.NewChatter("")
+		if !assert.Nil(t, err) {
+			return
+		}
+		c := cache.NewInMemCache(0, node)
+		defer c.Close(context.Background())
+		srv, addr := serve(t, c)
+		defer srv.Close()
+		addrs = append(addrs, addr)
+	}
+	client1 := dial(t, addrs[0])
+	defer client1.conn.Close()
+	client2 := dial(t, addrs[1])
+	defer client2.conn.Close()
+
+	assert.Equal(t, []string{"STORED"}, client1.do("set session1 3 0 5\r\nvalue\r\n", "STORED"))
+	bus.Settle()
+	assert.Equal(t, []string{"VALUE session1 3 5", "value", "END"}, client2.do("get session1\r\n", "END"), "the other node has it")
+	assert.Equal(t, []string{"DELETED"}, client2.do("delete session1\r\n", "DELETED", "NOT_FOUND"))
+	bus.Settle()
+	assert.Equal(t, []string{"END"}, client1.do("get session1\r\n", "END"))
+}
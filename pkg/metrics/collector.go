@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+// Package metrics exports cache stats to prometheus.  It is a package of its own so only programs that use it pull
+// in the prometheus client
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/theotw/chatty-cache/pkg/cache"
+	"strconv"
+)
+
+// StatsSource anything with a Stats snapshot, an InMemCache
+type StatsSource interface {
+	Stats() cache.Stats
+}
+
+// Collector a prometheus.Collector that takes a fresh Stats snapshot on every scrape
+type Collector struct {
+	source StatsSource
+
+	hits            *prometheus.Desc
+	misses          *prometheus.Desc
+	puts            *prometheus.Desc
+	entries         *prometheus.Desc
+	cacheBytes      *prometheus.Desc
+	usedBytes       *prometheus.Desc
+	maxBytes        *prometheus.Desc
+	evictions       *prometheus.Desc
+	publishLatency  *prometheus.Desc
+	messages        *prometheus.Desc
+	decodeFailures  *prometheus.Desc
+	decryptFailures *prometheus.Desc
+	sendFailures    *prometheus.Desc
+}
+
+// NewCollector a collector for source, constLabels tell apart several caches in one process and may be nil
+func NewCollector(source StatsSource, constLabels prometheus.Labels) *Collector {
+	ret := new(Collector)
+	ret.source = source
+	desc := func(name string, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc("chatty_"+name, help, labels, constLabels)
+	}
+	ret.hits = desc("cache_hits_total", "Gets found in memory.", "cache")
+	ret.misses = desc("cache_misses_total", "Gets not found in memory, even if then fetched or loaded.", "cache")
+	ret.puts = desc("cache_puts_total", "Puts made on this node.", "cache")
+	ret.entries = desc("cache_entries", "Entries held.", "cache")
+	ret.cacheBytes = desc("cache_bytes", "Bytes held.", "cache")
+	ret.usedBytes = desc("cache_used_bytes", "Bytes held over every cache name.")
+	ret.maxBytes = desc("cache_max_bytes", "The most bytes the cache holds, 0 is no limit.")
+	ret.evictions = desc("cache_evictions_total", "Entries taken out other than by a newer value.", "reason")
+	ret.publishLatency = desc("replication_publish_seconds", "Time taken handing replication messages to the chatter.")
+	ret.messages = desc("replication_messages_total", "Replication envelopes by direction and protocol version.", "direction", "version")
+	ret.decodeFailures = desc("replication_decode_failures_total", "Received envelopes that could not be decoded.")
+	ret.decryptFailures = desc("replication_decrypt_failures_total", "Received envelopes that could not be decrypted.")
+	ret.sendFailures = desc("replication_send_failures_total", "Messages a peer did not get because the relay could not hand them on.")
+	return ret
+}
+
+// Describe sends every descriptor, the replication ones even when the chatter does not count envelopes
+func (t *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{t.hits, t.misses, t.puts, t.entries, t.cacheBytes, t.usedBytes, t.maxBytes,
+		t.evictions, t.publishLatency, t.messages, t.decodeFailures, t.decryptFailures, t.sendFailures} {
+		ch <- d
+	}
+}
+
+// Collect sends the metrics of a fresh snapshot
+func (t *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := t.source.Stats()
+	for name, ns := range stats.Namespaces {
+		ch <- prometheus.MustNewConstMetric(t.hits, prometheus.CounterValue, float64(ns.Hits), name)
+		ch <- prometheus.MustNewConstMetric(t.misses, prometheus.CounterValue, float64(ns.Misses), name)
+		ch <- prometheus.MustNewConstMetric(t.puts, prometheus.CounterValue, float64(ns.Puts), name)
+		ch <- prometheus.MustNewConstMetric(t.entries, prometheus.GaugeValue, float64(ns.Entries), name)
+		ch <- prometheus.MustNewConstMetric(t.cacheBytes, prometheus.GaugeValue, float64(ns.Bytes), name)
+	}
+	ch <- prometheus.MustNewConstMetric(t.usedBytes, prometheus.GaugeValue, float64(stats.UsedBytes))
+	ch <- prometheus.MustNewConstMetric(t.maxBytes, prometheus.GaugeValue, float64(stats.MaxBytes))
+	for reason, count := range stats.Evictions {
+		ch <- prometheus.MustNewConstMetric(t.evictions, prometheus.CounterValue, float64(count), string(reason))
+	}
+
+	buckets := make(map[float64]uint64, len(cache.LatencyBuckets))
+	for i, bound := range cache.LatencyBuckets {
+		buckets[bound.Seconds()] = stats.PublishLatency.Buckets[i]
+	}
+	ch <- prometheus.MustNewConstHistogram(t.publishLatency, stats.PublishLatency.Count, stats.PublishLatency.Sum.Seconds(), buckets)
+
+	if stats.Replication == nil {
+		return
+	}
+	directions := map[string]map[int]uint64{
+		"sent":     stats.Replication.Sent,
+		"received": stats.Replication.Received,
+		"dropped":  stats.Replication.Dropped,
+	}
+	for direction, counts := range directions {
+		for version, count := range counts {
+			ch <- prometheus.MustNewConstMetric(t.messages, prometheus.CounterValue, float64(count), direction, strconv.Itoa(version))
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(t.decodeFailures, prometheus.CounterValue, float64(stats.Replication.DecodeFailures))
+	ch <- prometheus.MustNewConstMetric(t.decryptFailures, prometheus.CounterValue, float64(stats.Replication.DecryptFailures))
+	ch <- prometheus.MustNewConstMetric(t.sendFailures, prometheus.CounterValue, float64(stats.Replication.SendFailures))
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/theotw/chatty-cache/pkg/cache"
+	"github.com/theotw/chatty-cache/pkg/chatter"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fixedStats cache.Stats
+
+func (t fixedStats) Stats() cache.Stats {
+	return cache.Stats(t)
+}
+
+func TestCollector(t *testing.T) {
+	latency := cache.LatencyStats{Count: 2, Sum: 3 * time.Millisecond, Buckets: make([]uint64, len(cache.LatencyBuckets))}
+	for i, bound := range cache.LatencyBuckets {
+		if bound >= 2500*time.Microsecond {
+			latency.Buckets[i] = 2
+		} else if bound >= 500*time.Microsecond {
+			latency.Buckets[i] = 1
+		}
+	}
+	stats := fixedStats{
+		MaxBytes:       100,
+		UsedBytes:      40,
+		Namespaces:     map[string]cache.NamespaceStats{"users": {Hits: 3, Misses: 1, Puts: 2, Entries: 2, Bytes: 40}},
+		Evictions:      map[cache.EvictionReason]uint64{cache.EvictedForSpace: 4},
+		PublishLatency: latency,
+	}
+	t.Run("Cache", func(t *testing.T) {
+		collector := NewCollector(stats, prometheus.Labels{"node": "node0"})
+		registry := prometheus.NewPedanticRegistry()
+		if !assert.Nil(t, registry.Register(collector)) {
+			return
+		}
+		expected := `
+# HELP chatty_cache_hits_total Gets found in memory.
+# TYPE chatty_cache_hits_total counter
+chatty_cache_hits_total{cache="users",node="node0"} 3
+# HELP chatty_cache_evictions_total Entries taken out other than by a newer value.
+# TYPE chatty_cache_evictions_total counter
+chatty_cache_evictions_total{node="node0",reason="size"} 4
+# HELP chatty_cache_used_bytes Bytes held over every cache name.
+# TYPE chatty_cache_used_bytes gauge
+chatty_cache_used_bytes{node="node0"} 40
+`
+		err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+			"chatty_cache_hits_total", "chatty_cache_evictions_total", "chatty_cache_used_bytes")
+		assert.Nil(t, err)
+		// 5 per cache name, used, max, one eviction reason and the histogram
+		assert.Equal(t, 9, testutil.CollectAndCount(collector))
+	})
+	t.Run("Replication", func(t *testing.T) {
+		withReplication := stats
+		withReplication.Replication = &chatter.ReplicationStats{
+			Sent:            map[int]uint64{0: 5, 1: 2},
+			Received:        map[int]uint64{1: 3},
+			Dropped:         map[int]uint64{1: 1},
+			DecryptFailures: 1,
+			SendFailures:    2,
+		}
+		collector := NewCollector(withReplication, nil)
+		expected := `
+# HELP chatty_replication_messages_total Replication envelopes by direction and protocol version.
+# TYPE chatty_replication_messages_total counter
+chatty_replication_messages_total{direction="dropped",version="1"} 1
+chatty_replication_messages_total{direction="received",version="1"} 3
+chatty_replication_messages_total{direction="sent",version="0"} 5
+chatty_replication_messages_total{direction="sent",version="1"} 2
+# HELP chatty_replication_decrypt_failures_total Received envelopes that could not be decrypted.
+# TYPE chatty_replication_decrypt_failures_total counter
+chatty_replication_decrypt_failures_total 1
+# HELP chatty_replication_send_failures_total Messages a peer did not get because the relay could not hand them on.
+# TYPE chatty_replication_send_failures_total counter
+chatty_replication_send_failures_total 2
+`
+		err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+			"chatty_replication_messages_total", "chatty_replication_decrypt_failures_total", "chatty_replication_send_failures_total")
+		assert.Nil(t, err)
+		assert.Equal(t, 16, testutil.CollectAndCount(collector))
+	})
+	t.Run("InMemCache", func(t *testing.T) {
+		bus := chatter.NewLocalBus()
+		node, err := bus.NewChatter("node0")
+		if !assert.Nil(t, err) {
+			return
+		}
+		cache1 := cache.NewInMemCache(0, node)
+		cache1.Put("users", "key1", "value")
+		registry := prometheus.NewPedanticRegistry()
+		if !assert.Nil(t, registry.Register(NewCollector(cache1, nil))) {
+			return
+		}
+		families, err := registry.Gather()
+		assert.Nil(t, err)
+		assert.NotEmpty(t, families)
+	})
+}
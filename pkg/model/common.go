@@ -4,6 +4,48 @@
 
 package model
 
+// RelayAction says what the receiver of a CacheRelayMessage should do with it
+type RelayAction int
+
+// RelayPut stores the value, it is the zero value so older senders that do not set an action still work
+const RelayPut = RelayAction(0)
+
+// RelayFetch asks the receiving node for its copy of the value
+const RelayFetch = RelayAction(1)
+
+// RelayInvalidate tells the receiver to drop its copy, CacheValue is empty
+const RelayInvalidate = RelayAction(2)
+
+// RelayDropTenant tells the receiver to drop everything held for TenantID
+const RelayDropTenant = RelayAction(3)
+
+// RelayDelete tells the receiver to drop its copy unless it is newer, unlike RelayInvalidate the next miss does not
+// fetch it from the sender
+const RelayDelete = RelayAction(4)
+
+// RelayFlush tells the receiver to drop what other nodes sent it for the cache names that are replicated, the chatter
+// lost messages from NodeID that it cannot say more about.  Chatters make it on receipt, it is never sent and is
+// refused off the wire
+const RelayFlush = RelayAction(5)
+
+func (t RelayAction) String() string {
+	switch t {
+	case RelayPut:
+		return "put"
+	case RelayFetch:
+		return "fetch"
+	case RelayInvalidate:
+		return "invalidate"
+	case RelayDropTenant:
+		return "drop_tenant"
+	case RelayDelete:
+		return "delete"
+	case RelayFlush:
+		return "flush"
+	}
+	return "unknown"
+}
+
 type CacheRelayMessage struct {
 	// CacheName
 	CacheName string
@@ -11,4 +53,16 @@ type CacheRelayMessage struct {
 	CacheKey string
 	// Base64 encoded value of the cached jsonifiled bits
 	CacheValue string
+	// Action what to do with the message, defaults to RelayPut
+	Action RelayAction `json:",omitempty"`
+	// Version of the value, newer versions win.  0 from older senders means unknown
+	Version int64 `json:",omitempty"`
+	// TenantID the tenant the cache name belongs to, empty for caches not used through a tenant
+	TenantID string `json:",omitempty"`
+	// ExpiresAt when the value expires in unix nanoseconds, 0 is never
+	ExpiresAt int64 `json:",omitempty"`
+	// NodeID the node that sent the message, filled in by the chatter when the message is received
+	NodeID string `json:"-"`
+	// TraceContext the W3C trace context of the sender's span, empty when the sender is not tracing
+	TraceContext map[string]string `json:",omitempty"`
 }
@@ -5,25 +5,58 @@
 package tests
 
 import (
+	"context"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/theotw/chatty-cache/pkg/cache"
 	"github.com/theotw/chatty-cache/pkg/chatter"
-	"os"
+	"github.com/theotw/chatty-cache/pkg/logging"
+	"net"
 	"testing"
 	"time"
 )
 
-func runCacheTest(t *testing.T, putCacheName string, getCacheName string) {
-	os.Setenv("CHATTY_PASSPHRASE", "bob")
-	log.SetLevel(log.TraceLevel)
-	relay, err := chatter.NewNatsMessageChatterRelay()
+// freeClusterListens loopback host:ports nothing is listening on, for embedded servers that have to know each other's
+// cluster address before they start
+func freeClusterListens(t *testing.T, count int) []string {
+	ret := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Unable to find a free port: %v", err)
+		}
+		ret = append(ret, l.Addr().String())
+		l.Close()
+	}
+	return ret
+}
+
+// runCacheTest puts into one cache name and waits for the other side to put into the other.  Both sides use the nats
+// server in NATS_SERVER unless opts say otherwise, and can run on goroutines of the same test
+func runCacheTest(t *testing.T, putCacheName string, getCacheName string, opts ...chatter.NatsOption) {
+	// trace level on a logger of our own, not the global one the rest of the process uses
+	testLogger := log.New()
+	testLogger.SetLevel(log.TraceLevel)
+	logger := logging.NewLogrusLogger(testLogger)
+	opts = append([]chatter.NatsOption{chatter.WithNatsPassPhrase("bob"), chatter.WithNatsLogger(logger)}, opts...)
+	relay, err := chatter.NewNatsMessageChatterRelay(opts...)
 	if err != nil {
-		log.WithError(err).Fatalf("Unable to connect to nats")
+		t.Errorf("Unable to connect to nats: %v", err)
+		return
 	}
+	defer relay.Close(context.Background())
 
+	start := time.Now()
 	memCache := cache.NewInMemCache(2*1024*1024, relay)
-	time.Sleep(20 * time.Second)
+	memCache.SetLogger(logger)
+	// wait for the other side, once we hear its heartbeat it is subscribed
+	for len(relay.Members()) < 2 {
+		if time.Since(start) > 2*time.Minute {
+			t.Error("timeout waiting for the other side")
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
 	limit := 5
 	for i := 0; i < limit; i++ {
 		key := fmt.Sprintf("key%d", i)
@@ -31,7 +64,7 @@ func runCacheTest(t *testing.T, putCacheName string, getCacheName string) {
 		memCache.Put(putCacheName, key, &val)
 	}
 	time.Sleep(2 * time.Second)
-	start := time.Now()
+	start = time.Now()
 	for i := 0; i < limit; i++ {
 		for {
 			key := fmt.Sprintf("key%d", i)
@@ -48,7 +81,8 @@ func runCacheTest(t *testing.T, putCacheName string, getCacheName string) {
 			}
 			now := time.Now()
 			if now.Sub(start) > 2*time.Minute {
-				t.Fatal("timeout waiting for cache")
+				t.Error("timeout waiting for cache")
+				return
 			}
 		}
 
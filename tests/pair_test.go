@@ -0,0 +1,35 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package tests
+
+import (
+	"github.com/theotw/chatty-cache/pkg/chatter"
+	"os"
+	"sync"
+	"testing"
+)
+
+// TestCachePair runs the A and B sides together in this process, each with an embedded server routed to the other
+// unless NATS_SERVER is set
+func TestCachePair(t *testing.T) {
+	var optsA, optsB []chatter.NatsOption
+	if len(os.Getenv(chatter.NatsURLEnvVar)) == 0 {
+		listens := freeClusterListens(t, 2)
+		auth := chatter.WithNatsClusterAuth("pair", "secret")
+		optsA = []chatter.NatsOption{chatter.WithNatsEmbedded("127.0.0.1:-1", listens[0], listens...), auth}
+		optsB = []chatter.NatsOption{chatter.WithNatsEmbedded("127.0.0.1:-1", listens[1], listens...), auth}
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		runCacheTest(t, "cacheA", "cacheB", optsA...)
+	}()
+	go func() {
+		defer wg.Done()
+		runCacheTest(t, "cacheB", "cacheA", optsB...)
+	}()
+	wg.Wait()
+}